@@ -1,6 +1,12 @@
 #!/bin/bash
 # modify MDS addr
 sed -i "s/mds\.listen\.addr=.*/mds.listen.addr=${MDSADDR}/" /etc/curve/client.conf
+# curve_ops_tool reads the MDS addr of the default cluster from tools.conf
+if [ -f /etc/curve/tools.conf ]; then
+    sed -i "s/^mdsAddr=.*/mdsAddr=${MDSADDR}/" /etc/curve/tools.conf
+else
+    echo "mdsAddr=${MDSADDR}" > /etc/curve/tools.conf
+fi
 
 # start nebd
 nebd-daemon start
@@ -20,11 +20,13 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	"k8s.io/klog/v2"
 
 	"github.com/opencurve/curve-csi/cmd/options"
 	"github.com/opencurve/curve-csi/pkg/curve"
+	"github.com/opencurve/curve-csi/pkg/curveservice"
 	"github.com/opencurve/curve-csi/pkg/logs"
 	"github.com/opencurve/curve-csi/pkg/util"
 )
@@ -41,6 +43,7 @@ var (
 func init() {
 	// common flags
 	flag.StringVar(&curveConf.Endpoint, "endpoint", "unix://tmp/csi.sock", "CSI endpoint")
+	flag.StringVar(&curveConf.CSIAddonsEndpoint, "csi-addons-endpoint", "", "endpoint of the csi-addons services for the csi-addons sidecar, e.g. unix:///csi/csi-addons.sock, set empty to disable")
 	flag.StringVar(&curveConf.DriverName, "drivername", "", "name of the driver")
 	flag.StringVar(&curveConf.NodeID, "nodeid", "", "node id")
 
@@ -51,12 +54,87 @@ func init() {
 	// curve snashot/clone server
 	flag.StringVar(&curveConf.SnapshotServer, "snapshot-server", "", "curve snapshot/clone http server address, set empty to disable snapshot")
 
+	// curve clusters
+	flag.StringVar(&curveConf.ClusterConfig, "cluster-config", util.DefaultClusterConfig, "path of the config file describing the curve clusters referred by clusterID")
+	flag.StringVar(&curveConf.MetadataDir, "metadata-dir", util.DefaultMetadataDir, "directory of the controller metadata, e.g. the QoS of volumes, set empty to disable")
+	flag.StringVar(&curveConf.MetadataNamespace, "metadata-namespace", "", "namespace of the ConfigMaps storing the controller metadata, which takes precedence over --metadata-dir; the node plugin reads the fence list from it")
+	flag.IntVar(&curveConf.MaxCloneDepth, "max-clone-depth", 0, "max depth of lazy clone chain, a deeper clone is flattened, set 0 to disable")
+
+	// flatten scheduler
+	flag.DurationVar(&curveConf.FlattenAfter, "flatten-after", 0, "flatten the lazy clones in the background after the age, e.g. 24h, set 0 to not wait")
+	flag.StringVar(&curveConf.FlattenWindow, "flatten-window", "", "flatten the lazy clones in the background only in the daily window of local time, e.g. 01:00-05:00")
+	flag.IntVar(&curveConf.FlattenConcurrency, "flatten-concurrency", 1, "max number of lazy clones flattening in the background at the same time")
+
+	// clone task GC
+	flag.DurationVar(&curveConf.CloneTaskGCInterval, "clone-task-gc-interval", 0, "interval to clean the stale clone and recover tasks, set 0 to disable")
+	flag.DurationVar(&curveConf.CloneTaskGCGrace, "clone-task-gc-grace", 24*time.Hour, "the error tasks older than it are cleaned")
+	flag.StringVar(&curveConf.CloneTaskGCUsers, "clone-task-gc-users", "", "comma separated curve users whose tasks are collected")
+	flag.BoolVar(&curveConf.CloneTaskGCDryRun, "clone-task-gc-dry-run", false, "only report the stale tasks without cleaning them")
+
+	// replication
+	flag.BoolVar(&curveConf.EnableReplication, "enable-replication", false, "serve the csi-addons replication on --csi-addons-endpoint, the volumes are copied between clusters by curve-nbd on the controller")
+	flag.StringVar(&curveConf.ReplicationCopyCommand, "replication-copy-command", "", "command copying a volume between clusters instead of curve-nbd, which enables the replication too")
+
+	// network fence
+	flag.BoolVar(&curveConf.EnableNetworkFence, "enable-network-fence", false, "serve the csi-addons network fence on --csi-addons-endpoint, the fence list is kept in the ConfigMaps of --metadata-namespace")
+
+	// background workers
+	flag.StringVar(&curveConf.CredentialsDir, "credentials-dir", "", "directory of the curve credentials used by the background workers, <dir>/<user>/password and <dir>/<user>/token, e.g. a mounted Secret")
+	flag.BoolVar(&curveConf.LeaderElection, "leader-election", false, "run the background workers of the controller on the elected leader of the replicas only")
+	flag.StringVar(&curveConf.LeaderElectionNamespace, "leader-election-namespace", "", "namespace of the Lease of the leader election, defaults to $POD_NAMESPACE")
+
+	// populating volumes from images
+	flag.StringVar(&curveConf.PopulateDir, "populate-dir", "", "work directory of the controller to populate volumes from disk images, set empty to disable")
+	flag.IntVar(&curveConf.PopulateConcurrency, "populate-concurrency", 2, "max number of volumes populating from images at the same time")
+
+	// space reclaim
+	flag.DurationVar(&curveConf.ReclaimSpaceInterval, "reclaim-space-interval", 0, "interval to trim the filesystems of the staged volumes on the node, set 0 to disable")
+	flag.BoolVar(&curveConf.EnableReclaimSpace, "enable-reclaim-space", false, "serve the csi-addons offline space reclaim of the controller on --csi-addons-endpoint, the zero ranges of the detached volumes are discarded by curve-nbd on the controller")
+
+	// ephemeral inline volumes
+	flag.StringVar(&curveConf.EphemeralDir, "ephemeral-dir", "", "directory on the node recording the ephemeral inline volumes, which must survive the restart of the plugin, e.g. "+util.DefaultEphemeralDir+", set empty to disable")
+	flag.StringVar(&curveConf.EphemeralUsers, "ephemeral-users", "", "comma separated curve users allowed to create the ephemeral inline volumes, set by the nodePublishSecretRef of the volumes")
+	flag.BoolVar(&curveConf.EphemeralAllowClone, "ephemeral-allow-clone", false, "allow the ephemeral inline volumes to be cloned from the volumes and snapshots of their users by cloneFrom")
+
+	// curve-nbd
+	flag.DurationVar(&curveConf.NodeReconcileInterval, "node-reconcile-interval", 0, "interval to repair the staged volumes and the nbd devices on the node, also repaired on start, set 0 to disable")
+	flag.StringVar(&curveConf.KubeletDir, "kubelet-dir", util.DefaultKubeletDir, "root dir of kubelet, where the volumes are staged")
+	flag.StringVar(&curveConf.InUseCheckPolicy, "in-use-check-policy", curveservice.InUseCheckFailClosed, "what to do if the check of the clients of other hosts opening a volume keeps failing before mapping it: fail-closed, to fail the staging, or fail-open, to map the volume anyway")
+	flag.StringVar(&curveConf.NbdMapMode, "nbd-map-mode", curveservice.MapModeProcess, "how curve-nbd is run on the node: process, as a child of the plugin, or systemd, as a transient unit on the host surviving the restarts of the plugin")
+
+	// topology
+	flag.StringVar(&curveConf.Topology, "topology", "", "topology segments of the node, e.g. zone=zone-a,rack=rack1, the key is qualified by topology.<drivername>/ if not")
+	flag.StringVar(&curveConf.TopologyNodeLabels, "topology-node-labels", "", "comma separated node labels reported as topology segments, e.g. topology.kubernetes.io/zone")
+
 	// debug
 	flag.IntVar(&curveConf.DebugPort, "debug-port", 0, "debug port, set 0 to disable")
 	flag.BoolVar(&curveConf.EnableProfiling, "enableprofiling", false, "enable go profiling")
 }
 
 func main() {
+	// subcommands
+	if len(os.Args) > 1 && os.Args[1] == "orphans" {
+		if err := curve.RunOrphans(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		if err := curve.RunImport(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := curve.RunExport(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	flag.Parse()
 	if *showVersion {
 		fmt.Println(util.GetVersion())
@@ -16,11 +16,15 @@ limitations under the License.
 
 package options
 
+import "time"
+
 // Config holds the parameters list which can be configured
 type CurveConf struct {
 	Endpoint   string // CSI endpoint
 	DriverName string // name of the driver
 	NodeID     string // node id
+	// endpoint of the csi-addons services, empty to disable
+	CSIAddonsEndpoint string
 
 	// csi flags
 	IsControllerServer bool
@@ -28,6 +32,62 @@ type CurveConf struct {
 
 	// curve flags
 	SnapshotServer string
+	ClusterConfig  string
+	MetadataDir    string
+	// namespace of the ConfigMaps storing the controller metadata, which the node
+	// server reads the fence list from
+	MetadataNamespace string
+	MaxCloneDepth     int
+
+	// flatten scheduler flags of the controller server
+	FlattenAfter       time.Duration
+	FlattenWindow      string
+	FlattenConcurrency int
+
+	// clone task GC flags of the controller server
+	CloneTaskGCInterval time.Duration
+	CloneTaskGCGrace    time.Duration
+	CloneTaskGCUsers    string
+	CloneTaskGCDryRun   bool
+
+	// the csi-addons replication, copied by the command instead of curve-nbd if set
+	EnableReplication      bool
+	ReplicationCopyCommand string
+
+	// the csi-addons network fence of the controller server
+	EnableNetworkFence bool
+
+	// the background workers of the controller server
+	CredentialsDir          string
+	LeaderElection          bool
+	LeaderElectionNamespace string
+
+	// populating volumes from images of the controller server
+	PopulateDir         string
+	PopulateConcurrency int
+
+	// the space reclaim of the node, and the csi-addons offline one of the controller server
+	ReclaimSpaceInterval time.Duration
+	EnableReclaimSpace   bool
+
+	// the ephemeral inline volumes on the node: the journal dir, the allowed users,
+	// and whether they may be cloned
+	EphemeralDir        string
+	EphemeralUsers      string
+	EphemeralAllowClone bool
+
+	// how curve-nbd is run on the node: process or systemd
+	NbdMapMode string
+	// what NodeStageVolume does if the in-use check keeps failing
+	InUseCheckPolicy string
+
+	// reconciliation of the staged volumes on the node
+	NodeReconcileInterval time.Duration
+	KubeletDir            string
+
+	// topology flags of the node server
+	Topology           string
+	TopologyNodeLabels string
 
 	// debugs
 	DebugPort       int
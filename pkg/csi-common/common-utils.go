@@ -69,6 +69,24 @@ func NewDefaultControllerServer(d *CSIDriver) *DefaultControllerServer {
 	}
 }
 
+// NewDefaultGroupControllerServer initializes default group controller server
+func NewDefaultGroupControllerServer(d *CSIDriver) *DefaultGroupControllerServer {
+	return &DefaultGroupControllerServer{
+		Driver: d,
+	}
+}
+
+// NewGroupControllerServiceCapability returns group controller capabilities
+func NewGroupControllerServiceCapability(ctrlCap csi.GroupControllerServiceCapability_RPC_Type) *csi.GroupControllerServiceCapability {
+	return &csi.GroupControllerServiceCapability{
+		Type: &csi.GroupControllerServiceCapability_Rpc{
+			Rpc: &csi.GroupControllerServiceCapability_RPC{
+				Type: ctrlCap,
+			},
+		},
+	}
+}
+
 // NewControllerServiceCapability returns controller capabilities
 func NewControllerServiceCapability(ctrlCap csi.ControllerServiceCapability_RPC_Type) *csi.ControllerServiceCapability {
 	return &csi.ControllerServiceCapability{
@@ -85,7 +103,7 @@ func RunNodePublishServer(endpoint string, d *CSIDriver, ns csi.NodeServer) {
 	ids := NewDefaultIdentityServer(d)
 
 	s := NewNonBlockingGRPCServer()
-	s.Start(endpoint, ids, nil, ns)
+	s.Start(endpoint, ids, nil, ns, nil)
 	s.Wait()
 }
 
@@ -94,7 +112,7 @@ func RunControllerPublishServer(endpoint string, d *CSIDriver, cs csi.Controller
 	ids := NewDefaultIdentityServer(d)
 
 	s := NewNonBlockingGRPCServer()
-	s.Start(endpoint, ids, cs, nil)
+	s.Start(endpoint, ids, cs, nil, nil)
 	s.Wait()
 }
 
@@ -103,7 +121,7 @@ func RunControllerAndNodePublishServer(endpoint string, d *CSIDriver, cs csi.Con
 	ids := NewDefaultIdentityServer(d)
 
 	s := NewNonBlockingGRPCServer()
-	s.Start(endpoint, ids, cs, ns)
+	s.Start(endpoint, ids, cs, ns, nil)
 	s.Wait()
 }
 
@@ -119,6 +137,10 @@ func getReqID(req interface{}) string {
 		reqID = r.Name
 	case *csi.DeleteSnapshotRequest:
 		reqID = r.SnapshotId
+	case *csi.CreateVolumeGroupSnapshotRequest:
+		reqID = r.Name
+	case *csi.DeleteVolumeGroupSnapshotRequest:
+		reqID = r.GroupSnapshotId
 	case *csi.ControllerExpandVolumeRequest:
 		reqID = r.VolumeId
 	case *csi.NodeStageVolumeRequest:
@@ -141,6 +163,8 @@ func getReqID(req interface{}) string {
 		reqID = r.VolumeId
 	case *replication.ResyncVolumeRequest:
 		reqID = r.VolumeId
+	case *replication.GetVolumeReplicationInfoRequest:
+		reqID = r.VolumeId
 	}
 	return reqID
 }
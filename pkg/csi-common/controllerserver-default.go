@@ -28,6 +28,7 @@ import (
 
 // DefaultControllerServer points to default driver
 type DefaultControllerServer struct {
+	csi.UnimplementedControllerServer
 	Driver *CSIDriver
 }
 
@@ -24,12 +24,13 @@ import (
 )
 
 type CSIDriver struct {
-	name         string
-	nodeID       string
-	version      string
-	topology     map[string]string
-	capabilities []*csi.ControllerServiceCapability
-	vc           []*csi.VolumeCapability_AccessMode
+	name          string
+	nodeID        string
+	version       string
+	topology      map[string]string
+	capabilities  []*csi.ControllerServiceCapability
+	gcapabilities []*csi.GroupControllerServiceCapability
+	vc            []*csi.VolumeCapability_AccessMode
 }
 
 // Creates a NewCSIDriver object. Assumes vendor version is equal to driver version &
@@ -60,6 +61,24 @@ func NewCSIDriver(name, v, nodeID string) *CSIDriver {
 	return &driver
 }
 
+// GetName returns the driver name
+func (d *CSIDriver) GetName() string {
+	return d.name
+}
+
+// GetVersion returns the driver version
+func (d *CSIDriver) GetVersion() string {
+	return d.version
+}
+
+// SetTopology sets the topology segments of the node
+func (d *CSIDriver) SetTopology(segments map[string]string) {
+	d.topology = make(map[string]string, len(segments))
+	for k, v := range segments {
+		d.topology[k] = v
+	}
+}
+
 // ValidateControllerServiceRequest validates the controller
 // plugin capabilities
 func (d *CSIDriver) ValidateControllerServiceRequest(c csi.ControllerServiceCapability_RPC_Type) error {
@@ -88,6 +107,34 @@ func (d *CSIDriver) AddControllerServiceCapabilities(cl []csi.ControllerServiceC
 	d.capabilities = csc
 }
 
+// AddGroupControllerServiceCapabilities stores the group controller capabilities
+// in driver object
+func (d *CSIDriver) AddGroupControllerServiceCapabilities(cl []csi.GroupControllerServiceCapability_RPC_Type) {
+	var gcsc []*csi.GroupControllerServiceCapability
+
+	for _, c := range cl {
+		klog.Infof("Enabling group controller service capability: %v", c.String())
+		gcsc = append(gcsc, NewGroupControllerServiceCapability(c))
+	}
+
+	d.gcapabilities = gcsc
+}
+
+// ValidateGroupControllerServiceRequest validates the group controller
+// plugin capabilities
+func (d *CSIDriver) ValidateGroupControllerServiceRequest(c csi.GroupControllerServiceCapability_RPC_Type) error {
+	if c == csi.GroupControllerServiceCapability_RPC_UNKNOWN {
+		return nil
+	}
+
+	for _, cap := range d.gcapabilities {
+		if c == cap.GetRpc().GetType() {
+			return nil
+		}
+	}
+	return status.Error(codes.InvalidArgument, string(c))
+}
+
 // AddVolumeCapabilityAccessModes stores volume access modes
 func (d *CSIDriver) AddVolumeCapabilityAccessModes(vc []csi.VolumeCapability_AccessMode_Mode) []*csi.VolumeCapability_AccessMode {
 	var vca []*csi.VolumeCapability_AccessMode
@@ -0,0 +1,59 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"context"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/opencurve/curve-csi/pkg/util/ctxlog"
+)
+
+// DefaultGroupControllerServer points to default driver
+type DefaultGroupControllerServer struct {
+	csi.UnimplementedGroupControllerServer
+	Driver *CSIDriver
+}
+
+// GroupControllerGetCapabilities implements the default GRPC callout.
+func (gcs *DefaultGroupControllerServer) GroupControllerGetCapabilities(ctx context.Context, req *csi.GroupControllerGetCapabilitiesRequest) (*csi.GroupControllerGetCapabilitiesResponse, error) {
+	ctxlog.V(5).Infof(ctx, "Using default GroupControllerGetCapabilities")
+	if gcs.Driver == nil {
+		return nil, status.Error(codes.Unimplemented, "Group controller server is not enabled")
+	}
+	return &csi.GroupControllerGetCapabilitiesResponse{
+		Capabilities: gcs.Driver.gcapabilities,
+	}, nil
+}
+
+// CreateVolumeGroupSnapshot creates group snapshot
+func (gcs *DefaultGroupControllerServer) CreateVolumeGroupSnapshot(ctx context.Context, req *csi.CreateVolumeGroupSnapshotRequest) (*csi.CreateVolumeGroupSnapshotResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+// DeleteVolumeGroupSnapshot deletes group snapshot
+func (gcs *DefaultGroupControllerServer) DeleteVolumeGroupSnapshot(ctx context.Context, req *csi.DeleteVolumeGroupSnapshotRequest) (*csi.DeleteVolumeGroupSnapshotResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+// GetVolumeGroupSnapshot gets group snapshot
+func (gcs *DefaultGroupControllerServer) GetVolumeGroupSnapshot(ctx context.Context, req *csi.GetVolumeGroupSnapshotRequest) (*csi.GetVolumeGroupSnapshotResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
@@ -28,6 +28,7 @@ import (
 
 // DefaultNodeServer stores driver object
 type DefaultNodeServer struct {
+	csi.UnimplementedNodeServer
 	Driver *CSIDriver
 }
 
@@ -46,12 +47,16 @@ func (ns *DefaultNodeServer) NodeExpandVolume(ctx context.Context, req *csi.Node
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
-// NodeGetInfo returns node ID
+// NodeGetInfo returns node ID and the topology if set
 func (ns *DefaultNodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
 	ctxlog.V(5).Infof(ctx, "Using default NodeGetInfo")
-	return &csi.NodeGetInfoResponse{
+	resp := &csi.NodeGetInfoResponse{
 		NodeId: ns.Driver.nodeID,
-	}, nil
+	}
+	if len(ns.Driver.topology) > 0 {
+		resp.AccessibleTopology = &csi.Topology{Segments: ns.Driver.topology}
+	}
+	return resp, nil
 }
 
 // NodeGetCapabilities returns RPC unknow capability
@@ -27,10 +27,13 @@ import (
 	"k8s.io/klog/v2"
 )
 
+// ServiceRegistrar registers an extra service, e.g. of csi-addons, on the GRPC server.
+type ServiceRegistrar func(server *grpc.Server)
+
 // NonBlockingGRPCServer defines Non blocking GRPC server interfaces
 type NonBlockingGRPCServer interface {
 	// Start services at the endpoint
-	Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer)
+	Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer, gcs csi.GroupControllerServer, extra ...ServiceRegistrar)
 	// Waits for the service to stop
 	Wait()
 	// Stops the service gracefully
@@ -51,9 +54,9 @@ type nonBlockingGRPCServer struct {
 }
 
 // Start the service on endpoint
-func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer, gcs csi.GroupControllerServer, extra ...ServiceRegistrar) {
 	s.wg.Add(1)
-	go s.serve(endpoint, ids, cs, ns)
+	go s.serve(endpoint, ids, cs, ns, gcs, extra)
 }
 
 // Wait blocks until the WaitGroup counter
@@ -71,7 +74,7 @@ func (s *nonBlockingGRPCServer) ForceStop() {
 	s.server.Stop()
 }
 
-func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer, gcs csi.GroupControllerServer, extra []ServiceRegistrar) {
 	proto, addr, err := parseEndpoint(endpoint)
 	if err != nil {
 		klog.Fatal(err.Error())
@@ -106,6 +109,12 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 	if ns != nil {
 		csi.RegisterNodeServer(server, ns)
 	}
+	if gcs != nil {
+		csi.RegisterGroupControllerServer(server, gcs)
+	}
+	for _, register := range extra {
+		register(server)
+	}
 
 	klog.Infof("Listening for connections on address: %#v", listener.Addr())
 	err = server.Serve(listener)
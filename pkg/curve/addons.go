@@ -0,0 +1,154 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+
+	"github.com/csi-addons/spec/lib/go/fence"
+	"github.com/csi-addons/spec/lib/go/identity"
+	"github.com/csi-addons/spec/lib/go/reclaimspace"
+	"github.com/csi-addons/spec/lib/go/replication"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	csicommon "github.com/opencurve/curve-csi/pkg/csi-common"
+)
+
+// addonsIdentityServer is the csi-addons identity of the driver, which advertises
+// the csi-addons services served on the csi-addons endpoint.
+type addonsIdentityServer struct {
+	identity.UnimplementedIdentityServer
+
+	driver       *csicommon.CSIDriver
+	capabilities []*identity.Capability
+}
+
+// GetIdentity returns the name and the version of the driver.
+func (is *addonsIdentityServer) GetIdentity(
+	ctx context.Context,
+	req *identity.GetIdentityRequest) (*identity.GetIdentityResponse, error) {
+	if is.driver.GetName() == "" {
+		return nil, status.Error(codes.Unavailable, "Driver name not configured")
+	}
+	return &identity.GetIdentityResponse{
+		Name:          is.driver.GetName(),
+		VendorVersion: is.driver.GetVersion(),
+	}, nil
+}
+
+// GetCapabilities returns the csi-addons services served.
+func (is *addonsIdentityServer) GetCapabilities(
+	ctx context.Context,
+	req *identity.GetCapabilitiesRequest) (*identity.GetCapabilitiesResponse, error) {
+	return &identity.GetCapabilitiesResponse{Capabilities: is.capabilities}, nil
+}
+
+// Probe returns ready once the services are registered.
+func (is *addonsIdentityServer) Probe(
+	ctx context.Context,
+	req *identity.ProbeRequest) (*identity.ProbeResponse, error) {
+	return &identity.ProbeResponse{Ready: wrapperspb.Bool(true)}, nil
+}
+
+func addonsServiceCapability(t identity.Capability_Service_Type) *identity.Capability {
+	return &identity.Capability{
+		Type: &identity.Capability_Service_{
+			Service: &identity.Capability_Service{Type: t},
+		},
+	}
+}
+
+func addonsReclaimSpaceCapability(t identity.Capability_ReclaimSpace_Type) *identity.Capability {
+	return &identity.Capability{
+		Type: &identity.Capability_ReclaimSpace_{
+			ReclaimSpace: &identity.Capability_ReclaimSpace{Type: t},
+		},
+	}
+}
+
+// newAddonsIdentityServer returns the identity advertising the csi-addons services of the servers.
+func newAddonsIdentityServer(driver *csicommon.CSIDriver, cs *controllerServer, ns *nodeServer) *addonsIdentityServer {
+	is := &addonsIdentityServer{driver: driver}
+	if ns != nil {
+		is.capabilities = append(is.capabilities,
+			addonsServiceCapability(identity.Capability_Service_NODE_SERVICE),
+			addonsReclaimSpaceCapability(identity.Capability_ReclaimSpace_ONLINE))
+	}
+	if cs != nil {
+		is.capabilities = append(is.capabilities, addonsServiceCapability(identity.Capability_Service_CONTROLLER_SERVICE))
+		if cs.replication != nil {
+			is.capabilities = append(is.capabilities, &identity.Capability{
+				Type: &identity.Capability_VolumeReplication_{
+					VolumeReplication: &identity.Capability_VolumeReplication{
+						Type: identity.Capability_VolumeReplication_VOLUME_REPLICATION,
+					},
+				},
+			})
+		}
+		if cs.reclaimSpace != nil {
+			is.capabilities = append(is.capabilities, addonsReclaimSpaceCapability(identity.Capability_ReclaimSpace_OFFLINE))
+		}
+		if cs.fence != nil {
+			is.capabilities = append(is.capabilities, &identity.Capability{
+				Type: &identity.Capability_NetworkFence_{
+					NetworkFence: &identity.Capability_NetworkFence{
+						Type: identity.Capability_NetworkFence_NETWORK_FENCE,
+					},
+				},
+			})
+		}
+	}
+	return is
+}
+
+// addonsServices returns the registrars of the csi-addons services of the servers, with the identity.
+func addonsServices(driver *csicommon.CSIDriver, cs *controllerServer, ns *nodeServer) []csicommon.ServiceRegistrar {
+	is := newAddonsIdentityServer(driver, cs, ns)
+	registrars := []csicommon.ServiceRegistrar{
+		func(server *grpc.Server) {
+			identity.RegisterIdentityServer(server, is)
+		},
+	}
+	if cs != nil && cs.replication != nil {
+		rs := cs.replication
+		registrars = append(registrars, func(server *grpc.Server) {
+			replication.RegisterControllerServer(server, rs)
+		})
+	}
+	if cs != nil && cs.reclaimSpace != nil {
+		rs := cs.reclaimSpace
+		registrars = append(registrars, func(server *grpc.Server) {
+			reclaimspace.RegisterReclaimSpaceControllerServer(server, rs)
+		})
+	}
+	if cs != nil && cs.fence != nil {
+		fs := cs.fence
+		registrars = append(registrars, func(server *grpc.Server) {
+			fence.RegisterFenceControllerServer(server, fs)
+		})
+	}
+	if ns != nil {
+		rs := &nodeReclaimSpaceServer{ns: ns}
+		registrars = append(registrars, func(server *grpc.Server) {
+			reclaimspace.RegisterReclaimSpaceNodeServer(server, rs)
+		})
+	}
+	return registrars
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"testing"
+
+	"github.com/csi-addons/spec/lib/go/identity"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+
+	csicommon "github.com/opencurve/curve-csi/pkg/csi-common"
+)
+
+// registeredServices returns the names of the services registered by the registrars.
+func registeredServices(registrars []csicommon.ServiceRegistrar) []string {
+	server := grpc.NewServer()
+	for _, register := range registrars {
+		register(server)
+	}
+	var services []string
+	for name := range server.GetServiceInfo() {
+		services = append(services, name)
+	}
+	return services
+}
+
+func TestAddonsServices(t *testing.T) {
+	ctx := context.TODO()
+	driver := csicommon.NewCSIDriver("curve.csi.netease.com", "v3.2.0", "node1")
+
+	// the node
+	ns := &nodeServer{}
+	is := newAddonsIdentityServer(driver, nil, ns)
+	resp, err := is.GetCapabilities(ctx, &identity.GetCapabilitiesRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, resp.GetCapabilities(), 2)
+	assert.Equal(t, identity.Capability_Service_NODE_SERVICE, resp.GetCapabilities()[0].GetService().GetType())
+	assert.Equal(t, identity.Capability_ReclaimSpace_ONLINE, resp.GetCapabilities()[1].GetReclaimSpace().GetType())
+	assert.ElementsMatch(t, []string{"identity.Identity", "reclaimspace.ReclaimSpaceNode"}, registeredServices(addonsServices(driver, nil, ns)))
+
+	// the controller without the csi-addons services
+	cs := &controllerServer{}
+	is = newAddonsIdentityServer(driver, cs, nil)
+	resp, err = is.GetCapabilities(ctx, &identity.GetCapabilitiesRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, resp.GetCapabilities(), 1)
+	assert.Equal(t, []string{"identity.Identity"}, registeredServices(addonsServices(driver, cs, nil)))
+
+	// the controller with the replication, the space reclaim and the network fence
+	cs = &controllerServer{replication: &replicationServer{}, fence: &fenceServer{}}
+	cs.reclaimSpace = newControllerReclaimSpaceServer(cs, true)
+	is = newAddonsIdentityServer(driver, cs, nil)
+	resp, err = is.GetCapabilities(ctx, &identity.GetCapabilitiesRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, resp.GetCapabilities(), 4)
+	assert.Equal(t, identity.Capability_Service_CONTROLLER_SERVICE, resp.GetCapabilities()[0].GetService().GetType())
+	assert.Equal(t, identity.Capability_VolumeReplication_VOLUME_REPLICATION, resp.GetCapabilities()[1].GetVolumeReplication().GetType())
+	assert.Equal(t, identity.Capability_ReclaimSpace_OFFLINE, resp.GetCapabilities()[2].GetReclaimSpace().GetType())
+	assert.Equal(t, identity.Capability_NetworkFence_NETWORK_FENCE, resp.GetCapabilities()[3].GetNetworkFence().GetType())
+	assert.ElementsMatch(t, []string{"identity.Identity", "replication.Controller", "reclaimspace.ReclaimSpaceController", "fence.FenceController"},
+		registeredServices(addonsServices(driver, cs, nil)))
+
+	id, err := is.GetIdentity(ctx, &identity.GetIdentityRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, "curve.csi.netease.com", id.GetName())
+	assert.Equal(t, "v3.2.0", id.GetVendorVersion())
+	probe, err := is.Probe(ctx, &identity.ProbeRequest{})
+	assert.NoError(t, err)
+	assert.True(t, probe.GetReady().GetValue())
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+	"github.com/opencurve/curve-csi/pkg/util"
+	"github.com/opencurve/curve-csi/pkg/util/ctxlog"
+)
+
+const (
+	// StorageClass parameter of the max depth of lazy clone chain, overrides --max-clone-depth
+	maxCloneDepthParam = "maxCloneDepth"
+
+	// StorageClass parameter of what is flattened when the max clone depth is exceeded,
+	// the new clone or the nearest lazy clone it depends on
+	cloneDepthFlattenParam  = "cloneDepthFlatten"
+	cloneDepthFlattenClone  = "clone"
+	cloneDepthFlattenSource = "source"
+
+	// stops walking the lineage, in case of a loop
+	maxCloneLineageSteps = 64
+)
+
+// parseMaxCloneDepth returns nil if the parameter is not set, 0 means unlimited.
+func parseMaxCloneDepth(parameters map[string]string) (*int, error) {
+	str, ok := parameters[maxCloneDepthParam]
+	if !ok {
+		return nil, nil
+	}
+	depth, err := strconv.Atoi(str)
+	if err != nil || depth < 0 {
+		return nil, fmt.Errorf("invalid %s %q, must be a non-negative integer", maxCloneDepthParam, str)
+	}
+	return &depth, nil
+}
+
+// parseCloneDepthFlatten returns cloneDepthFlattenClone if the parameter is not set.
+func parseCloneDepthFlatten(parameters map[string]string) (string, error) {
+	str, ok := parameters[cloneDepthFlattenParam]
+	if !ok {
+		return cloneDepthFlattenClone, nil
+	}
+	if str != cloneDepthFlattenClone && str != cloneDepthFlattenSource {
+		return "", fmt.Errorf("invalid %s %q, must be %s or %s", cloneDepthFlattenParam, str, cloneDepthFlattenClone, cloneDepthFlattenSource)
+	}
+	return str, nil
+}
+
+// contentSourceVolID returns the source volume ID of the content source, the one
+// of the snapshot if the source is a snapshot. It returns empty if not set or invalid.
+func contentSourceVolID(contentSource *csi.VolumeContentSource) string {
+	if snapshot := contentSource.GetSnapshot(); snapshot != nil {
+		_, volId, err := decomposeSnapshotID(snapshot.GetSnapshotId())
+		if err != nil {
+			return ""
+		}
+		return volId
+	}
+	return contentSource.GetVolume().GetVolumeId()
+}
+
+// lazyClone is a lazy clone not flattened yet on the lineage of a volume.
+type lazyClone struct {
+	user     string
+	path     string
+	taskUUID string
+}
+
+// cloneLineage returns the lazy clones on the lineage of the volume, starting from the
+// volume itself, its depth is the length. A lazy clone depends on the source of its clone
+// task until flattened: a volume path, or a snapshot UUID, which refers to the volume
+// it was taken of. The lineage stays in the cluster of the volume and may cross the users,
+// each accessed with its secrets, or the credentials in the credentials dir.
+func (cs *controllerServer) cloneLineage(ctx context.Context, volOptions *volumeOptions, secrets map[string]string) ([]lazyClone, error) {
+	if !volOptions.snapshotEnabled() {
+		return nil, nil
+	}
+	lineage := make([]lazyClone, 0)
+	vo := *volOptions
+	for i := 0; i < maxCloneLineageSteps; i++ {
+		if err := cs.applyLineageCredentials(ctx, &vo, secrets); err != nil {
+			return lineage, err
+		}
+		path := vo.genVolumePath()
+		taskInfo, err := cs.backend.snapshotServer(&vo).GetCloneTaskOfDestination(ctx, path)
+		if err != nil {
+			if util.IsNotFoundErr(err) {
+				return lineage, nil
+			}
+			return lineage, err
+		}
+		if taskInfo.TaskStatus != curveservice.TaskStatusMetaInstalled {
+			return lineage, nil
+		}
+		lineage = append(lineage, lazyClone{user: vo.user, path: path, taskUUID: taskInfo.UUID})
+
+		srcPath := taskInfo.Src
+		if !strings.HasPrefix(srcPath, "/") {
+			// a snapshot of the user issuing the clone
+			snapOptions := vo
+			if taskInfo.User != "" {
+				snapOptions.user = taskInfo.User
+			}
+			if err = cs.applyLineageCredentials(ctx, &snapOptions, secrets); err != nil {
+				return lineage, err
+			}
+			snap, err := cs.backend.snapshotServer(&snapOptions).GetUserSnapshotOfId(ctx, taskInfo.Src)
+			if err != nil {
+				if util.IsNotFoundErr(err) {
+					return lineage, nil
+				}
+				return lineage, fmt.Errorf("failed to get snapshot %s, the clone source of %s: %v", taskInfo.Src, path, err)
+			}
+			srcPath = snap.File
+		}
+		ctxlog.V(5).Infof(ctx, "%s is a lazy clone of %s(%s)", path, taskInfo.Src, srcPath)
+		user, volName, ok := splitVolumePath(srcPath)
+		if !ok {
+			return lineage, fmt.Errorf("invalid clone source %q of %s", srcPath, path)
+		}
+		vo.user, vo.volName, vo.creds = user, volName, nil
+	}
+	return lineage, nil
+}
+
+// applyLineageCredentials sets the credentials of the user of the volume on the lineage.
+func (cs *controllerServer) applyLineageCredentials(ctx context.Context, vo *volumeOptions, secrets map[string]string) error {
+	vo.creds = nil
+	userSecrets := secretsFor(secrets, vo.user)
+	if util.NewCredentials(userSecrets) == nil {
+		userSecrets = backgroundSecrets(ctx, cs.credentialsDir, vo.user)
+	}
+	return vo.applyCredentials(userSecrets)
+}
+
+// splitVolumePath returns the user and the name of the volume path /<user>/<name>.
+func splitVolumePath(volPath string) (string, string, bool) {
+	parts := strings.Split(strings.TrimPrefix(volPath, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// limitCloneDepth flattens the new lazy clone, or the nearest lazy clone it depends on,
+// in the background if its depth exceeds the max clone depth. The failure is only logged,
+// since the clone is usable anyway.
+func (cs *controllerServer) limitCloneDepth(ctx context.Context, destVolOptions *volumeOptions, secrets map[string]string) {
+	maxDepth := cs.maxCloneDepth
+	if destVolOptions.maxCloneDepth != nil {
+		maxDepth = *destVolOptions.maxCloneDepth
+	}
+	if maxDepth <= 0 {
+		return
+	}
+
+	lineage, err := cs.cloneLineage(ctx, destVolOptions, secrets)
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to get clone depth of %s, skip limiting: %v", destVolOptions.volId, err)
+		return
+	}
+	if len(lineage) <= maxDepth {
+		ctxlog.V(4).Infof(ctx, "clone depth of %s is %d, max %d", destVolOptions.volId, len(lineage), maxDepth)
+		return
+	}
+	target := lineage[0]
+	if destVolOptions.cloneDepthFlatten == cloneDepthFlattenSource {
+		target = lineage[1]
+	}
+	ctxlog.Infof(ctx, "clone depth of %s is %d, exceeds max %d, flatten %s", destVolOptions.volId, len(lineage), maxDepth, target.path)
+	vo := *destVolOptions
+	vo.user = target.user
+	if err = cs.applyLineageCredentials(ctx, &vo, secrets); err == nil {
+		err = cs.backend.snapshotServer(&vo).Flatten(ctx, target.taskUUID)
+	}
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to flatten clone task %s of %s: %v", target.taskUUID, target.path, err)
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+	"github.com/opencurve/curve-csi/pkg/util"
+)
+
+func TestParseMaxCloneDepth(t *testing.T) {
+	depth, err := parseMaxCloneDepth(map[string]string{"user": "k8s"})
+	assert.NoError(t, err)
+	assert.Nil(t, depth)
+
+	depth, err = parseMaxCloneDepth(map[string]string{maxCloneDepthParam: "0"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, *depth)
+
+	depth, err = parseMaxCloneDepth(map[string]string{maxCloneDepthParam: "3"})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, *depth)
+
+	for _, str := range []string{"", "-1", "three", "1.5"} {
+		_, err = parseMaxCloneDepth(map[string]string{maxCloneDepthParam: str})
+		assert.Error(t, err, str)
+	}
+}
+
+func TestParseCloneDepthFlatten(t *testing.T) {
+	mode, err := parseCloneDepthFlatten(map[string]string{})
+	assert.NoError(t, err)
+	assert.Equal(t, cloneDepthFlattenClone, mode)
+
+	mode, err = parseCloneDepthFlatten(map[string]string{cloneDepthFlattenParam: "source"})
+	assert.NoError(t, err)
+	assert.Equal(t, cloneDepthFlattenSource, mode)
+
+	_, err = parseCloneDepthFlatten(map[string]string{cloneDepthFlattenParam: "parent"})
+	assert.Error(t, err)
+}
+
+func TestLimitCloneDepth(t *testing.T) {
+	ctx := context.TODO()
+	credentialsDir := t.TempDir()
+	writeCredentials(t, credentialsDir, "other", "other-secret")
+
+	backend := newFakeBackend()
+	backend.tasks = map[string]curveservice.TaskInfo{
+		// cloned from a snapshot of a lazy clone
+		"/k8s/csi-vol-pvc-3": {UUID: "t3", User: "k8s", Src: "s2", TaskStatus: curveservice.TaskStatusMetaInstalled},
+		// cloned from a volume of another user
+		"/k8s/csi-vol-pvc-2":   {UUID: "t2", User: "k8s", Src: "/other/csi-vol-pvc-1", TaskStatus: curveservice.TaskStatusMetaInstalled},
+		"/other/csi-vol-pvc-1": {UUID: "t1", User: "other", Src: "/other/csi-vol-pvc-0", TaskStatus: curveservice.TaskStatusMetaInstalled},
+		// flattened
+		"/other/csi-vol-pvc-0": {UUID: "t0", User: "other", Src: "/other/base", TaskStatus: curveservice.TaskStatusDone},
+	}
+	backend.snapshots["s2"] = curveservice.Snapshot{UUID: "s2", User: "k8s", File: "/k8s/csi-vol-pvc-2"}
+	cs := &controllerServer{credentialsDir: credentialsDir, backend: backend}
+	destVolOptions := &volumeOptions{
+		volId:   "v1-00-00-0-03k8s-csi-vol-pvc-3",
+		user:    "k8s",
+		volName: "csi-vol-pvc-3",
+		cluster: &util.ClusterInfo{SnapshotServers: []string{"http://127.0.0.1:5555"}},
+	}
+	secrets := map[string]string{"user": "k8s", "password": "secret"}
+
+	lineage, err := cs.cloneLineage(ctx, destVolOptions, secrets)
+	assert.NoError(t, err)
+	assert.Equal(t, []lazyClone{
+		{user: "k8s", path: "/k8s/csi-vol-pvc-3", taskUUID: "t3"},
+		{user: "k8s", path: "/k8s/csi-vol-pvc-2", taskUUID: "t2"},
+		{user: "other", path: "/other/csi-vol-pvc-1", taskUUID: "t1"},
+	}, lineage)
+	// each user with its credentials
+	assert.Equal(t, map[string]string{"k8s": "secret", "other": "other-secret"}, backend.passwords)
+
+	// within the depth
+	maxDepth := 3
+	destVolOptions.maxCloneDepth = &maxDepth
+	cs.limitCloneDepth(ctx, destVolOptions, secrets)
+	assert.Empty(t, backend.flattened)
+
+	// the new clone is flattened by default
+	maxDepth = 2
+	cs.limitCloneDepth(ctx, destVolOptions, secrets)
+	assert.Equal(t, []string{"t3"}, backend.flattened)
+
+	// or the nearest lazy clone it depends on
+	backend.flattened = nil
+	destVolOptions.cloneDepthFlatten = cloneDepthFlattenSource
+	cs.limitCloneDepth(ctx, destVolOptions, secrets)
+	assert.Equal(t, []string{"t2"}, backend.flattened)
+}
+
+func TestContentSourceVolID(t *testing.T) {
+	volId := "v1-00-00-0-03k8s-csi-vol-pvc-1"
+	snapshotId, err := composeSnapshotID("5a0f2e41-6a2c-4c0c-9a1d-3f0c2a9b7e11", volId)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "", contentSourceVolID(nil))
+	assert.Equal(t, volId, contentSourceVolID(&csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: volId},
+		},
+	}))
+	assert.Equal(t, volId, contentSourceVolID(&csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotId},
+		},
+	}))
+	assert.Equal(t, "", contentSourceVolID(&csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "bad"},
+		},
+	}))
+}
@@ -0,0 +1,239 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+	"github.com/opencurve/curve-csi/pkg/util"
+	"github.com/opencurve/curve-csi/pkg/util/ctxlog"
+)
+
+// cloneTaskGCItem is a clone or recover task collected by the GC.
+type cloneTaskGCItem struct {
+	ClusterID string `json:"clusterID"`
+	User      string `json:"user"`
+	UUID      string `json:"uuid"`
+	File      string `json:"file"`
+	TaskType  string `json:"taskType"`
+	Reason    string `json:"reason"`
+	Cleaned   bool   `json:"cleaned"`
+	Error     string `json:"error,omitempty"`
+}
+
+// cloneTaskGCReport is the result of a GC run.
+type cloneTaskGCReport struct {
+	StartedAt time.Time         `json:"startedAt"`
+	DryRun    bool              `json:"dryRun"`
+	Items     []cloneTaskGCItem `json:"items"`
+	// the clusters can not be listed, e.g. the cluster config is broken
+	Error string `json:"error,omitempty"`
+}
+
+// cloneTaskGC periodically cleans the clone and recover tasks of the CSI volumes
+// on the snapshot servers, which are the done tasks whose destination no longer
+// exists and the error tasks older than the grace period. In dry-run mode, the
+// tasks are only reported.
+type cloneTaskGC struct {
+	*worker
+	clusters *clusterResolver
+	// skips the volumes in operation
+	volumeLocks *util.VolumeLocks
+	users       []string
+	grace       time.Duration
+	dryRun      bool
+	// the credentials of the users, see --credentials-dir
+	credentialsDir string
+
+	backend workerBackend
+	now     func() time.Time
+}
+
+// newCloneTaskGC returns nil if the interval is not set.
+func newCloneTaskGC(
+	clusters *clusterResolver,
+	volumeLocks *util.VolumeLocks,
+	credentialsDir string,
+	users string,
+	interval, grace time.Duration,
+	dryRun bool) (*cloneTaskGC, error) {
+	if interval <= 0 {
+		return nil, nil
+	}
+	gc := &cloneTaskGC{
+		clusters:       clusters,
+		volumeLocks:    volumeLocks,
+		grace:          grace,
+		dryRun:         dryRun,
+		credentialsDir: credentialsDir,
+		backend:        curveBackend{},
+		now:            time.Now,
+	}
+	gc.worker = newWorker("clone-task-gc", interval, func(ctx context.Context) interface{} {
+		return gc.collect(ctx)
+	})
+	for _, user := range strings.Split(users, ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			gc.users = append(gc.users, user)
+		}
+	}
+	if len(gc.users) == 0 {
+		return nil, fmt.Errorf("the clone task GC requires the users")
+	}
+	if grace < 0 {
+		return nil, fmt.Errorf("invalid clone task GC grace period %v", grace)
+	}
+	return gc, nil
+}
+
+// taskGCReason returns why the task should be cleaned, empty if not. Only the tasks
+// of the CSI volumes are collected, destExists is called for the done tasks only.
+func taskGCReason(
+	task curveservice.TaskInfo,
+	now time.Time,
+	grace time.Duration,
+	destExists func() (bool, error)) (string, error) {
+	if !strings.HasPrefix(path.Base(task.File), csiVolNamingPrefix) {
+		return "", nil
+	}
+	switch task.TaskStatus {
+	case curveservice.TaskStatusDone:
+		exists, err := destExists()
+		if err != nil || exists {
+			return "", err
+		}
+		return "done and the destination not found", nil
+	case curveservice.TaskStatusError:
+		age := now.Sub(time.Unix(0, task.Time*1000))
+		if age < grace {
+			return "", nil
+		}
+		return fmt.Sprintf("error for %v", age.Truncate(time.Second)), nil
+	}
+	return "", nil
+}
+
+func taskTypeString(taskType curveservice.TaskType) string {
+	switch taskType {
+	case curveservice.TaskTypeClone:
+		return "clone"
+	case curveservice.TaskTypeRecover:
+		return "recover"
+	}
+	return fmt.Sprintf("unknown(%d)", taskType)
+}
+
+// collect runs the GC once in all the clusters with the snapshot server.
+func (gc *cloneTaskGC) collect(ctx context.Context) *cloneTaskGCReport {
+	ctxlog.V(4).Infof(ctx, "collecting clone tasks, users: %v, grace: %v, dry-run: %v", gc.users, gc.grace, gc.dryRun)
+	report := &cloneTaskGCReport{StartedAt: gc.now(), DryRun: gc.dryRun, Items: []cloneTaskGCItem{}}
+	clusters, err := gc.clusters.all()
+	if err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to list the clusters")
+		report.Error = err.Error()
+	}
+	for _, cluster := range clusters {
+		if len(cluster.SnapshotServers) == 0 {
+			continue
+		}
+		for _, user := range gc.users {
+			report.Items = append(report.Items, gc.collectUser(ctx, &cluster, user)...)
+		}
+	}
+
+	cleaned := 0
+	for _, item := range report.Items {
+		if item.Cleaned {
+			cleaned++
+		}
+	}
+	ctxlog.Infof(ctx, "clone task GC done, %d collected, %d cleaned, dry-run: %v", len(report.Items), cleaned, gc.dryRun)
+	return report
+}
+
+func (gc *cloneTaskGC) collectUser(ctx context.Context, cluster *util.ClusterInfo, user string) []cloneTaskGCItem {
+	userOptions := &volumeOptions{user: user, cluster: cluster}
+	if err := userOptions.applyCredentials(backgroundSecrets(ctx, gc.credentialsDir, user)); err != nil {
+		ctxlog.Warningf(ctx, "invalid credentials of user %s: %v", user, err)
+		return nil
+	}
+	snapServer := gc.backend.snapshotServer(userOptions)
+	tasks, err := snapServer.ListCloneTasks(ctx)
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to list clone tasks of user %s in cluster %q: %v", user, cluster.ClusterID, err)
+		return nil
+	}
+
+	now := gc.now()
+	items := make([]cloneTaskGCItem, 0)
+	for _, task := range tasks {
+		volName := path.Base(task.File)
+		reason, err := taskGCReason(task, now, gc.grace, func() (bool, error) {
+			destOptions := *userOptions
+			destOptions.volName = volName
+			if _, err := gc.backend.stat(ctx, &destOptions); err != nil {
+				if util.IsNotFoundErr(err) {
+					return false, nil
+				}
+				return false, err
+			}
+			return true, nil
+		})
+		if err != nil {
+			ctxlog.Warningf(ctx, "failed to check clone task %s of %s: %v", task.UUID, task.File, err)
+			continue
+		}
+		if reason == "" {
+			continue
+		}
+
+		item := cloneTaskGCItem{
+			ClusterID: cluster.ClusterID,
+			User:      user,
+			UUID:      task.UUID,
+			File:      task.File,
+			TaskType:  taskTypeString(task.TaskType),
+			Reason:    reason,
+		}
+		if gc.dryRun {
+			ctxlog.Infof(ctx, "[dry-run] clone task %s of %s can be cleaned: %s", task.UUID, task.File, reason)
+			items = append(items, item)
+			continue
+		}
+		// lock out the CreateVolume of the same request name
+		reqName := strings.TrimPrefix(volName, csiVolNamingPrefix)
+		if acquired := gc.volumeLocks.TryAcquire(reqName); !acquired {
+			ctxlog.V(4).Infof(ctx, "volume %s is in operation, skip cleaning its clone task", volName)
+			continue
+		}
+		if err = snapServer.CleanFinishedCloneTask(ctx, task.UUID); err != nil {
+			ctxlog.Warningf(ctx, "failed to clean clone task %s of %s: %v", task.UUID, task.File, err)
+			item.Error = err.Error()
+		} else {
+			ctxlog.Infof(ctx, "cleaned clone task %s of %s: %s", task.UUID, task.File, reason)
+			item.Cleaned = true
+		}
+		gc.volumeLocks.Release(reqName)
+		items = append(items, item)
+	}
+	return items
+}
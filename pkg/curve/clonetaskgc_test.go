@@ -0,0 +1,95 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+)
+
+func TestNewCloneTaskGC(t *testing.T) {
+	gc, err := newCloneTaskGC(nil, nil, "", "k8s", 0, time.Hour, false)
+	assert.NoError(t, err)
+	assert.Nil(t, gc)
+
+	_, err = newCloneTaskGC(nil, nil, "", " , ", time.Hour, time.Hour, false)
+	assert.Error(t, err)
+	_, err = newCloneTaskGC(nil, nil, "", "k8s", time.Hour, -time.Hour, false)
+	assert.Error(t, err)
+
+	gc, err = newCloneTaskGC(nil, nil, "", "k8s, foo", time.Hour, time.Hour, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"k8s", "foo"}, gc.users)
+}
+
+func TestTaskGCReason(t *testing.T) {
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	microseconds := func(t time.Time) int64 { return t.UnixNano() / 1000 }
+	exists := func(b bool, err error) func() (bool, error) {
+		return func() (bool, error) { return b, err }
+	}
+
+	done := curveservice.TaskInfo{
+		File:       "/k8s/csi-vol-pvc-1",
+		TaskStatus: curveservice.TaskStatusDone,
+		Time:       microseconds(now),
+	}
+	reason, err := taskGCReason(done, now, time.Hour, exists(true, nil))
+	assert.NoError(t, err)
+	assert.Empty(t, reason)
+	reason, err = taskGCReason(done, now, time.Hour, exists(false, nil))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, reason)
+	_, err = taskGCReason(done, now, time.Hour, exists(false, errors.New("stat failed")))
+	assert.Error(t, err)
+
+	// not a CSI volume
+	other := done
+	other.File = "/k8s/my-volume"
+	reason, err = taskGCReason(other, now, time.Hour, exists(false, nil))
+	assert.NoError(t, err)
+	assert.Empty(t, reason)
+
+	failed := done
+	failed.TaskStatus = curveservice.TaskStatusError
+	failed.Time = microseconds(now.Add(-30 * time.Minute))
+	reason, err = taskGCReason(failed, now, time.Hour, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, reason)
+	failed.Time = microseconds(now.Add(-2 * time.Hour))
+	reason, err = taskGCReason(failed, now, time.Hour, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "error for 2h0m0s", reason)
+
+	// the unfinished tasks are never collected
+	for _, status := range []curveservice.TaskStatus{
+		curveservice.TaskStatusCloning,
+		curveservice.TaskStatusMetaInstalled,
+		curveservice.TaskStatusRetrying,
+	} {
+		task := failed
+		task.TaskStatus = status
+		reason, err = taskGCReason(task, now, time.Hour, nil)
+		assert.NoError(t, err)
+		assert.Empty(t, reason)
+	}
+}
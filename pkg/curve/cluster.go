@@ -0,0 +1,124 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/opencurve/curve-csi/pkg/util"
+)
+
+// errClusterConfig is returned if the cluster config file can not be read or parsed,
+// which is a fault of the deployment rather than the request.
+var errClusterConfig = errors.New("bad cluster config")
+
+// clusterErrorToStatus returns Internal for the bad cluster config, otherwise the code.
+func clusterErrorToStatus(err error, code codes.Code) error {
+	if errors.Is(err, errClusterConfig) {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return status.Error(code, err.Error())
+}
+
+// clusterResolver resolves the cluster info of a clusterID.
+// The empty clusterID refers to the default cluster, which is reached by
+// the default curve client.conf and the driver flag --snapshot-server,
+// an entry with the empty clusterID in the config file overrides it.
+type clusterResolver struct {
+	// path of the cluster config file
+	configPath string
+	// snapshot server of the default cluster
+	snapshotServer string
+}
+
+func newClusterResolver(configPath, snapshotServer string) *clusterResolver {
+	return &clusterResolver{
+		configPath:     configPath,
+		snapshotServer: snapshotServer,
+	}
+}
+
+// resolve returns the NotFoundErr if clusterID is not in the config file,
+// and errClusterConfig if the config file is broken.
+func (cr *clusterResolver) resolve(clusterID string) (*util.ClusterInfo, error) {
+	cluster, err := util.GetClusterInfo(cr.configPath, clusterID)
+	switch {
+	case err == nil:
+	case clusterID == "" && (util.IsNotFoundErr(err) || errors.Is(err, os.ErrNotExist)):
+		// the config of the default cluster is optional
+		cluster = &util.ClusterInfo{}
+	case util.IsNotFoundErr(err, clusterID):
+		return nil, err
+	default:
+		return nil, fmt.Errorf("%w: %v", errClusterConfig, err)
+	}
+
+	if clusterID == "" && len(cluster.SnapshotServers) == 0 && cr.snapshotServer != "" {
+		cluster.SnapshotServers = []string{cr.snapshotServer}
+	}
+	return cluster, nil
+}
+
+// candidates returns the clusters the volume can be created in, which is the
+// cluster of clusterID if set, otherwise all the clusters in the config file.
+func (cr *clusterResolver) candidates(clusterID string) ([]util.ClusterInfo, error) {
+	if clusterID != "" {
+		cluster, err := cr.resolve(clusterID)
+		if err != nil {
+			return nil, err
+		}
+		return []util.ClusterInfo{*cluster}, nil
+	}
+	return cr.list()
+}
+
+// list returns the clusters in the config file, none if the file does not exist.
+func (cr *clusterResolver) list() ([]util.ClusterInfo, error) {
+	clusters, err := util.ListClusterInfo(cr.configPath)
+	if err != nil {
+		// the config file is optional for the default cluster
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: %v", errClusterConfig, err)
+	}
+	return clusters, nil
+}
+
+// all returns all the clusters in the config file and the default cluster.
+func (cr *clusterResolver) all() ([]util.ClusterInfo, error) {
+	clusters, err := cr.list()
+	if err != nil {
+		return nil, err
+	}
+	all := make([]util.ClusterInfo, 0, len(clusters)+1)
+	for _, cluster := range clusters {
+		if cluster.ClusterID != "" {
+			all = append(all, cluster)
+		}
+	}
+	defaultCluster, err := cr.resolve("")
+	if err != nil {
+		return nil, err
+	}
+	return append(all, *defaultCluster), nil
+}
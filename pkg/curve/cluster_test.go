@@ -0,0 +1,74 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/opencurve/curve-csi/pkg/util"
+)
+
+func TestClusterResolver(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+
+	// the config file is optional for the default cluster
+	cr := newClusterResolver(configPath, "http://127.0.0.1:5555")
+	cluster, err := cr.resolve("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http://127.0.0.1:5555"}, cluster.SnapshotServers)
+	clusters, err := cr.candidates("")
+	assert.NoError(t, err)
+	assert.Empty(t, clusters)
+	clusters, err = cr.all()
+	assert.NoError(t, err)
+	assert.Len(t, clusters, 1)
+
+	assert.NoError(t, os.WriteFile(configPath, []byte(`[{"clusterID": "cluster1"}]`), 0o600))
+	cluster, err = cr.resolve("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http://127.0.0.1:5555"}, cluster.SnapshotServers)
+	_, err = cr.resolve("cluster2")
+	assert.True(t, util.IsNotFoundErr(err, "cluster2"))
+	clusters, err = cr.all()
+	assert.NoError(t, err)
+	assert.Len(t, clusters, 2)
+
+	// the broken config is not the default cluster
+	assert.NoError(t, os.WriteFile(configPath, []byte(`[{"clusterID": "cluster1"`), 0o600))
+	for _, clusterID := range []string{"", "cluster1"} {
+		_, err = cr.resolve(clusterID)
+		assert.ErrorIs(t, err, errClusterConfig)
+		_, err = cr.candidates(clusterID)
+		assert.ErrorIs(t, err, errClusterConfig)
+	}
+	_, err = cr.all()
+	assert.ErrorIs(t, err, errClusterConfig)
+
+	vo := &volumeOptions{}
+	err = vo.resolveCluster(cr)
+	assert.Equal(t, codes.Internal, status.Code(clusterErrorToStatus(err, codes.InvalidArgument)))
+	vo = &volumeOptions{clusterID: "cluster2"}
+	assert.NoError(t, os.WriteFile(configPath, []byte(`[{"clusterID": "cluster1"}]`), 0o600))
+	err = vo.resolveCluster(cr)
+	assert.Equal(t, codes.InvalidArgument, status.Code(clusterErrorToStatus(err, codes.InvalidArgument)))
+}
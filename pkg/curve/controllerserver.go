@@ -43,7 +43,29 @@ type controllerServer struct {
 	// for that same snapshot (as defined by SnapshotID/snapshot name) return an Aborted error
 	snapshotLocks *util.VolumeLocks
 
-	snapshotServer string
+	clusters *clusterResolver
+	// the stores of the controller metadata, see --metadata-namespace
+	metadata *metadataStores
+	// the controller side metadata of volumes
+	volumeMeta *volumeMetaStore
+	// max depth of lazy clone chain, 0 is unlimited
+	maxCloneDepth int
+	// the credentials of the users for the work without the CSI secrets, see --credentials-dir
+	credentialsDir string
+	// reaches the curve clusters, e.g. to walk the clone lineage
+	backend workerBackend
+	// flattens the lazy clones in the background, nil if disabled
+	flattens *flattenScheduler
+	// cleans the stale clone tasks periodically, nil if disabled
+	taskGC *cloneTaskGC
+	// the csi-addons replication service, nil if disabled
+	replication *replicationServer
+	// the csi-addons offline space reclaim service, nil if disabled
+	reclaimSpace *controllerReclaimSpaceServer
+	// the csi-addons network fence service, nil if disabled
+	fence *fenceServer
+	// populates the new volumes from disk images, nil if disabled
+	populator *populator
 }
 
 // CreateVolume creates the volume in backend, if it is not already present
@@ -69,21 +91,47 @@ func (cs *controllerServer) CreateVolume(
 		ctxlog.ErrorS(ctx, err, "failed to new volume options")
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	volOptions.cloneSource = contentSourceVolID(req.GetVolumeContentSource())
+	accessibleTopology, err := volOptions.resolveTopology(cs.clusters, cs.Driver.GetName(), req.GetAccessibilityRequirements())
+	if err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to resolve topology of volume")
+		return nil, clusterErrorToStatus(err, codes.ResourceExhausted)
+	}
+	if err = volOptions.resolveCluster(cs.clusters); err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to resolve cluster of volume")
+		return nil, clusterErrorToStatus(err, codes.InvalidArgument)
+	}
+	if err = volOptions.resolveSize(req.GetCapacityRange()); err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to resolve size of volume")
+		return nil, sizeErrorToStatus(err)
+	}
 	ctxlog.V(5).Infof(ctx, "build volumeOptions: %+v", volOptions)
 
 	// verify the volume already exists
-	curveVol := curveservice.NewCurveVolume(volOptions.user, volOptions.volName, volOptions.sizeGiB)
+	curveVol := volOptions.curveVolume()
 	volDetail, err := curveVol.Stat(ctx)
 	if err == nil {
 		ctxlog.V(4).Infof(ctx, "the volume %v already created, status: %v", volOptions.volName, volDetail.FileStatus)
 		if volDetail.LengthGiB != volOptions.sizeGiB {
 			return nil, status.Errorf(codes.AlreadyExists, "request size %vGiB not equal with existing %vGiB", volOptions.sizeGiB, volDetail.LengthGiB)
 		}
+		if err = volOptions.placement.checkFile(volDetail); err != nil {
+			return nil, status.Error(codes.AlreadyExists, err.Error())
+		}
+		if volOptions.image != nil {
+			if err = cs.populator.populate(ctx, volOptions); err != nil {
+				return nil, err
+			}
+		}
+		if err = cs.setupVolumeMeta(ctx, volOptions, curveVol); err != nil {
+			return nil, err
+		}
 		return &csi.CreateVolumeResponse{
 			Volume: &csi.Volume{
-				VolumeId:      volOptions.volId,
-				CapacityBytes: int64(volOptions.sizeGiB * volumehelpers.GiB),
-				VolumeContext: req.GetParameters(),
+				VolumeId:           volOptions.volId,
+				CapacityBytes:      int64(volOptions.sizeGiB * volumehelpers.GiB),
+				VolumeContext:      req.GetParameters(),
+				AccessibleTopology: accessibleTopology,
 			},
 		}, nil
 	}
@@ -98,14 +146,18 @@ func (cs *controllerServer) CreateVolume(
 		return nil, err
 	}
 	if len(volSource) > 0 {
+		if err = cs.setupVolumeMeta(ctx, volOptions, curveVol); err != nil {
+			return nil, err
+		}
 		volContext := req.GetParameters()
 		volContext["volSource"] = volSource
 		return &csi.CreateVolumeResponse{
 			Volume: &csi.Volume{
-				VolumeId:      volOptions.volId,
-				CapacityBytes: int64(volOptions.sizeGiB * volumehelpers.GiB),
-				ContentSource: req.GetVolumeContentSource(),
-				VolumeContext: volContext,
+				VolumeId:           volOptions.volId,
+				CapacityBytes:      int64(volOptions.sizeGiB * volumehelpers.GiB),
+				ContentSource:      req.GetVolumeContentSource(),
+				VolumeContext:      volContext,
+				AccessibleTopology: accessibleTopology,
 			},
 		}, nil
 	}
@@ -115,13 +167,22 @@ func (cs *controllerServer) CreateVolume(
 		ctxlog.ErrorS(ctx, err, "failed to create volume")
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	if volOptions.image != nil {
+		if err = cs.populator.populate(ctx, volOptions); err != nil {
+			return nil, err
+		}
+	}
+	if err = cs.setupVolumeMeta(ctx, volOptions, curveVol); err != nil {
+		return nil, err
+	}
 
 	ctxlog.Infof(ctx, "successfully created volume named %s for request name %s", curveVol.FileName, reqName)
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      volOptions.volId,
-			CapacityBytes: int64(volOptions.sizeGiB * volumehelpers.GiB),
-			VolumeContext: req.GetParameters(),
+			VolumeId:           volOptions.volId,
+			CapacityBytes:      int64(volOptions.sizeGiB * volumehelpers.GiB),
+			VolumeContext:      req.GetParameters(),
+			AccessibleTopology: accessibleTopology,
 		},
 	}, nil
 }
@@ -157,30 +218,58 @@ func (cs *controllerServer) DeleteVolume(
 	}
 	defer cs.volumeLocks.Release(volOptions.reqName)
 
-	if cs.snapshotServer == "" {
+	if err = volOptions.resolveCluster(cs.clusters); err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to resolve cluster of volume", "volumeId", volumeId)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err = volOptions.applyCredentials(req.GetSecrets()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	meta, err := cs.volumeMeta.get(volumeId)
+	if err != nil {
+		// deleted by the volume ID as without the metadata, the adopted file is kept
+		ctxlog.Warningf(ctx, "failed to get metadata of volume %s, deleting it by the volume ID: %v", volumeId, err)
+		meta = &volumeMeta{}
+	}
+	cs.populator.cancel(volumeId)
+	forceDelete := meta.Trash != nil && !*meta.Trash
+	// the adopted file is not created by the driver, keep it unless owned
+	if volOptions.adopted() && (meta.Owned == nil || !*meta.Owned) {
+		cs.deleteVolumeMeta(ctx, volumeId)
+		ctxlog.Infof(ctx, "volume %s is adopted and not owned, keep the file %s", volumeId, volOptions.genVolumePath())
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	if !volOptions.snapshotEnabled() {
 		// delete volume
-		curveVol := curveservice.NewCurveVolume(volOptions.user, volOptions.volName, volOptions.sizeGiB)
-		if err := curveVol.Delete(ctx); err != nil {
+		curveVol := volOptions.curveVolume()
+		if err := curveVol.Delete(ctx, forceDelete); err != nil {
 			ctxlog.ErrorS(ctx, err, "failed to delete volume", "volumeId", volumeId)
 			return nil, status.Error(codes.Internal, err.Error())
 		}
+		cs.deleteVolumeMeta(ctx, volumeId)
 		ctxlog.Infof(ctx, "successfully deleted volume %s", volumeId)
 		return &csi.DeleteVolumeResponse{}, nil
 	}
 
 	// ensure all the tasks created from this volume status done.
-	snapServer := curveservice.NewSnapshotServer(cs.snapshotServer, volOptions.user, volOptions.volName)
+	if err = cs.ensureCrossUserClonesDone(ctx, volumeId, volOptions.genVolumePath()); err != nil {
+		ctxlog.Errorf(ctx, "failed to ensure cross-user clones from %v done: %v", volumeId, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	snapServer := volOptions.snapshotServer()
 	if err = snapServer.EnsureTaskFromSourceDone(ctx, volOptions.genVolumePath()); err != nil {
 		ctxlog.Errorf(ctx, "failed to ensure tasks from %v status done: %v", volumeId, err)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
 	// detete volume
-	curveVol := curveservice.NewCurveVolume(volOptions.user, volOptions.volName, volOptions.sizeGiB)
-	if err := curveVol.Delete(ctx); err != nil {
+	curveVol := volOptions.curveVolume()
+	if err := curveVol.Delete(ctx, forceDelete); err != nil {
 		ctxlog.ErrorS(ctx, err, "failed to delete volume", "volumeId", volumeId)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	cs.deleteVolumeMeta(ctx, volumeId)
 	ctxlog.Infof(ctx, "successfully deleted volume %s", volumeId)
 
 	// clean cloneTask if the volume is cloned
@@ -206,11 +295,6 @@ func (cs *controllerServer) ControllerExpandVolume(
 		ctxlog.ErrorS(ctx, err, "ExpandVolumeRequest validation failed")
 		return nil, err
 	}
-	reqSizeGiB, err := roundUpToGiBInt(req.GetCapacityRange().GetRequiredBytes())
-	if err != nil {
-		return nil, err
-	}
-
 	volumeId := req.GetVolumeId()
 
 	// lock out parallel requests against the same volume ID
@@ -222,7 +306,7 @@ func (cs *controllerServer) ControllerExpandVolume(
 
 	volOptions, err := newVolumeOptionsFromVolID(volumeId)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, status.Error(codes.NotFound, err.Error())
 	}
 
 	// lock out parallel delete/create/expand requests against the same volume name
@@ -232,25 +316,167 @@ func (cs *controllerServer) ControllerExpandVolume(
 	}
 	defer cs.volumeLocks.Release(volOptions.reqName)
 
-	curveVol := curveservice.NewCurveVolume(volOptions.user, volOptions.volName, reqSizeGiB)
-	sizeGiB, resizeRequired, err := expandVolume(ctx, curveVol, reqSizeGiB)
+	if err = volOptions.resolveCluster(cs.clusters); err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to resolve cluster of volume", "volumeId", volumeId)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err = volOptions.applyCredentials(req.GetSecrets()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// the size policy of StorageClass is not available, use the cluster's one
+	if err = volOptions.resolveSize(req.GetCapacityRange()); err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to resolve size of volume", "volumeId", volumeId)
+		return nil, sizeErrorToStatus(err)
+	}
+	curveVol := volOptions.curveVolume()
+	sizeGiB, resizeRequired, err := expandVolume(ctx, curveVol, volOptions.sizeGiB)
 	if err != nil {
 		ctxlog.ErrorS(ctx, err, "failed to expandVolume")
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+
+	// reapply the QoS scaled with size
+	meta, err := cs.volumeMeta.get(volumeId)
+	if err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to get volume metadata", "volumeId", volumeId)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if meta.QoS.scalesWithSize() {
+		if err = applyQoS(ctx, curveVol, meta.QoS, sizeGiB); err != nil {
+			ctxlog.ErrorS(ctx, err, "failed to reapply QoS", "volumeId", volumeId)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
 	return &csi.ControllerExpandVolumeResponse{
 		CapacityBytes:         int64(sizeGiB * volumehelpers.GiB),
 		NodeExpansionRequired: resizeRequired,
 	}, nil
 }
 
+// ControllerGetVolume gets the volume and its effective QoS in VolumeContext.
+func (cs *controllerServer) ControllerGetVolume(
+	ctx context.Context,
+	req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	volumeId := req.GetVolumeId()
+	if volumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty volume ID in request")
+	}
+
+	volOptions, err := newVolumeOptionsFromVolID(volumeId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err = volOptions.resolveCluster(cs.clusters); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	volDetail, err := volOptions.curveVolume().Stat(ctx)
+	if err != nil {
+		if util.IsNotFoundErr(err) {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeId)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	meta, err := cs.volumeMeta.get(volumeId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      volumeId,
+			CapacityBytes: int64(volDetail.LengthGiB * volumehelpers.GiB),
+			VolumeContext: meta.QoS.toParameters(volDetail.LengthGiB),
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{},
+	}, nil
+}
+
+// ControllerModifyVolume modifies the mutable attributes of the volume,
+// the immutable ones are rejected by validation.
+func (cs *controllerServer) ControllerModifyVolume(
+	ctx context.Context,
+	req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	if err := cs.validateModifyVolumeRequest(req); err != nil {
+		ctxlog.ErrorS(ctx, err, "ModifyVolumeRequest validation failed")
+		return nil, err
+	}
+	if !cs.volumeMeta.enabled() {
+		return nil, status.Error(codes.FailedPrecondition, "the controller metadata store is not set, see --metadata-namespace")
+	}
+
+	volumeId := req.GetVolumeId()
+	if acquired := cs.volumeLocks.TryAcquire(volumeId); !acquired {
+		ctxlog.Infof(ctx, util.VolumeOperationAlreadyExistsFmt, volumeId)
+		return nil, status.Errorf(codes.Aborted, util.VolumeOperationAlreadyExistsFmt, volumeId)
+	}
+	defer cs.volumeLocks.Release(volumeId)
+
+	volOptions, err := newVolumeOptionsFromVolID(volumeId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if acquired := cs.volumeLocks.TryAcquire(volOptions.reqName); !acquired {
+		ctxlog.Infof(ctx, util.VolumeOperationAlreadyExistsFmt, volumeId)
+		return nil, status.Errorf(codes.Aborted, util.VolumeOperationAlreadyExistsFmt, volOptions.reqName)
+	}
+	defer cs.volumeLocks.Release(volOptions.reqName)
+
+	if err = volOptions.resolveCluster(cs.clusters); err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to resolve cluster of volume", "volumeId", volumeId)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err = volOptions.applyCredentials(req.GetSecrets()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	curveVol := volOptions.curveVolume()
+	volDetail, err := curveVol.Stat(ctx)
+	if err != nil {
+		if util.IsNotFoundErr(err) {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeId)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	meta, err := cs.volumeMeta.get(volumeId)
+	if err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to get volume metadata", "volumeId", volumeId)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	removed, err := meta.modify(req.GetMutableParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	for _, throttleType := range removed {
+		if err = curveVol.UpdateThrottle(ctx, throttleType, 0); err != nil {
+			ctxlog.ErrorS(ctx, err, "failed to remove throttle", "volumeId", volumeId)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if err = applyQoS(ctx, curveVol, meta.QoS, volDetail.LengthGiB); err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to apply QoS", "volumeId", volumeId)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if meta.isEmpty() {
+		err = cs.volumeMeta.delete(volumeId)
+	} else {
+		err = cs.volumeMeta.put(volumeId, meta)
+	}
+	if err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to save volume metadata", "volumeId", volumeId)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	ctxlog.Infof(ctx, "successfully modified volume %s", volumeId)
+	return &csi.ControllerModifyVolumeResponse{}, nil
+}
+
 // CreateSnapshot creates the snapshot in backend.
 func (cs *controllerServer) CreateSnapshot(
 	ctx context.Context,
 	req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	if cs.snapshotServer == "" {
-		return nil, status.Error(codes.Unimplemented, "")
-	}
 	if err := cs.validateSnapshotReq(req); err != nil {
 		ctxlog.ErrorS(ctx, err, "CreateSnapshotRequest validation failed")
 		return nil, err
@@ -271,6 +497,16 @@ func (cs *controllerServer) CreateSnapshot(
 		ctxlog.ErrorS(ctx, err, "failed to new volume options from id", "volumeId", sourceVolId)
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	if err = volOptions.resolveCluster(cs.clusters); err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to resolve cluster of volume", "volumeId", sourceVolId)
+		return nil, clusterErrorToStatus(err, codes.InvalidArgument)
+	}
+	if err = volOptions.applyCredentials(req.GetSecrets()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !volOptions.snapshotEnabled() {
+		return nil, status.Error(codes.Unimplemented, "")
+	}
 	ctxlog.V(5).Infof(ctx, "build volOptions: %+v", volOptions)
 
 	// lock out parallel delete/create/snapshot requests against the same volume
@@ -280,7 +516,7 @@ func (cs *controllerServer) CreateSnapshot(
 	}
 	defer cs.volumeLocks.Release(volOptions.reqName)
 
-	snapServer := curveservice.NewSnapshotServer(cs.snapshotServer, volOptions.user, volOptions.volName)
+	snapServer := volOptions.snapshotServer()
 	// verify the snapshot already exists
 	curveSnapshot, err := snapServer.GetFileSnapshotOfName(ctx, snapshotName)
 	if err == nil {
@@ -293,7 +529,7 @@ func (cs *controllerServer) CreateSnapshot(
 	}
 
 	// check source volume status
-	curveVol := curveservice.NewCurveVolume(volOptions.user, volOptions.volName, volOptions.sizeGiB)
+	curveVol := volOptions.curveVolume()
 	volDetail, err := curveVol.Stat(ctx)
 	if err != nil {
 		ctxlog.ErrorS(ctx, err, "failed to stat source volume", "volumeId", sourceVolId)
@@ -325,57 +561,13 @@ func (cs *controllerServer) CreateSnapshot(
 func (cs *controllerServer) DeleteSnapshot(
 	ctx context.Context,
 	req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	if cs.snapshotServer == "" {
-		return nil, status.Error(codes.Unimplemented, "")
-	}
 	if err := cs.validateDeleteSnapshotReq(req); err != nil {
 		ctxlog.ErrorS(ctx, err, "DeleteSnapshotRequest validation failed")
 		return nil, err
 	}
 
-	snapshotId := req.GetSnapshotId()
-	// lock out parallel snapshot
-	if acquired := cs.snapshotLocks.TryAcquire(snapshotId); !acquired {
-		ctxlog.Errorf(ctx, util.SnapshotOperationAlreadyExistsFmt, snapshotId)
-		return nil, status.Errorf(codes.Aborted, util.SnapshotOperationAlreadyExistsFmt, snapshotId)
-	}
-	defer cs.snapshotLocks.Release(snapshotId)
-
-	snapCurveUUID, volOptions, err := parseSnapshotID(snapshotId)
-	if err != nil {
-		ctxlog.Warningf(ctx, "failed to parse snapshot id: %v", snapshotId)
-		return &csi.DeleteSnapshotResponse{}, nil
-	}
-
-	snapServer := curveservice.NewSnapshotServer(cs.snapshotServer, volOptions.user, volOptions.volName)
-	// get snapshot
-	curveSnapshot, err := snapServer.GetFileSnapshotOfId(ctx, snapCurveUUID)
-	if err != nil {
-		if util.IsNotFoundErr(err, snapCurveUUID) {
-			ctxlog.Infof(ctx, "snapshot %v not found, maybe already deleted.", snapshotId)
-			return &csi.DeleteSnapshotResponse{}, nil
-		}
-		ctxlog.ErrorS(ctx, err, "failed to get snapshot", "snapCurveUUID", snapCurveUUID)
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	// lock out parallel snapshot
-	if acquired := cs.snapshotLocks.TryAcquire(curveSnapshot.Name); !acquired {
-		ctxlog.Errorf(ctx, util.SnapshotOperationAlreadyExistsFmt, curveSnapshot.Name)
-		return nil, status.Errorf(codes.Aborted, util.SnapshotOperationAlreadyExistsFmt, curveSnapshot.Name)
-	}
-	defer cs.snapshotLocks.Release(curveSnapshot.Name)
-
-	// ensure all the tasks created from this snapshot status done.
-	if err = snapServer.EnsureTaskFromSourceDone(ctx, snapCurveUUID); err != nil {
-		ctxlog.Errorf(ctx, "failed to ensure tasks from %v status done: %v", snapCurveUUID, err)
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	// do delete
-	if err = snapServer.DeleteSnapshot(ctx, snapCurveUUID); err != nil {
-		ctxlog.ErrorS(ctx, err, "failed to delete snapshot", "snapCurveUUID", snapCurveUUID)
-		return nil, status.Error(codes.Internal, err.Error())
+	if err := cs.deleteSnapshot(ctx, req.GetSnapshotId(), req.GetSecrets()); err != nil {
+		return nil, err
 	}
 	return &csi.DeleteSnapshotResponse{}, nil
 }
@@ -397,7 +589,13 @@ func (cs *controllerServer) ValidateVolumeCapabilities(
 	if err != nil {
 		return nil, status.Error(codes.NotFound, err.Error())
 	}
-	curveVol := curveservice.NewCurveVolume(volOptions.user, volOptions.volName, volOptions.sizeGiB)
+	if err = volOptions.resolveCluster(cs.clusters); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err = volOptions.applyCredentials(req.GetSecrets()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	curveVol := volOptions.curveVolume()
 	volDetail, err := curveVol.Stat(ctx)
 	if err != nil || volDetail.FileStatus == curveservice.CurveVolumeStatusNotExist {
 		return nil, status.Error(codes.NotFound, err.Error())
@@ -422,14 +620,30 @@ func (cs *controllerServer) createVolFromContentSource(
 		return "", nil
 	}
 
+	if !destVolOptions.snapshotEnabled() {
+		return "", status.Error(codes.Unimplemented, "")
+	}
+
 	volDestination := destVolOptions.genVolumePath()
+	// the source of another user must be allowed by the destination, and is accessed
+	// with the credentials of its user
+	srcUser := ""
+	if srcVolOptions, err := newVolumeOptionsFromVolID(contentSourceVolID(req.VolumeContentSource)); err == nil {
+		srcUser = srcVolOptions.user
+	}
+	if srcUser != "" && !destVolOptions.allowCloneFrom(srcUser) {
+		return "", status.Errorf(codes.InvalidArgument, "cloning from the volumes of user %q is not allowed, see the parameter %s",
+			srcUser, cloneSourceUsersParam)
+	}
+	srcSecrets, err := cs.sourceSecrets(ctx, req.VolumeContentSource, srcUser, destVolOptions.user, req.GetSecrets())
+	if err != nil {
+		return "", err
+	}
+
+	var srcVolId string
 	// check contentSource
 	switch req.VolumeContentSource.Type.(type) {
 	case *csi.VolumeContentSource_Snapshot:
-		if cs.snapshotServer == "" {
-			return "", status.Error(codes.Unimplemented, "")
-		}
-
 		snapshotId := req.VolumeContentSource.GetSnapshot().GetSnapshotId()
 		// lock out parallel snapshot
 		if acquired := cs.snapshotLocks.TryAcquire(snapshotId); !acquired {
@@ -439,7 +653,10 @@ func (cs *controllerServer) createVolFromContentSource(
 		defer cs.snapshotLocks.Release(snapshotId)
 		// ensure the source snapshot exists,
 		// and get the snapshot UUID as the source to create a new volume
-		volSource, err = ensureSnapshotExists(ctx, cs.snapshotServer, snapshotId)
+		volSource, err = ensureSnapshotExists(ctx, cs.clusters, snapshotId, destVolOptions.clusterID, srcSecrets)
+		if err == nil {
+			_, srcVolId, _ = decomposeSnapshotID(snapshotId)
+		}
 	case *csi.VolumeContentSource_Volume:
 		volumeId := req.VolumeContentSource.GetVolume().GetVolumeId()
 		// lock out parallel source volume
@@ -450,23 +667,34 @@ func (cs *controllerServer) createVolFromContentSource(
 		defer cs.volumeLocks.Release(volumeId)
 		// ensurce the source volume exists,
 		// and get the volume path as the source to create a new volume
-		volSource, err = ensureVolumeExists(ctx, cs.snapshotServer, volumeId)
+		volSource, err = ensureVolumeExists(ctx, cs.clusters, volumeId, destVolOptions.clusterID, srcSecrets)
+		srcVolId = volumeId
 	default:
 		err = status.Errorf(codes.InvalidArgument, "not a proper volume source %v", req.VolumeContentSource)
 	}
 	if err != nil {
 		return "", err
 	}
+	if err = checkCloneStripe(ctx, cs.clusters, srcVolId, destVolOptions, srcSecrets); err != nil {
+		return "", err
+	}
 
 	ctxlog.V(4).Infof(ctx, "clone/snapshot volume from %v to %v", volSource, volDestination)
-	snapServer := curveservice.NewSnapshotServer(cs.snapshotServer, destVolOptions.user, destVolOptions.volName)
+	snapServer := destVolOptions.snapshotServer()
+	cloneLazy := cs.cloneLazyFrom(ctx, srcVolId, destVolOptions.cloneLazy)
 	var taskUUID string
-	taskUUID, err = cloneVolume(ctx, snapServer, volSource, volDestination, destVolOptions.cloneLazy)
+	taskUUID, err = cloneVolume(ctx, snapServer, volSource, volDestination, cloneLazy)
 	if err != nil {
 		ctxlog.ErrorS(ctx, err, "failed to clone volume")
 		return "", status.Error(codes.Internal, err.Error())
 	}
 	ctxlog.V(4).Infof(ctx, "clone %v status done", taskUUID)
+	if srcUser != destVolOptions.user {
+		if err = cs.recordCrossUserClone(ctx, srcVolId, destVolOptions.volId, volSource); err != nil {
+			ctxlog.ErrorS(ctx, err, "failed to record cross-user clone", "srcVolId", srcVolId)
+			return "", status.Error(codes.Internal, err.Error())
+		}
+	}
 
 	// fix size if the cloned volume size less than requested size.
 	_, _, err = expandVolume(ctx, curveVol, destVolOptions.sizeGiB)
@@ -474,10 +702,164 @@ func (cs *controllerServer) createVolFromContentSource(
 		ctxlog.ErrorS(ctx, err, "failed to expand volume")
 		return "", status.Error(codes.Internal, err.Error())
 	}
+	if cloneLazy {
+		cs.limitCloneDepth(ctx, destVolOptions, req.GetSecrets())
+		cs.flattens.enqueue(ctx, destVolOptions.volId, taskUUID)
+	}
 
 	return volSource, nil
 }
 
+// deleteSnapshot deletes the snapshot in backend, it is not an error if not exists.
+func (cs *controllerServer) deleteSnapshot(ctx context.Context, snapshotId string, secrets map[string]string) error {
+	// lock out parallel snapshot
+	if acquired := cs.snapshotLocks.TryAcquire(snapshotId); !acquired {
+		ctxlog.Errorf(ctx, util.SnapshotOperationAlreadyExistsFmt, snapshotId)
+		return status.Errorf(codes.Aborted, util.SnapshotOperationAlreadyExistsFmt, snapshotId)
+	}
+	defer cs.snapshotLocks.Release(snapshotId)
+
+	snapCurveUUID, volOptions, err := parseSnapshotID(snapshotId)
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to parse snapshot id: %v", snapshotId)
+		return nil
+	}
+	if err = volOptions.resolveCluster(cs.clusters); err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to resolve cluster of snapshot", "snapshotId", snapshotId)
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err = volOptions.applyCredentials(secrets); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !volOptions.snapshotEnabled() {
+		return status.Error(codes.Unimplemented, "")
+	}
+
+	snapServer := volOptions.snapshotServer()
+	// get snapshot
+	curveSnapshot, err := snapServer.GetFileSnapshotOfId(ctx, snapCurveUUID)
+	if err != nil {
+		if util.IsNotFoundErr(err, snapCurveUUID) {
+			ctxlog.Infof(ctx, "snapshot %v not found, maybe already deleted.", snapshotId)
+			return nil
+		}
+		ctxlog.ErrorS(ctx, err, "failed to get snapshot", "snapCurveUUID", snapCurveUUID)
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	// lock out parallel snapshot
+	if acquired := cs.snapshotLocks.TryAcquire(curveSnapshot.Name); !acquired {
+		ctxlog.Errorf(ctx, util.SnapshotOperationAlreadyExistsFmt, curveSnapshot.Name)
+		return status.Errorf(codes.Aborted, util.SnapshotOperationAlreadyExistsFmt, curveSnapshot.Name)
+	}
+	defer cs.snapshotLocks.Release(curveSnapshot.Name)
+
+	// ensure all the tasks created from this snapshot status done.
+	if err = cs.ensureCrossUserClonesDone(ctx, volOptions.volId, snapCurveUUID); err != nil {
+		ctxlog.Errorf(ctx, "failed to ensure cross-user clones from %v done: %v", snapCurveUUID, err)
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err = snapServer.EnsureTaskFromSourceDone(ctx, snapCurveUUID); err != nil {
+		ctxlog.Errorf(ctx, "failed to ensure tasks from %v status done: %v", snapCurveUUID, err)
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	// do delete
+	if err = snapServer.DeleteSnapshot(ctx, snapCurveUUID); err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to delete snapshot", "snapCurveUUID", snapCurveUUID)
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// setupVolumeMeta applies the QoS of the created volume and saves its metadata.
+func (cs *controllerServer) setupVolumeMeta(
+	ctx context.Context,
+	volOptions *volumeOptions,
+	curveVol *curveservice.CurveVolume) error {
+	meta := volOptions.meta()
+	if meta == nil {
+		return nil
+	}
+	if err := applyQoS(ctx, curveVol, meta.QoS, volOptions.sizeGiB); err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to apply QoS", "volumeId", volOptions.volId)
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := cs.volumeMeta.put(volOptions.volId, meta); err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to save volume metadata", "volumeId", volOptions.volId)
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// cloneLazyFrom returns the laziness of cloning from the source volume,
+// the one in the metadata of the source overrides the default.
+func (cs *controllerServer) cloneLazyFrom(ctx context.Context, srcVolId string, defaultLazy bool) bool {
+	meta, err := cs.volumeMeta.get(srcVolId)
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to get metadata of source volume %s: %v", srcVolId, err)
+		return defaultLazy
+	}
+	if meta.CloneLazy != nil {
+		return *meta.CloneLazy
+	}
+	return defaultLazy
+}
+
+// deleteVolumeMeta deletes the metadata of the deleted volume, the failure is only logged.
+func (cs *controllerServer) deleteVolumeMeta(ctx context.Context, volumeId string) {
+	if meta, err := cs.volumeMeta.get(volumeId); err == nil && meta.CloneSource != "" {
+		cs.forgetCrossUserClone(ctx, meta.CloneSource, volumeId)
+	}
+	if err := cs.volumeMeta.delete(volumeId); err != nil {
+		ctxlog.Warningf(ctx, "failed to delete metadata of volume %s: %v", volumeId, err)
+	}
+	cs.flattens.remove(ctx, volumeId)
+	cs.replication.forget(ctx, volumeId)
+}
+
+// checkCloneStripe rejects the clone if the destination requests a stripe different
+// from the source, since the clone always inherits the striping of the source.
+func checkCloneStripe(
+	ctx context.Context,
+	clusters *clusterResolver,
+	srcVolId string,
+	destVolOptions *volumeOptions,
+	secrets map[string]string) error {
+	if !destVolOptions.placement.hasStripe() {
+		return nil
+	}
+	srcVolOptions, err := newVolumeOptionsFromVolID(srcVolId)
+	if err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to new volume options from id", "volumeId", srcVolId)
+		return status.Error(codes.NotFound, err.Error())
+	}
+	if err = srcVolOptions.resolveCluster(clusters); err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to resolve cluster of volume", "volumeId", srcVolId)
+		return clusterErrorToStatus(err, codes.NotFound)
+	}
+	if err = srcVolOptions.applyCredentials(secrets); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	srcDetail, err := srcVolOptions.curveVolume().Stat(ctx)
+	if err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to stat the source volume", "volumeId", srcVolId)
+		if util.IsNotFoundErr(err) {
+			return status.Error(codes.NotFound, err.Error())
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+	// the source without stripe is cloned without stripe
+	if srcDetail.StripeUnit != destVolOptions.placement.stripeUnit ||
+		srcDetail.StripeCount != destVolOptions.placement.stripeCount {
+		return status.Errorf(codes.InvalidArgument,
+			"the clone inherits the stripe (unit %d, count %d) of source volume %s, but requested (unit %d, count %d)",
+			srcDetail.StripeUnit, srcDetail.StripeCount, srcVolId,
+			destVolOptions.placement.stripeUnit, destVolOptions.placement.stripeCount)
+	}
+	return nil
+}
+
 // Expand volume if the existing size is less than reqSizeGiB
 func expandVolume(
 	ctx context.Context,
@@ -563,38 +945,74 @@ func cloneVolume(
 	return taskUUID, snapServer.WaitForCloneTaskReady(ctx, volDestination)
 }
 
-// Ensure the snapshot exists.
-func ensureSnapshotExists(ctx context.Context, snapshotServer, snapshotId string) (string, error) {
+// Ensure the snapshot exists in the cluster of clusterID, the secrets are used to access it.
+func ensureSnapshotExists(
+	ctx context.Context,
+	clusters *clusterResolver,
+	snapshotId, clusterID string,
+	secrets map[string]string) (string, error) {
 	snapCurveUUID, volOptions, err := parseSnapshotID(snapshotId)
 	if err != nil {
 		return "", status.Errorf(codes.NotFound, "snapshot id %v not found", snapshotId)
 	}
-	snapServer := curveservice.NewSnapshotServer(snapshotServer, volOptions.user, volOptions.volName)
-	if _, err := snapServer.GetFileSnapshotOfId(ctx, snapCurveUUID); err != nil {
+	if volOptions.clusterID != clusterID {
+		return "", status.Errorf(codes.InvalidArgument, "can not restore snapshot of cluster %q to cluster %q", volOptions.clusterID, clusterID)
+	}
+	if err = volOptions.resolveCluster(clusters); err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	if err = volOptions.applyCredentials(secrets); err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	snapServer := volOptions.snapshotServer()
+	snapshot, err := snapServer.GetFileSnapshotOfId(ctx, snapCurveUUID)
+	if err != nil {
 		if util.IsNotFoundErr(err, snapCurveUUID) {
 			return "", status.Errorf(codes.NotFound, "the source snapshot(UUID %v) not found", snapCurveUUID)
 		}
 		return "", status.Error(codes.Internal, err.Error())
 	}
+	if snapshot.User != "" && snapshot.User != volOptions.user {
+		return "", status.Errorf(codes.InvalidArgument, "the source snapshot(UUID %v) is owned by user %q, not %q",
+			snapCurveUUID, snapshot.User, volOptions.user)
+	}
 	return snapCurveUUID, nil
 }
 
-// Ensure the volume exists.
+// Ensure the volume exists in the cluster of clusterID, the secrets are used to access it.
 // If the volume was cloned, ensure the clone task done.
-func ensureVolumeExists(ctx context.Context, snapshotServer, volumeId string) (string, error) {
+func ensureVolumeExists(
+	ctx context.Context,
+	clusters *clusterResolver,
+	volumeId, clusterID string,
+	secrets map[string]string) (string, error) {
 	volOptions, err := newVolumeOptionsFromVolID(volumeId)
 	if err != nil {
 		return "", status.Errorf(codes.NotFound, "volume id %v not found", volumeId)
 	}
-	curveVol := curveservice.NewCurveVolume(volOptions.user, volOptions.volName, volOptions.sizeGiB)
-	if _, err := curveVol.Stat(ctx); err != nil {
+	if volOptions.clusterID != clusterID {
+		return "", status.Errorf(codes.InvalidArgument, "can not clone volume of cluster %q to cluster %q", volOptions.clusterID, clusterID)
+	}
+	if err = volOptions.resolveCluster(clusters); err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	if err = volOptions.applyCredentials(secrets); err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	curveVol := volOptions.curveVolume()
+	volDetail, err := curveVol.Stat(ctx)
+	if err != nil {
 		if util.IsNotFoundErr(err) {
 			return "", status.Errorf(codes.NotFound, "the source volume (%v) not found", volOptions)
 		}
 		return "", status.Error(codes.Internal, err.Error())
 	}
+	if volDetail.User != "" && volDetail.User != volOptions.user {
+		return "", status.Errorf(codes.InvalidArgument, "the source volume %s is owned by user %q, not %q",
+			volumeId, volDetail.User, volOptions.user)
+	}
 	// flatten the volume if it was cloned by other lazy
-	snapServer := curveservice.NewSnapshotServer(snapshotServer, volOptions.user, volOptions.volName)
+	snapServer := volOptions.snapshotServer()
 	volPath := volOptions.genVolumePath()
 	taskInfo, err := snapServer.GetCloneTaskOfDestination(ctx, volPath)
 	if err != nil {
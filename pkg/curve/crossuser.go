@@ -0,0 +1,199 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+	"github.com/opencurve/curve-csi/pkg/util"
+	"github.com/opencurve/curve-csi/pkg/util/ctxlog"
+)
+
+const (
+	// StorageClass parameter of the comma separated users whose volumes may be cloned
+	// from, "*" for any user
+	cloneSourceUsersParam = "cloneSourceUsers"
+	anyCloneSourceUser    = "*"
+)
+
+// parseCloneSourceUsers returns nil if the parameter is not set.
+func parseCloneSourceUsers(parameters map[string]string) ([]string, error) {
+	str, ok := parameters[cloneSourceUsersParam]
+	if !ok {
+		return nil, nil
+	}
+	var users []string
+	for _, user := range strings.Split(str, ",") {
+		if user = strings.TrimSpace(user); user == "" {
+			continue
+		}
+		if user != anyCloneSourceUser && len(user) > curveUserMaxLen {
+			return nil, fmt.Errorf("invalid %s %q, the user is longer than %d", cloneSourceUsersParam, str, curveUserMaxLen)
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// allowCloneFrom returns true if the volume can be cloned from the volumes of the user,
+// which is always true for its own user.
+func (vo *volumeOptions) allowCloneFrom(user string) bool {
+	if user == vo.user {
+		return true
+	}
+	for _, allowed := range vo.cloneSourceUsers {
+		if allowed == anyCloneSourceUser || allowed == user {
+			return true
+		}
+	}
+	return false
+}
+
+// secretsFor returns the secrets to access the volumes of the user, which is nil
+// if the secrets belong to another user, e.g. the destination of a cross-user clone.
+func secretsFor(secrets map[string]string, user string) map[string]string {
+	if creds := util.NewCredentials(secrets); creds.GetUser() != "" && creds.GetUser() != user {
+		return nil
+	}
+	return secrets
+}
+
+// sourceSecrets returns the secrets to access the source of srcUser. The CSI secrets
+// of the request are of the destination user, so the source of another user is accessed
+// with its credentials in the credentials dir, and is rejected without them if the
+// destination is accessed with a password or a token.
+//
+// The snapshot server issues the clone as the destination user, which owns the clone,
+// and reads a source volume of any user as its root user, but only clones the snapshots
+// of the issuing user, so the snapshots of another user are rejected as well.
+func (cs *controllerServer) sourceSecrets(ctx context.Context, contentSource *csi.VolumeContentSource, srcUser, destUser string, secrets map[string]string) (map[string]string, error) {
+	if srcUser == "" || srcUser == destUser {
+		return secrets, nil
+	}
+	if contentSource.GetSnapshot() != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "restoring the snapshot of user %q to user %q is not supported by the snapshot server, "+
+			"clone the source volume instead", srcUser, destUser)
+	}
+	if srcSecrets := secretsFor(secrets, srcUser); util.NewCredentials(srcSecrets) != nil {
+		return srcSecrets, nil
+	}
+	srcSecrets := backgroundSecrets(ctx, cs.credentialsDir, srcUser)
+	if util.NewCredentials(srcSecrets) == nil && util.NewCredentials(secrets) != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "no credentials of the source user %q, see --credentials-dir", srcUser)
+	}
+	return srcSecrets, nil
+}
+
+// recordCrossUserClone records the clone of another user in the metadata of the source,
+// so the clone is flattened before the source is deleted. The source is the volume path
+// or the snapshot UUID the clone task is created from.
+func (cs *controllerServer) recordCrossUserClone(ctx context.Context, srcVolId, destVolId, source string) error {
+	meta, err := cs.volumeMeta.get(srcVolId)
+	if err != nil {
+		return err
+	}
+	if meta.CrossUserClones[destVolId] == source {
+		return nil
+	}
+	if meta.CrossUserClones == nil {
+		meta.CrossUserClones = make(map[string]string)
+	}
+	meta.CrossUserClones[destVolId] = source
+	ctxlog.V(4).Infof(ctx, "record cross-user clone %s of %s(%s)", destVolId, srcVolId, source)
+	return cs.volumeMeta.put(srcVolId, meta)
+}
+
+// forgetCrossUserClone removes the deleted clone from the metadata of the source,
+// the failure is only logged.
+func (cs *controllerServer) forgetCrossUserClone(ctx context.Context, srcVolId, destVolId string) {
+	meta, err := cs.volumeMeta.get(srcVolId)
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to get metadata of source volume %s: %v", srcVolId, err)
+		return
+	}
+	if _, ok := meta.CrossUserClones[destVolId]; !ok {
+		return
+	}
+	delete(meta.CrossUserClones, destVolId)
+	if len(meta.CrossUserClones) == 0 {
+		meta.CrossUserClones = nil
+	}
+	if meta.isEmpty() {
+		err = cs.volumeMeta.delete(srcVolId)
+	} else {
+		err = cs.volumeMeta.put(srcVolId, meta)
+	}
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to remove cross-user clone %s from metadata of %s: %v", destVolId, srcVolId, err)
+	}
+}
+
+// ensureCrossUserClonesDone flattens the lazy clones of other users created from the source
+// and waits for them done. They are not found by listing the tasks of the source user,
+// so they are reached by the lineage in the metadata, with the credentials of their users
+// from the credentials dir, since the CSI secrets are of the source user.
+func (cs *controllerServer) ensureCrossUserClonesDone(ctx context.Context, srcVolId, source string) error {
+	meta, err := cs.volumeMeta.get(srcVolId)
+	if err != nil {
+		return err
+	}
+	for destVolId, cloneSource := range meta.CrossUserClones {
+		if cloneSource != source {
+			continue
+		}
+		destVolOptions, err := newVolumeOptionsFromVolID(destVolId)
+		if err != nil {
+			ctxlog.Warningf(ctx, "invalid cross-user clone %s of %s: %v", destVolId, srcVolId, err)
+			continue
+		}
+		if err = destVolOptions.resolveCluster(cs.clusters); err != nil {
+			return err
+		}
+		if err = destVolOptions.applyCredentials(backgroundSecrets(ctx, cs.credentialsDir, destVolOptions.user)); err != nil {
+			return err
+		}
+		snapServer := destVolOptions.snapshotServer()
+		destPath := destVolOptions.genVolumePath()
+		taskInfo, err := snapServer.GetCloneTaskOfDestination(ctx, destPath)
+		if err != nil {
+			if util.IsNotFoundErr(err) {
+				continue
+			}
+			return err
+		}
+		if taskInfo.TaskStatus == curveservice.TaskStatusDone {
+			continue
+		}
+		if taskInfo.TaskStatus == curveservice.TaskStatusMetaInstalled {
+			ctxlog.Infof(ctx, "flatten cross-user clone %s before deleting its source %s", destVolId, source)
+			if err = snapServer.Flatten(ctx, taskInfo.UUID); err != nil {
+				return err
+			}
+		}
+		if err = snapServer.WaitForCloneTaskDone(ctx, destPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
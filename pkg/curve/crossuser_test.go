@@ -0,0 +1,124 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/opencurve/curve-csi/pkg/util"
+)
+
+func TestParseCloneSourceUsers(t *testing.T) {
+	users, err := parseCloneSourceUsers(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, users)
+
+	users, err = parseCloneSourceUsers(map[string]string{cloneSourceUsersParam: " k8s-golden, ,k8s-shared"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"k8s-golden", "k8s-shared"}, users)
+
+	_, err = parseCloneSourceUsers(map[string]string{cloneSourceUsersParam: strings.Repeat("a", curveUserMaxLen+1)})
+	assert.Error(t, err)
+}
+
+func TestAllowCloneFrom(t *testing.T) {
+	vo := &volumeOptions{user: "k8s"}
+	assert.True(t, vo.allowCloneFrom("k8s"))
+	assert.False(t, vo.allowCloneFrom("k8s-golden"))
+
+	vo.cloneSourceUsers = []string{"k8s-golden"}
+	assert.True(t, vo.allowCloneFrom("k8s-golden"))
+	assert.False(t, vo.allowCloneFrom("k8s-other"))
+
+	vo.cloneSourceUsers = []string{anyCloneSourceUser}
+	assert.True(t, vo.allowCloneFrom("k8s-other"))
+}
+
+func TestSecretsFor(t *testing.T) {
+	secrets := map[string]string{"user": "k8s", "password": "pass"}
+	assert.Equal(t, secrets, secretsFor(secrets, "k8s"))
+	assert.Nil(t, secretsFor(secrets, "k8s-golden"))
+	// the secrets without the user apply to any user
+	token := map[string]string{"token": "t"}
+	assert.Equal(t, token, secretsFor(token, "k8s-golden"))
+	assert.Nil(t, secretsFor(nil, "k8s"))
+}
+
+func TestSourceSecrets(t *testing.T) {
+	ctx := context.TODO()
+	credentialsDir := t.TempDir()
+	cs := &controllerServer{credentialsDir: credentialsDir}
+	secrets := map[string]string{"user": "k8s", "password": "pass"}
+	volumeSource := &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{
+		Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "v1-00-00-0-0ak8s-golden-csi-vol-pvc-0"},
+	}}
+	snapshotSource := &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Snapshot{
+		Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "snapshot"},
+	}}
+
+	// of the same user
+	srcSecrets, err := cs.sourceSecrets(ctx, snapshotSource, "k8s", "k8s", secrets)
+	assert.NoError(t, err)
+	assert.Equal(t, secrets, srcSecrets)
+
+	// no credentials of the source user
+	_, err = cs.sourceSecrets(ctx, volumeSource, "k8s-golden", "k8s", secrets)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	// neither of the destination user
+	srcSecrets, err = cs.sourceSecrets(ctx, volumeSource, "k8s-golden", "k8s", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, srcSecrets)
+
+	writeCredentials(t, credentialsDir, "k8s-golden", "golden")
+	srcSecrets, err = cs.sourceSecrets(ctx, volumeSource, "k8s-golden", "k8s", secrets)
+	assert.NoError(t, err)
+	assert.Equal(t, "golden", srcSecrets["password"])
+
+	// the snapshots of another user can not be cloned
+	_, err = cs.sourceSecrets(ctx, snapshotSource, "k8s-golden", "k8s", secrets)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestCrossUserCloneLineage(t *testing.T) {
+	ctx := context.TODO()
+	cs := &controllerServer{volumeMeta: newVolumeMetaStore(util.NewFileStore(t.TempDir()))}
+	srcVolId := "0010-k8s-golden-csi-vol-pvc-0"
+	destVolId := "0003-k8s-csi-vol-pvc-1"
+
+	assert.NoError(t, cs.recordCrossUserClone(ctx, srcVolId, destVolId, "/k8s-golden/csi-vol-pvc-0"))
+	// idempotent
+	assert.NoError(t, cs.recordCrossUserClone(ctx, srcVolId, destVolId, "/k8s-golden/csi-vol-pvc-0"))
+	meta, err := cs.volumeMeta.get(srcVolId)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{destVolId: "/k8s-golden/csi-vol-pvc-0"}, meta.CrossUserClones)
+
+	// the clones of other sources are not touched
+	assert.NoError(t, cs.ensureCrossUserClonesDone(ctx, srcVolId, "snapshot-uuid"))
+
+	// the metadata of the source is removed with the last clone
+	cs.forgetCrossUserClone(ctx, srcVolId, destVolId)
+	meta, err = cs.volumeMeta.get(srcVolId)
+	assert.NoError(t, err)
+	assert.True(t, meta.isEmpty())
+}
@@ -17,11 +17,17 @@ limitations under the License.
 package curve
 
 import (
+	"context"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
 	"k8s.io/utils/mount"
 
@@ -30,6 +36,7 @@ import (
 	"github.com/opencurve/curve-csi/pkg/curveservice"
 	"github.com/opencurve/curve-csi/pkg/logs"
 	"github.com/opencurve/curve-csi/pkg/util"
+	"github.com/opencurve/curve-csi/pkg/util/ctxlog"
 )
 
 type curveDriver struct {
@@ -38,6 +45,7 @@ type curveDriver struct {
 	ids *identityServer
 	cs  *controllerServer
 	ns  *nodeServer
+	gcs *groupControllerServer
 }
 
 func NewCurveDriver() *curveDriver {
@@ -50,29 +58,158 @@ func NewIdentityServer(d *csicommon.CSIDriver) *identityServer {
 	}
 }
 
-func NewControllerServer(d *csicommon.CSIDriver, snapshotServer string) *controllerServer {
-	return &controllerServer{
+func NewControllerServer(d *csicommon.CSIDriver, curveConf options.CurveConf) *controllerServer {
+	metadata, err := newMetadataStores(curveConf.MetadataDir, curveConf.MetadataNamespace, curveConf.DriverName)
+	if err != nil {
+		klog.Fatalf("Failed to initialize metadata stores: %v", err)
+	}
+	cs := &controllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
 		volumeLocks:             util.NewVolumeLocks(),
 		snapshotLocks:           util.NewVolumeLocks(),
-		snapshotServer:          snapshotServer,
+		clusters:                newClusterResolver(curveConf.ClusterConfig, curveConf.SnapshotServer),
+		metadata:                metadata,
+		volumeMeta:              newVolumeMetaStore(metadata.store(volumeMetaKind)),
+		maxCloneDepth:           curveConf.MaxCloneDepth,
+		credentialsDir:          curveConf.CredentialsDir,
+		backend:                 curveBackend{},
+	}
+	flattens, err := newFlattenScheduler(cs, metadata.store(flattenMetaDir), curveConf.FlattenAfter, curveConf.FlattenWindow, curveConf.FlattenConcurrency)
+	if err != nil {
+		klog.Fatalf("Failed to initialize flatten scheduler: %v", err)
+	}
+	cs.flattens = flattens
+	taskGC, err := newCloneTaskGC(cs.clusters, cs.volumeLocks, curveConf.CredentialsDir, curveConf.CloneTaskGCUsers,
+		curveConf.CloneTaskGCInterval, curveConf.CloneTaskGCGrace, curveConf.CloneTaskGCDryRun)
+	if err != nil {
+		klog.Fatalf("Failed to initialize clone task GC: %v", err)
+	}
+	cs.taskGC = taskGC
+	copier := newMirrorCopier(curveConf.EnableReplication, curveConf.ReplicationCopyCommand)
+	if copier != nil && curveConf.CSIAddonsEndpoint == "" {
+		klog.Fatalf("The replication is served on the csi-addons endpoint, set --csi-addons-endpoint")
+	}
+	replicationServer, err := newReplicationServer(cs, metadata.store(replicationMetaDir), copier)
+	if err != nil {
+		klog.Fatalf("Failed to initialize replication server: %v", err)
+	}
+	cs.replication = replicationServer
+	cs.reclaimSpace = newControllerReclaimSpaceServer(cs, curveConf.EnableReclaimSpace)
+	if cs.reclaimSpace != nil && curveConf.CSIAddonsEndpoint == "" {
+		klog.Fatalf("The space reclaim is served on the csi-addons endpoint, set --csi-addons-endpoint")
+	}
+	fenceServer, err := newFenceServer(metadata.store(fenceMetaKind), curveConf.EnableNetworkFence)
+	if err != nil {
+		klog.Fatalf("Failed to initialize network fence server: %v", err)
+	}
+	cs.fence = fenceServer
+	if cs.fence != nil && curveConf.CSIAddonsEndpoint == "" {
+		klog.Fatalf("The network fence is served on the csi-addons endpoint, set --csi-addons-endpoint")
+	}
+	populator, err := newPopulator(cs, curveConf.PopulateDir, curveConf.PopulateConcurrency)
+	if err != nil {
+		klog.Fatalf("Failed to initialize populator: %v", err)
+	}
+	if _, copiesByNbd := copier.(nbdCopier); populator != nil || copiesByNbd || cs.reclaimSpace != nil {
+		// the volumes are mapped on the controller to be populated, replicated or discarded
+		if err = curveservice.SetMapMode(curveConf.NbdMapMode); err != nil {
+			klog.Fatalf("failed to set the map mode: %v", err)
+		}
+		if err = curveservice.InitCurveNbd(); err != nil {
+			klog.Fatalf("Populating, replicating or reclaiming the space of volumes requires curve-nbd on the controller, see docs/populate.md: %v", err)
+		}
 	}
+	cs.populator = populator
+	return cs
 }
 
-func NewNodeServer(d *csicommon.CSIDriver) *nodeServer {
-	curveservice.InitCurveNbd()
+func NewGroupControllerServer(d *csicommon.CSIDriver, cs *controllerServer) *groupControllerServer {
+	return &groupControllerServer{
+		DefaultGroupControllerServer: csicommon.NewDefaultGroupControllerServer(d),
+		cs:                           cs,
+		groupSnapshots:               newGroupSnapshotStore(cs.metadata.store(groupSnapshotMetaDir)),
+	}
+}
+
+func NewNodeServer(d *csicommon.CSIDriver, curveConf options.CurveConf) *nodeServer {
+	if err := curveservice.SetMapMode(curveConf.NbdMapMode); err != nil {
+		klog.Fatalf("failed to set the map mode: %v", err)
+	}
+	if err := curveservice.SetInUseCheckPolicy(curveConf.InUseCheckPolicy); err != nil {
+		klog.Fatalf("failed to set the in-use check policy: %v", err)
+	}
+	if err := curveservice.CheckOpsTool(); err != nil {
+		klog.Errorf("the in-use checks of the volumes fail in the %s policy: %v", curveConf.InUseCheckPolicy, err)
+	}
+	// the failures are logged, the staging fails later
+	_ = curveservice.InitCurveNbd()
+	// the devices of the units left by the previous plugin are still in use
+	ctx := context.WithValue(context.Background(), ctxlog.CtxKey, "nbd-units")
+	if _, err := curveservice.ReconnectNbdUnits(ctx); err != nil {
+		klog.Errorf("failed to reconnect to the curve-nbd units: %v", err)
+	}
+	// the hosts fenced by the controller, see --enable-network-fence
+	if curveConf.MetadataNamespace != "" {
+		metadata, err := newMetadataStores("", curveConf.MetadataNamespace, curveConf.DriverName)
+		if err != nil {
+			klog.Fatalf("Failed to initialize the fence list: %v", err)
+		}
+		fences := metadata.store(fenceMetaKind)
+		curveservice.SetFenceList(func() ([]string, error) {
+			return listFencedCIDRs(fences)
+		})
+	}
 	mounter := mount.New("")
-	return &nodeServer{
+	ns := &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d),
 		mounter:           mounter,
 		volumeLocks:       util.NewVolumeLocks(),
+		clusters:          newClusterResolver(curveConf.ClusterConfig, curveConf.SnapshotServer),
+		kubeletDir:        curveConf.KubeletDir,
+		credentialsDir:    curveConf.CredentialsDir,
+	}
+	ns.reclaimer = newSpaceReclaimer(ns, curveConf.ReclaimSpaceInterval)
+	ns.reconciler = newNodeReconciler(ns, curveConf.KubeletDir, curveConf.NodeReconcileInterval)
+	ephemerals, err := newEphemeralVolumes(ns, curveConf.NodeID, curveConf.EphemeralDir, curveConf.CredentialsDir,
+		curveConf.EphemeralUsers, curveConf.EphemeralAllowClone)
+	if err != nil {
+		klog.Fatalf("failed to set the ephemeral inline volumes: %v", err)
 	}
+	ns.ephemerals = ephemerals
+	return ns
 }
 
-func listenAndServeDebugger(port int) {
+func listenAndServeDebugger(port int, cs *controllerServer, ns *nodeServer) {
 	address := "127.0.0.1"
 	mux := http.NewServeMux()
 	mux.HandleFunc("/debug/flags/v", util.StringFlagPutHandler(logs.GlogSetter))
+	if cs != nil && cs.flattens != nil {
+		mux.Handle("/debug/flatten", cs.flattens)
+	}
+	if cs != nil && cs.taskGC != nil {
+		mux.Handle("/debug/clonetaskgc", cs.taskGC)
+	}
+	if cs != nil && cs.replication != nil {
+		mux.Handle("/debug/replication", cs.replication)
+	}
+	if cs != nil && cs.populator != nil {
+		mux.Handle("/debug/populate", cs.populator)
+	}
+	if cs != nil && cs.fence != nil {
+		mux.Handle("/debug/fence", cs.fence)
+	}
+	if ns != nil && ns.reclaimer != nil {
+		mux.Handle("/debug/reclaimspace", ns.reclaimer)
+	}
+	if ns != nil && ns.reconciler != nil {
+		mux.Handle("/debug/reconcile", ns.reconciler)
+	}
+	if ns != nil && ns.ephemerals != nil {
+		mux.Handle("/debug/ephemeral", ns.ephemerals)
+	}
+	if ns != nil {
+		mux.HandleFunc("/debug/staged", ns.serveStagedVolumes)
+	}
 
 	klog.Infof("starting debug http server to listen on %s:%d", address, port)
 	err := http.ListenAndServe(net.JoinHostPort(address, strconv.Itoa(port)), mux)
@@ -93,6 +230,11 @@ func (c *curveDriver) Run(curveConf options.CurveConf) {
 			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
 			csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
 			csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+			csi.ControllerServiceCapability_RPC_GET_VOLUME,
+			csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
+		})
+		c.driver.AddGroupControllerServiceCapabilities([]csi.GroupControllerServiceCapability_RPC_Type{
+			csi.GroupControllerServiceCapability_RPC_CREATE_DELETE_GET_VOLUME_GROUP_SNAPSHOT,
 		})
 		c.driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
 			csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
@@ -102,23 +244,77 @@ func (c *curveDriver) Run(curveConf options.CurveConf) {
 
 	c.ids = NewIdentityServer(c.driver)
 	if curveConf.IsControllerServer {
-		c.cs = NewControllerServer(c.driver, curveConf.SnapshotServer)
+		c.cs = NewControllerServer(c.driver, curveConf)
+	}
+	if curveConf.IsNodeServer || !curveConf.IsControllerServer {
+		var (
+			client kubernetes.Interface
+			err    error
+		)
+		if curveConf.TopologyNodeLabels != "" {
+			if client, err = util.NewKubeClient(); err != nil {
+				klog.Fatalf("Failed to create kubernetes client: %v", err)
+			}
+		}
+		segments, err := nodeTopology(client, curveConf.DriverName, curveConf.NodeID, curveConf.Topology, curveConf.TopologyNodeLabels)
+		if err != nil {
+			klog.Fatalf("Failed to get topology of node: %v", err)
+		}
+		klog.Infof("Node topology: %v", segments)
+		c.driver.SetTopology(segments)
 	}
 	if curveConf.IsNodeServer {
-		c.ns = NewNodeServer(c.driver)
+		c.ns = NewNodeServer(c.driver, curveConf)
 	}
 
 	if !curveConf.IsControllerServer && !curveConf.IsNodeServer {
-		c.cs = NewControllerServer(c.driver, curveConf.SnapshotServer)
-		c.ns = NewNodeServer(c.driver)
+		c.cs = NewControllerServer(c.driver, curveConf)
+		c.ns = NewNodeServer(c.driver, curveConf)
+	}
+
+	// the group controller is served with the controller only
+	var gcs csi.GroupControllerServer
+	if c.cs != nil {
+		c.gcs = NewGroupControllerServer(c.driver, c.cs)
+		gcs = c.gcs
 	}
 
 	s := csicommon.NewNonBlockingGRPCServer()
-	s.Start(curveConf.Endpoint, c.ids, c.cs, c.ns)
+	s.Start(curveConf.Endpoint, c.ids, c.cs, c.ns, gcs)
+
+	// the csi-addons services are served on their own endpoint, for the csi-addons sidecar
+	var addons csicommon.NonBlockingGRPCServer
+	if curveConf.CSIAddonsEndpoint != "" {
+		addons = csicommon.NewNonBlockingGRPCServer()
+		addons.Start(curveConf.CSIAddonsEndpoint, nil, nil, nil, nil, addonsServices(c.driver, c.cs, c.ns)...)
+	}
+
+	// the workers stop on the signals, then the server stops
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	var workers sync.WaitGroup
+	workers.Add(2)
+	go func() {
+		defer workers.Done()
+		runControllerWorkers(ctx, newWorkersLeaderElection(curveConf, c.cs), c.controllerWorkers())
+	}()
+	go func() {
+		defer workers.Done()
+		runWorkers(ctx, c.nodeWorkers())
+	}()
+	go func() {
+		<-ctx.Done()
+		klog.Infof("stopping the workers and the server")
+		workers.Wait()
+		if addons != nil {
+			addons.Stop()
+		}
+		s.Stop()
+	}()
 
 	// start debug server
 	if curveConf.DebugPort > 0 {
-		go listenAndServeDebugger(curveConf.DebugPort)
+		go listenAndServeDebugger(curveConf.DebugPort, c.cs, c.ns)
 	}
 	if curveConf.EnableProfiling {
 		klog.Infof("Registering profiling handler")
@@ -127,3 +323,57 @@ func (c *curveDriver) Run(curveConf options.CurveConf) {
 
 	s.Wait()
 }
+
+func (c *curveDriver) controllerWorkers() []*worker {
+	var workers []*worker
+	if c.cs == nil {
+		return workers
+	}
+	if c.cs.flattens != nil {
+		workers = append(workers, c.cs.flattens.worker)
+	}
+	if c.cs.taskGC != nil {
+		workers = append(workers, c.cs.taskGC.worker)
+	}
+	if c.cs.replication != nil {
+		workers = append(workers, c.cs.replication.worker)
+	}
+	return workers
+}
+
+func (c *curveDriver) nodeWorkers() []*worker {
+	var workers []*worker
+	if c.ns == nil {
+		return workers
+	}
+	if c.ns.reclaimer != nil {
+		workers = append(workers, c.ns.reclaimer.worker)
+	}
+	if c.ns.reconciler != nil {
+		workers = append(workers, c.ns.reconciler.worker)
+	}
+	if c.ns.ephemerals != nil {
+		workers = append(workers, c.ns.ephemerals.worker)
+	}
+	return workers
+}
+
+// newWorkersLeaderElection returns nil if the leader election is disabled,
+// then the workers of the controller run in every replica.
+func newWorkersLeaderElection(curveConf options.CurveConf, cs *controllerServer) *util.LeaderElection {
+	if cs == nil || !curveConf.LeaderElection {
+		return nil
+	}
+	namespace := curveConf.LeaderElectionNamespace
+	if namespace == "" {
+		namespace = os.Getenv("POD_NAMESPACE")
+	}
+	if namespace == "" {
+		klog.Fatalf("the leader election requires --leader-election-namespace or $POD_NAMESPACE")
+	}
+	client, err := util.NewKubeClient()
+	if err != nil {
+		klog.Fatalf("Failed to create kubernetes client: %v", err)
+	}
+	return util.NewLeaderElection(client, namespace, curveConf.DriverName+"-workers")
+}
@@ -0,0 +1,474 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+	utilexec "k8s.io/utils/exec"
+	"k8s.io/utils/mount"
+
+	csicommon "github.com/opencurve/curve-csi/pkg/csi-common"
+	"github.com/opencurve/curve-csi/pkg/util"
+	"github.com/opencurve/curve-csi/pkg/util/ctxlog"
+)
+
+const (
+	// set by kubelet in the volume context of the CSI ephemeral inline volumes
+	ephemeralContextKey = "csi.storage.k8s.io/ephemeral"
+
+	// the curve file of an ephemeral volume is named
+	// csiEphNamingPrefix + <node ID> + ephNodeSeparator + <volume ID>,
+	// the node IDs and the volume IDs generated by kubelet never contain the separator
+	csiEphNamingPrefix = "csi-eph-"
+	ephNodeSeparator   = "_"
+
+	// volumeAttributes of the ephemeral volumes, besides clusterID and cloneLazy, the
+	// user is taken from the node publish secrets
+	ephemeralSizeAttr      = "size"
+	ephemeralFsTypeAttr    = "fsType"
+	ephemeralCloneFromAttr = "cloneFrom"
+
+	defaultEphemeralFsType     = "ext4"
+	ephemeralReconcileInterval = 10 * time.Minute
+)
+
+func isEphemeral(volumeContext map[string]string) bool {
+	return volumeContext[ephemeralContextKey] == "true"
+}
+
+func ephemeralVolName(nodeID, volumeId string) string {
+	return csiEphNamingPrefix + nodeID + ephNodeSeparator + volumeId
+}
+
+// parseEphemeralVolName returns the node ID of the ephemeral volume name.
+func parseEphemeralVolName(volName string) (string, bool) {
+	if !strings.HasPrefix(volName, csiEphNamingPrefix) {
+		return "", false
+	}
+	nodeID, volumeId, ok := strings.Cut(strings.TrimPrefix(volName, csiEphNamingPrefix), ephNodeSeparator)
+	if !ok || nodeID == "" || volumeId == "" {
+		return "", false
+	}
+	return nodeID, true
+}
+
+// newEphemeralVolumeOptions returns the options of the ephemeral volume from the
+// volumeAttributes of the inline volume and the node publish secrets, which set the
+// user. The size is resolved with the cluster by resolveSize.
+func newEphemeralVolumeOptions(nodeID, volumeId string, attrs, secrets map[string]string) (*volumeOptions, *csi.CapacityRange, error) {
+	// the attributes are written by the pod authors
+	if _, ok := attrs["user"]; ok {
+		return nil, nil, fmt.Errorf("the user of ephemeral volumes is set by the user key of nodePublishSecretRef, not by volumeAttributes")
+	}
+	opts := &volumeOptions{
+		volId:     volumeId,
+		reqName:   volumeId,
+		volName:   ephemeralVolName(nodeID, volumeId),
+		user:      util.NewCredentials(secrets).GetUser(),
+		clusterID: attrs["clusterID"],
+		cloneLazy: curveCloneDefaultLazy,
+	}
+	if opts.user == "" {
+		return nil, nil, fmt.Errorf("missing the user key in nodePublishSecretRef of ephemeral volumes")
+	}
+	if len(opts.user) > curveUserMaxLen {
+		return nil, nil, fmt.Errorf("length of field user must be 1~%v", curveUserMaxLen)
+	}
+	if err := opts.applyCredentials(secrets); err != nil {
+		return nil, nil, err
+	}
+
+	sizeStr, ok := attrs[ephemeralSizeAttr]
+	if !ok {
+		return nil, nil, fmt.Errorf("missing required field: %s", ephemeralSizeAttr)
+	}
+	size, err := resource.ParseQuantity(sizeStr)
+	if err != nil || size.Sign() <= 0 {
+		return nil, nil, fmt.Errorf("invalid %s %q", ephemeralSizeAttr, sizeStr)
+	}
+
+	if cloneLazy, ok := attrs[cloneLazyParam]; ok {
+		opts.cloneLazy = cloneLazy == "true"
+	}
+	opts.sizePolicy, err = parseSizePolicy(attrs)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts.cloneSource = attrs[ephemeralCloneFromAttr]
+	return opts, &csi.CapacityRange{RequiredBytes: size.Value()}, nil
+}
+
+// ephemeralRecord is the journal of an ephemeral volume on the node, it is written
+// before the curve file is created and removed after the file is deleted.
+type ephemeralRecord struct {
+	ClusterID  string    `json:"clusterID"`
+	User       string    `json:"user"`
+	VolName    string    `json:"volName"`
+	TargetPath string    `json:"targetPath"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// volumeOptions returns the options of the volume with the secrets of its user.
+func (r *ephemeralRecord) volumeOptions(volumeId string, secrets map[string]string) *volumeOptions {
+	vo := &volumeOptions{
+		volId:     volumeId,
+		reqName:   volumeId,
+		volName:   r.VolName,
+		user:      r.User,
+		clusterID: r.ClusterID,
+	}
+	if creds := util.NewCredentials(secrets); creds != nil {
+		creds.User = r.User
+		vo.creds = creds
+	}
+	return vo
+}
+
+// podGone returns true if kubelet has cleaned the volume dir of the pod,
+// which is the parent of the target path.
+func (r *ephemeralRecord) podGone() (bool, error) {
+	_, err := os.Stat(filepath.Dir(r.TargetPath))
+	if err == nil {
+		return false, nil
+	}
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	return false, err
+}
+
+// ephemeralVolumes serves the CSI ephemeral inline volumes on the node, and deletes
+// the ones left behind by a crash of the node or the plugin, whose pods are gone.
+type ephemeralVolumes struct {
+	*worker
+	ns      *nodeServer
+	nodeID  string
+	records *util.FileStore
+	// NodeUnpublishVolume carries no secrets, the volumes are deleted with the
+	// credentials of their users in the dir, see --credentials-dir
+	credentialsDir string
+	// the users allowed by the admin, see --ephemeral-users
+	users map[string]bool
+	// whether the volumes may be cloned from cloneFrom, see --ephemeral-allow-clone
+	allowClone bool
+}
+
+// newEphemeralVolumes returns nil if the journal dir is not set. The users are
+// comma separated, which are required.
+func newEphemeralVolumes(ns *nodeServer, nodeID, dir, credentialsDir, users string, allowClone bool) (*ephemeralVolumes, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	e := &ephemeralVolumes{
+		ns:             ns,
+		nodeID:         nodeID,
+		records:        util.NewFileStore(dir),
+		credentialsDir: credentialsDir,
+		users:          make(map[string]bool),
+		allowClone:     allowClone,
+	}
+	for _, user := range strings.Split(users, ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			e.users[user] = true
+		}
+	}
+	if len(e.users) == 0 {
+		return nil, fmt.Errorf("the ephemeral inline volumes require the users")
+	}
+	e.worker = newWorker("ephemeral", ephemeralReconcileInterval, func(ctx context.Context) interface{} {
+		e.reconcile(ctx)
+		return nil
+	})
+	return e, nil
+}
+
+// publish creates the curve file of the ephemeral volume, maps it, and mounts it
+// to the target path. The caller holds the lock of the volume ID.
+func (e *ephemeralVolumes) publish(ctx context.Context, req *csi.NodePublishVolumeRequest) error {
+	if e == nil {
+		return status.Error(codes.FailedPrecondition, "ephemeral inline volumes are disabled on the node, see --ephemeral-dir")
+	}
+	if req.GetVolumeCapability().GetBlock() != nil {
+		return status.Error(codes.InvalidArgument, "ephemeral inline volumes must be of access type `mount`")
+	}
+	volumeId := req.GetVolumeId()
+	targetPath := req.GetTargetPath()
+
+	volOptions, capRange, err := newEphemeralVolumeOptions(e.nodeID, volumeId, req.GetVolumeContext(), req.GetSecrets())
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	// any pod author may refer to a secret of the user, the admin allows the users
+	// and the cloning of their volumes
+	if !e.users[volOptions.user] {
+		return status.Errorf(codes.PermissionDenied, "user %q is not allowed to create ephemeral volumes, see --ephemeral-users", volOptions.user)
+	}
+	if volOptions.cloneSource != "" && !e.allowClone {
+		return status.Errorf(codes.PermissionDenied, "the %s of ephemeral volumes is not allowed, see --ephemeral-allow-clone", ephemeralCloneFromAttr)
+	}
+
+	notMnt, err := e.ns.createTargetMountPath(ctx, targetPath, false)
+	if err != nil {
+		return err
+	}
+	if !notMnt {
+		ctxlog.Infof(ctx, "ephemeral volume %s is already mounted to %s, skipping", volumeId, targetPath)
+		return nil
+	}
+
+	if err = volOptions.resolveCluster(e.ns.clusters); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err = volOptions.resolveSize(capRange); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	secrets := req.GetSecrets()
+	nodeSecrets := backgroundSecrets(ctx, e.credentialsDir, volOptions.user)
+	if creds := volOptions.creds; creds.Password == "" && creds.Token == "" && nodeSecrets != nil {
+		// the secret sets the user only, which is served with its credentials on the node
+		secrets = nodeSecrets
+		if err = volOptions.applyCredentials(secrets); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+	// the secrets are not kept, so the volume of a user with a password or a token
+	// could not be deleted without its credentials on the node
+	if creds := volOptions.creds; (creds.Password != "" || creds.Token != "") && nodeSecrets == nil {
+		return status.Errorf(codes.FailedPrecondition, "no credentials of user %q on the node to delete the ephemeral volume, see --credentials-dir",
+			volOptions.user)
+	}
+
+	record := &ephemeralRecord{
+		ClusterID:  volOptions.clusterID,
+		User:       volOptions.user,
+		VolName:    volOptions.volName,
+		TargetPath: targetPath,
+		CreatedAt:  time.Now(),
+	}
+	if err = e.records.Put(volumeId, record); err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to record ephemeral volume", "volumeId", volumeId)
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	curveVol := volOptions.curveVolume()
+	if volOptions.cloneSource != "" {
+		err = e.clone(ctx, volOptions, secrets)
+	} else {
+		err = curveVol.Create(ctx)
+	}
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	devicePath, err := curveVol.Map(ctx, false)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	ctxlog.Infof(ctx, "curve file %s successfully mapped at %s", curveVol.FilePath, devicePath)
+
+	fsType := req.GetVolumeContext()[ephemeralFsTypeAttr]
+	if fsType == "" {
+		fsType = req.GetVolumeCapability().GetMount().GetFsType()
+	}
+	if fsType == "" {
+		fsType = defaultEphemeralFsType
+	}
+	opt := []string{"_netdev"}
+	opt = csicommon.ConstructMountOptions(opt, req.GetVolumeCapability())
+	if req.GetReadonly() {
+		opt = append(opt, "ro")
+	}
+	if fsType == "xfs" {
+		opt = append(opt, "nouuid")
+	}
+	diskMounter := &mount.SafeFormatAndMount{Interface: e.ns.mounter, Exec: utilexec.New()}
+	if err = diskMounter.FormatAndMount(devicePath, targetPath, fsType, opt); err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to mount device to target path", "devicePath", devicePath, "targetPath", targetPath, "volumeId", volumeId)
+		return status.Error(codes.Internal, err.Error())
+	}
+	if !req.GetReadonly() {
+		// #nosec - allow anyone to write inside the target path
+		if err = os.Chmod(targetPath, 0o777); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+	ctxlog.Infof(ctx, "successfully mounted ephemeral volume %s to targetPath %s", volumeId, targetPath)
+	return nil
+}
+
+// clone creates the curve file of the ephemeral volume from the source, a snapshot
+// ID or a volume ID of the driver, owned by the same user in the same cluster.
+func (e *ephemeralVolumes) clone(ctx context.Context, volOptions *volumeOptions, secrets map[string]string) error {
+	if !volOptions.snapshotEnabled() {
+		return status.Errorf(codes.FailedPrecondition, "no snapshot server of cluster %q to clone from", volOptions.clusterID)
+	}
+	source := volOptions.cloneSource
+	var (
+		srcOptions *volumeOptions
+		volSource  string
+		err        error
+	)
+	if _, srcOptions, err = parseSnapshotID(source); err == nil {
+		if srcOptions.user != volOptions.user {
+			return status.Errorf(codes.InvalidArgument, "the %s of ephemeral volumes must be owned by user %q", ephemeralCloneFromAttr, volOptions.user)
+		}
+		volSource, err = ensureSnapshotExists(ctx, e.ns.clusters, source, volOptions.clusterID, secrets)
+	} else if srcOptions, err = newVolumeOptionsFromVolID(source); err == nil {
+		if srcOptions.user != volOptions.user {
+			return status.Errorf(codes.InvalidArgument, "the %s of ephemeral volumes must be owned by user %q", ephemeralCloneFromAttr, volOptions.user)
+		}
+		volSource, err = ensureVolumeExists(ctx, e.ns.clusters, source, volOptions.clusterID, secrets)
+	} else {
+		return status.Errorf(codes.InvalidArgument, "invalid %s %q, must be a snapshot ID or a volume ID", ephemeralCloneFromAttr, source)
+	}
+	if err != nil {
+		return err
+	}
+
+	taskUUID, err := cloneVolume(ctx, volOptions.snapshotServer(), volSource, volOptions.genVolumePath(), volOptions.cloneLazy)
+	if err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to clone volume")
+		return status.Error(codes.Internal, err.Error())
+	}
+	ctxlog.V(4).Infof(ctx, "clone %v status done", taskUUID)
+	// fix size if the cloned volume size less than requested size.
+	if _, _, err = expandVolume(ctx, volOptions.curveVolume(), volOptions.sizeGiB); err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to expand volume")
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// remove unmaps and deletes the curve file of the ephemeral volume, it is not
+// an error if the volume is not ephemeral. The caller holds the lock of the volume ID.
+func (e *ephemeralVolumes) remove(ctx context.Context, volumeId string) error {
+	if e == nil {
+		return nil
+	}
+	record := &ephemeralRecord{}
+	if err := e.records.Get(volumeId, record); err != nil {
+		if util.IsNotFoundErr(err, volumeId) {
+			return nil
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	volOptions := record.volumeOptions(volumeId, backgroundSecrets(ctx, e.credentialsDir, record.User))
+	if err := volOptions.resolveCluster(e.ns.clusters); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	curveVol := volOptions.curveVolume()
+	if err := curveVol.UnMap(ctx); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	// the scratch data is never moved to the trash
+	if err := curveVol.Delete(ctx, true); err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to delete ephemeral volume", "volumeId", volumeId)
+		return status.Error(codes.Internal, err.Error())
+	}
+	if volOptions.snapshotEnabled() {
+		snapServer := volOptions.snapshotServer()
+		taskInfo, err := snapServer.GetCloneTaskOfDestination(ctx, volOptions.genVolumePath())
+		if err == nil {
+			if err = snapServer.CleanCloneTask(ctx, taskInfo.UUID); err != nil {
+				ctxlog.Warningf(ctx, "can not clean task %v", taskInfo.UUID)
+			}
+		} else if !util.IsNotFoundErr(err) {
+			ctxlog.Warningf(ctx, "can not get taskInfo of path %v", volOptions.genVolumePath())
+		}
+	}
+	if err := e.records.Delete(volumeId); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	ctxlog.Infof(ctx, "successfully deleted ephemeral volume %s", volumeId)
+	return nil
+}
+
+// ServeHTTP returns the ephemeral volumes on the node in json.
+func (e *ephemeralVolumes) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	records := map[string]*ephemeralRecord{}
+	keys, err := e.records.Keys()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, volumeId := range keys {
+		record := &ephemeralRecord{}
+		if err = e.records.Get(volumeId, record); err != nil {
+			continue
+		}
+		records[volumeId] = record
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(records)
+}
+
+// reconcile deletes the ephemeral volumes whose pods are gone, e.g. the
+// NodeUnpublishVolume was never called or failed before the plugin crashed.
+func (e *ephemeralVolumes) reconcile(ctx context.Context) {
+	keys, err := e.records.Keys()
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to list ephemeral volumes: %v", err)
+		return
+	}
+	for _, volumeId := range keys {
+		e.reconcileOne(ctx, volumeId)
+	}
+}
+
+func (e *ephemeralVolumes) reconcileOne(ctx context.Context, volumeId string) {
+	// the volumes in operation are checked in the next round
+	if acquired := e.ns.volumeLocks.TryAcquire(volumeId); !acquired {
+		return
+	}
+	defer e.ns.volumeLocks.Release(volumeId)
+
+	record := &ephemeralRecord{}
+	if err := e.records.Get(volumeId, record); err != nil {
+		if !util.IsNotFoundErr(err, volumeId) {
+			ctxlog.Warningf(ctx, "failed to get ephemeral volume %s: %v", volumeId, err)
+		}
+		return
+	}
+	gone, err := record.podGone()
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to check target path %s of ephemeral volume %s: %v", record.TargetPath, volumeId, err)
+		return
+	}
+	if !gone {
+		return
+	}
+	ctxlog.Infof(ctx, "the pod of ephemeral volume %s is gone, deleting %s", volumeId, record.VolName)
+	if err = e.remove(ctx, volumeId); err != nil {
+		ctxlog.Warningf(ctx, "failed to delete ephemeral volume %s: %v", volumeId, err)
+	}
+}
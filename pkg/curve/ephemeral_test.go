@@ -0,0 +1,162 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/opencurve/curve-csi/pkg/util"
+)
+
+const testEphemeralVolumeId = "csi-8a2b6f4e0c1d3e5f7a9b1c3d5e7f9a1b3c5d7e9f1a3b5c7d9e1f3a5b7c9d1e3f"
+
+func TestEphemeralVolName(t *testing.T) {
+	volName := ephemeralVolName("node-1.example.com", testEphemeralVolumeId)
+	assert.Equal(t, "csi-eph-node-1.example.com_"+testEphemeralVolumeId, volName)
+	node, ok := parseEphemeralVolName(volName)
+	assert.True(t, ok)
+	assert.Equal(t, "node-1.example.com", node)
+
+	for _, name := range []string{"csi-vol-pvc-1", "csi-eph-node-1", "csi-eph-_csi-1", "csi-eph-node-1_"} {
+		_, ok = parseEphemeralVolName(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestNewEphemeralVolumeOptions(t *testing.T) {
+	attrs := map[string]string{"clusterID": "c1", "size": "10Gi", "cloneFrom": "src", "cloneLazy": "false"}
+	vo, capRange, err := newEphemeralVolumeOptions("node-1", testEphemeralVolumeId, attrs, map[string]string{"user": "k8s"})
+	assert.NoError(t, err)
+	assert.Equal(t, "/k8s/csi-eph-node-1_"+testEphemeralVolumeId, vo.genVolumePath())
+	assert.Equal(t, testEphemeralVolumeId, vo.volId)
+	assert.Equal(t, "c1", vo.clusterID)
+	assert.Equal(t, "src", vo.cloneSource)
+	assert.False(t, vo.cloneLazy)
+	assert.Equal(t, int64(10<<30), capRange.GetRequiredBytes())
+
+	// the user of the node publish secrets
+	vo, _, err = newEphemeralVolumeOptions("node-1", testEphemeralVolumeId,
+		map[string]string{"size": "1Gi"}, map[string]string{"user": "k8s", "password": "pass"})
+	assert.NoError(t, err)
+	assert.Equal(t, "k8s", vo.user)
+	assert.Equal(t, "pass", vo.creds.Password)
+	assert.True(t, vo.cloneLazy)
+
+	for _, attrs := range []map[string]string{
+		{},
+		{"size": "-1Gi"},
+		{"size": "big"},
+		// the user is never taken from the attributes
+		{"user": "k8s", "size": "1Gi"},
+	} {
+		_, _, err = newEphemeralVolumeOptions("node-1", testEphemeralVolumeId, attrs, map[string]string{"user": "k8s"})
+		assert.Error(t, err, attrs)
+	}
+	_, _, err = newEphemeralVolumeOptions("node-1", testEphemeralVolumeId, map[string]string{"size": "1Gi"}, nil)
+	assert.Error(t, err)
+	_, _, err = newEphemeralVolumeOptions("node-1", testEphemeralVolumeId,
+		map[string]string{"size": "1Gi"}, map[string]string{"password": "pass"})
+	assert.Error(t, err)
+}
+
+func TestNewEphemeralVolumes(t *testing.T) {
+	e, err := newEphemeralVolumes(&nodeServer{}, "node-1", "", "", "k8s", false)
+	assert.NoError(t, err)
+	assert.Nil(t, e)
+
+	// enabled without the users
+	_, err = newEphemeralVolumes(&nodeServer{}, "node-1", t.TempDir(), "", " , ", false)
+	assert.Error(t, err)
+
+	e, err = newEphemeralVolumes(&nodeServer{}, "node-1", t.TempDir(), "", "k8s, scratch", true)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"k8s": true, "scratch": true}, e.users)
+	assert.True(t, e.allowClone)
+}
+
+func TestEphemeralPublishRejected(t *testing.T) {
+	ctx := context.TODO()
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:   testEphemeralVolumeId,
+		TargetPath: filepath.Join(t.TempDir(), "mount"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		},
+		VolumeContext: map[string]string{ephemeralContextKey: "true"},
+	}
+
+	var disabled *ephemeralVolumes
+	assert.Equal(t, codes.FailedPrecondition, status.Code(disabled.publish(ctx, req)))
+	assert.NoError(t, disabled.remove(ctx, testEphemeralVolumeId))
+
+	e, err := newEphemeralVolumes(&nodeServer{volumeLocks: util.NewVolumeLocks()}, "node-1", t.TempDir(), "", "k8s", false)
+	assert.NoError(t, err)
+	assert.Equal(t, codes.InvalidArgument, status.Code(e.publish(ctx, req)))
+
+	req.VolumeCapability = &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+	}
+	req.VolumeContext = map[string]string{ephemeralContextKey: "true", "size": "1Gi"}
+	// a user not allowed by the admin
+	req.Secrets = map[string]string{"user": "admin"}
+	assert.Equal(t, codes.PermissionDenied, status.Code(e.publish(ctx, req)))
+	// the clone is not allowed
+	req.Secrets = map[string]string{"user": "k8s"}
+	req.VolumeContext[ephemeralCloneFromAttr] = "src"
+	assert.Equal(t, codes.PermissionDenied, status.Code(e.publish(ctx, req)))
+	// not an ephemeral volume
+	assert.NoError(t, e.remove(ctx, testEphemeralVolumeId))
+}
+
+func TestEphemeralReconcileKeepsLivePods(t *testing.T) {
+	ctx := context.TODO()
+	ns := &nodeServer{volumeLocks: util.NewVolumeLocks()}
+	e, err := newEphemeralVolumes(ns, "node-1", t.TempDir(), "", "k8s", false)
+	assert.NoError(t, err)
+
+	volDir := filepath.Join(t.TempDir(), "volumes", "kubernetes.io~csi", "scratch")
+	assert.NoError(t, os.MkdirAll(volDir, 0o750))
+	record := &ephemeralRecord{User: "k8s", VolName: "csi-eph-node-1_" + testEphemeralVolumeId,
+		TargetPath: filepath.Join(volDir, "mount"), CreatedAt: time.Now()}
+	assert.NoError(t, e.records.Put(testEphemeralVolumeId, record))
+
+	gone, err := record.podGone()
+	assert.NoError(t, err)
+	assert.False(t, gone)
+	e.reconcile(ctx)
+	assert.NoError(t, e.records.Get(testEphemeralVolumeId, &ephemeralRecord{}))
+
+	vo := record.volumeOptions(testEphemeralVolumeId, map[string]string{"password": "pass"})
+	assert.Equal(t, "/k8s/csi-eph-node-1_"+testEphemeralVolumeId, vo.genVolumePath())
+	assert.Equal(t, "k8s", vo.creds.User)
+	assert.Equal(t, "pass", vo.creds.Password)
+	assert.Nil(t, record.volumeOptions(testEphemeralVolumeId, nil).creds)
+
+	assert.NoError(t, os.RemoveAll(volDir))
+	gone, err = record.podGone()
+	assert.NoError(t, err)
+	assert.True(t, gone)
+}
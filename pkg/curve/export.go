@@ -0,0 +1,262 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+	"github.com/opencurve/curve-csi/pkg/util"
+	"github.com/opencurve/curve-csi/pkg/util/ctxlog"
+)
+
+const (
+	// the snapshot is exported through a lazy clone of the name
+	csiExportNamingPrefix = "csi-export-"
+	// the manifest is written next to the image file
+	exportManifestSuffix = ".manifest.json"
+)
+
+// exportManifest describes an exported image file.
+type exportManifest struct {
+	// the CSI volume or snapshot ID exported
+	VolumeID   string `json:"volumeID,omitempty"`
+	SnapshotID string `json:"snapshotID,omitempty"`
+	Format     string `json:"format"`
+	// the size of the volume, the virtual size of the image
+	SizeBytes int64 `json:"sizeBytes"`
+	// sha256:<hex> of the image file, the imageChecksum to populate a volume from it
+	Checksum   string    `json:"checksum"`
+	ExportedAt time.Time `json:"exportedAt"`
+}
+
+// exportImage writes the device to a new image file of the format, returns the size of the device.
+// The device mapped by the export itself is opened exclusively, not to be unmapped by the node reconciler.
+func exportImage(ctx context.Context, devicePath, output, format string, exclusive bool) (int64, error) {
+	flag := os.O_RDONLY
+	if exclusive {
+		flag |= syscall.O_EXCL
+	}
+	// #nosec:G304, the device is mapped by the driver
+	dev, err := os.OpenFile(devicePath, flag, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer dev.Close()
+	size, err := dev.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = dev.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	if format == imageFormatQcow2 {
+		// qemu-img skips the zero clusters itself
+		args := []string{"convert", "-f", imageFormatRaw, "-O", imageFormatQcow2, devicePath, output}
+		ctxlog.V(4).Infof(ctx, "starting exec: qemu-img %v", args)
+		if out, err := util.ExecCommand("qemu-img", args); err != nil {
+			os.Remove(output)
+			return 0, fmt.Errorf("failed to convert %s to qcow2, err: %v, output: %s", devicePath, err, out)
+		}
+		return size, nil
+	}
+
+	// #nosec:G304, the output is given by the admin
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	switch format {
+	case imageFormatRaw:
+		_, err = copySparse(ctx, f, dev, size, func(int64) {})
+		if err == nil {
+			// the trailing zero blocks are skipped
+			err = f.Truncate(size)
+		}
+	case imageFormatGzip:
+		gz := gzip.NewWriter(f)
+		if _, err = io.Copy(gz, dev); err == nil {
+			err = gz.Close()
+		}
+	default:
+		err = fmt.Errorf("invalid format %q", format)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(output)
+		return 0, err
+	}
+	return size, nil
+}
+
+// checksumFile returns sha256:<hex> of the file.
+func checksumFile(path string) (string, error) {
+	// #nosec:G304, the output is given by the admin
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// mapForExport maps the curve file, returns the device and the function to unmap it,
+// which is nil if the device is mapped before, e.g. by a pod on the node, and kept.
+func mapForExport(ctx context.Context, curveVol *curveservice.CurveVolume, allowInUse bool) (string, func(), error) {
+	devicePath, err := curveVol.MappedDevice(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	if devicePath != "" {
+		return devicePath, nil, nil
+	}
+	if devicePath, err = curveVol.Map(ctx, allowInUse); err != nil {
+		return "", nil, err
+	}
+	return devicePath, func() {
+		if err := curveVol.UnMap(ctx); err != nil {
+			ctxlog.Warningf(ctx, "failed to unmap %s: %v", curveVol.FilePath, err)
+		}
+	}, nil
+}
+
+// RunExport implements the subcommand 'export', which writes a volume or snapshot
+// to an image file and its manifest, and writes the manifest to out.
+func RunExport(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	var (
+		clusterConfig  = fs.String("cluster-config", util.DefaultClusterConfig, "path of the config file describing the curve clusters")
+		snapshotServer = fs.String("snapshot-server", "", "snapshot server of the default cluster")
+		volumeId       = fs.String("volume-id", "", "the CSI volume ID to export")
+		snapshotId     = fs.String("snapshot-id", "", "the CSI snapshot ID to export")
+		password       = fs.String("password", "", "the password of the user of the volume")
+		output         = fs.String("output", "", "path of the image file, the manifest is written to <output>"+exportManifestSuffix)
+		format         = fs.String("format", imageFormatRaw, "format of the image file: raw, qcow2 or gzip")
+		allowInUse     = fs.Bool("allow-in-use", false, "export the volume even if it is mapped on other nodes, the image may be inconsistent")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*volumeId == "") == (*snapshotId == "") {
+		return fmt.Errorf("exactly one of --volume-id and --snapshot-id is required")
+	}
+	if *output == "" {
+		return fmt.Errorf("missing --output")
+	}
+	if *format != imageFormatRaw && *format != imageFormatQcow2 && *format != imageFormatGzip {
+		return fmt.Errorf("invalid format %q", *format)
+	}
+	for _, path := range []string{*output, *output + exportManifestSuffix} {
+		if _, err := os.Lstat(path); err == nil {
+			return fmt.Errorf("%s already exists", path)
+		}
+	}
+
+	clusters := newClusterResolver(*clusterConfig, *snapshotServer)
+	manifest := &exportManifest{VolumeID: *volumeId, SnapshotID: *snapshotId, Format: *format}
+	var (
+		vo            *volumeOptions
+		snapCurveUUID string
+		err           error
+	)
+	if *snapshotId != "" {
+		snapCurveUUID, vo, err = parseSnapshotID(*snapshotId)
+	} else {
+		vo, err = newVolumeOptionsFromVolID(*volumeId)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid ID: %v", err)
+	}
+	if err = vo.resolveCluster(clusters); err != nil {
+		return err
+	}
+	if *password != "" {
+		vo.creds = &util.Credentials{User: vo.user, Password: *password}
+	}
+
+	ctx := context.WithValue(context.Background(), ctxlog.CtxKey, "export")
+	if snapCurveUUID != "" {
+		// a snapshot can not be mapped, export the lazy clone of it
+		if !vo.snapshotEnabled() {
+			return fmt.Errorf("no snapshot server of cluster %q", vo.clusterID)
+		}
+		snapServer := vo.snapshotServer()
+		if _, err = snapServer.GetFileSnapshotOfId(ctx, snapCurveUUID); err != nil {
+			return fmt.Errorf("failed to get snapshot %s: %v", snapCurveUUID, err)
+		}
+		clone := *vo
+		clone.volName = csiExportNamingPrefix + snapCurveUUID
+		clonePath := clone.genVolumePath()
+		taskUUID, err := cloneVolume(ctx, snapServer, snapCurveUUID, clonePath, true)
+		if err != nil {
+			return fmt.Errorf("failed to clone snapshot %s to %s: %v", snapCurveUUID, clonePath, err)
+		}
+		defer func() {
+			if err := clone.curveVolume().Delete(ctx, true); err != nil {
+				ctxlog.Warningf(ctx, "failed to delete %s: %v", clonePath, err)
+			}
+			if err := snapServer.CleanCloneTask(ctx, taskUUID); err != nil {
+				ctxlog.Warningf(ctx, "failed to clean clone task %s: %v", taskUUID, err)
+			}
+		}()
+		vo = &clone
+	}
+
+	devicePath, unmap, err := mapForExport(ctx, vo.curveVolume(), *allowInUse)
+	if err != nil {
+		return err
+	}
+	if unmap != nil {
+		defer unmap()
+	}
+	ctxlog.Infof(ctx, "exporting %s at %s to %s", vo.genVolumePath(), devicePath, *output)
+	if manifest.SizeBytes, err = exportImage(ctx, devicePath, *output, *format, unmap != nil); err != nil {
+		return err
+	}
+	if manifest.Checksum, err = checksumFile(*output); err != nil {
+		return err
+	}
+	manifest.ExportedAt = time.Now().UTC()
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if err = os.WriteFile(*output+exportManifestSuffix, data, 0o600); err != nil {
+		return err
+	}
+	_, err = out.Write(data)
+	return err
+}
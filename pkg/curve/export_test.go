@@ -0,0 +1,92 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImage(t *testing.T) {
+	ctx := context.TODO()
+	dir := t.TempDir()
+	// a device with data at the head and a zero tail
+	data := make([]byte, populateChunkSize+3*populateBlockSize)
+	copy(data, "boot")
+	device := filepath.Join(dir, "nbd0")
+	assert.NoError(t, os.WriteFile(device, data, 0o600))
+
+	raw := filepath.Join(dir, "vol.img")
+	size, err := exportImage(ctx, device, raw, imageFormatRaw, false)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), size)
+	exported, err := os.ReadFile(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, data, exported)
+
+	sum := sha256.Sum256(data)
+	checksum, err := checksumFile(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:"+hex.EncodeToString(sum[:]), checksum)
+	// the checksum is accepted as the imageChecksum
+	_, err = parseImageSpec(map[string]string{imageSourceParam: raw, imageChecksumParam: checksum})
+	assert.NoError(t, err)
+
+	compressed := filepath.Join(dir, "vol.img.gz")
+	_, err = exportImage(ctx, device, compressed, imageFormatGzip, false)
+	assert.NoError(t, err)
+	content, err := os.ReadFile(compressed)
+	assert.NoError(t, err)
+	gz, err := gzip.NewReader(bytes.NewReader(content))
+	assert.NoError(t, err)
+	exported, err = ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.Equal(t, data, exported)
+
+	// never overwrite
+	_, err = exportImage(ctx, device, raw, imageFormatRaw, false)
+	assert.Error(t, err)
+	_, err = exportImage(ctx, device, filepath.Join(dir, "vol.vmdk"), "vmdk", false)
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(dir, "vol.vmdk"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRunExportArgs(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "vol.img")
+	assert.NoError(t, os.WriteFile(existing, nil, 0o600))
+	for _, args := range [][]string{
+		{"--output", filepath.Join(dir, "a.img")},
+		{"--volume-id", testEphemeralVolumeId, "--snapshot-id", "snap", "--output", filepath.Join(dir, "a.img")},
+		{"--volume-id", testEphemeralVolumeId},
+		{"--volume-id", testEphemeralVolumeId, "--output", filepath.Join(dir, "a.img"), "--format", "vmdk"},
+		{"--volume-id", testEphemeralVolumeId, "--output", existing},
+		{"--volume-id", "not-a-volume-id", "--output", filepath.Join(dir, "a.img")},
+	} {
+		assert.Error(t, RunExport(args, ioutil.Discard), args)
+	}
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/csi-addons/spec/lib/go/fence"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/opencurve/curve-csi/pkg/util"
+	"github.com/opencurve/curve-csi/pkg/util/ctxlog"
+)
+
+// the metadata kind of the fenced CIDRs
+const fenceMetaKind = "fence"
+
+// fenceRecord is a CIDR fenced by the csi-addons NetworkFence.
+type fenceRecord struct {
+	CIDR     string    `json:"cidr"`
+	FencedAt time.Time `json:"fencedAt"`
+}
+
+// fenceServer serves the csi-addons NetworkFence of the controller. The fence list
+// is kept in the ConfigMaps read by the node plugins, which refuse to map the volumes
+// on the fenced hosts, and ignore the clients of the fenced hosts in the in-use checks,
+// so the volumes of a failed node can be attached elsewhere.
+type fenceServer struct {
+	fence.UnimplementedFenceControllerServer
+
+	store util.ObjectStore
+	now   func() time.Time
+}
+
+// newFenceServer returns nil if not enabled. The fence list must be kept in the
+// ConfigMaps, which are shared with the node plugins.
+func newFenceServer(store util.ObjectStore, enabled bool) (*fenceServer, error) {
+	if !enabled {
+		return nil, nil
+	}
+	if _, ok := store.(*util.ConfigMapStore); !ok {
+		return nil, fmt.Errorf("the network fence requires the metadata in the ConfigMaps, set --metadata-namespace")
+	}
+	return &fenceServer{store: store, now: time.Now}, nil
+}
+
+// normalizeCIDR returns the CIDR of the network, e.g. 10.0.0.0/24 of 10.0.0.1/24,
+// an address without the prefix length is the network of the address alone.
+func normalizeCIDR(cidr string) (string, error) {
+	if ip := net.ParseIP(cidr); ip != nil {
+		if ip.To4() != nil {
+			return ip.String() + "/32", nil
+		}
+		return ip.String() + "/128", nil
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", fmt.Errorf("invalid CIDR %q", cidr)
+	}
+	return ipNet.String(), nil
+}
+
+// normalizeCIDRs returns the normalized CIDRs of the request, at least one.
+func normalizeCIDRs(cidrs []*fence.CIDR) ([]string, error) {
+	if len(cidrs) == 0 {
+		return nil, fmt.Errorf("empty CIDRs in request")
+	}
+	normalized := make([]string, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		n, err := normalizeCIDR(cidr.GetCidr())
+		if err != nil {
+			return nil, err
+		}
+		normalized = append(normalized, n)
+	}
+	return normalized, nil
+}
+
+// FenceClusterNetwork adds the CIDRs to the fence list, the fenced ones are kept.
+func (fs *fenceServer) FenceClusterNetwork(
+	ctx context.Context,
+	req *fence.FenceClusterNetworkRequest) (*fence.FenceClusterNetworkResponse, error) {
+	cidrs, err := normalizeCIDRs(req.GetCidrs())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	for _, cidr := range cidrs {
+		err = fs.store.Get(cidr, &fenceRecord{})
+		if err == nil {
+			continue
+		}
+		if !util.IsNotFoundErr(err, cidr) {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if err = fs.store.Put(cidr, &fenceRecord{CIDR: cidr, FencedAt: fs.now()}); err != nil {
+			ctxlog.ErrorS(ctx, err, "failed to fence CIDR", "cidr", cidr)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		ctxlog.Infof(ctx, "fenced CIDR %s", cidr)
+	}
+	return &fence.FenceClusterNetworkResponse{}, nil
+}
+
+// UnfenceClusterNetwork removes the CIDRs from the fence list, it is not an error if not fenced.
+func (fs *fenceServer) UnfenceClusterNetwork(
+	ctx context.Context,
+	req *fence.UnfenceClusterNetworkRequest) (*fence.UnfenceClusterNetworkResponse, error) {
+	cidrs, err := normalizeCIDRs(req.GetCidrs())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	for _, cidr := range cidrs {
+		if err = fs.store.Delete(cidr); err != nil {
+			ctxlog.ErrorS(ctx, err, "failed to unfence CIDR", "cidr", cidr)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		ctxlog.Infof(ctx, "unfenced CIDR %s", cidr)
+	}
+	return &fence.UnfenceClusterNetworkResponse{}, nil
+}
+
+// ListClusterFence returns the fenced CIDRs.
+func (fs *fenceServer) ListClusterFence(
+	ctx context.Context,
+	req *fence.ListClusterFenceRequest) (*fence.ListClusterFenceResponse, error) {
+	cidrs, err := listFencedCIDRs(fs.store)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp := &fence.ListClusterFenceResponse{}
+	for _, cidr := range cidrs {
+		resp.Cidrs = append(resp.Cidrs, &fence.CIDR{Cidr: cidr})
+	}
+	return resp, nil
+}
+
+// ServeHTTP returns the fence list in json.
+func (fs *fenceServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	records, err := listFenceRecords(fs.store)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(records)
+}
+
+// listFenceRecords returns the records of the fence list ordered by CIDR.
+func listFenceRecords(store util.ObjectStore) ([]*fenceRecord, error) {
+	keys, err := store.Keys()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*fenceRecord, 0, len(keys))
+	for _, key := range keys {
+		record := &fenceRecord{}
+		if err = store.Get(key, record); err != nil {
+			// unfenced after listed
+			if util.IsNotFoundErr(err, key) {
+				continue
+			}
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].CIDR < records[j].CIDR })
+	return records, nil
+}
+
+// listFencedCIDRs returns the fenced CIDRs ordered.
+func listFencedCIDRs(store util.ObjectStore) ([]string, error) {
+	records, err := listFenceRecords(store)
+	if err != nil {
+		return nil, err
+	}
+	cidrs := make([]string, 0, len(records))
+	for _, record := range records {
+		cidrs = append(cidrs, record.CIDR)
+	}
+	return cidrs, nil
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/csi-addons/spec/lib/go/fence"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/opencurve/curve-csi/pkg/util"
+)
+
+func TestNormalizeCIDR(t *testing.T) {
+	for cidr, expected := range map[string]string{
+		"10.0.0.1/24": "10.0.0.0/24",
+		"10.0.0.1":    "10.0.0.1/32",
+		"fd00::1/64":  "fd00::/64",
+		"fd00::1":     "fd00::1/128",
+	} {
+		normalized, err := normalizeCIDR(cidr)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, normalized)
+	}
+	for _, cidr := range []string{"", "10.0.0.0/33", "node-1"} {
+		_, err := normalizeCIDR(cidr)
+		assert.Error(t, err, cidr)
+	}
+}
+
+func TestNewFenceServer(t *testing.T) {
+	fs, err := newFenceServer(nil, false)
+	assert.NoError(t, err)
+	assert.Nil(t, fs)
+
+	// the node plugins can not read the dir of the controller
+	_, err = newFenceServer(util.NewFileStore(filepath.Join(t.TempDir(), fenceMetaKind)), true)
+	assert.Error(t, err)
+	_, err = newFenceServer(nil, true)
+	assert.Error(t, err)
+}
+
+func TestFenceServer(t *testing.T) {
+	ctx := context.TODO()
+	store := util.NewConfigMapStore(fake.NewSimpleClientset(), "curve", "curve.csi.netease.com", fenceMetaKind)
+	fs, err := newFenceServer(store, true)
+	assert.NoError(t, err)
+	fencedAt := time.Date(2022, 8, 1, 8, 0, 0, 0, time.UTC)
+	fs.now = func() time.Time { return fencedAt }
+
+	_, err = fs.FenceClusterNetwork(ctx, &fence.FenceClusterNetworkRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = fs.FenceClusterNetwork(ctx, &fence.FenceClusterNetworkRequest{
+		Cidrs: []*fence.CIDR{{Cidr: "10.0.0.0/24"}, {Cidr: "node-1"}},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	// nothing is fenced by an invalid request
+	resp, err := fs.ListClusterFence(ctx, &fence.ListClusterFenceRequest{})
+	assert.NoError(t, err)
+	assert.Empty(t, resp.GetCidrs())
+
+	_, err = fs.FenceClusterNetwork(ctx, &fence.FenceClusterNetworkRequest{
+		Cidrs: []*fence.CIDR{{Cidr: "10.0.1.7/24"}, {Cidr: "10.0.0.2"}},
+	})
+	assert.NoError(t, err)
+	// fenced again, the time of the first fence is kept
+	fs.now = func() time.Time { return fencedAt.Add(time.Hour) }
+	_, err = fs.FenceClusterNetwork(ctx, &fence.FenceClusterNetworkRequest{
+		Cidrs: []*fence.CIDR{{Cidr: "10.0.1.0/24"}},
+	})
+	assert.NoError(t, err)
+	resp, err = fs.ListClusterFence(ctx, &fence.ListClusterFenceRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, []*fence.CIDR{{Cidr: "10.0.0.2/32"}, {Cidr: "10.0.1.0/24"}}, resp.GetCidrs())
+
+	rec := httptest.NewRecorder()
+	fs.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/fence", nil))
+	var records []*fenceRecord
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &records))
+	assert.Equal(t, []*fenceRecord{
+		{CIDR: "10.0.0.2/32", FencedAt: fencedAt},
+		{CIDR: "10.0.1.0/24", FencedAt: fencedAt},
+	}, records)
+
+	// unfencing is idempotent
+	for i := 0; i < 2; i++ {
+		_, err = fs.UnfenceClusterNetwork(ctx, &fence.UnfenceClusterNetworkRequest{
+			Cidrs: []*fence.CIDR{{Cidr: "10.0.1.0/24"}},
+		})
+		assert.NoError(t, err)
+	}
+	cidrs, err := listFencedCIDRs(store)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2/32"}, cidrs)
+}
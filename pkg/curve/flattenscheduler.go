@@ -0,0 +1,360 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+	"github.com/opencurve/curve-csi/pkg/util"
+	"github.com/opencurve/curve-csi/pkg/util/ctxlog"
+)
+
+const (
+	// the metadata kind of the lazy clones to flatten, the subdir in the metadata dir
+	flattenMetaDir = "flatten"
+	// the interval to check the lazy clones
+	flattenCheckInterval = time.Minute
+)
+
+// flattenWindow is the daily time range of the local time, in minutes of the day.
+// The end is not included, and the range wraps around midnight if the end is before the start.
+type flattenWindow struct {
+	start, end int
+}
+
+// parseFlattenWindow parses the window like "01:00-05:00", returns nil if empty.
+func parseFlattenWindow(str string) (*flattenWindow, error) {
+	str = strings.TrimSpace(str)
+	if str == "" {
+		return nil, nil
+	}
+	bounds := strings.Split(str, "-")
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("invalid flatten window %q, must be HH:MM-HH:MM", str)
+	}
+	w := &flattenWindow{}
+	for i, bound := range bounds {
+		t, err := time.Parse("15:04", strings.TrimSpace(bound))
+		if err != nil {
+			return nil, fmt.Errorf("invalid flatten window %q, must be HH:MM-HH:MM", str)
+		}
+		minutes := t.Hour()*60 + t.Minute()
+		if i == 0 {
+			w.start = minutes
+		} else {
+			w.end = minutes
+		}
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("invalid flatten window %q, the start equals the end", str)
+	}
+	return w, nil
+}
+
+// contains returns true if the time is in the window, it is safe to call on nil.
+func (w *flattenWindow) contains(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+	minutes := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return minutes >= w.start && minutes < w.end
+	}
+	return minutes >= w.start || minutes < w.end
+}
+
+// flattenTask is the persisted progress of flattening a lazy clone.
+type flattenTask struct {
+	// the clone task UUID, resolved by the volume path if empty
+	TaskUUID string `json:"taskUUID,omitempty"`
+	// when the lazy clone is created, or found on startup
+	CreatedAt time.Time `json:"createdAt"`
+	// when the flatten is requested, nil if not yet
+	StartedAt *time.Time `json:"startedAt,omitempty"`
+	Attempts  int        `json:"attempts,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+// flattenStatus is a lazy clone waiting for or in flattening.
+type flattenStatus struct {
+	VolumeID string `json:"volumeID"`
+	flattenTask
+}
+
+// flattenScheduler flattens the lazy clones in the background once they are older than
+// the age and the time is in the window. At most concurrency clones are flattening in
+// the cluster at the same time. The lazy clones are persisted in the metadata store, so
+// the progress survives restarts.
+type flattenScheduler struct {
+	*worker
+	cs          *controllerServer
+	store       util.ObjectStore
+	age         time.Duration
+	window      *flattenWindow
+	concurrency int
+
+	// serializes the enqueue and removal, a record of a deleted volume written
+	// back by a concurrent check is dropped by the next check
+	mu sync.Mutex
+	// the lazy clones recorded in the volume metadata are scheduled on the first check
+	adopted bool
+	backend workerBackend
+	now     func() time.Time
+}
+
+// newFlattenScheduler returns nil if neither the age nor the window is set.
+func newFlattenScheduler(cs *controllerServer, store util.ObjectStore, age time.Duration, window string, concurrency int) (*flattenScheduler, error) {
+	w, err := parseFlattenWindow(window)
+	if err != nil {
+		return nil, err
+	}
+	if age <= 0 && w == nil {
+		return nil, nil
+	}
+	if store == nil {
+		return nil, fmt.Errorf("the flatten scheduler requires the metadata store")
+	}
+	if concurrency <= 0 {
+		return nil, fmt.Errorf("invalid flatten concurrency %d, must be positive", concurrency)
+	}
+	s := &flattenScheduler{
+		cs:          cs,
+		store:       store,
+		age:         age,
+		window:      w,
+		concurrency: concurrency,
+		backend:     curveBackend{},
+		now:         time.Now,
+	}
+	s.worker = newWorker("flatten-scheduler", flattenCheckInterval, func(ctx context.Context) interface{} {
+		s.check(ctx)
+		return nil
+	})
+	return s, nil
+}
+
+// due returns true if the lazy clone can be flattened now.
+func (s *flattenScheduler) due(task *flattenTask, now time.Time) bool {
+	return now.Sub(task.CreatedAt) >= s.age && s.window.contains(now)
+}
+
+// enqueue adds the lazy clone to flatten, it is safe to call on nil.
+func (s *flattenScheduler) enqueue(ctx context.Context, volumeId, taskUUID string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task := &flattenTask{}
+	if err := s.store.Get(volumeId, task); err == nil {
+		return
+	}
+	task = &flattenTask{TaskUUID: taskUUID, CreatedAt: s.now()}
+	if err := s.store.Put(volumeId, task); err != nil {
+		ctxlog.Warningf(ctx, "failed to schedule flattening of %s: %v", volumeId, err)
+		return
+	}
+	ctxlog.V(4).Infof(ctx, "scheduled flattening of lazy clone %s", volumeId)
+}
+
+// remove deletes the lazy clone from the schedule, it is safe to call on nil.
+func (s *flattenScheduler) remove(ctx context.Context, volumeId string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.store.Delete(volumeId); err != nil {
+		ctxlog.Warningf(ctx, "failed to unschedule flattening of %s: %v", volumeId, err)
+	}
+}
+
+// pending lists the lazy clones waiting for or in flattening, sorted by creation.
+func (s *flattenScheduler) pending() ([]flattenStatus, error) {
+	keys, err := s.store.Keys()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]flattenStatus, 0, len(keys))
+	for _, volumeId := range keys {
+		status := flattenStatus{VolumeID: volumeId}
+		if err = s.store.Get(volumeId, &status.flattenTask); err != nil {
+			continue
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].CreatedAt.Before(statuses[j].CreatedAt)
+	})
+	return statuses, nil
+}
+
+// ServeHTTP lists the pending lazy clones in json.
+func (s *flattenScheduler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	statuses, err := s.pending()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(statuses)
+}
+
+// adoptLazyClones schedules the clones recorded in the volume metadata, e.g. created
+// before the scheduler is enabled. The ones already flattened are removed by check.
+func (s *flattenScheduler) adoptLazyClones(ctx context.Context) {
+	if !s.cs.volumeMeta.enabled() {
+		return
+	}
+	keys, err := s.cs.volumeMeta.store.Keys()
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to list volume metadata: %v", err)
+		return
+	}
+	for _, volumeId := range keys {
+		meta, err := s.cs.volumeMeta.get(volumeId)
+		if err != nil || meta.CloneSource == "" {
+			continue
+		}
+		s.enqueue(ctx, volumeId, "")
+	}
+}
+
+// check refreshes the status of the lazy clones, and requests flattening the due
+// ones until concurrency clones are flattening.
+func (s *flattenScheduler) check(ctx context.Context) {
+	if !s.adopted {
+		ctxlog.Infof(ctx, "flatten scheduler, age: %v, window: %+v, concurrency: %d", s.age, s.window, s.concurrency)
+		s.adoptLazyClones(ctx)
+		s.adopted = true
+	}
+	statuses, err := s.pending()
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to list lazy clones to flatten: %v", err)
+		return
+	}
+
+	now := s.now()
+	flattening := 0
+	var due []flattenStatus
+	for _, status := range statuses {
+		taskStatus, err := s.refresh(ctx, status.VolumeID, &status.flattenTask)
+		if err != nil {
+			continue
+		}
+		switch taskStatus {
+		case curveservice.TaskStatusCloning, curveservice.TaskStatusRecovering, curveservice.TaskStatusRetrying:
+			flattening++
+		case curveservice.TaskStatusMetaInstalled:
+			if s.due(&status.flattenTask, now) {
+				due = append(due, status)
+			}
+		}
+	}
+	ctxlog.V(4).Infof(ctx, "lazy clones: %d pending, %d flattening, %d due", len(statuses), flattening, len(due))
+
+	for i := 0; i < len(due) && flattening < s.concurrency; i++ {
+		if s.flatten(ctx, due[i].VolumeID, &due[i].flattenTask, now) {
+			flattening++
+		}
+	}
+}
+
+// refresh gets the clone task of the volume, the volume is removed from the schedule
+// if its clone task is not found or done. The other failures, e.g. of the cluster
+// config or the credentials, are retried by the next check.
+func (s *flattenScheduler) refresh(ctx context.Context, volumeId string, task *flattenTask) (curveservice.TaskStatus, error) {
+	volOptions, err := s.volumeOptions(ctx, volumeId)
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to check lazy clone %s: %v", volumeId, err)
+		return 0, err
+	}
+	taskInfo, err := s.backend.snapshotServer(volOptions).GetCloneTaskOfDestination(ctx, volOptions.genVolumePath())
+	if err != nil {
+		if util.IsNotFoundErr(err) {
+			ctxlog.V(4).Infof(ctx, "clone task of %s not found, unschedule it", volumeId)
+			_ = s.store.Delete(volumeId)
+		} else {
+			ctxlog.Warningf(ctx, "failed to get clone task of %s: %v", volumeId, err)
+		}
+		return 0, err
+	}
+	if taskInfo.TaskStatus == curveservice.TaskStatusDone {
+		ctxlog.Infof(ctx, "lazy clone %s is flattened", volumeId)
+		_ = s.store.Delete(volumeId)
+		return taskInfo.TaskStatus, nil
+	}
+	if task.TaskUUID == "" {
+		task.TaskUUID = taskInfo.UUID
+		_ = s.store.Put(volumeId, task)
+	}
+	return taskInfo.TaskStatus, nil
+}
+
+// flatten requests flattening the lazy clone, returns true if requested.
+func (s *flattenScheduler) flatten(ctx context.Context, volumeId string, task *flattenTask, now time.Time) bool {
+	// skip the volume in operation, e.g. being deleted
+	if acquired := s.cs.volumeLocks.TryAcquire(volumeId); !acquired {
+		return false
+	}
+	defer s.cs.volumeLocks.Release(volumeId)
+
+	volOptions, err := s.volumeOptions(ctx, volumeId)
+	if err != nil {
+		return false
+	}
+	task.Attempts++
+	err = s.backend.snapshotServer(volOptions).Flatten(ctx, task.TaskUUID)
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to flatten lazy clone %s: %v", volumeId, err)
+		task.LastError = err.Error()
+	} else {
+		ctxlog.Infof(ctx, "flattening lazy clone %s, task %s", volumeId, task.TaskUUID)
+		task.StartedAt = &now
+		task.LastError = ""
+	}
+	if err := s.store.Put(volumeId, task); err != nil {
+		ctxlog.Warningf(ctx, "failed to save flatten progress of %s: %v", volumeId, err)
+	}
+	return task.LastError == ""
+}
+
+func (s *flattenScheduler) volumeOptions(ctx context.Context, volumeId string) (*volumeOptions, error) {
+	volOptions, err := newVolumeOptionsFromVolID(volumeId)
+	if err != nil {
+		return nil, err
+	}
+	if err = volOptions.resolveCluster(s.cs.clusters); err != nil {
+		return nil, err
+	}
+	if err = volOptions.applyCredentials(backgroundSecrets(ctx, s.cs.credentialsDir, volOptions.user)); err != nil {
+		return nil, err
+	}
+	if !volOptions.snapshotEnabled() {
+		return nil, fmt.Errorf("snapshot server of cluster %q is not set", volOptions.clusterID)
+	}
+	return volOptions, nil
+}
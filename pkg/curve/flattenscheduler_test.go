@@ -0,0 +1,159 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+	"github.com/opencurve/curve-csi/pkg/util"
+)
+
+func TestFlattenWindow(t *testing.T) {
+	w, err := parseFlattenWindow("")
+	assert.NoError(t, err)
+	assert.Nil(t, w)
+	assert.True(t, w.contains(time.Now()))
+
+	at := func(hour, minute int) time.Time {
+		return time.Date(2022, 1, 1, hour, minute, 0, 0, time.Local)
+	}
+
+	w, err = parseFlattenWindow("01:00-05:30")
+	assert.NoError(t, err)
+	assert.False(t, w.contains(at(0, 59)))
+	assert.True(t, w.contains(at(1, 0)))
+	assert.True(t, w.contains(at(5, 29)))
+	assert.False(t, w.contains(at(5, 30)))
+
+	// wraps around midnight
+	w, err = parseFlattenWindow("22:00-02:00")
+	assert.NoError(t, err)
+	assert.True(t, w.contains(at(23, 0)))
+	assert.True(t, w.contains(at(1, 59)))
+	assert.False(t, w.contains(at(12, 0)))
+
+	for _, str := range []string{"01:00", "01:00-", "1-5", "25:00-02:00", "01:00-01:00", "01:00-02:00-03:00"} {
+		_, err = parseFlattenWindow(str)
+		assert.Error(t, err, str)
+	}
+}
+
+func TestNewFlattenScheduler(t *testing.T) {
+	s, err := newFlattenScheduler(nil, util.NewFileStore(t.TempDir()), 0, "", 1)
+	assert.NoError(t, err)
+	assert.Nil(t, s)
+
+	_, err = newFlattenScheduler(nil, nil, time.Hour, "", 1)
+	assert.Error(t, err)
+	_, err = newFlattenScheduler(nil, util.NewFileStore(t.TempDir()), time.Hour, "", 0)
+	assert.Error(t, err)
+	_, err = newFlattenScheduler(nil, util.NewFileStore(t.TempDir()), 0, "bad", 1)
+	assert.Error(t, err)
+
+	s, err = newFlattenScheduler(nil, util.NewFileStore(t.TempDir()), time.Hour, "01:00-05:00", 2)
+	assert.NoError(t, err)
+	assert.NotNil(t, s)
+}
+
+func TestFlattenSchedulerQueue(t *testing.T) {
+	ctx := context.TODO()
+	// nil is disabled
+	var disabled *flattenScheduler
+	disabled.enqueue(ctx, "vol", "uuid")
+	disabled.remove(ctx, "vol")
+
+	s, err := newFlattenScheduler(nil, util.NewFileStore(t.TempDir()), time.Hour, "", 1)
+	assert.NoError(t, err)
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.Local)
+	s.now = func() time.Time { return now }
+
+	s.enqueue(ctx, "vol-1", "uuid-1")
+	now = now.Add(time.Minute)
+	s.enqueue(ctx, "vol-2", "")
+	// the existing one is kept
+	s.enqueue(ctx, "vol-1", "uuid-x")
+
+	pending, err := s.pending()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 2)
+	assert.Equal(t, "vol-1", pending[0].VolumeID)
+	assert.Equal(t, "uuid-1", pending[0].TaskUUID)
+	assert.Equal(t, "vol-2", pending[1].VolumeID)
+
+	assert.False(t, s.due(&pending[0].flattenTask, now))
+	assert.True(t, s.due(&pending[0].flattenTask, now.Add(time.Hour)))
+	assert.False(t, s.due(&pending[1].flattenTask, now.Add(time.Hour-time.Second)))
+
+	s.window = &flattenWindow{start: 60, end: 300}
+	assert.False(t, s.due(&pending[0].flattenTask, now.Add(time.Hour)))
+	assert.True(t, s.due(&pending[0].flattenTask, now.Add(14*time.Hour)))
+
+	s.remove(ctx, "vol-1")
+	pending, err = s.pending()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+}
+
+func TestFlattenSchedulerRefresh(t *testing.T) {
+	ctx := context.TODO()
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	cs := &controllerServer{
+		volumeLocks: util.NewVolumeLocks(),
+		clusters:    newClusterResolver(configPath, "http://127.0.0.1:5555"),
+		volumeMeta:  newVolumeMetaStore(nil),
+	}
+	s, err := newFlattenScheduler(cs, util.NewFileStore(t.TempDir()), time.Hour, "", 1)
+	assert.NoError(t, err)
+	backend := newFakeBackend()
+	s.backend = backend
+
+	volId, err := composeCSIID(&csiIdentifier{clusterID: "cluster1", scheme: namingSchemeCSI, user: "k8s", volName: "csi-vol-pvc-1"})
+	assert.NoError(t, err)
+	s.enqueue(ctx, volId, "")
+	task := &flattenTask{}
+
+	// the cluster config is broken, kept for the next check
+	assert.NoError(t, os.WriteFile(configPath, []byte(`[{"clusterID": "cluster1"`), 0o600))
+	_, err = s.refresh(ctx, volId, task)
+	assert.Error(t, err)
+	pending, err := s.pending()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+
+	// the clone task is found
+	assert.NoError(t, os.WriteFile(configPath, []byte(`[{"clusterID": "cluster1", "snapshotServers": ["http://127.0.0.1:5555"]}]`), 0o600))
+	backend.tasks["/k8s/csi-vol-pvc-1"] = curveservice.TaskInfo{UUID: "t1", TaskStatus: curveservice.TaskStatusMetaInstalled}
+	taskStatus, err := s.refresh(ctx, volId, task)
+	assert.NoError(t, err)
+	assert.Equal(t, curveservice.TaskStatusMetaInstalled, taskStatus)
+	assert.Equal(t, "t1", task.TaskUUID)
+
+	// the clone task is gone
+	delete(backend.tasks, "/k8s/csi-vol-pvc-1")
+	_, err = s.refresh(ctx, volId, task)
+	assert.Error(t, err)
+	pending, err = s.pending()
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+}
@@ -0,0 +1,320 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	csicommon "github.com/opencurve/curve-csi/pkg/csi-common"
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+	"github.com/opencurve/curve-csi/pkg/util"
+	"github.com/opencurve/curve-csi/pkg/util/ctxlog"
+)
+
+// groupControllerServer serves the volume group snapshots. The snapshots of a group
+// are curve snapshots named by the group name, which are taken concurrently to
+// minimize the skew between them.
+type groupControllerServer struct {
+	*csicommon.DefaultGroupControllerServer
+
+	// shares the locks and clusters with the controller server
+	cs *controllerServer
+	// the membership of group snapshots
+	groupSnapshots *groupSnapshotStore
+}
+
+// CreateVolumeGroupSnapshot takes the snapshots of the source volumes at the same time.
+func (gcs *groupControllerServer) CreateVolumeGroupSnapshot(
+	ctx context.Context,
+	req *csi.CreateVolumeGroupSnapshotRequest) (*csi.CreateVolumeGroupSnapshotResponse, error) {
+	if err := gcs.validateCreateVolumeGroupSnapshotRequest(req); err != nil {
+		ctxlog.ErrorS(ctx, err, "CreateVolumeGroupSnapshotRequest validation failed")
+		return nil, err
+	}
+
+	name := req.GetName()
+	// lock out parallel group snapshot operations
+	if acquired := gcs.cs.snapshotLocks.TryAcquire(name); !acquired {
+		ctxlog.Infof(ctx, util.SnapshotOperationAlreadyExistsFmt, name)
+		return nil, status.Errorf(codes.Aborted, util.SnapshotOperationAlreadyExistsFmt, name)
+	}
+	defer gcs.cs.snapshotLocks.Release(name)
+
+	// build the options of source volumes, which must be in the same cluster
+	members := make([]*volumeOptions, 0, len(req.GetSourceVolumeIds()))
+	for _, volumeId := range req.GetSourceVolumeIds() {
+		volOptions, err := newVolumeOptionsFromVolID(volumeId)
+		if err != nil {
+			ctxlog.ErrorS(ctx, err, "failed to new volume options from id", "volumeId", volumeId)
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if len(members) > 0 && volOptions.clusterID != members[0].clusterID {
+			return nil, status.Errorf(codes.InvalidArgument, "the source volumes must be in the same cluster, %s is in %q but %s is in %q",
+				volumeId, volOptions.clusterID, members[0].volId, members[0].clusterID)
+		}
+		if err = volOptions.resolveCluster(gcs.cs.clusters); err != nil {
+			ctxlog.ErrorS(ctx, err, "failed to resolve cluster of volume", "volumeId", volumeId)
+			return nil, clusterErrorToStatus(err, codes.InvalidArgument)
+		}
+		if err = volOptions.applyCredentials(req.GetSecrets()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if !volOptions.snapshotEnabled() {
+			return nil, status.Error(codes.Unimplemented, "")
+		}
+		members = append(members, volOptions)
+	}
+	groupSnapshotId, err := composeGroupSnapshotID(members[0].clusterID, name)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// lock out parallel delete/create/snapshot requests against the source volumes
+	for _, volOptions := range members {
+		if acquired := gcs.cs.volumeLocks.TryAcquire(volOptions.reqName); !acquired {
+			ctxlog.Infof(ctx, util.VolumeOperationAlreadyExistsFmt, volOptions.reqName)
+			return nil, status.Errorf(codes.Aborted, util.VolumeOperationAlreadyExistsFmt, volOptions.reqName)
+		}
+		defer gcs.cs.volumeLocks.Release(volOptions.reqName)
+	}
+
+	// find the snapshots already taken, and flatten the cloning volumes ahead,
+	// so that the pending snapshots can be taken close together.
+	snaps := make([]curveservice.Snapshot, len(members))
+	var pending []int
+	for i, volOptions := range members {
+		snapServer := volOptions.snapshotServer()
+		snaps[i], err = snapServer.GetFileSnapshotOfName(ctx, name)
+		if err == nil {
+			ctxlog.V(4).Infof(ctx, "snapshot (name %v) of volume %v already exists", name, volOptions.volId)
+			continue
+		}
+		if !util.IsNotFoundErr(err) {
+			ctxlog.ErrorS(ctx, err, "failed to get snapshot by name", "snapshotName", name, "volumeId", volOptions.volId)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		volDetail, err := volOptions.curveVolume().Stat(ctx)
+		if err != nil {
+			ctxlog.ErrorS(ctx, err, "failed to stat source volume", "volumeId", volOptions.volId)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if volDetail.FileStatus == curveservice.CurveVolumeStatusBeingCloned {
+			ctxlog.Warningf(ctx, "the source volume %v status is BeingCloned, flatten it", volOptions.volId)
+			if err = snapServer.EnsureTaskFromSourceDone(ctx, volOptions.genVolumePath()); err != nil {
+				ctxlog.ErrorS(ctx, err, "failed to flatten all tasks sourced volume", "volumeId", volOptions.volId)
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+		pending = append(pending, i)
+	}
+	if err = takeGroupSnapshots(ctx, name, members, pending, snaps); err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to take group snapshots", "name", name)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	groupSnapshot := &csi.VolumeGroupSnapshot{
+		GroupSnapshotId: groupSnapshotId,
+		ReadyToUse:      true,
+	}
+	meta := &groupSnapshotMeta{}
+	for i, volOptions := range members {
+		resp, err := waitSnapshotDone(ctx, volOptions.snapshotServer(), snaps[i], volOptions.volId)
+		if err != nil {
+			return nil, err
+		}
+		snapshot := resp.GetSnapshot()
+		snapshot.GroupSnapshotId = groupSnapshotId
+		groupSnapshot.Snapshots = append(groupSnapshot.Snapshots, snapshot)
+		if groupSnapshot.CreationTime == nil || snapshot.CreationTime.AsTime().Before(groupSnapshot.CreationTime.AsTime()) {
+			groupSnapshot.CreationTime = snapshot.CreationTime
+		}
+		meta.SnapshotIDs = append(meta.SnapshotIDs, snapshot.SnapshotId)
+	}
+	if err = gcs.groupSnapshots.put(groupSnapshotId, meta); err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to save group snapshot metadata", "groupSnapshotId", groupSnapshotId)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	ctxlog.Infof(ctx, "group snapshot %v of %d volumes status Done", groupSnapshotId, len(members))
+	return &csi.CreateVolumeGroupSnapshotResponse{GroupSnapshot: groupSnapshot}, nil
+}
+
+// DeleteVolumeGroupSnapshot deletes all the snapshots of the group.
+func (gcs *groupControllerServer) DeleteVolumeGroupSnapshot(
+	ctx context.Context,
+	req *csi.DeleteVolumeGroupSnapshotRequest) (*csi.DeleteVolumeGroupSnapshotResponse, error) {
+	if err := gcs.validateDeleteVolumeGroupSnapshotRequest(req); err != nil {
+		ctxlog.ErrorS(ctx, err, "DeleteVolumeGroupSnapshotRequest validation failed")
+		return nil, err
+	}
+
+	groupSnapshotId := req.GetGroupSnapshotId()
+	if acquired := gcs.cs.snapshotLocks.TryAcquire(groupSnapshotId); !acquired {
+		ctxlog.Errorf(ctx, util.SnapshotOperationAlreadyExistsFmt, groupSnapshotId)
+		return nil, status.Errorf(codes.Aborted, util.SnapshotOperationAlreadyExistsFmt, groupSnapshotId)
+	}
+	defer gcs.cs.snapshotLocks.Release(groupSnapshotId)
+
+	if _, _, err := decomposeGroupSnapshotID(groupSnapshotId); err != nil {
+		ctxlog.Warningf(ctx, "failed to parse group snapshot id: %v", groupSnapshotId)
+		return &csi.DeleteVolumeGroupSnapshotResponse{}, nil
+	}
+	snapshotIds, err := gcs.groupMembers(groupSnapshotId, req.GetSnapshotIds())
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshotId := range snapshotIds {
+		if err = gcs.cs.deleteSnapshot(ctx, snapshotId, req.GetSecrets()); err != nil {
+			ctxlog.ErrorS(ctx, err, "failed to delete snapshot of group", "snapshotId", snapshotId, "groupSnapshotId", groupSnapshotId)
+			return nil, err
+		}
+	}
+	if err = gcs.groupSnapshots.delete(groupSnapshotId); err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to delete group snapshot metadata", "groupSnapshotId", groupSnapshotId)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.DeleteVolumeGroupSnapshotResponse{}, nil
+}
+
+// GetVolumeGroupSnapshot gets the status of the snapshots of the group.
+func (gcs *groupControllerServer) GetVolumeGroupSnapshot(
+	ctx context.Context,
+	req *csi.GetVolumeGroupSnapshotRequest) (*csi.GetVolumeGroupSnapshotResponse, error) {
+	if err := gcs.validateGetVolumeGroupSnapshotRequest(req); err != nil {
+		ctxlog.ErrorS(ctx, err, "GetVolumeGroupSnapshotRequest validation failed")
+		return nil, err
+	}
+
+	groupSnapshotId := req.GetGroupSnapshotId()
+	if _, _, err := decomposeGroupSnapshotID(groupSnapshotId); err != nil {
+		return nil, status.Errorf(codes.NotFound, "group snapshot id %v not found", groupSnapshotId)
+	}
+	snapshotIds, err := gcs.groupMembers(groupSnapshotId, req.GetSnapshotIds())
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshotIds) == 0 {
+		return nil, status.Errorf(codes.NotFound, "group snapshot id %v not found", groupSnapshotId)
+	}
+
+	groupSnapshot := &csi.VolumeGroupSnapshot{
+		GroupSnapshotId: groupSnapshotId,
+		ReadyToUse:      true,
+	}
+	for _, snapshotId := range snapshotIds {
+		snapCurveUUID, volOptions, err := parseSnapshotID(snapshotId)
+		if err != nil {
+			return nil, status.Errorf(codes.NotFound, "snapshot id %v not found", snapshotId)
+		}
+		if err = volOptions.resolveCluster(gcs.cs.clusters); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if err = volOptions.applyCredentials(req.GetSecrets()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		curveSnapshot, err := volOptions.snapshotServer().GetFileSnapshotOfId(ctx, snapCurveUUID)
+		if err != nil {
+			if util.IsNotFoundErr(err, snapCurveUUID) {
+				return nil, status.Errorf(codes.NotFound, "snapshot %v of group %v not found", snapshotId, groupSnapshotId)
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		snapshot := &csi.Snapshot{
+			SizeBytes:       int64(curveSnapshot.FileLength),
+			SnapshotId:      snapshotId,
+			SourceVolumeId:  volOptions.volId,
+			CreationTime:    timestamppb.New(time.Unix(0, curveSnapshot.Time*1000)),
+			ReadyToUse:      curveSnapshot.Status == curveservice.SnapshotStatusDone,
+			GroupSnapshotId: groupSnapshotId,
+		}
+		groupSnapshot.Snapshots = append(groupSnapshot.Snapshots, snapshot)
+		groupSnapshot.ReadyToUse = groupSnapshot.ReadyToUse && snapshot.ReadyToUse
+		if groupSnapshot.CreationTime == nil || snapshot.CreationTime.AsTime().Before(groupSnapshot.CreationTime.AsTime()) {
+			groupSnapshot.CreationTime = snapshot.CreationTime
+		}
+	}
+	return &csi.GetVolumeGroupSnapshotResponse{GroupSnapshot: groupSnapshot}, nil
+}
+
+// groupMembers returns the snapshot IDs of the group, the recorded membership
+// is preferred, and the requested snapshots must be the members of it.
+func (gcs *groupControllerServer) groupMembers(groupSnapshotId string, snapshotIds []string) ([]string, error) {
+	meta, err := gcs.groupSnapshots.get(groupSnapshotId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if meta == nil {
+		return snapshotIds, nil
+	}
+	if !meta.has(snapshotIds) {
+		return nil, status.Errorf(codes.InvalidArgument, "snapshots %v are not the members %v of group snapshot %v",
+			snapshotIds, meta.SnapshotIDs, groupSnapshotId)
+	}
+	return meta.SnapshotIDs, nil
+}
+
+// takeGroupSnapshots takes the pending snapshots of members concurrently,
+// and stores the created snapshots in snaps.
+func takeGroupSnapshots(
+	ctx context.Context,
+	name string,
+	members []*volumeOptions,
+	pending []int,
+	snaps []curveservice.Snapshot) error {
+	if len(pending) == 0 {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(pending))
+	start := time.Now()
+	for j, i := range pending {
+		wg.Add(1)
+		go func(j, i int) {
+			defer wg.Done()
+			snapServer := members[i].snapshotServer()
+			snapCurveUUID, err := snapServer.CreateSnapshot(ctx, name)
+			if err != nil {
+				errs[j] = fmt.Errorf("failed to snapshot volume %s: %v", members[i].volId, err)
+				return
+			}
+			snaps[i], err = snapServer.GetFileSnapshotOfId(ctx, snapCurveUUID)
+			if err != nil {
+				errs[j] = fmt.Errorf("failed to get snapshot %s of volume %s: %v", snapCurveUUID, members[i].volId, err)
+			}
+		}(j, i)
+	}
+	wg.Wait()
+	ctxlog.Infof(ctx, "took %d snapshots of group %s in %v", len(pending), name, time.Since(start))
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
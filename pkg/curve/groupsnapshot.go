@@ -0,0 +1,130 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/opencurve/curve-csi/pkg/util"
+)
+
+const (
+	// the group snapshot ID is distinguished from the snapshot ID by it
+	groupSnapshotIDMark = "g"
+	// the metadata kind of the group snapshots, the subdir in the metadata dir
+	groupSnapshotMetaDir = "groupsnapshots"
+)
+
+/*
+composeGroupSnapshotID composes a group snapshot ID from passed in parameters.
+
+	[version=v1:2byte] + [-:1byte]
+	[g:1byte] + [-:1byte]
+	[length of clusterID:2byte] + [clusterID] + [-:1byte]
+	[group name]
+*/
+func composeGroupSnapshotID(clusterID, name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("name of group snapshot ID can not be empty")
+	}
+	if len(clusterID) > 0xff {
+		return "", fmt.Errorf("field %q of group snapshot ID is too long", clusterID)
+	}
+	id := fmt.Sprintf("%s-%s-%02x%s-%s", csiIDVersion1, groupSnapshotIDMark, len(clusterID), clusterID, name)
+	if len(id) > maxCSIIDLen {
+		return "", fmt.Errorf("group snapshot ID encoding length overflow")
+	}
+	return id, nil
+}
+
+// decomposeGroupSnapshotID returns errInvalidCSIID if the ID is malformed.
+func decomposeGroupSnapshotID(composedID string) (clusterID, name string, err error) {
+	if len(composedID) > maxCSIIDLen {
+		return "", "", fmt.Errorf("%w: %q is longer than %d", errInvalidCSIID, composedID, maxCSIIDLen)
+	}
+	prefix := csiIDVersion1 + "-" + groupSnapshotIDMark
+	if !strings.HasPrefix(composedID, prefix+"-") {
+		return "", "", fmt.Errorf("%w: %q is not a group snapshot ID", errInvalidCSIID, composedID)
+	}
+	clusterID, rest, err := nextLenPrefixedField(strings.TrimPrefix(composedID, prefix), 2)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %q bad clusterID: %v", errInvalidCSIID, composedID, err)
+	}
+	if len(rest) < 2 || rest[0] != '-' {
+		return "", "", fmt.Errorf("%w: %q missing name", errInvalidCSIID, composedID)
+	}
+	return clusterID, rest[1:], nil
+}
+
+// groupSnapshotMeta is the membership of a group snapshot.
+type groupSnapshotMeta struct {
+	SnapshotIDs []string `json:"snapshotIDs"`
+}
+
+// has returns true if all the snapshots are members of the group.
+func (m *groupSnapshotMeta) has(snapshotIds []string) bool {
+	members := make(map[string]bool, len(m.SnapshotIDs))
+	for _, id := range m.SnapshotIDs {
+		members[id] = true
+	}
+	for _, id := range snapshotIds {
+		if !members[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// groupSnapshotStore persists the groupSnapshotMeta by group snapshot ID,
+// it does nothing if the metadata store is not set.
+type groupSnapshotStore struct {
+	store util.ObjectStore
+}
+
+func newGroupSnapshotStore(store util.ObjectStore) *groupSnapshotStore {
+	return &groupSnapshotStore{store: store}
+}
+
+// get returns nil if not found.
+func (s *groupSnapshotStore) get(groupSnapshotId string) (*groupSnapshotMeta, error) {
+	if s.store == nil {
+		return nil, nil
+	}
+	meta := &groupSnapshotMeta{}
+	if err := s.store.Get(groupSnapshotId, meta); err != nil {
+		if util.IsNotFoundErr(err, groupSnapshotId) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (s *groupSnapshotStore) put(groupSnapshotId string, meta *groupSnapshotMeta) error {
+	if s.store == nil {
+		return nil
+	}
+	return s.store.Put(groupSnapshotId, meta)
+}
+
+func (s *groupSnapshotStore) delete(groupSnapshotId string) error {
+	if s.store == nil {
+		return nil
+	}
+	return s.store.Delete(groupSnapshotId)
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opencurve/curve-csi/pkg/util"
+)
+
+func TestGroupSnapshotID(t *testing.T) {
+	id, err := composeGroupSnapshotID("cluster1", "groupsnapshot-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1-g-08cluster1-groupsnapshot-1", id)
+	clusterID, name, err := decomposeGroupSnapshotID(id)
+	assert.NoError(t, err)
+	assert.Equal(t, "cluster1", clusterID)
+	assert.Equal(t, "groupsnapshot-1", name)
+
+	id, err = composeGroupSnapshotID("", "groupsnapshot-1")
+	assert.NoError(t, err)
+	clusterID, name, err = decomposeGroupSnapshotID(id)
+	assert.NoError(t, err)
+	assert.Equal(t, "", clusterID)
+	assert.Equal(t, "groupsnapshot-1", name)
+
+	_, err = composeGroupSnapshotID("cluster1", "")
+	assert.Error(t, err)
+	_, err = composeGroupSnapshotID("cluster1", strings.Repeat("a", maxCSIIDLen))
+	assert.Error(t, err)
+
+	for _, id := range []string{
+		"",
+		"v1-g",
+		"v1-g-08cluster1",
+		"v1-g-08cluster1-",
+		"v1-0cabcdefabcdef-v1-00-00-0-03k8s-csi-vol-pvc-1",
+		"v1-g-zzcluster1-groupsnapshot-1",
+	} {
+		_, _, err = decomposeGroupSnapshotID(id)
+		assert.True(t, errors.Is(err, errInvalidCSIID), id)
+	}
+}
+
+func TestGroupSnapshotStore(t *testing.T) {
+	meta := &groupSnapshotMeta{SnapshotIDs: []string{"snap-1", "snap-2"}}
+	assert.True(t, meta.has(nil))
+	assert.True(t, meta.has([]string{"snap-2", "snap-1"}))
+	assert.False(t, meta.has([]string{"snap-1", "snap-3"}))
+
+	// disabled
+	s := newGroupSnapshotStore(nil)
+	assert.NoError(t, s.put("group-1", meta))
+	got, err := s.get("group-1")
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+	assert.NoError(t, s.delete("group-1"))
+
+	s = newGroupSnapshotStore(util.NewFileStore(t.TempDir()))
+	got, err = s.get("group-1")
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+	assert.NoError(t, s.put("group-1", meta))
+	got, err = s.get("group-1")
+	assert.NoError(t, err)
+	assert.Equal(t, meta, got)
+	assert.NoError(t, s.delete("group-1"))
+	got, err = s.get("group-1")
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+}
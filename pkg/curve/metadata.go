@@ -0,0 +1,67 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"path/filepath"
+
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/opencurve/curve-csi/pkg/util"
+)
+
+// the metadata kind of the volumes, stored in the root of the metadata dir
+const volumeMetaKind = "volume"
+
+// metadataStores creates the stores of the controller metadata. With the namespace set,
+// the metadata is kept in the ConfigMaps of the namespace, shared by the controller
+// replicas on any node. Otherwise it is kept in the dir, which must survive the
+// restarts and reschedules of the controller.
+type metadataStores struct {
+	dir       string
+	namespace string
+	driver    string
+	client    kubernetes.Interface
+}
+
+func newMetadataStores(dir, namespace, driver string) (*metadataStores, error) {
+	m := &metadataStores{dir: dir, namespace: namespace, driver: driver}
+	if namespace == "" {
+		return m, nil
+	}
+	client, err := util.NewKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	m.client = client
+	return m, nil
+}
+
+// store returns nil if neither the namespace nor the dir is set.
+func (m *metadataStores) store(kind string) util.ObjectStore {
+	if m.namespace != "" {
+		return util.NewConfigMapStore(m.client, m.namespace, m.driver, kind)
+	}
+	if m.dir == "" {
+		return nil
+	}
+	subdir := kind
+	if kind == volumeMetaKind {
+		subdir = ""
+	}
+	return util.NewFileStore(filepath.Join(m.dir, subdir))
+}
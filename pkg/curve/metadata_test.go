@@ -0,0 +1,48 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/opencurve/curve-csi/pkg/util"
+)
+
+func TestMetadataStores(t *testing.T) {
+	dir := t.TempDir()
+	m := &metadataStores{}
+	assert.Nil(t, m.store(volumeMetaKind))
+
+	// the volume metadata is in the root of the dir, the others in the subdirs
+	m = &metadataStores{dir: dir}
+	assert.NoError(t, m.store(volumeMetaKind).Put("vol-1", &volumeMeta{CloneSource: "/k8s/a"}))
+	assert.NoError(t, m.store(flattenMetaDir).Put("vol-2", &flattenTask{TaskUUID: "t2"}))
+	assert.FileExists(t, filepath.Join(dir, "vol-1.json"))
+	assert.FileExists(t, filepath.Join(dir, flattenMetaDir, "vol-2.json"))
+
+	// the ConfigMaps take precedence over the dir
+	m = &metadataStores{dir: dir, namespace: "curve", driver: "curve.csi.netease.com", client: fake.NewSimpleClientset()}
+	store := m.store(volumeMetaKind)
+	assert.IsType(t, &util.ConfigMapStore{}, store)
+	keys, err := store.Keys()
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+	"github.com/opencurve/curve-csi/pkg/util"
+	"github.com/opencurve/curve-csi/pkg/util/ctxlog"
+)
+
+// the unit compared and copied by the mirror copy
+const mirrorChunkSize = 4 << 20
+
+// mirrorCopy is the copy of a sync round, from the point-in-time clone of the
+// source to the destination volume, which is at least the size of the source.
+type mirrorCopy struct {
+	// the clone of the round, in the source cluster
+	src *curveservice.CurveVolume
+	// the clone of the last round, whose image the destination holds, in the
+	// source cluster; nil if unknown, then the destination is read to compare
+	base *curveservice.CurveVolume
+	dst  *curveservice.CurveVolume
+	// the size of the source
+	sizeGiB int
+}
+
+// mirrorCopier copies the image of a round, returns the bytes written to the destination.
+type mirrorCopier interface {
+	copy(ctx context.Context, job *mirrorCopy) (int64, error)
+}
+
+// newMirrorCopier returns the copier of the replication, nil if the replication is disabled.
+func newMirrorCopier(enabled bool, copyCommand string) mirrorCopier {
+	switch {
+	case copyCommand != "":
+		return commandCopier{command: copyCommand}
+	case enabled:
+		return nbdCopier{}
+	}
+	return nil
+}
+
+// nbdCopier maps the volumes on the controller and writes the changed chunks to the destination.
+type nbdCopier struct{}
+
+func (nbdCopier) copy(ctx context.Context, job *mirrorCopy) (int64, error) {
+	src, unmapSrc, err := openMapped(ctx, job.src, os.O_RDONLY)
+	if err != nil {
+		return 0, err
+	}
+	defer unmapSrc()
+	// the destination must not be mounted anywhere, and is opened exclusively
+	dst, unmapDst, err := openMapped(ctx, job.dst, os.O_RDWR|syscall.O_EXCL)
+	if err != nil {
+		return 0, err
+	}
+	defer unmapDst()
+	var base io.ReaderAt
+	if job.base != nil {
+		baseDev, unmapBase, err := openMapped(ctx, job.base, os.O_RDONLY)
+		if err != nil {
+			return 0, err
+		}
+		defer unmapBase()
+		base = baseDev
+	}
+
+	written, err := copyChanged(ctx, src, base, dst, int64(job.sizeGiB)<<30)
+	if err != nil {
+		return written, fmt.Errorf("failed to copy %s to %s: %v", job.src.FilePath, job.dst.FilePath, err)
+	}
+	if err = dst.Sync(); err != nil {
+		return written, err
+	}
+	return written, nil
+}
+
+// openMapped maps the volume and opens the device, returns the func closing and unmapping it.
+func openMapped(ctx context.Context, curveVol *curveservice.CurveVolume, flag int) (*os.File, func(), error) {
+	devicePath, err := curveVol.Map(ctx, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to map %s: %w", curveVol.FilePath, err)
+	}
+	unmap := func() {
+		if err := curveVol.UnMap(ctx); err != nil {
+			ctxlog.Warningf(ctx, "failed to unmap %s: %v", curveVol.FilePath, err)
+		}
+	}
+	// #nosec:G304, the device is mapped by the driver
+	dev, err := os.OpenFile(devicePath, flag, 0)
+	if err != nil {
+		unmap()
+		return nil, nil, err
+	}
+	return dev, func() {
+		dev.Close()
+		unmap()
+	}, nil
+}
+
+type readWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// copyChanged writes the chunks of src differing from base to dst, dst is read
+// as the base if base is nil. It returns the bytes written.
+func copyChanged(ctx context.Context, src, base io.ReaderAt, dst readWriterAt, size int64) (int64, error) {
+	if base == nil {
+		base = dst
+	}
+	srcBuf := make([]byte, mirrorChunkSize)
+	baseBuf := make([]byte, mirrorChunkSize)
+	var written int64
+	for off := int64(0); off < size; off += mirrorChunkSize {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		n := int64(mirrorChunkSize)
+		if size-off < n {
+			n = size - off
+		}
+		if _, err := src.ReadAt(srcBuf[:n], off); err != nil {
+			return written, err
+		}
+		if _, err := base.ReadAt(baseBuf[:n], off); err != nil {
+			return written, err
+		}
+		if bytes.Equal(srcBuf[:n], baseBuf[:n]) {
+			continue
+		}
+		if _, err := dst.WriteAt(srcBuf[:n], off); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// commandCopier runs the external copy command, see docs/replication.md.
+type commandCopier struct {
+	command string
+}
+
+func (c commandCopier) copy(ctx context.Context, job *mirrorCopy) (int64, error) {
+	args := []string{
+		"--src-conf", job.src.ConfPath,
+		"--src-mds", strings.Join(job.src.MdsAddrs, ","),
+		"--src-path", job.src.FilePath,
+		"--dst-conf", job.dst.ConfPath,
+		"--dst-mds", strings.Join(job.dst.MdsAddrs, ","),
+		"--dst-path", job.dst.FilePath,
+		"--user", job.src.User,
+		"--size-gib", strconv.Itoa(job.sizeGiB),
+	}
+	if job.base != nil {
+		args = append(args, "--base-path", job.base.FilePath)
+	}
+	ctxlog.V(4).Infof(ctx, "starting to copy: %s %v", c.command, args)
+	// the password is passed in the environment, never in the args
+	output, err := util.ExecCommandWithEnv(c.command, args, mirrorCopyEnv(job.src.Password))
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy %s to %s, err: %v, output: %s", job.src.FilePath, job.dst.FilePath, err, output)
+	}
+	// the written bytes are unknown
+	return -1, nil
+}
+
+// mirrorCopyEnv returns the environment of the copy command with the password of the user.
+func mirrorCopyEnv(password string) []string {
+	if password == "" {
+		return nil
+	}
+	return []string{"CURVE_PASSWORD=" + password}
+}
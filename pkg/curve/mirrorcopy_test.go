@@ -0,0 +1,97 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMirrorCopier(t *testing.T) {
+	assert.Nil(t, newMirrorCopier(false, ""))
+	assert.Equal(t, nbdCopier{}, newMirrorCopier(true, ""))
+	assert.Equal(t, commandCopier{command: "/usr/bin/curve-copy"}, newMirrorCopier(false, "/usr/bin/curve-copy"))
+	assert.Nil(t, mirrorCopyEnv(""))
+	assert.Equal(t, []string{"CURVE_PASSWORD=secret"}, mirrorCopyEnv("secret"))
+}
+
+// chunks returns the image of the chunks filled with the bytes, the last chunk is half.
+func chunks(fills ...byte) []byte {
+	var image []byte
+	for i, b := range fills {
+		n := mirrorChunkSize
+		if i == len(fills)-1 {
+			n /= 2
+		}
+		image = append(image, bytes.Repeat([]byte{b}, n)...)
+	}
+	return image
+}
+
+func writeImage(t *testing.T, name string, image []byte) *os.File {
+	path := filepath.Join(t.TempDir(), name)
+	assert.NoError(t, os.WriteFile(path, image, 0o600))
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	assert.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestCopyChanged(t *testing.T) {
+	ctx := context.TODO()
+	src := writeImage(t, "src", chunks(1, 2, 3, 4))
+	size := int64(len(chunks(1, 2, 3, 4)))
+
+	// against the base, the chunks changed since it are written only
+	base := writeImage(t, "base", chunks(1, 0, 3, 0))
+	dst := writeImage(t, "dst", chunks(1, 0, 3, 0))
+	written, err := copyChanged(ctx, src, base, dst, size)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(mirrorChunkSize+mirrorChunkSize/2), written)
+	data, err := os.ReadFile(dst.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, chunks(1, 2, 3, 4), data)
+
+	// without the base, the destination is compared
+	dst = writeImage(t, "dst2", chunks(1, 9, 9, 4))
+	written, err = copyChanged(ctx, src, nil, dst, size)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2*mirrorChunkSize), written)
+	data, err = os.ReadFile(dst.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, chunks(1, 2, 3, 4), data)
+
+	// in sync
+	written, err = copyChanged(ctx, src, nil, dst, size)
+	assert.NoError(t, err)
+	assert.Zero(t, written)
+
+	// the destination is shorter than the source
+	dst = writeImage(t, "dst3", chunks(1, 2))
+	_, err = copyChanged(ctx, src, nil, dst, size)
+	assert.Error(t, err)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = copyChanged(cancelled, src, base, dst, size)
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,408 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/mount"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+	"github.com/opencurve/curve-csi/pkg/util"
+	"github.com/opencurve/curve-csi/pkg/util/ctxlog"
+)
+
+const (
+	// the actions of the node reconciler
+	reconcileRemount       = "remount"
+	reconcileUnmap         = "unmap"
+	reconcileRemoveStaging = "remove-staging"
+
+	// kubelet stages the CSI volumes at <kubelet dir>/plugins/kubernetes.io/csi/<driver or pv>/<hash or pv name>/globalmount,
+	// and the Block volumes at <kubelet dir>/plugins/kubernetes.io/csi/volumeDevices/staging/<pv name>,
+	// and the driver mounts them at <staging path>/<volume ID>
+	kubeletStagingGlob      = "plugins/kubernetes.io/csi/*/*/globalmount/*"
+	kubeletBlockStagingGlob = "plugins/kubernetes.io/csi/volumeDevices/staging/*/*"
+)
+
+// stagingEntry is a volume staged by the driver, <staging path>/<volume ID>.
+type stagingEntry struct {
+	volumeId string
+	path     string
+	isBlock  bool
+	// the staging metadata, nil if staged by the old driver
+	meta    *stageMeta
+	metaErr error
+}
+
+// reconcileAction is a repair of the node reconciler.
+type reconcileAction struct {
+	Action   string `json:"action"`
+	VolumeID string `json:"volumeID,omitempty"`
+	// the staging path of the volume
+	Path string `json:"path,omitempty"`
+	// the dead device to remount, or the device to unmap
+	Device string `json:"device,omitempty"`
+	// the curve file, its user and cluster of the device to unmap
+	FilePath string `json:"filePath,omitempty"`
+	User     string `json:"user,omitempty"`
+	ConfPath string `json:"confPath,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	// the stale mount to remount
+	fsType   string
+	readOnly bool
+	isBlock  bool
+	meta     *stageMeta
+}
+
+// mountDevice returns the nbd device of the mount, empty if not an nbd device.
+// A block volume is the device file bind mounted from the devtmpfs.
+func mountDevice(mi mount.MountInfo) string {
+	if strings.HasPrefix(mi.Source, "/dev/nbd") {
+		return mi.Source
+	}
+	if mi.FsType == "devtmpfs" && strings.HasPrefix(mi.Root, "/nbd") {
+		return "/dev" + mi.Root
+	}
+	return ""
+}
+
+// planReconcile cross checks the staged volumes, the mapped devices and the mounts.
+// A device to unmap must be found not mounted by the last plan too, which is suspects,
+// it returns the suspects of this plan.
+func planReconcile(
+	entries []stagingEntry,
+	mappings []curveservice.NbdMapping,
+	mounts []mount.MountInfo,
+	suspects map[string]bool) ([]reconcileAction, map[string]bool) {
+	mountsByPath := make(map[string]mount.MountInfo, len(mounts))
+	referenced := map[string]bool{}
+	for _, mi := range mounts {
+		mountsByPath[mi.MountPoint] = mi
+		if dev := mountDevice(mi); dev != "" {
+			referenced[dev] = true
+		}
+	}
+	mapped := make(map[string]curveservice.NbdMapping, len(mappings))
+	for _, m := range mappings {
+		mapped[m.Device] = m
+	}
+
+	var actions []reconcileAction
+	// the files remapped by the remounts are kept
+	remapping := map[string]bool{}
+	for _, entry := range entries {
+		mi, ok := mountsByPath[entry.path]
+		if !ok {
+			actions = append(actions, reconcileAction{Action: reconcileRemoveStaging, VolumeID: entry.volumeId, Path: entry.path})
+			continue
+		}
+		// the cluster is known only by the metadata
+		var filePath, confPath string
+		if entry.meta != nil {
+			filePath, confPath = entry.meta.FilePath, entry.meta.ConfPath
+		} else {
+			volOptions, err := newVolumeOptionsFromVolID(entry.volumeId)
+			if err != nil {
+				continue
+			}
+			filePath = volOptions.genVolumePath()
+		}
+		dev := mountDevice(mi)
+		if m, ok := mapped[dev]; ok && m.FilePath == filePath && (entry.meta == nil || m.ConfPath == confPath) {
+			continue
+		}
+		// the device died, or is reused by another file
+		remapping[confPath+":"+filePath] = true
+		actions = append(actions, reconcileAction{
+			Action:   reconcileRemount,
+			VolumeID: entry.volumeId,
+			Path:     entry.path,
+			Device:   dev,
+			fsType:   mi.FsType,
+			readOnly: mountOptionContains(mi.MountOptions, "ro"),
+			isBlock:  entry.isBlock,
+			meta:     entry.meta,
+		})
+	}
+
+	next := map[string]bool{}
+	for _, m := range mappings {
+		if referenced[m.Device] || remapping[m.ConfPath+":"+m.FilePath] {
+			continue
+		}
+		key := m.Device + " " + m.FilePath
+		if !suspects[key] {
+			next[key] = true
+			continue
+		}
+		actions = append(actions, reconcileAction{
+			Action: reconcileUnmap, Device: m.Device, FilePath: m.FilePath, User: m.User, ConfPath: m.ConfPath,
+		})
+	}
+	return actions, next
+}
+
+// listStagingEntries returns the volumes staged by the driver under the kubelet dir.
+func listStagingEntries(kubeletDir string) ([]stagingEntry, error) {
+	var paths []string
+	for _, glob := range []string{kubeletStagingGlob, kubeletBlockStagingGlob} {
+		matches, err := filepath.Glob(filepath.Join(kubeletDir, glob))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	entries := make([]stagingEntry, 0, len(paths))
+	for _, path := range paths {
+		volumeId := filepath.Base(path)
+		if isStageMetaFile(volumeId) {
+			continue
+		}
+		if !isStagedVolumeId(filepath.Dir(path), volumeId) {
+			continue
+		}
+		info, err := os.Lstat(path)
+		if err != nil {
+			continue
+		}
+		entry := stagingEntry{volumeId: volumeId, path: path, isBlock: !info.IsDir()}
+		entry.meta, entry.metaErr = getStageMeta(filepath.Dir(path), volumeId)
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// deviceBusy returns true if the device is mounted or opened exclusively, e.g. by export.
+func deviceBusy(device string) bool {
+	// #nosec:G304, the device is mapped by the driver
+	f, err := os.OpenFile(device, os.O_RDONLY|syscall.O_EXCL, 0)
+	if err != nil {
+		return errors.Is(err, syscall.EBUSY)
+	}
+	f.Close()
+	return false
+}
+
+// remount maps the volume again and mounts it at the staging path instead of the dead device,
+// with the credentials of the secrets, or of --credentials-dir if nil. The caller holds the
+// volume lock.
+func (ns *nodeServer) remount(ctx context.Context, action *reconcileAction, secrets map[string]string) error {
+	ctxlog.Warningf(ctx, "the device %q of volume %s staged at %s is dead, remapping it", action.Device, action.VolumeID, action.Path)
+	meta := action.meta
+	var curveVol *curveservice.CurveVolume
+	if meta != nil {
+		// the file mapped and the client conf of its cluster are recorded when staged
+		curveVol = meta.curveVolume()
+	} else {
+		// staged by the old driver
+		volOptions, err := newVolumeOptionsFromVolID(action.VolumeID)
+		if err != nil {
+			return err
+		}
+		if err = volOptions.resolveCluster(ns.clusters); err != nil {
+			return err
+		}
+		curveVol = volOptions.curveVolume()
+	}
+	if secrets == nil {
+		secrets = backgroundSecrets(ctx, ns.credentialsDir, curveVol.User)
+	}
+	if creds := util.NewCredentials(secrets); creds != nil {
+		if creds.User != "" && creds.User != curveVol.User {
+			return fmt.Errorf("the user %q of secrets does not match the user %q of volume", creds.User, curveVol.User)
+		}
+		curveVol.Password = creds.Password
+	}
+
+	if err := ns.mounter.Unmount(action.Path); err != nil {
+		return fmt.Errorf("failed to unmount %s: %v", action.Path, err)
+	}
+	devicePath, err := curveVol.Map(ctx, meta != nil && meta.DisableInUseChecks)
+	if err != nil {
+		return err
+	}
+
+	// never format it, mount it as staged if recorded
+	var opt []string
+	var fsType string
+	if meta != nil {
+		opt, fsType = meta.MountOptions, meta.FsType
+	} else {
+		opt, fsType = []string{"_netdev"}, action.fsType
+		if action.isBlock {
+			opt, fsType = append(opt, "bind"), ""
+		} else if fsType == "xfs" {
+			opt = append(opt, "nouuid")
+		}
+		if action.readOnly {
+			opt = append(opt, "ro")
+		}
+	}
+	if err = ns.mounter.Mount(devicePath, action.Path, fsType, opt); err != nil {
+		return fmt.Errorf("failed to mount %s to %s: %v", devicePath, action.Path, err)
+	}
+	if meta != nil {
+		meta.Device, meta.NbdUnit, meta.MapMode = devicePath, curveVol.NbdUnit(), curveservice.MapMode()
+		if err = putStageMeta(filepath.Dir(action.Path), meta); err != nil {
+			return fmt.Errorf("failed to save the staging metadata: %v", err)
+		}
+	}
+	ctxlog.Warningf(ctx, "volume %s is remounted at %s from %s, the pods using it must be restarted", action.VolumeID, action.Path, devicePath)
+	return nil
+}
+
+// checkStagedDevice remounts the volume staged at stagingTargetPath with the node stage
+// secrets if its device died, the caller holds the volume lock.
+func (ns *nodeServer) checkStagedDevice(ctx context.Context, volumeId, stagingTargetPath string, secrets map[string]string) error {
+	mappings, err := curveservice.ListMapped(ctx)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	mounts, err := mount.ParseMountInfo("/proc/self/mountinfo")
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	info, err := os.Lstat(stagingTargetPath)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	entry := stagingEntry{volumeId: volumeId, path: stagingTargetPath, isBlock: !info.IsDir()}
+	if entry.meta, err = getStageMeta(filepath.Dir(stagingTargetPath), volumeId); err != nil {
+		ctxlog.Warningf(ctx, "failed to read the staging metadata of volume %s, err: %v", volumeId, err)
+	}
+	actions, _ := planReconcile([]stagingEntry{entry}, mappings, mounts, nil)
+	for i := range actions {
+		if actions[i].Action != reconcileRemount {
+			continue
+		}
+		if err = ns.remount(ctx, &actions[i], secrets); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+	return nil
+}
+
+// reconcileReport is the result of a run of the node reconciler.
+type reconcileReport struct {
+	StartedAt time.Time         `json:"startedAt"`
+	Actions   []reconcileAction `json:"actions"`
+}
+
+// nodeReconciler repairs the staged volumes of the node at the start of the plugin and
+// periodically, e.g. after the node rebooted or curve-nbd crashed:
+// - remaps and remounts the staged volumes whose devices died,
+// - unmaps the devices not mounted anywhere,
+// - removes the staging paths not mounted.
+type nodeReconciler struct {
+	*worker
+	ns         *nodeServer
+	kubeletDir string
+	// the devices found not mounted by the last run
+	suspects map[string]bool
+}
+
+// newNodeReconciler returns nil if the interval is not set.
+func newNodeReconciler(ns *nodeServer, kubeletDir string, interval time.Duration) *nodeReconciler {
+	if interval <= 0 {
+		return nil
+	}
+	r := &nodeReconciler{ns: ns, kubeletDir: kubeletDir}
+	r.worker = newWorker("node-reconcile", interval, func(ctx context.Context) interface{} {
+		return r.reconcile(ctx)
+	})
+	return r
+}
+
+func (r *nodeReconciler) reconcile(ctx context.Context) *reconcileReport {
+	report := &reconcileReport{StartedAt: time.Now(), Actions: []reconcileAction{}}
+	entries, err := listStagingEntries(r.kubeletDir)
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to list the staging paths: %v", err)
+		return report
+	}
+	mappings, err := curveservice.ListMapped(ctx)
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to list the mapped devices: %v", err)
+		return report
+	}
+	mounts, err := mount.ParseMountInfo("/proc/self/mountinfo")
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to list the mounts: %v", err)
+		return report
+	}
+
+	var actions []reconcileAction
+	actions, r.suspects = planReconcile(entries, mappings, mounts, r.suspects)
+	for i := range actions {
+		action := &actions[i]
+		if err = r.apply(ctx, action); err != nil {
+			ctxlog.Warningf(ctx, "failed to %s %s%s: %v", action.Action, action.VolumeID, action.Device, err)
+			action.Error = err.Error()
+		}
+		report.Actions = append(report.Actions, *action)
+	}
+	ctxlog.Infof(ctx, "node reconciler done, %d staged volumes, %d mapped devices, %d actions",
+		len(entries), len(mappings), len(report.Actions))
+	return report
+}
+
+func (r *nodeReconciler) apply(ctx context.Context, action *reconcileAction) error {
+	switch action.Action {
+	case reconcileUnmap:
+		if deviceBusy(action.Device) {
+			ctxlog.Infof(ctx, "device %s of %s is in use, skip unmapping it", action.Device, action.FilePath)
+			return nil
+		}
+		ctxlog.Warningf(ctx, "unmapping device %s of %s, which is not staged", action.Device, action.FilePath)
+		curveVol := &curveservice.CurveVolume{FilePath: action.FilePath, User: action.User, ConfPath: action.ConfPath}
+		return curveVol.UnMap(ctx)
+	}
+
+	// the volume in operation is checked by the next run
+	if acquired := r.ns.volumeLocks.TryAcquire(action.VolumeID); !acquired {
+		ctxlog.Infof(ctx, util.VolumeOperationAlreadyExistsFmt, action.VolumeID)
+		return nil
+	}
+	defer r.ns.volumeLocks.Release(action.VolumeID)
+	switch action.Action {
+	case reconcileRemoveStaging:
+		// staged after listed
+		if notMnt, err := mount.IsNotMountPoint(r.ns.mounter, action.Path); err != nil || !notMnt {
+			return err
+		}
+		ctxlog.Warningf(ctx, "removing the staging path %s of volume %s, which is not mounted", action.Path, action.VolumeID)
+		if err := os.Remove(action.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		// the device left is unmapped as not mounted
+		return deleteStageMeta(filepath.Dir(action.Path), action.VolumeID)
+	case reconcileRemount:
+		return r.ns.remount(ctx, action, nil)
+	}
+	return nil
+}
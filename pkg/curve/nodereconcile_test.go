@@ -0,0 +1,123 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/utils/mount"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+)
+
+func TestMountDevice(t *testing.T) {
+	assert.Equal(t, "/dev/nbd0", mountDevice(mount.MountInfo{Source: "/dev/nbd0", FsType: "ext4", Root: "/"}))
+	// a block volume
+	assert.Equal(t, "/dev/nbd1", mountDevice(mount.MountInfo{Source: "udev", FsType: "devtmpfs", Root: "/nbd1"}))
+	assert.Empty(t, mountDevice(mount.MountInfo{Source: "udev", FsType: "devtmpfs", Root: "/"}))
+	assert.Empty(t, mountDevice(mount.MountInfo{Source: "/dev/sda1", FsType: "ext4", Root: "/"}))
+}
+
+func TestPlanReconcile(t *testing.T) {
+	volIds := make([]string, 4)
+	for i := range volIds {
+		var err error
+		volIds[i], err = composeCSIID(&csiIdentifier{scheme: namingSchemeCSI, user: "k8s", volName: csiVolNamingPrefix + "pvc-" + string(rune('0'+i))})
+		assert.NoError(t, err)
+	}
+	staging := "/var/lib/kubelet/plugins/kubernetes.io/csi/curve.csi.netease.com/abc/globalmount/"
+	entries := []stagingEntry{
+		// healthy
+		{volumeId: volIds[0], path: staging + volIds[0]},
+		// the device died
+		{volumeId: volIds[1], path: staging + volIds[1]},
+		// a block volume whose device is reused by another file
+		{volumeId: volIds[2], path: staging + volIds[2], isBlock: true},
+		// not mounted
+		{volumeId: volIds[3], path: staging + volIds[3]},
+	}
+	mounts := []mount.MountInfo{
+		{MountPoint: staging + volIds[0], Source: "/dev/nbd0", FsType: "ext4", Root: "/", MountOptions: []string{"rw"}},
+		{MountPoint: staging + volIds[1], Source: "/dev/nbd1", FsType: "xfs", Root: "/", MountOptions: []string{"ro", "relatime"}},
+		{MountPoint: staging + volIds[2], Source: "udev", FsType: "devtmpfs", Root: "/nbd2", MountOptions: []string{"rw"}},
+		// an ephemeral volume mounted at the pod
+		{MountPoint: "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/scratch/mount", Source: "/dev/nbd5", FsType: "ext4", Root: "/"},
+	}
+	mappings := []curveservice.NbdMapping{
+		{Device: "/dev/nbd0", FilePath: "/k8s/csi-vol-pvc-0", User: "k8s"},
+		{Device: "/dev/nbd2", FilePath: "/k8s/csi-vol-other", User: "k8s"},
+		// remapped by a previous remount of pvc-1
+		{Device: "/dev/nbd3", FilePath: "/k8s/csi-vol-pvc-1", User: "k8s"},
+		// not mounted
+		{Device: "/dev/nbd4", FilePath: "/k8s/csi-vol-pvc-3", User: "k8s"},
+		{Device: "/dev/nbd5", FilePath: "/k8s/csi-eph-node-1_csi-1", User: "k8s"},
+	}
+
+	actions, suspects := planReconcile(entries, mappings, mounts, nil)
+	assert.Equal(t, []reconcileAction{
+		{Action: reconcileRemount, VolumeID: volIds[1], Path: staging + volIds[1], Device: "/dev/nbd1", fsType: "xfs", readOnly: true},
+		{Action: reconcileRemount, VolumeID: volIds[2], Path: staging + volIds[2], Device: "/dev/nbd2", fsType: "devtmpfs", isBlock: true},
+		{Action: reconcileRemoveStaging, VolumeID: volIds[3], Path: staging + volIds[3]},
+	}, actions)
+	// the device not mounted is unmapped on the next run
+	assert.Equal(t, map[string]bool{"/dev/nbd4 /k8s/csi-vol-pvc-3": true}, suspects)
+	actions, suspects = planReconcile(entries, mappings, mounts, suspects)
+	assert.Len(t, actions, 4)
+	assert.Equal(t, reconcileAction{Action: reconcileUnmap, Device: "/dev/nbd4", FilePath: "/k8s/csi-vol-pvc-3", User: "k8s"}, actions[3])
+	assert.Empty(t, suspects)
+}
+
+func TestListStagingEntries(t *testing.T) {
+	kubeletDir := t.TempDir()
+	volId, err := composeCSIID(&csiIdentifier{scheme: namingSchemeCSI, user: "k8s", volName: "csi-vol-pvc-1"})
+	assert.NoError(t, err)
+	fsDir := filepath.Join(kubeletDir, "plugins/kubernetes.io/csi/curve.csi.netease.com/abc/globalmount")
+	blockDir := filepath.Join(kubeletDir, "plugins/kubernetes.io/csi/pv/pvc-2/globalmount")
+	// the staging path of the Block volumes
+	deviceDir := filepath.Join(kubeletDir, "plugins/kubernetes.io/csi/volumeDevices/staging/pvc-3")
+	assert.NoError(t, os.MkdirAll(filepath.Join(fsDir, volId), 0o750))
+	assert.NoError(t, os.MkdirAll(filepath.Join(fsDir, "lost+found"), 0o750))
+	assert.NoError(t, os.MkdirAll(blockDir, 0o750))
+	assert.NoError(t, os.WriteFile(filepath.Join(blockDir, volId), nil, 0o600))
+	assert.NoError(t, os.MkdirAll(deviceDir, 0o750))
+	assert.NoError(t, os.WriteFile(filepath.Join(deviceDir, volId), nil, 0o600))
+
+	entries, err := listStagingEntries(kubeletDir)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []stagingEntry{
+		{volumeId: volId, path: filepath.Join(fsDir, volId)},
+		{volumeId: volId, path: filepath.Join(blockDir, volId), isBlock: true},
+		{volumeId: volId, path: filepath.Join(deviceDir, volId), isBlock: true},
+	}, entries)
+}
+
+func TestRemountChecksSecrets(t *testing.T) {
+	ctx := context.TODO()
+	ns := &nodeServer{}
+	// a static volume handle, the file is known only by the metadata
+	action := &reconcileAction{Action: reconcileRemount, VolumeID: "static-vol", Path: "/staging/static-vol",
+		meta: &stageMeta{VolumeID: "static-vol", User: "k8s", FilePath: "/k8s/static-vol"}}
+	assert.ErrorContains(t, ns.remount(ctx, action, map[string]string{"user": "other", "password": "pass"}), "does not match")
+
+	// no metadata, the volume ID must be decoded
+	action.meta = nil
+	assert.Error(t, ns.remount(ctx, action, map[string]string{"user": "k8s", "password": "pass"}))
+}
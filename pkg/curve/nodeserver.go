@@ -20,6 +20,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
@@ -39,6 +40,17 @@ type nodeServer struct {
 
 	mounter     mount.Interface
 	volumeLocks *util.VolumeLocks
+	clusters    *clusterResolver
+	// the staging paths are under <kubelet dir>/plugins/kubernetes.io/csi
+	kubeletDir string
+	// the credentials of the users for the work without the CSI secrets, see --credentials-dir
+	credentialsDir string
+	// trims the staged filesystems periodically, nil if disabled
+	reclaimer *spaceReclaimer
+	// repairs the staged volumes periodically, nil if disabled
+	reconciler *nodeReconciler
+	// the CSI ephemeral inline volumes, nil if disabled
+	ephemerals *ephemeralVolumes
 }
 
 func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
@@ -60,15 +72,23 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 	if !isNotMnt {
+		// the device may die, e.g. curve-nbd crashed
+		if err = ns.checkStagedDevice(ctx, volumeId, stagingTargetPath, req.GetSecrets()); err != nil {
+			return nil, err
+		}
 		ctxlog.Infof(ctx, "volume %s is already mounted to %s, skipping", volumeId, stagingTargetPath)
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
 	// attach
-	devicePath, err := ns.attachDevice(ctx, req)
+	meta, err := ns.attachDevice(ctx, req)
 	if err != nil {
 		return nil, err
 	}
+	// record the device at once, so that it is unmapped even if failed to mount
+	if err = putStageMeta(req.GetStagingTargetPath(), meta); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to save the staging metadata, err: %v", err)
+	}
 
 	// create targetPath
 	isBlock := req.GetVolumeCapability().GetBlock() != nil
@@ -78,11 +98,13 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	}
 
 	// nodeStage Path
-	readOnly, err := ns.mountVolumeToStagePath(ctx, req, stagingTargetPath, devicePath)
-	if err != nil {
+	if err = ns.mountVolumeToStagePath(ctx, req, stagingTargetPath, meta); err != nil {
 		return nil, err
 	}
-	if !readOnly {
+	if err = putStageMeta(req.GetStagingTargetPath(), meta); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to save the staging metadata, err: %v", err)
+	}
+	if !meta.ReadOnly {
 		// #nosec - allow anyone to write inside the target path
 		if err = os.Chmod(stagingTargetPath, 0o777); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
@@ -93,7 +115,8 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
-func (ns *nodeServer) attachDevice(ctx context.Context, req *csi.NodeStageVolumeRequest) (string, error) {
+// attachDevice maps the volume, and returns the staging metadata of the mapped device.
+func (ns *nodeServer) attachDevice(ctx context.Context, req *csi.NodeStageVolumeRequest) (*stageMeta, error) {
 	isBlock := req.GetVolumeCapability().GetBlock() != nil
 	disableInUseCheck := false
 	// MULTI_NODE_MULTI_WRITER is supported by default for Block access type volumes
@@ -102,23 +125,53 @@ func (ns *nodeServer) attachDevice(ctx context.Context, req *csi.NodeStageVolume
 			disableInUseCheck = true
 		} else {
 			ctxlog.Warningf(ctx, "MULTI_NODE_MULTI_WRITER currently only supported with volumes of access type `block`, invalid AccessMode for volume: %v", req.GetVolumeId())
-			return "", status.Error(codes.InvalidArgument, "RWX access mode request is only valid for volumes with access type `block`")
+			return nil, status.Error(codes.InvalidArgument, "RWX access mode request is only valid for volumes with access type `block`")
 		}
 	}
 
-	volOptions, err := newVolumeOptionsFromVolID(req.GetVolumeId())
+	volOptions, err := newNodeVolumeOptions(req.GetVolumeId(), req.GetVolumeContext())
 	if err != nil {
-		return "", status.Error(codes.Internal, err.Error())
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err = volOptions.resolveCluster(ns.clusters); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err = volOptions.applyCredentials(req.GetSecrets()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 	ctxlog.V(5).Infof(ctx, "get volume options: %+v", volOptions)
 
-	curveVol := curveservice.NewCurveVolume(volOptions.user, volOptions.volName, volOptions.sizeGiB)
+	curveVol := volOptions.curveVolume()
 	devicePath, err := curveVol.Map(ctx, disableInUseCheck)
 	if err != nil {
-		return "", status.Error(codes.Internal, err.Error())
+		// a single-writer volume held by another host, or the node is fenced
+		switch err.(type) {
+		case *curveservice.InUseError, *curveservice.FencedError:
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		// the holders are unknown, retried by kubelet
+		if _, ok := err.(*curveservice.InUseCheckError); ok {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 	ctxlog.Infof(ctx, "curve file %s successfully mapped at %s", curveVol.FilePath, devicePath)
-	return devicePath, nil
+
+	now := time.Now()
+	return &stageMeta{
+		VolumeID:           req.GetVolumeId(),
+		ClusterID:          volOptions.clusterID,
+		User:               curveVol.User,
+		FilePath:           curveVol.FilePath,
+		ConfPath:           curveVol.ConfPath,
+		Device:             devicePath,
+		MapMode:            curveservice.MapMode(),
+		NbdUnit:            curveVol.NbdUnit(),
+		DisableInUseChecks: disableInUseCheck,
+		Block:              isBlock,
+		CloneSource:        req.GetVolumeContext()["volSource"],
+		StagedAt:           now,
+	}, nil
 }
 
 func (ns *nodeServer) createStageMountPoint(ctx context.Context, mountPath string, isBlock bool) error {
@@ -147,7 +200,9 @@ func (ns *nodeServer) createStageMountPoint(ctx context.Context, mountPath strin
 	return nil
 }
 
-func (ns *nodeServer) mountVolumeToStagePath(ctx context.Context, req *csi.NodeStageVolumeRequest, stagingPath, devicePath string) (bool, error) {
+// mountVolumeToStagePath mounts the device of meta, and records the mount in meta.
+func (ns *nodeServer) mountVolumeToStagePath(ctx context.Context, req *csi.NodeStageVolumeRequest, stagingPath string, meta *stageMeta) error {
+	devicePath := meta.Device
 	readOnly := false
 	fsType := req.GetVolumeCapability().GetMount().GetFsType()
 	diskMounter := &mount.SafeFormatAndMount{Interface: ns.mounter, Exec: utilexec.New()}
@@ -183,10 +238,13 @@ func (ns *nodeServer) mountVolumeToStagePath(ctx context.Context, req *csi.NodeS
 	}
 	if err != nil {
 		ctxlog.ErrorS(ctx, err, "failed to mount device to staging path", "devicePath", devicePath, "stagingPath", stagingPath, "volumeId", req.GetVolumeId())
-		return readOnly, status.Error(codes.Internal, err.Error())
+		return status.Error(codes.Internal, err.Error())
 	}
 
-	return readOnly, nil
+	meta.FsType = fsType
+	meta.MountOptions = opt
+	meta.ReadOnly = readOnly
+	return nil
 }
 
 // NodePublishVolume mounts the volume mounted to the device path to the target path
@@ -207,6 +265,13 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	}
 	defer ns.volumeLocks.Release(volumeId)
 
+	if isEphemeral(req.GetVolumeContext()) {
+		if err := ns.ephemerals.publish(ctx, req); err != nil {
+			return nil, err
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
 	// Check if that target path exists properly
 	notMnt, err := ns.createTargetMountPath(ctx, targetPath, isBlock)
 	if err != nil {
@@ -280,32 +345,39 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	}
 	defer ns.volumeLocks.Release(volumeId)
 
+	if err := ns.unmountTargetPath(ctx, targetPath); err != nil {
+		return nil, err
+	}
+	ctxlog.Infof(ctx, "successfully unbound volume %s from %s", volumeId, targetPath)
+
+	// the ephemeral volume is deleted with its pod
+	if err := ns.ephemerals.remove(ctx, volumeId); err != nil {
+		return nil, err
+	}
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// unmountTargetPath unmounts and removes the target path, it is not an error if not exists.
+func (ns *nodeServer) unmountTargetPath(ctx context.Context, targetPath string) error {
 	notMnt, err := mount.IsNotMountPoint(ns.mounter, targetPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// targetPath has already been deleted
 			ctxlog.V(4).Infof(ctx, "targetPath: %s has already been deleted", targetPath)
-			return &csi.NodeUnpublishVolumeResponse{}, nil
+			return nil
 		}
-		return nil, status.Error(codes.NotFound, err.Error())
+		return status.Error(codes.NotFound, err.Error())
 	}
-	if notMnt {
-		if err = os.RemoveAll(targetPath); err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+	if !notMnt {
+		if err = ns.mounter.Unmount(targetPath); err != nil {
+			return status.Error(codes.Internal, err.Error())
 		}
-		return &csi.NodeUnpublishVolumeResponse{}, nil
-	}
-
-	if err = ns.mounter.Unmount(targetPath); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
 	}
 
 	if err = os.RemoveAll(targetPath); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return status.Error(codes.Internal, err.Error())
 	}
-
-	ctxlog.Infof(ctx, "successfully unbound volume %s from %s", volumeId, targetPath)
-	return &csi.NodeUnpublishVolumeResponse{}, nil
+	return nil
 }
 
 // NodeUnstageVolume unstages the volume from the staging path
@@ -323,6 +395,12 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	}
 	defer ns.volumeLocks.Release(volumeId)
 
+	meta, err := getStageMeta(req.GetStagingTargetPath(), volumeId)
+	if err != nil {
+		// fall back to the volume ID
+		ctxlog.Warningf(ctx, "failed to read the staging metadata of volume %s, err: %v", volumeId, err)
+	}
+
 	notMnt, err := mount.IsNotMountPoint(ns.mounter, stagingTargetPath)
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -348,16 +426,29 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 		}
 	}
 
-	// unmap
-	volOptions, err := newVolumeOptionsFromVolID(volumeId)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	// unmap the file recorded at stage time, the volume staged by the old driver has no metadata
+	var curveVol *curveservice.CurveVolume
+	if meta != nil {
+		ctxlog.V(5).Infof(ctx, "get staging metadata: %+v", meta)
+		curveVol = meta.curveVolume()
+	} else {
+		volOptions, err := newVolumeOptionsFromVolID(volumeId)
+		if err != nil {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		if err = volOptions.resolveCluster(ns.clusters); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		ctxlog.V(5).Infof(ctx, "get volume options: %+v", volOptions)
+		curveVol = volOptions.curveVolume()
 	}
-	ctxlog.V(5).Infof(ctx, "get volume options: %+v", volOptions)
-	curveVol := curveservice.NewCurveVolume(volOptions.user, volOptions.volName, volOptions.sizeGiB)
 	if err := curveVol.UnMap(ctx); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	// kubelet removes the staging path, which must be empty
+	if err = deleteStageMeta(req.GetStagingTargetPath(), volumeId); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 
 	ctxlog.Infof(ctx, "successfully unmounted volume %s from stagingPath %s", volumeId, stagingTargetPath)
 	return &csi.NodeUnstageVolumeResponse{}, nil
@@ -394,7 +485,11 @@ func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 		return nil, status.Errorf(codes.Internal, "can not stat path %v", volumePath)
 	}
 
-	if req.GetVolumeCapability().GetBlock() != nil {
+	meta, err := getStageMeta(volumePath, volumeId)
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to read the staging metadata of volume %s, err: %v", volumeId, err)
+	}
+	if req.GetVolumeCapability().GetBlock() != nil || (meta != nil && meta.Block) {
 		return &csi.NodeExpandVolumeResponse{}, nil
 	}
 
@@ -404,6 +499,9 @@ func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "can not get device from mount, err: %v", err)
 	}
+	if devicePath != "" && meta != nil && devicePath != meta.Device {
+		ctxlog.Warningf(ctx, "volume %s is mounted from %s, but staged at %s", volumeId, devicePath, meta.Device)
+	}
 	if devicePath == "" {
 		ctxlog.V(4).Infof(ctx, "the path %s is not mounted, ignore resizing", volumePath)
 		return &csi.NodeExpandVolumeResponse{}, nil
@@ -441,6 +539,7 @@ func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 	}
 
 	ctxlog.V(5).Infof(ctx, "get volumePath %q stats: %+v", volumePath, stats)
+	condition := ns.volumeCondition(ctx, req.GetVolumeId(), req.GetStagingTargetPath())
 
 	if stats.Block {
 		return &csi.NodeGetVolumeStatsResponse{
@@ -450,6 +549,7 @@ func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 					Unit:  csi.VolumeUsage_BYTES,
 				},
 			},
+			VolumeCondition: condition,
 		}, nil
 	}
 
@@ -467,9 +567,33 @@ func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 				Unit:      csi.VolumeUsage_INODES,
 			},
 		},
+		VolumeCondition: condition,
 	}, nil
 }
 
+// volumeCondition checks the device recorded in the staging metadata is still served by curve-nbd,
+// returns nil if the volume has no metadata.
+func (ns *nodeServer) volumeCondition(ctx context.Context, volumeId, stagingPath string) *csi.VolumeCondition {
+	if stagingPath == "" {
+		return nil
+	}
+	meta, err := getStageMeta(stagingPath, volumeId)
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to read the staging metadata of volume %s, err: %v", volumeId, err)
+		return nil
+	}
+	if meta == nil {
+		return nil
+	}
+	if !nbdConnected(meta.Device) {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("device %s of volume %s is disconnected", meta.Device, volumeId),
+		}
+	}
+	return &csi.VolumeCondition{Message: fmt.Sprintf("device %s is connected", meta.Device)}
+}
+
 // NodeGetCapabilities returns the supported capabilities of the node server
 func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	return &csi.NodeGetCapabilitiesResponse{
@@ -493,6 +617,12 @@ func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetC
 						Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
 					},
 				},
+			}, {
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
 			},
 		},
 	}, nil
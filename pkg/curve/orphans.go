@@ -0,0 +1,465 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+	"github.com/opencurve/curve-csi/pkg/util"
+	"github.com/opencurve/curve-csi/pkg/util/ctxlog"
+)
+
+const (
+	orphanKindVolume    = "volume"
+	orphanKindSnapshot  = "snapshot"
+	orphanKindEphemeral = "ephemeral"
+
+	// the actions on the orphans
+	orphanActionReport = "report"
+	orphanActionDelete = "delete"
+	orphanActionTrash  = "trash"
+
+	// the format of createtime in the output of curve stat
+	curveTimeLayout = "2006-01-02 15:04:05"
+)
+
+// liveObjects is the set of the volumes and snapshots referenced by kubernetes.
+type liveObjects struct {
+	// keyed by volumeKey
+	volumes map[string]bool
+	// keyed by the user and the name of the volumes, of any cluster
+	volumeNames map[string]bool
+	// keyed by snapshotKey
+	snapshots map[string]bool
+	// the nodes, the ephemeral volumes of the other nodes are orphans
+	nodes map[string]bool
+}
+
+func volumeKey(clusterID, user, volName string) string {
+	return clusterID + "/" + user + "/" + volName
+}
+
+func snapshotKey(clusterID, snapCurveUUID string) string {
+	return clusterID + "/" + snapCurveUUID
+}
+
+func newLiveObjects() *liveObjects {
+	return &liveObjects{
+		volumes:     map[string]bool{},
+		volumeNames: map[string]bool{},
+		snapshots:   map[string]bool{},
+		nodes:       map[string]bool{},
+	}
+}
+
+func (l *liveObjects) addVolume(volumeId string) error {
+	ci, err := decomposeCSIID(volumeId)
+	if err != nil {
+		return err
+	}
+	l.volumes[volumeKey(ci.clusterID, ci.user, ci.volName)] = true
+	l.volumeNames[ci.user+"/"+ci.volName] = true
+	return nil
+}
+
+// replicated returns true if the volume is a copy of the replication of a live volume,
+// i.e. the mirror with the same user and name in the peer cluster, or the clone of a
+// sync. The clusters of the mirrors are not known, any cluster is matched.
+func (l *liveObjects) replicated(user, volName string) bool {
+	return l.volumeNames[user+"/"+volName] || l.volumeNames[user+"/"+mirrorSourceName(volName)]
+}
+
+func (l *liveObjects) addSnapshot(snapshotId string) error {
+	snapCurveUUID, volOptions, err := parseSnapshotID(snapshotId)
+	if err != nil {
+		return err
+	}
+	l.snapshots[snapshotKey(volOptions.clusterID, snapCurveUUID)] = true
+	return nil
+}
+
+// liveObjectsFile is the content of a live objects file, which is either the lists
+// of the IDs, or a kubernetes list of PersistentVolumes, VolumeSnapshotContents and
+// Nodes, e.g. the output of "kubectl get pv,volumesnapshotcontent,node -o json".
+type liveObjectsFile struct {
+	VolumeIDs   []string `json:"volumeIDs"`
+	SnapshotIDs []string `json:"snapshotIDs"`
+	Items       []struct {
+		Kind     string `json:"kind"`
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Spec struct {
+			// PersistentVolume
+			CSI *struct {
+				Driver       string `json:"driver"`
+				VolumeHandle string `json:"volumeHandle"`
+			} `json:"csi"`
+			// VolumeSnapshotContent
+			Driver string `json:"driver"`
+			Source struct {
+				SnapshotHandle string `json:"snapshotHandle"`
+			} `json:"source"`
+		} `json:"spec"`
+		Status struct {
+			SnapshotHandle string `json:"snapshotHandle"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// parse adds the objects of the driver in the file content to the live objects,
+// it returns an error if an ID of the driver is malformed.
+func (l *liveObjects) parse(driverName string, content []byte) error {
+	var f liveObjectsFile
+	if err := json.Unmarshal(content, &f); err != nil {
+		return err
+	}
+	for _, volumeId := range f.VolumeIDs {
+		if err := l.addVolume(volumeId); err != nil {
+			return err
+		}
+	}
+	for _, snapshotId := range f.SnapshotIDs {
+		if err := l.addSnapshot(snapshotId); err != nil {
+			return err
+		}
+	}
+	for _, item := range f.Items {
+		switch item.Kind {
+		case "PersistentVolume":
+			if item.Spec.CSI == nil || item.Spec.CSI.Driver != driverName {
+				continue
+			}
+			if err := l.addVolume(item.Spec.CSI.VolumeHandle); err != nil {
+				return err
+			}
+		case "VolumeSnapshotContent":
+			if item.Spec.Driver != driverName {
+				continue
+			}
+			for _, snapshotId := range []string{item.Status.SnapshotHandle, item.Spec.Source.SnapshotHandle} {
+				if snapshotId == "" {
+					continue
+				}
+				if err := l.addSnapshot(snapshotId); err != nil {
+					return err
+				}
+			}
+		case "Node":
+			l.nodes[item.Metadata.Name] = true
+		}
+	}
+	return nil
+}
+
+// orphan is a volume or snapshot of CSI in curve, which is not referenced by kubernetes.
+type orphan struct {
+	Kind      string `json:"kind"`
+	ClusterID string `json:"clusterID"`
+	User      string `json:"user"`
+	// the file path of the volume, or the source file of the snapshot
+	Path string `json:"path"`
+	// the snapshot UUID and name
+	UUID string `json:"uuid,omitempty"`
+	Name string `json:"name,omitempty"`
+	// the node of the ephemeral volume
+	Node      string    `json:"node,omitempty"`
+	SizeBytes int64     `json:"sizeBytes"`
+	CreatedAt time.Time `json:"createdAt,omitempty"`
+	// the result of the action, empty if only reported
+	Action string `json:"action,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// age returns the age of the orphan, a negative value if the creation time is unknown.
+func (o *orphan) age(now time.Time) time.Duration {
+	if o.CreatedAt.IsZero() {
+		return -1
+	}
+	return now.Sub(o.CreatedAt)
+}
+
+// live returns true if the object is referenced. The ephemeral volumes are deleted
+// by their nodes, they are orphans only if the nodes are known and theirs is gone.
+// The copies of the replication of the referenced volumes, and the snapshots of the
+// syncs, are live too.
+func (o *orphan) live(l *liveObjects) bool {
+	volName := strings.TrimPrefix(o.Path, "/"+o.User+"/")
+	switch o.Kind {
+	case orphanKindSnapshot:
+		if strings.HasPrefix(o.Name, mirrorSnapshotPrefix) && l.replicated(o.User, volName) {
+			return true
+		}
+		return l.snapshots[snapshotKey(o.ClusterID, o.UUID)]
+	case orphanKindEphemeral:
+		return len(l.nodes) == 0 || l.nodes[o.Node]
+	}
+	return l.volumes[volumeKey(o.ClusterID, o.User, volName)] || l.replicated(o.User, volName)
+}
+
+// selectOrphans returns the objects not referenced. A volume with a referenced
+// snapshot is referenced too, since curve does not delete it.
+func selectOrphans(objects []*orphan, l *liveObjects) []*orphan {
+	snapshotted := map[string]bool{}
+	for _, o := range objects {
+		if o.Kind == orphanKindSnapshot && o.live(l) {
+			snapshotted[o.Path] = true
+		}
+	}
+	orphans := make([]*orphan, 0)
+	for _, o := range objects {
+		if o.live(l) || (o.Kind == orphanKindVolume && snapshotted[o.Path]) {
+			continue
+		}
+		orphans = append(orphans, o)
+	}
+	return orphans
+}
+
+// orphanFinder lists the CSI objects in curve and takes actions on the orphans.
+type orphanFinder struct {
+	clusters *clusterResolver
+	users    []string
+	live     *liveObjects
+}
+
+// find lists the CSI volumes of the users in all the clusters, and their snapshots,
+// then returns the ones not referenced.
+func (f *orphanFinder) find(ctx context.Context) ([]*orphan, error) {
+	orphans := make([]*orphan, 0)
+	clusters, err := f.clusters.all()
+	if err != nil {
+		return nil, err
+	}
+	for _, cluster := range clusters {
+		for _, user := range f.users {
+			objects, err := listCSIObjects(ctx, &cluster, user)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list volumes of user %s in cluster %q: %v", user, cluster.ClusterID, err)
+			}
+			orphans = append(orphans, selectOrphans(objects, f.live)...)
+		}
+	}
+	return orphans, nil
+}
+
+// listCSIObjects lists the CSI volumes of the user and their snapshots, and the
+// ephemeral volumes. The snapshots of the volumes deleted outside CSI are not found,
+// while curve does not delete a volume with snapshots.
+func listCSIObjects(ctx context.Context, cluster *util.ClusterInfo, user string) ([]*orphan, error) {
+	dir := curveVolumeOf(cluster, user, "")
+	names, err := dir.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]*orphan, 0)
+	for _, name := range names {
+		node, ephemeral := parseEphemeralVolName(name)
+		if !ephemeral && !strings.HasPrefix(name, csiVolNamingPrefix) {
+			continue
+		}
+		curveVol := curveVolumeOf(cluster, user, name)
+		detail, err := curveVol.Stat(ctx)
+		if err != nil {
+			if util.IsNotFoundErr(err) {
+				continue
+			}
+			return nil, err
+		}
+		o := &orphan{
+			Kind:      orphanKindVolume,
+			ClusterID: cluster.ClusterID,
+			User:      user,
+			Path:      curveVol.FilePath,
+			SizeBytes: int64(detail.LengthGiB) << 30,
+		}
+		if createdAt, err := time.ParseInLocation(curveTimeLayout, detail.CreateTime, time.Local); err == nil {
+			o.CreatedAt = createdAt
+		}
+		if ephemeral {
+			o.Kind = orphanKindEphemeral
+			o.Node = node
+		}
+		objects = append(objects, o)
+
+		// the ephemeral volumes are never snapshotted
+		if ephemeral || len(cluster.SnapshotServers) == 0 {
+			continue
+		}
+		snaps, err := curveservice.NewSnapshotServer(cluster.SnapshotServers, user, name).ListFileSnapshots(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, snap := range snaps {
+			objects = append(objects, &orphan{
+				Kind:      orphanKindSnapshot,
+				ClusterID: cluster.ClusterID,
+				User:      user,
+				Path:      snap.File,
+				UUID:      snap.UUID,
+				Name:      snap.Name,
+				SizeBytes: int64(snap.FileLength),
+				CreatedAt: time.Unix(0, snap.Time*1000),
+			})
+		}
+	}
+	return objects, nil
+}
+
+func curveVolumeOf(cluster *util.ClusterInfo, user, volName string) *curveservice.CurveVolume {
+	curveVol := curveservice.NewCurveVolume(user, volName, 0)
+	curveVol.ConfPath = cluster.ClientConf
+	curveVol.MdsAddrs = cluster.MdsAddrs
+	return curveVol
+}
+
+// remove deletes the orphan or moves it to the trash, the snapshots have no trash.
+// The clones from the orphan are flattened before.
+func (f *orphanFinder) remove(ctx context.Context, o *orphan, action string) error {
+	cluster, err := f.clusters.resolve(o.ClusterID)
+	if err != nil {
+		return err
+	}
+	volName := strings.TrimPrefix(o.Path, "/"+o.User+"/")
+	var snapServer *curveservice.SnapshotServer
+	if len(cluster.SnapshotServers) > 0 {
+		snapServer = curveservice.NewSnapshotServer(cluster.SnapshotServers, o.User, volName)
+	}
+
+	if o.Kind == orphanKindSnapshot {
+		if snapServer == nil {
+			return fmt.Errorf("snapshot server of cluster %q is not set", o.ClusterID)
+		}
+		if action == orphanActionTrash {
+			return fmt.Errorf("snapshot can not be moved to the trash")
+		}
+		if err = snapServer.EnsureTaskFromSourceDone(ctx, o.UUID); err != nil {
+			return err
+		}
+		return snapServer.DeleteSnapshot(ctx, o.UUID)
+	}
+
+	if snapServer != nil {
+		if err = snapServer.EnsureTaskFromSourceDone(ctx, o.Path); err != nil {
+			return err
+		}
+	}
+	curveVol := curveVolumeOf(cluster, o.User, volName)
+	return curveVol.Delete(ctx, action == orphanActionDelete)
+}
+
+// RunOrphans runs the orphans subcommand, which reports the CSI volumes and snapshots
+// in curve not referenced by kubernetes, and optionally deletes them.
+func RunOrphans(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("orphans", flag.ContinueOnError)
+	var (
+		driverName     = fs.String("drivername", "curve.csi.netease.com", "name of the driver, the PVs and VolumeSnapshotContents of other drivers are ignored")
+		clusterConfig  = fs.String("cluster-config", util.DefaultClusterConfig, "path of the config file describing the curve clusters")
+		snapshotServer = fs.String("snapshot-server", "", "snapshot server of the default cluster")
+		users          = fs.String("users", "", "comma separated curve users whose volumes are checked")
+		liveFiles      = fs.String("live", "", "comma separated json files of the live volume and snapshot IDs, or of the kubernetes PersistentVolumes, VolumeSnapshotContents and Nodes")
+		action         = fs.String("action", orphanActionReport, "action on the orphans: report, delete, or trash which deletes the volumes to the curve trash and skips the snapshots")
+		minAge         = fs.Duration("min-age", time.Hour, "only take action on the orphans older than it")
+		output         = fs.String("output", "table", "output format: table or json")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *action != orphanActionReport && *action != orphanActionDelete && *action != orphanActionTrash {
+		return fmt.Errorf("invalid action %q", *action)
+	}
+	if *output != "table" && *output != "json" {
+		return fmt.Errorf("invalid output %q", *output)
+	}
+	finder := &orphanFinder{
+		clusters: newClusterResolver(*clusterConfig, *snapshotServer),
+		live:     newLiveObjects(),
+	}
+	for _, user := range strings.Split(*users, ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			finder.users = append(finder.users, user)
+		}
+	}
+	if len(finder.users) == 0 {
+		return fmt.Errorf("missing --users")
+	}
+	for _, file := range strings.Split(*liveFiles, ",") {
+		if file = strings.TrimSpace(file); file == "" {
+			continue
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err = finder.live.parse(*driverName, content); err != nil {
+			return fmt.Errorf("failed to parse live objects %s: %v", file, err)
+		}
+	}
+	// refuse to delete everything by an empty or missing dump
+	if *action != orphanActionReport && len(finder.live.volumes) == 0 && len(finder.live.snapshots) == 0 {
+		return fmt.Errorf("no live objects found in --live, refusing to %s", *action)
+	}
+
+	ctx := context.WithValue(context.Background(), ctxlog.CtxKey, "orphans")
+	orphans, err := finder.find(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if *action != orphanActionReport {
+		for _, o := range orphans {
+			if age := o.age(now); age < *minAge {
+				o.Action = "skipped"
+				continue
+			}
+			if err := finder.remove(ctx, o, *action); err != nil {
+				klog.Warningf("failed to %s %s %s: %v", *action, o.Kind, o.Path, err)
+				o.Action = "failed"
+				o.Error = err.Error()
+				continue
+			}
+			o.Action = *action
+		}
+	}
+
+	if *output == "json" {
+		return json.NewEncoder(out).Encode(orphans)
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tCLUSTER\tPATH\tSNAPSHOT\tSIZE(GiB)\tAGE\tACTION")
+	for _, o := range orphans {
+		age := "unknown"
+		if d := o.age(now); d >= 0 {
+			age = d.Truncate(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%.2f\t%s\t%s\n",
+			o.Kind, o.ClusterID, o.Path, o.UUID, float64(o.SizeBytes)/(1<<30), age, o.Action)
+	}
+	return w.Flush()
+}
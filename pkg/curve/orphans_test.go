@@ -0,0 +1,142 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLiveObjectsParse(t *testing.T) {
+	volId, err := composeCSIID(&csiIdentifier{clusterID: "c1", pool: "ssd", scheme: namingSchemeCSI, user: "k8s", volName: "csi-vol-pvc-1"})
+	assert.NoError(t, err)
+	snapId, err := composeSnapshotID("5a0f2e41-6a2c-4c0c-9a1d-3f0c2a9b7e11", volId)
+	assert.NoError(t, err)
+
+	l := newLiveObjects()
+	assert.NoError(t, l.parse("curve.csi.netease.com", []byte(fmt.Sprintf(`{"volumeIDs": [%q], "snapshotIDs": [%q]}`, volId, snapId))))
+	assert.True(t, l.volumes["c1/k8s/csi-vol-pvc-1"])
+	assert.True(t, l.snapshots["c1/5a0f2e41-6a2c-4c0c-9a1d-3f0c2a9b7e11"])
+
+	l = newLiveObjects()
+	assert.NoError(t, l.parse("curve.csi.netease.com", []byte(fmt.Sprintf(`{
+  "kind": "List",
+  "items": [
+    {"kind": "PersistentVolume", "spec": {"csi": {"driver": "curve.csi.netease.com", "volumeHandle": %q}}},
+    {"kind": "PersistentVolume", "spec": {"csi": {"driver": "other.csi.io", "volumeHandle": "not-curve"}}},
+    {"kind": "PersistentVolume", "spec": {"hostPath": {"path": "/data"}}},
+    {"kind": "VolumeSnapshotContent", "spec": {"driver": "curve.csi.netease.com"}, "status": {"snapshotHandle": %q}},
+    {"kind": "VolumeSnapshotContent", "spec": {"driver": "other.csi.io"}, "status": {"snapshotHandle": "not-curve"}}
+  ]
+}`, volId, snapId))))
+	assert.Len(t, l.volumes, 1)
+	assert.True(t, l.volumes["c1/k8s/csi-vol-pvc-1"])
+	assert.Len(t, l.snapshots, 1)
+
+	l = newLiveObjects()
+	assert.NoError(t, l.parse("curve.csi.netease.com", []byte(`{"items": [{"kind": "Node", "metadata": {"name": "node-1"}}]}`)))
+	assert.True(t, l.nodes["node-1"])
+
+	assert.Error(t, l.parse("curve.csi.netease.com", []byte(`{"volumeIDs": ["bad"]}`)))
+	assert.Error(t, l.parse("curve.csi.netease.com", []byte(`not json`)))
+}
+
+func TestSelectOrphans(t *testing.T) {
+	now := time.Now()
+	l := newLiveObjects()
+	l.volumes["c1/k8s/csi-vol-live"] = true
+	l.snapshots["c1/snap-live"] = true
+
+	objects := []*orphan{
+		{Kind: orphanKindVolume, ClusterID: "c1", User: "k8s", Path: "/k8s/csi-vol-live"},
+		{Kind: orphanKindVolume, ClusterID: "c1", User: "k8s", Path: "/k8s/csi-vol-orphan", CreatedAt: now.Add(-time.Hour)},
+		{Kind: orphanKindSnapshot, ClusterID: "c1", User: "k8s", Path: "/k8s/csi-vol-orphan", UUID: "snap-orphan"},
+		// the volume of a live snapshot is kept
+		{Kind: orphanKindVolume, ClusterID: "c1", User: "k8s", Path: "/k8s/csi-vol-snapshotted"},
+		{Kind: orphanKindSnapshot, ClusterID: "c1", User: "k8s", Path: "/k8s/csi-vol-snapshotted", UUID: "snap-live"},
+		{Kind: orphanKindVolume, ClusterID: "c2", User: "k8s", Path: "/k8s/csi-vol-other"},
+	}
+	orphans := selectOrphans(objects, l)
+	assert.Len(t, orphans, 3)
+	assert.Equal(t, "/k8s/csi-vol-orphan", orphans[0].Path)
+	assert.Equal(t, "snap-orphan", orphans[1].UUID)
+	assert.Equal(t, "c2", orphans[2].ClusterID)
+
+	assert.Equal(t, time.Hour, orphans[0].age(now))
+	assert.True(t, orphans[2].age(now) < 0)
+}
+
+func TestSelectReplicationOrphans(t *testing.T) {
+	volId, err := composeCSIID(&csiIdentifier{clusterID: "c1", scheme: namingSchemeCSI, user: "k8s", volName: "csi-vol-live"})
+	assert.NoError(t, err)
+	l := newLiveObjects()
+	assert.NoError(t, l.addVolume(volId))
+
+	objects := []*orphan{
+		// the mirror in the peer cluster
+		{Kind: orphanKindVolume, ClusterID: "c2", User: "k8s", Path: "/k8s/csi-vol-live"},
+		// the clones of the syncs in both clusters
+		{Kind: orphanKindVolume, ClusterID: "c1", User: "k8s", Path: "/k8s/csi-vol-live-mirror-1654077600"},
+		{Kind: orphanKindVolume, ClusterID: "c2", User: "k8s", Path: "/k8s/csi-vol-live-mirror-1654077600"},
+		// the snapshots of the syncs, of the primary and of the mirror pulled by a resync
+		{Kind: orphanKindSnapshot, ClusterID: "c1", User: "k8s", Path: "/k8s/csi-vol-live", UUID: "s1", Name: "mirror-1654077600"},
+		{Kind: orphanKindSnapshot, ClusterID: "c2", User: "k8s", Path: "/k8s/csi-vol-live", UUID: "s2", Name: "mirror-1654077600"},
+		// not of the replication
+		{Kind: orphanKindSnapshot, ClusterID: "c2", User: "k8s", Path: "/k8s/csi-vol-live", UUID: "s3", Name: "snapshot-1"},
+		{Kind: orphanKindVolume, ClusterID: "c1", User: "k8s", Path: "/k8s/csi-vol-orphan-mirror-1654077600"},
+		{Kind: orphanKindSnapshot, ClusterID: "c1", User: "k8s", Path: "/k8s/csi-vol-orphan", UUID: "s4", Name: "mirror-1654077600"},
+		{Kind: orphanKindVolume, ClusterID: "c1", User: "other", Path: "/other/csi-vol-live"},
+	}
+	orphans := selectOrphans(objects, l)
+	uuids := []string{}
+	paths := []string{}
+	for _, o := range orphans {
+		if o.Kind == orphanKindSnapshot {
+			uuids = append(uuids, o.UUID)
+		} else {
+			paths = append(paths, o.ClusterID+o.Path)
+		}
+	}
+	assert.Equal(t, []string{"s3", "s4"}, uuids)
+	assert.Equal(t, []string{"c1/k8s/csi-vol-orphan-mirror-1654077600", "c1/other/csi-vol-live"}, paths)
+}
+
+func TestSelectEphemeralOrphans(t *testing.T) {
+	objects := []*orphan{
+		{Kind: orphanKindEphemeral, ClusterID: "c1", User: "k8s", Path: "/k8s/csi-eph-node-1_csi-a", Node: "node-1"},
+		{Kind: orphanKindEphemeral, ClusterID: "c1", User: "k8s", Path: "/k8s/csi-eph-node-2_csi-b", Node: "node-2"},
+	}
+	// the nodes are unknown
+	l := newLiveObjects()
+	assert.Len(t, selectOrphans(objects, l), 0)
+
+	l.nodes["node-1"] = true
+	orphans := selectOrphans(objects, l)
+	assert.Len(t, orphans, 1)
+	assert.Equal(t, "node-2", orphans[0].Node)
+}
+
+func TestRunOrphansArgs(t *testing.T) {
+	assert.Error(t, RunOrphans([]string{"--action", "destroy", "--users", "k8s"}, nil))
+	assert.Error(t, RunOrphans([]string{"--output", "yaml", "--users", "k8s"}, nil))
+	assert.Error(t, RunOrphans([]string{}, nil))
+	// an empty dump never deletes everything
+	assert.Error(t, RunOrphans([]string{"--users", "k8s", "--action", "delete"}, nil))
+}
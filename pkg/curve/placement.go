@@ -0,0 +1,96 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+)
+
+const (
+	// StorageClass parameters of the data placement, immutable after creation
+	stripeUnitParam  = "stripeUnit"
+	stripeCountParam = "stripeCount"
+	poolsetParam     = "poolset"
+
+	// the stripe unit must be a power of 2 in [minStripeUnit, curveChunkSize]
+	minStripeUnit  = 4 * 1024
+	curveChunkSize = 16 * 1024 * 1024
+	maxStripeCount = 1024
+)
+
+var poolsetNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
+// placement is the striping and poolset of a volume, the zero fields follow the cluster.
+type placement struct {
+	stripeUnit  int64
+	stripeCount int64
+	poolset     string
+}
+
+// parsePlacement parses and validates the placement in StorageClass parameters.
+func parsePlacement(parameters map[string]string) (placement, error) {
+	var (
+		p   placement
+		err error
+	)
+	stripeUnit, hasStripeUnit := parameters[stripeUnitParam]
+	stripeCount, hasStripeCount := parameters[stripeCountParam]
+	if hasStripeUnit != hasStripeCount {
+		return p, fmt.Errorf("%s and %s must be set together", stripeUnitParam, stripeCountParam)
+	}
+	if hasStripeUnit {
+		p.stripeUnit, err = strconv.ParseInt(stripeUnit, 10, 64)
+		if err != nil || p.stripeUnit < minStripeUnit || p.stripeUnit > curveChunkSize ||
+			p.stripeUnit&(p.stripeUnit-1) != 0 {
+			return p, fmt.Errorf("invalid %s %q, must be a power of 2 bytes in [%d, %d]",
+				stripeUnitParam, stripeUnit, minStripeUnit, curveChunkSize)
+		}
+		p.stripeCount, err = strconv.ParseInt(stripeCount, 10, 64)
+		if err != nil || p.stripeCount < 1 || p.stripeCount > maxStripeCount {
+			return p, fmt.Errorf("invalid %s %q, must be in [1, %d]", stripeCountParam, stripeCount, maxStripeCount)
+		}
+	}
+
+	if poolset, ok := parameters[poolsetParam]; ok {
+		if !poolsetNameRegexp.MatchString(poolset) {
+			return p, fmt.Errorf("invalid %s %q, must match %s", poolsetParam, poolset, poolsetNameRegexp)
+		}
+		p.poolset = poolset
+	}
+	return p, nil
+}
+
+func (p placement) hasStripe() bool {
+	return p.stripeUnit > 0
+}
+
+// checkFile returns an error if the existing file is not placed as requested,
+// the zero fields follow the cluster and match any placement.
+func (p placement) checkFile(detail *curveservice.CurveVolumeDetail) error {
+	if p.hasStripe() && (detail.StripeUnit != p.stripeUnit || detail.StripeCount != p.stripeCount) {
+		return fmt.Errorf("request stripe (unit %d, count %d) not equal with existing (unit %d, count %d)",
+			p.stripeUnit, p.stripeCount, detail.StripeUnit, detail.StripeCount)
+	}
+	if p.poolset != "" && detail.Poolset != p.poolset {
+		return fmt.Errorf("request poolset %q not equal with existing %q", p.poolset, detail.Poolset)
+	}
+	return nil
+}
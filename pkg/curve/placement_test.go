@@ -0,0 +1,92 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+)
+
+func TestParsePlacement(t *testing.T) {
+	p, err := parsePlacement(map[string]string{"user": "k8s"})
+	assert.NoError(t, err)
+	assert.Equal(t, placement{}, p)
+	assert.False(t, p.hasStripe())
+
+	p, err = parsePlacement(map[string]string{
+		stripeUnitParam:  "65536",
+		stripeCountParam: "16",
+		poolsetParam:     "ssd",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, placement{stripeUnit: 65536, stripeCount: 16, poolset: "ssd"}, p)
+	assert.True(t, p.hasStripe())
+
+	for _, parameters := range []map[string]string{
+		{stripeUnitParam: "65536"},
+		{stripeCountParam: "16"},
+		{stripeUnitParam: "1024", stripeCountParam: "16"},
+		{stripeUnitParam: "65535", stripeCountParam: "16"},
+		{stripeUnitParam: "33554432", stripeCountParam: "16"},
+		{stripeUnitParam: "64Ki", stripeCountParam: "16"},
+		{stripeUnitParam: "65536", stripeCountParam: "0"},
+		{stripeUnitParam: "65536", stripeCountParam: "1025"},
+		{poolsetParam: ""},
+		{poolsetParam: "ssd/hdd"},
+	} {
+		_, err = parsePlacement(parameters)
+		assert.Error(t, err, parameters)
+	}
+}
+
+func TestVolumeOptionsPlacement(t *testing.T) {
+	req := &csi.CreateVolumeRequest{
+		Name: "pvc-1",
+		Parameters: map[string]string{
+			"user":           "k8s",
+			stripeUnitParam:  "65536",
+			stripeCountParam: "16",
+			poolsetParam:     "ssd",
+		},
+	}
+	vo, err := newVolumeOptions(req)
+	assert.NoError(t, err)
+	curveVol := vo.curveVolume()
+	assert.Equal(t, int64(65536), curveVol.StripeUnit)
+	assert.Equal(t, int64(16), curveVol.StripeCount)
+	assert.Equal(t, "ssd", curveVol.Poolset)
+	assert.Equal(t, "ssd", vo.snapshotServer().Poolset)
+
+	// the poolset is recovered from the volume ID
+	voFromID, err := newVolumeOptionsFromVolID(vo.volId)
+	assert.NoError(t, err)
+	assert.Equal(t, "ssd", voFromID.placement.poolset)
+	assert.Equal(t, "ssd", voFromID.curveVolume().Poolset)
+}
+
+func TestPlacementCheckFile(t *testing.T) {
+	detail := &curveservice.CurveVolumeDetail{StripeUnit: 65536, StripeCount: 16, Poolset: "ssd"}
+	assert.NoError(t, placement{}.checkFile(detail))
+	assert.NoError(t, placement{stripeUnit: 65536, stripeCount: 16, poolset: "ssd"}.checkFile(detail))
+	assert.Error(t, placement{stripeUnit: 65536, stripeCount: 8}.checkFile(detail))
+	assert.Error(t, placement{poolset: "hdd"}.checkFile(detail))
+	assert.Error(t, placement{stripeUnit: 65536, stripeCount: 16}.checkFile(&curveservice.CurveVolumeDetail{}))
+}
@@ -0,0 +1,534 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/opencurve/curve-csi/pkg/util"
+	"github.com/opencurve/curve-csi/pkg/util/ctxlog"
+)
+
+const (
+	// StorageClass parameters
+	imageSourceParam   = "imageSource"
+	imageFormatParam   = "imageFormat"
+	imageChecksumParam = "imageChecksum"
+
+	imageFormatRaw   = "raw"
+	imageFormatQcow2 = "qcow2"
+	// a gzip compressed raw image, e.g. exported by the subcommand 'export'
+	imageFormatGzip = "gzip"
+
+	// the phases of a populate job
+	populateQueued      = "queued"
+	populateDownloading = "downloading"
+	populateConverting  = "converting"
+	populateCopying     = "copying"
+	populateDone        = "done"
+	populateFailed      = "failed"
+
+	// the image is read in chunks, and written in blocks skipping the zero ones
+	populateChunkSize = 4 << 20
+	populateBlockSize = 64 << 10
+)
+
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+// imageSpec is the disk image a volume is populated from.
+type imageSpec struct {
+	// a local path on the controller, or a http(s) URL
+	Source string `json:"source"`
+	Format string `json:"format"`
+	// <algorithm>:<hex digest> of the image file, empty to not verify
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// parseImageSpec returns nil if the volume is not populated from an image.
+func parseImageSpec(parameters map[string]string) (*imageSpec, error) {
+	source, ok := parameters[imageSourceParam]
+	if !ok {
+		return nil, nil
+	}
+	spec := &imageSpec{Source: source, Format: parameters[imageFormatParam], Checksum: parameters[imageChecksumParam]}
+	if !spec.remote() && !filepath.IsAbs(source) {
+		return nil, fmt.Errorf("invalid %s %q, must be an absolute path or a http(s) URL", imageSourceParam, source)
+	}
+	if spec.Format == "" {
+		spec.Format = imageFormatRaw
+	}
+	if spec.Format != imageFormatRaw && spec.Format != imageFormatQcow2 && spec.Format != imageFormatGzip {
+		return nil, fmt.Errorf("invalid %s %q, must be %s, %s or %s", imageFormatParam, spec.Format, imageFormatRaw, imageFormatQcow2, imageFormatGzip)
+	}
+	if spec.Checksum != "" {
+		if _, _, err := parseImageChecksum(spec.Checksum); err != nil {
+			return nil, err
+		}
+	}
+	return spec, nil
+}
+
+func (s *imageSpec) remote() bool {
+	u, err := url.Parse(s.Source)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// parseImageChecksum returns the hash of the algorithm and the expected digest.
+func parseImageChecksum(checksum string) (hash.Hash, string, error) {
+	invalid := fmt.Errorf("invalid %s %q, must be sha256:<hex> or sha512:<hex>", imageChecksumParam, checksum)
+	algo, digest, _ := strings.Cut(checksum, ":")
+	var h hash.Hash
+	switch algo {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return nil, "", invalid
+	}
+	digest = strings.ToLower(digest)
+	if _, err := hex.DecodeString(digest); err != nil || len(digest) != 2*h.Size() {
+		return nil, "", invalid
+	}
+	return h, digest, nil
+}
+
+// checksumReader hashes what is read through it.
+type checksumReader struct {
+	r        io.Reader
+	h        hash.Hash
+	expected string
+}
+
+// newChecksumReader returns r itself if the checksum is empty.
+func newChecksumReader(r io.Reader, checksum string) (io.Reader, *checksumReader, error) {
+	if checksum == "" {
+		return r, nil, nil
+	}
+	h, expected, err := parseImageChecksum(checksum)
+	if err != nil {
+		return nil, nil, err
+	}
+	cr := &checksumReader{r: io.TeeReader(r, h), h: h, expected: expected}
+	return cr, cr, nil
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// verify checks the digest of all the bytes read, it does nothing on nil.
+func (c *checksumReader) verify() error {
+	if c == nil {
+		return nil
+	}
+	if actual := hex.EncodeToString(c.h.Sum(nil)); actual != c.expected {
+		return status.Errorf(codes.InvalidArgument, "checksum mismatch of image, expected %s, got %s", c.expected, actual)
+	}
+	return nil
+}
+
+// copySparse copies src to dst from offset 0, the zero blocks are skipped since
+// dst is a new thin volume. It returns an error if src is longer than limit.
+func copySparse(ctx context.Context, dst io.WriterAt, src io.Reader, limit int64, progress func(int64)) (int64, error) {
+	buf := make([]byte, populateChunkSize)
+	zero := make([]byte, populateBlockSize)
+	var off int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return off, err
+		}
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			if off+int64(n) > limit {
+				return off, status.Errorf(codes.OutOfRange, "image is larger than the volume of %d bytes", limit)
+			}
+			for i := 0; i < n; i += populateBlockSize {
+				end := i + populateBlockSize
+				if end > n {
+					end = n
+				}
+				if bytes.Equal(buf[i:end], zero[:end-i]) {
+					continue
+				}
+				if _, werr := dst.WriteAt(buf[i:end], off+int64(i)); werr != nil {
+					return off, werr
+				}
+			}
+			off += int64(n)
+			progress(off)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return off, nil
+		}
+		if err != nil {
+			return off, err
+		}
+	}
+}
+
+// openImage opens the image file or URL, returns the size, -1 if unknown.
+func openImage(ctx context.Context, source string) (io.ReadCloser, int64, error) {
+	spec := &imageSpec{Source: source}
+	if !spec.remote() {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, 0, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		return f, info.Size(), nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, status.Error(codes.Unavailable, err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, status.Errorf(codes.Unavailable, "failed to get image %s: %s", source, resp.Status)
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// populateJob is populating a volume from an image.
+type populateJob struct {
+	VolumeID    string     `json:"volumeID"`
+	Image       *imageSpec `json:"image"`
+	Phase       string     `json:"phase"`
+	DoneBytes   int64      `json:"doneBytes"`
+	TotalBytes  int64      `json:"totalBytes"`
+	StartedAt   time.Time  `json:"startedAt"`
+	CompletedAt time.Time  `json:"completedAt,omitempty"`
+	Error       string     `json:"error,omitempty"`
+
+	err    error
+	cancel context.CancelFunc
+}
+
+// progress is e.g. "copying 42% (4.20 of 10.00 GiB)".
+func (j *populateJob) progress() string {
+	if j.TotalBytes <= 0 {
+		return fmt.Sprintf("%s %.2f GiB", j.Phase, float64(j.DoneBytes)/(1<<30))
+	}
+	return fmt.Sprintf("%s %d%% (%.2f of %.2f GiB)", j.Phase, j.DoneBytes*100/j.TotalBytes,
+		float64(j.DoneBytes)/(1<<30), float64(j.TotalBytes)/(1<<30))
+}
+
+// populator populates the new volumes from the images in the background, at most
+// concurrency volumes at the same time. CreateVolume returns Aborted with the
+// progress until the volume is populated, the provisioner retries it.
+type populator struct {
+	cs  *controllerServer
+	dir string
+	// the slots of the running jobs
+	slots chan struct{}
+	// copies the image to the volume, replaced in tests
+	copy func(ctx context.Context, job *populateJob, vo *volumeOptions) error
+
+	mu   sync.Mutex
+	jobs map[string]*populateJob
+}
+
+// newPopulator returns nil if the work dir is not set.
+func newPopulator(cs *controllerServer, dir string, concurrency int) (*populator, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if concurrency <= 0 {
+		return nil, fmt.Errorf("invalid populate concurrency %d, must be positive", concurrency)
+	}
+	if !cs.volumeMeta.enabled() {
+		return nil, fmt.Errorf("populating volumes from images requires the controller metadata store")
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	p := &populator{
+		cs:    cs,
+		dir:   dir,
+		slots: make(chan struct{}, concurrency),
+		jobs:  map[string]*populateJob{},
+	}
+	p.copy = p.copyImage
+	return p, nil
+}
+
+// populate returns nil if the volume is populated, Aborted with the progress if
+// populating, or the error of the failed job, which is restarted on the next call.
+func (p *populator) populate(ctx context.Context, vo *volumeOptions) error {
+	if p == nil {
+		return status.Errorf(codes.InvalidArgument, "populating volumes from images is disabled, see --populate-dir")
+	}
+	// populated before, never overwrite it
+	meta, err := p.cs.volumeMeta.get(vo.volId)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if meta.Image != nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	job, ok := p.jobs[vo.volId]
+	if !ok {
+		job = p.start(vo)
+		return status.Errorf(codes.Aborted, "populating volume %s from image %s: %s", vo.volId, vo.image.Source, job.Phase)
+	}
+	switch job.Phase {
+	case populateDone:
+		delete(p.jobs, vo.volId)
+		ctxlog.Infof(ctx, "populated volume %s from image %s", vo.volId, vo.image.Source)
+		return nil
+	case populateFailed:
+		delete(p.jobs, vo.volId)
+		return job.err
+	}
+	return status.Errorf(codes.Aborted, "populating volume %s from image %s: %s", vo.volId, vo.image.Source, job.progress())
+}
+
+// start runs a new job of the volume, the caller holds p.mu.
+func (p *populator) start(vo *volumeOptions) *populateJob {
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = context.WithValue(ctx, ctxlog.CtxKey, "populate-"+vo.volId)
+	job := &populateJob{
+		VolumeID:  vo.volId,
+		Image:     vo.image,
+		Phase:     populateQueued,
+		StartedAt: time.Now(),
+		cancel:    cancel,
+	}
+	p.jobs[vo.volId] = job
+
+	go func() {
+		defer cancel()
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		var err error
+		if err = ctx.Err(); err == nil {
+			ctxlog.Infof(ctx, "starting to populate volume %s from image %s", vo.volId, vo.image.Source)
+			err = p.copy(ctx, job, vo)
+			<-p.slots
+		}
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		job.CompletedAt = time.Now()
+		if err != nil {
+			ctxlog.Warningf(ctx, "failed to populate volume %s: %v", vo.volId, err)
+			if _, ok := status.FromError(err); !ok {
+				err = status.Error(codes.Internal, err.Error())
+			}
+			job.Phase, job.Error, job.err = populateFailed, err.Error(), err
+			return
+		}
+		job.Phase = populateDone
+		ctxlog.Infof(ctx, "volume %s populated, %d bytes", vo.volId, job.DoneBytes)
+	}()
+	return job
+}
+
+// cancel stops the job of the deleted volume.
+func (p *populator) cancel(volumeId string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if job, ok := p.jobs[volumeId]; ok {
+		job.cancel()
+		delete(p.jobs, volumeId)
+	}
+}
+
+func (p *populator) setPhase(job *populateJob, phase string, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	job.Phase, job.DoneBytes, job.TotalBytes = phase, 0, total
+}
+
+func (p *populator) setProgress(job *populateJob, done int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	job.DoneBytes = done
+}
+
+// copyImage maps the volume on the controller and writes the image to the device.
+// A qcow2 image is downloaded and converted to a sparse raw file in the work dir first.
+func (p *populator) copyImage(ctx context.Context, job *populateJob, vo *volumeOptions) error {
+	source := vo.image.Source
+	if vo.image.Format == imageFormatQcow2 {
+		raw, err := p.convert(ctx, job, vo.image)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(raw)
+		source = raw
+	}
+
+	src, size, err := openImage(ctx, source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	limit := int64(vo.sizeGiB) << 30
+	if vo.image.Format != imageFormatGzip && size > limit {
+		return status.Errorf(codes.OutOfRange, "image of %d bytes is larger than the volume of %d bytes", size, limit)
+	}
+	reader := io.Reader(src)
+	var sum *checksumReader
+	// the checksum of a qcow2 image is verified on downloading
+	if vo.image.Format != imageFormatQcow2 {
+		if reader, sum, err = newChecksumReader(src, vo.image.Checksum); err != nil {
+			return err
+		}
+	}
+	if vo.image.Format == imageFormatGzip {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "image %s is not gzip: %v", vo.image.Source, err)
+		}
+		defer gz.Close()
+		// the size of the uncompressed image is unknown
+		reader, size = gz, -1
+	}
+	head := make([]byte, len(qcow2Magic))
+	n, _ := io.ReadFull(reader, head)
+	if vo.image.Format != imageFormatQcow2 && bytes.Equal(head[:n], qcow2Magic) {
+		return status.Errorf(codes.InvalidArgument, "image %s is qcow2, set %s: %s", vo.image.Source, imageFormatParam, imageFormatQcow2)
+	}
+	reader = io.MultiReader(bytes.NewReader(head[:n]), reader)
+
+	curveVol := vo.curveVolume()
+	devicePath, err := curveVol.Map(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if uerr := curveVol.UnMap(ctx); uerr != nil {
+			ctxlog.Warningf(ctx, "failed to unmap %s: %v", curveVol.FilePath, uerr)
+		}
+	}()
+	// opened exclusively, so the device is not mounted or opened by another writer
+	// while populated, and is reported busy to the node reconciler
+	// #nosec:G304, the device is mapped by the driver
+	dev, err := os.OpenFile(devicePath, os.O_WRONLY|syscall.O_EXCL, 0)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	p.setPhase(job, populateCopying, size)
+	if _, err = copySparse(ctx, dev, reader, limit, func(n int64) { p.setProgress(job, n) }); err != nil {
+		return err
+	}
+	if err = dev.Sync(); err != nil {
+		return err
+	}
+	return sum.verify()
+}
+
+// convert downloads the qcow2 image if remote, verifies it, and converts it to a
+// sparse raw file in the work dir, returns the path of the raw file.
+func (p *populator) convert(ctx context.Context, job *populateJob, image *imageSpec) (string, error) {
+	source := image.Source
+	if image.remote() || image.Checksum != "" {
+		src, size, err := openImage(ctx, image.Source)
+		if err != nil {
+			return "", err
+		}
+		defer src.Close()
+		reader, sum, err := newChecksumReader(src, image.Checksum)
+		if err != nil {
+			return "", err
+		}
+		p.setPhase(job, populateDownloading, size)
+		tmp, err := ioutil.TempFile(p.dir, "image-")
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(tmp.Name())
+		n, err := copySparse(ctx, tmp, reader, 1<<62, func(n int64) { p.setProgress(job, n) })
+		if err == nil {
+			// the trailing zero blocks are skipped
+			err = tmp.Truncate(n)
+		}
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return "", err
+		}
+		if err = sum.verify(); err != nil {
+			return "", err
+		}
+		source = tmp.Name()
+	}
+
+	p.setPhase(job, populateConverting, -1)
+	raw := filepath.Join(p.dir, "raw-"+url.PathEscape(job.VolumeID))
+	args := []string{"convert", "-f", imageFormatQcow2, "-O", imageFormatRaw, source, raw}
+	ctxlog.V(4).Infof(ctx, "starting exec: qemu-img %v", args)
+	if output, err := util.ExecCommand("qemu-img", args); err != nil {
+		os.Remove(raw)
+		return "", status.Errorf(codes.InvalidArgument, "failed to convert image %s, err: %v, output: %s", image.Source, err, output)
+	}
+	return raw, nil
+}
+
+// ServeHTTP returns the running jobs in json.
+func (p *populator) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p.mu.Lock()
+	jobs := make([]populateJob, 0, len(p.jobs))
+	for _, job := range p.jobs {
+		jobs = append(jobs, *job)
+	}
+	p.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(jobs)
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/opencurve/curve-csi/pkg/util"
+)
+
+func TestParseImageSpec(t *testing.T) {
+	spec, err := parseImageSpec(map[string]string{})
+	assert.NoError(t, err)
+	assert.Nil(t, spec)
+
+	spec, err = parseImageSpec(map[string]string{imageSourceParam: "https://images.example.com/ubuntu.qcow2", imageFormatParam: "qcow2"})
+	assert.NoError(t, err)
+	assert.True(t, spec.remote())
+	assert.Equal(t, imageFormatQcow2, spec.Format)
+
+	spec, err = parseImageSpec(map[string]string{imageSourceParam: "/images/ci.img",
+		imageChecksumParam: "sha256:" + hex.EncodeToString(make([]byte, sha256.Size))})
+	assert.NoError(t, err)
+	assert.False(t, spec.remote())
+	assert.Equal(t, imageFormatRaw, spec.Format)
+
+	spec, err = parseImageSpec(map[string]string{imageSourceParam: "/backup/db.img.gz", imageFormatParam: "gzip"})
+	assert.NoError(t, err)
+	assert.Equal(t, imageFormatGzip, spec.Format)
+
+	for _, params := range []map[string]string{
+		{imageSourceParam: "images/ci.img"},
+		{imageSourceParam: "ftp://images.example.com/ci.img"},
+		{imageSourceParam: "/images/ci.img", imageFormatParam: "vmdk"},
+		{imageSourceParam: "/images/ci.img", imageChecksumParam: "md5:d41d8cd98f00b204e9800998ecf8427e"},
+		{imageSourceParam: "/images/ci.img", imageChecksumParam: "sha256:abc"},
+		{imageSourceParam: "/images/ci.img", imageChecksumParam: "sha256"},
+	} {
+		_, err = parseImageSpec(params)
+		assert.Error(t, err, params)
+	}
+}
+
+func TestChecksumReader(t *testing.T) {
+	data := []byte("curve image")
+	sum := sha256.Sum256(data)
+
+	r, cr, err := newChecksumReader(bytes.NewReader(data), "sha256:"+hex.EncodeToString(sum[:]))
+	assert.NoError(t, err)
+	_, err = io.Copy(ioutil.Discard, r)
+	assert.NoError(t, err)
+	assert.NoError(t, cr.verify())
+
+	r, cr, err = newChecksumReader(bytes.NewReader([]byte("tampered")), "sha256:"+hex.EncodeToString(sum[:]))
+	assert.NoError(t, err)
+	_, err = io.Copy(ioutil.Discard, r)
+	assert.NoError(t, err)
+	assert.Equal(t, codes.InvalidArgument, status.Code(cr.verify()))
+
+	// not verified
+	_, cr, err = newChecksumReader(bytes.NewReader(data), "")
+	assert.NoError(t, err)
+	assert.NoError(t, cr.verify())
+}
+
+type recordingWriterAt struct {
+	buf    []byte
+	writes int
+}
+
+func (w *recordingWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	w.writes++
+	copy(w.buf[off:], p)
+	return len(p), nil
+}
+
+func TestCopySparse(t *testing.T) {
+	ctx := context.TODO()
+	// a data block, a chunk of zeros and a short tail
+	src := make([]byte, populateChunkSize+2*populateBlockSize+10)
+	copy(src, "boot")
+	copy(src[populateChunkSize+populateBlockSize:], "data")
+	src[len(src)-1] = 1
+
+	dst := &recordingWriterAt{buf: make([]byte, len(src))}
+	var progress int64
+	n, err := copySparse(ctx, dst, bytes.NewReader(src), int64(len(src)), func(done int64) { progress = done })
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(src)), n)
+	assert.Equal(t, n, progress)
+	assert.Equal(t, src, dst.buf)
+	assert.Equal(t, 3, dst.writes)
+
+	_, err = copySparse(ctx, &recordingWriterAt{buf: make([]byte, len(src))}, bytes.NewReader(src), int64(len(src)-1), func(int64) {})
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = copySparse(canceled, dst, bytes.NewReader(src), int64(len(src)), func(int64) {})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestOpenImage(t *testing.T) {
+	ctx := context.TODO()
+	path := filepath.Join(t.TempDir(), "ci.img")
+	assert.NoError(t, os.WriteFile(path, []byte("local"), 0o600))
+	r, size, err := openImage(ctx, path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), size)
+	r.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/ci.img" {
+			http.NotFound(w, req)
+			return
+		}
+		fmt.Fprint(w, "remote")
+	}))
+	defer server.Close()
+	r, size, err = openImage(ctx, server.URL+"/ci.img")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), size)
+	data, _ := ioutil.ReadAll(r)
+	assert.Equal(t, "remote", string(data))
+	r.Close()
+
+	_, _, err = openImage(ctx, server.URL+"/missing.img")
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestPopulatorJobs(t *testing.T) {
+	ctx := context.TODO()
+	cs := &controllerServer{volumeMeta: newVolumeMetaStore(util.NewFileStore(t.TempDir()))}
+	p, err := newPopulator(cs, t.TempDir(), 1)
+	assert.NoError(t, err)
+
+	release := make(chan error)
+	p.copy = func(ctx context.Context, job *populateJob, vo *volumeOptions) error {
+		p.setPhase(job, populateCopying, 10)
+		p.setProgress(job, 4)
+		return <-release
+	}
+	vo := &volumeOptions{volId: "vol", image: &imageSpec{Source: "/images/ci.img", Format: imageFormatRaw}}
+	waitPhase := func(phase string) {
+		assert.Eventually(t, func() bool {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			return p.jobs[vo.volId] != nil && p.jobs[vo.volId].Phase == phase
+		}, time.Second, time.Millisecond)
+	}
+
+	err = p.populate(ctx, vo)
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	waitPhase(populateCopying)
+	err = p.populate(ctx, vo)
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	assert.Contains(t, err.Error(), "copying 40%")
+
+	// the failed job is reported once and restarted on the next call
+	release <- fmt.Errorf("disk full")
+	waitPhase(populateFailed)
+	assert.Equal(t, codes.Internal, status.Code(p.populate(ctx, vo)))
+	assert.Equal(t, codes.Aborted, status.Code(p.populate(ctx, vo)))
+	waitPhase(populateCopying)
+
+	release <- nil
+	waitPhase(populateDone)
+	assert.NoError(t, p.populate(ctx, vo))
+	assert.Empty(t, p.jobs)
+
+	// the populated volume is never populated again
+	assert.NoError(t, cs.volumeMeta.put(vo.volId, vo.meta()))
+	assert.NoError(t, p.populate(ctx, vo))
+	assert.Empty(t, p.jobs)
+
+	// canceled by DeleteVolume
+	vo2 := &volumeOptions{volId: "vol2", image: vo.image}
+	assert.Equal(t, codes.Aborted, status.Code(p.populate(ctx, vo2)))
+	p.cancel(vo2.volId)
+	assert.Empty(t, p.jobs)
+	close(release)
+
+	var disabled *populator
+	assert.Equal(t, codes.InvalidArgument, status.Code(disabled.populate(ctx, vo)))
+	disabled.cancel(vo.volId)
+
+	_, err = newPopulator(&controllerServer{volumeMeta: newVolumeMetaStore(nil)}, t.TempDir(), 1)
+	assert.Error(t, err)
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+)
+
+// the parameters suffixed by it scale with the volume size
+const qosPerGiBSuffix = "PerGiB"
+
+// StorageClass parameters of QoS and the curve throttle types
+var qosParams = []struct {
+	param        string
+	throttleType curveservice.ThrottleType
+}{
+	{"readIOPS", curveservice.ThrottleIOPSRead},
+	{"writeIOPS", curveservice.ThrottleIOPSWrite},
+	{"totalIOPS", curveservice.ThrottleIOPSTotal},
+	{"readBPS", curveservice.ThrottleBPSRead},
+	{"writeBPS", curveservice.ThrottleBPSWrite},
+	{"totalBPS", curveservice.ThrottleBPSTotal},
+}
+
+// qosSpec is the QoS of a volume, each throttle type is limited absolutely or per GiB.
+type qosSpec struct {
+	Limits       map[curveservice.ThrottleType]int64 `json:"limits,omitempty"`
+	LimitsPerGiB map[curveservice.ThrottleType]int64 `json:"limitsPerGiB,omitempty"`
+}
+
+// parseQoSSpec parses the QoS in StorageClass parameters, returns nil if not set.
+func parseQoSSpec(parameters map[string]string) (*qosSpec, error) {
+	q := &qosSpec{
+		Limits:       map[curveservice.ThrottleType]int64{},
+		LimitsPerGiB: map[curveservice.ThrottleType]int64{},
+	}
+	for _, p := range qosParams {
+		limit, hasLimit, err := parseQoSLimit(parameters, p.param)
+		if err != nil {
+			return nil, err
+		}
+		limitPerGiB, hasLimitPerGiB, err := parseQoSLimit(parameters, p.param+qosPerGiBSuffix)
+		if err != nil {
+			return nil, err
+		}
+		if hasLimit && hasLimitPerGiB {
+			return nil, fmt.Errorf("%s and %s can not be set at the same time", p.param, p.param+qosPerGiBSuffix)
+		}
+		if hasLimit {
+			q.Limits[p.throttleType] = limit
+		}
+		if hasLimitPerGiB {
+			q.LimitsPerGiB[p.throttleType] = limitPerGiB
+		}
+	}
+	if len(q.Limits) == 0 && len(q.LimitsPerGiB) == 0 {
+		return nil, nil
+	}
+	return q, nil
+}
+
+func parseQoSLimit(parameters map[string]string, key string) (int64, bool, error) {
+	str, ok := parameters[key]
+	if !ok {
+		return 0, false, nil
+	}
+	limit, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || limit <= 0 {
+		return 0, false, fmt.Errorf("invalid %s %q, must be a positive integer", key, str)
+	}
+	return limit, true, nil
+}
+
+// scalesWithSize returns true if the QoS must be reapplied after the volume is resized.
+func (q *qosSpec) scalesWithSize() bool {
+	return q != nil && len(q.LimitsPerGiB) > 0
+}
+
+// effectiveLimits returns the limits of the volume with sizeGiB.
+func (q *qosSpec) effectiveLimits(sizeGiB int) map[curveservice.ThrottleType]int64 {
+	limits := map[curveservice.ThrottleType]int64{}
+	if q == nil {
+		return limits
+	}
+	for throttleType, limit := range q.Limits {
+		limits[throttleType] = limit
+	}
+	for throttleType, limitPerGiB := range q.LimitsPerGiB {
+		limits[throttleType] = limitPerGiB * int64(sizeGiB)
+	}
+	return limits
+}
+
+// toParameters returns the effective limits keyed by the StorageClass parameter names.
+func (q *qosSpec) toParameters(sizeGiB int) map[string]string {
+	limits := q.effectiveLimits(sizeGiB)
+	parameters := map[string]string{}
+	for _, p := range qosParams {
+		if limit, ok := limits[p.throttleType]; ok {
+			parameters[p.param] = strconv.FormatInt(limit, 10)
+		}
+	}
+	return parameters
+}
+
+// applyQoS sets the throttles of the curve volume with sizeGiB.
+func applyQoS(ctx context.Context, curveVol *curveservice.CurveVolume, q *qosSpec, sizeGiB int) error {
+	limits := q.effectiveLimits(sizeGiB)
+	for _, p := range qosParams {
+		limit, ok := limits[p.throttleType]
+		if !ok {
+			continue
+		}
+		if err := curveVol.UpdateThrottle(ctx, p.throttleType, limit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// modifyQoSSpec returns the QoS of q modified by the mutable parameters, each parameter
+// replaces the limit of its throttle type, and "0" removes the limit.
+// The removed throttle types are returned to be reset.
+func modifyQoSSpec(q *qosSpec, parameters map[string]string) (*qosSpec, []curveservice.ThrottleType, error) {
+	modified := &qosSpec{
+		Limits:       map[curveservice.ThrottleType]int64{},
+		LimitsPerGiB: map[curveservice.ThrottleType]int64{},
+	}
+	if q != nil {
+		for throttleType, limit := range q.Limits {
+			modified.Limits[throttleType] = limit
+		}
+		for throttleType, limit := range q.LimitsPerGiB {
+			modified.LimitsPerGiB[throttleType] = limit
+		}
+	}
+
+	var removed []curveservice.ThrottleType
+	for _, p := range qosParams {
+		str, hasLimit := parameters[p.param]
+		strPerGiB, hasLimitPerGiB := parameters[p.param+qosPerGiBSuffix]
+		if hasLimit && hasLimitPerGiB {
+			return nil, nil, fmt.Errorf("%s and %s can not be set at the same time", p.param, p.param+qosPerGiBSuffix)
+		}
+		if !hasLimit && !hasLimitPerGiB {
+			continue
+		}
+
+		key, limits := p.param, modified.Limits
+		if hasLimitPerGiB {
+			key, str, limits = p.param+qosPerGiBSuffix, strPerGiB, modified.LimitsPerGiB
+		}
+		limit, err := strconv.ParseInt(str, 10, 64)
+		if err != nil || limit < 0 {
+			return nil, nil, fmt.Errorf("invalid %s %q, must be a non-negative integer", key, str)
+		}
+		delete(modified.Limits, p.throttleType)
+		delete(modified.LimitsPerGiB, p.throttleType)
+		if limit == 0 {
+			removed = append(removed, p.throttleType)
+			continue
+		}
+		limits[p.throttleType] = limit
+	}
+
+	if len(modified.Limits) == 0 && len(modified.LimitsPerGiB) == 0 {
+		return nil, removed, nil
+	}
+	return modified, removed, nil
+}
+
+// isQoSParam returns true if key is a QoS parameter.
+func isQoSParam(key string) bool {
+	for _, p := range qosParams {
+		if key == p.param || key == p.param+qosPerGiBSuffix {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+)
+
+func TestParseQoSSpec(t *testing.T) {
+	q, err := parseQoSSpec(map[string]string{"user": "k8s"})
+	assert.NoError(t, err)
+	assert.Nil(t, q)
+	assert.False(t, q.scalesWithSize())
+	assert.Empty(t, q.toParameters(10))
+
+	q, err = parseQoSSpec(map[string]string{
+		"readIOPS":        "1000",
+		"writeBPSPerGiB":  "1048576",
+		"totalIOPSPerGiB": "50",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[curveservice.ThrottleType]int64{curveservice.ThrottleIOPSRead: 1000}, q.Limits)
+	assert.Equal(t, map[curveservice.ThrottleType]int64{
+		curveservice.ThrottleBPSWrite:  1048576,
+		curveservice.ThrottleIOPSTotal: 50,
+	}, q.LimitsPerGiB)
+	assert.True(t, q.scalesWithSize())
+	assert.Equal(t, map[string]string{
+		"readIOPS":  "1000",
+		"totalIOPS": "1000",
+		"writeBPS":  "20971520",
+	}, q.toParameters(20))
+
+	for _, parameters := range []map[string]string{
+		{"readIOPS": "0"},
+		{"readIOPS": "-1"},
+		{"writeBPS": "10M"},
+		{"readIOPS": "100", "readIOPSPerGiB": "10"},
+	} {
+		_, err = parseQoSSpec(parameters)
+		assert.Error(t, err, parameters)
+	}
+}
+
+func TestModifyQoSSpec(t *testing.T) {
+	q, err := parseQoSSpec(map[string]string{
+		"readIOPS":       "1000",
+		"writeBPSPerGiB": "1048576",
+	})
+	assert.NoError(t, err)
+
+	// the unrelated parameters are ignored
+	modified, removed, err := modifyQoSSpec(q, map[string]string{"cloneLazy": "false"})
+	assert.NoError(t, err)
+	assert.Empty(t, removed)
+	assert.Equal(t, q, modified)
+
+	// switch readIOPS to per GiB, remove writeBPS and add totalIOPS
+	modified, removed, err = modifyQoSSpec(q, map[string]string{
+		"readIOPSPerGiB": "10",
+		"writeBPSPerGiB": "0",
+		"totalIOPS":      "5000",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []curveservice.ThrottleType{curveservice.ThrottleBPSWrite}, removed)
+	assert.Equal(t, map[string]string{
+		"readIOPS":  "100",
+		"totalIOPS": "5000",
+	}, modified.toParameters(10))
+	// the origin is not changed
+	assert.Equal(t, int64(1000), q.Limits[curveservice.ThrottleIOPSRead])
+
+	// remove all
+	modified, removed, err = modifyQoSSpec(q, map[string]string{"readIOPS": "0", "writeBPS": "0"})
+	assert.NoError(t, err)
+	assert.Nil(t, modified)
+	assert.Len(t, removed, 2)
+
+	for _, parameters := range []map[string]string{
+		{"readIOPS": "-1"},
+		{"readIOPS": "1k"},
+		{"readIOPS": "100", "readIOPSPerGiB": "10"},
+	} {
+		_, _, err = modifyQoSSpec(q, parameters)
+		assert.Error(t, err, parameters)
+	}
+}
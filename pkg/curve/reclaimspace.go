@@ -0,0 +1,424 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/csi-addons/spec/lib/go/reclaimspace"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+	"github.com/opencurve/curve-csi/pkg/util"
+	"github.com/opencurve/curve-csi/pkg/util/ctxlog"
+)
+
+// e.g. "/mnt/staging: 1.2 GiB (1288490188 bytes) trimmed on /dev/nbd0"
+var fstrimOutputRegexp = regexp.MustCompile(`\((\d+) bytes\) trimmed`)
+
+// parseFstrimOutput returns the trimmed bytes reported by 'fstrim -v'.
+func parseFstrimOutput(output []byte) (int64, error) {
+	match := fstrimOutputRegexp.FindSubmatch(output)
+	if match == nil {
+		return 0, fmt.Errorf("unexpected output of fstrim: %q", strings.TrimSpace(string(output)))
+	}
+	return strconv.ParseInt(string(match[1]), 10, 64)
+}
+
+// reclaimSpace discards the unused blocks of the filesystem staged at stagingPath,
+// returns the reclaimed bytes. The block volumes are rejected, since the unused
+// ranges of a raw device are known only to its consumer.
+func (ns *nodeServer) reclaimSpace(ctx context.Context, volumeId, stagingPath string) (int64, error) {
+	if acquired := ns.volumeLocks.TryAcquire(volumeId); !acquired {
+		ctxlog.Infof(ctx, util.VolumeOperationAlreadyExistsFmt, volumeId)
+		return 0, status.Errorf(codes.Aborted, util.VolumeOperationAlreadyExistsFmt, volumeId)
+	}
+	defer ns.volumeLocks.Release(volumeId)
+
+	stagingTargetPath := stagingPath + "/" + volumeId
+	info, err := os.Stat(stagingTargetPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, status.Errorf(codes.NotFound, "volume %s is not staged at %s", volumeId, stagingPath)
+		}
+		return 0, status.Error(codes.Internal, err.Error())
+	}
+	if !info.IsDir() {
+		return 0, status.Errorf(codes.FailedPrecondition, "volume %s is a block volume, reclaiming space is not supported", volumeId)
+	}
+
+	output, err := util.ExecCommand("fstrim", []string{"-v", stagingTargetPath})
+	if err != nil {
+		ctxlog.ErrorS(ctx, err, "failed to run fstrim", "path", stagingTargetPath, "output", string(output))
+		return 0, status.Errorf(codes.Internal, "failed to run fstrim on %s, err: %v, output: %s", stagingTargetPath, err, output)
+	}
+	reclaimed, err := parseFstrimOutput(output)
+	if err != nil {
+		return 0, status.Error(codes.Internal, err.Error())
+	}
+	ctxlog.Infof(ctx, "reclaimed %d bytes of volume %s", reclaimed, volumeId)
+	return reclaimed, nil
+}
+
+// stagedVolume is a volume staged on the node with a filesystem.
+type stagedVolume struct {
+	volumeId    string
+	stagingPath string
+}
+
+// stagedVolumes returns the volumes staged by the driver from the mount points,
+// which are the nbd devices mounted at <staging path>/<volume ID>.
+func stagedVolumes(mountPoints []stagedMount) []stagedVolume {
+	volumes := make([]stagedVolume, 0)
+	for _, mp := range mountPoints {
+		if !strings.HasPrefix(mp.device, "/dev/nbd") {
+			continue
+		}
+		volumeId := filepath.Base(mp.path)
+		if !isStagedVolumeId(filepath.Dir(mp.path), volumeId) {
+			continue
+		}
+		volumes = append(volumes, stagedVolume{volumeId: volumeId, stagingPath: filepath.Dir(mp.path)})
+	}
+	return volumes
+}
+
+// stagedMount is a mount point of a device.
+type stagedMount struct {
+	device string
+	path   string
+}
+
+// reclaimSpaceReport is the result of a run of the space reclaimer.
+type reclaimSpaceReport struct {
+	StartedAt time.Time                   `json:"startedAt"`
+	Volumes   map[string]reclaimSpaceItem `json:"volumes"`
+}
+
+type reclaimSpaceItem struct {
+	ReclaimedBytes int64  `json:"reclaimedBytes"`
+	Error          string `json:"error,omitempty"`
+}
+
+// spaceReclaimer trims the filesystems of the staged volumes periodically, so that the
+// blocks deleted in the filesystems are returned to the thin curve volumes.
+type spaceReclaimer struct {
+	*worker
+	ns *nodeServer
+}
+
+// newSpaceReclaimer returns nil if the interval is not set.
+func newSpaceReclaimer(ns *nodeServer, interval time.Duration) *spaceReclaimer {
+	if interval <= 0 {
+		return nil
+	}
+	r := &spaceReclaimer{ns: ns}
+	r.worker = newWorker("reclaim-space", interval, func(ctx context.Context) interface{} {
+		return r.reclaim(ctx)
+	})
+	return r
+}
+
+func (r *spaceReclaimer) reclaim(ctx context.Context) *reclaimSpaceReport {
+	report := &reclaimSpaceReport{StartedAt: time.Now(), Volumes: map[string]reclaimSpaceItem{}}
+	mountPoints, err := r.ns.mounter.List()
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to list mount points: %v", err)
+		return report
+	}
+	mounts := make([]stagedMount, 0, len(mountPoints))
+	for _, mp := range mountPoints {
+		mounts = append(mounts, stagedMount{device: mp.Device, path: mp.Path})
+	}
+
+	var total int64
+	for _, vol := range stagedVolumes(mounts) {
+		item := reclaimSpaceItem{}
+		item.ReclaimedBytes, err = r.ns.reclaimSpace(ctx, vol.volumeId, vol.stagingPath)
+		if err != nil {
+			// the block volumes and the volumes in operation are skipped
+			if code := status.Code(err); code == codes.FailedPrecondition || code == codes.Aborted {
+				continue
+			}
+			ctxlog.Warningf(ctx, "failed to reclaim space of volume %s: %v", vol.volumeId, err)
+			item.Error = err.Error()
+		}
+		total += item.ReclaimedBytes
+		report.Volumes[vol.volumeId] = item
+	}
+	ctxlog.Infof(ctx, "space reclaimer done, %d volumes trimmed, %d bytes reclaimed", len(report.Volumes), total)
+	return report
+}
+
+// nodeReclaimSpaceServer is the csi-addons online space reclaim of the node, which trims
+// the filesystem of a staged volume.
+type nodeReclaimSpaceServer struct {
+	reclaimspace.UnimplementedReclaimSpaceNodeServer
+
+	ns *nodeServer
+}
+
+// NodeReclaimSpace runs fstrim on the filesystem staged at the staging target path.
+// The block volumes are skipped, since the unused ranges of a raw device are known only
+// to its consumer, which is writing to it.
+func (rs *nodeReclaimSpaceServer) NodeReclaimSpace(
+	ctx context.Context,
+	req *reclaimspace.NodeReclaimSpaceRequest) (*reclaimspace.NodeReclaimSpaceResponse, error) {
+	volumeId := req.GetVolumeId()
+	if volumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty volume ID in request")
+	}
+	stagingPath := req.GetStagingTargetPath()
+	if stagingPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty staging target path in request")
+	}
+	if req.GetVolumeCapability().GetBlock() != nil {
+		ctxlog.Infof(ctx, "volume %s is a block volume, skip reclaiming space", volumeId)
+		return &reclaimspace.NodeReclaimSpaceResponse{}, nil
+	}
+
+	preUsage := rs.ns.storageConsumption(ctx, volumeId, stagingPath, req.GetSecrets())
+	if _, err := rs.ns.reclaimSpace(ctx, volumeId, stagingPath); err != nil {
+		if status.Code(err) == codes.FailedPrecondition {
+			// staged as a block volume
+			ctxlog.Infof(ctx, "skip reclaiming space: %v", err)
+			return &reclaimspace.NodeReclaimSpaceResponse{}, nil
+		}
+		return nil, err
+	}
+	return &reclaimspace.NodeReclaimSpaceResponse{
+		PreUsage:  preUsage,
+		PostUsage: rs.ns.storageConsumption(ctx, volumeId, stagingPath, req.GetSecrets()),
+	}, nil
+}
+
+// storageConsumption returns the allocated bytes of the staged volume, nil if unknown,
+// e.g. staged by the old driver without the staging metadata.
+func (ns *nodeServer) storageConsumption(ctx context.Context, volumeId, stagingPath string, secrets map[string]string) *reclaimspace.StorageConsumption {
+	meta, err := getStageMeta(stagingPath, volumeId)
+	if err != nil || meta == nil {
+		ctxlog.Warningf(ctx, "no staging metadata of volume %s to get its usage: %v", volumeId, err)
+		return nil
+	}
+	cluster, err := ns.clusters.resolve(meta.ClusterID)
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to get info of cluster %q to get the usage of volume %s: %v", meta.ClusterID, volumeId, err)
+		return nil
+	}
+	curveVol := meta.curveVolume()
+	curveVol.MdsAddrs = cluster.MdsAddrs
+	secrets = secretsFor(secrets, meta.User)
+	if util.NewCredentials(secrets) == nil {
+		secrets = backgroundSecrets(ctx, ns.credentialsDir, meta.User)
+	}
+	if creds := util.NewCredentials(secrets); creds != nil {
+		curveVol.Password = creds.Password
+	}
+	allocated, err := curveVol.AllocatedBytes(ctx)
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to get the usage of volume %s: %v", volumeId, err)
+		return nil
+	}
+	return &reclaimspace.StorageConsumption{UsageBytes: allocated}
+}
+
+// the unit scanned for the zero ranges by the offline space reclaim
+const reclaimChunkSize = 4 << 20
+
+// BLKDISCARD of linux/fs.h, _IO(0x12, 119)
+const blkDiscard = 0x1277
+
+// byteRange is a range of a device.
+type byteRange struct {
+	offset int64
+	length int64
+}
+
+// zeroRanges returns the zero-filled chunks of the device, the adjacent ones merged.
+func zeroRanges(ctx context.Context, dev io.ReaderAt, size int64) ([]byteRange, error) {
+	buf := make([]byte, reclaimChunkSize)
+	ranges := make([]byteRange, 0)
+	for off := int64(0); off < size; off += reclaimChunkSize {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n := int64(reclaimChunkSize)
+		if size-off < n {
+			n = size - off
+		}
+		if _, err := dev.ReadAt(buf[:n], off); err != nil {
+			return nil, err
+		}
+		if !isZero(buf[:n]) {
+			continue
+		}
+		if last := len(ranges) - 1; last >= 0 && ranges[last].offset+ranges[last].length == off {
+			ranges[last].length += n
+			continue
+		}
+		ranges = append(ranges, byteRange{offset: off, length: n})
+	}
+	return ranges, nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// discardRanges discards the ranges of the device, returns the bytes discarded.
+func discardRanges(dev *os.File, ranges []byteRange) (int64, error) {
+	var discarded int64
+	for _, r := range ranges {
+		arg := [2]uint64{uint64(r.offset), uint64(r.length)}
+		// #nosec:G103, the ioctl takes the pointer to the range
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, dev.Fd(), blkDiscard, uintptr(unsafe.Pointer(&arg))); errno != 0 {
+			return discarded, fmt.Errorf("failed to discard %d bytes at %d of %s: %v", r.length, r.offset, dev.Name(), errno)
+		}
+		discarded += r.length
+	}
+	return discarded, nil
+}
+
+// controllerReclaimSpaceServer is the csi-addons offline space reclaim of the controller,
+// which discards the zero ranges of a volume attached nowhere.
+type controllerReclaimSpaceServer struct {
+	reclaimspace.UnimplementedReclaimSpaceControllerServer
+
+	cs *controllerServer
+}
+
+// newControllerReclaimSpaceServer returns nil if disabled.
+func newControllerReclaimSpaceServer(cs *controllerServer, enabled bool) *controllerReclaimSpaceServer {
+	if !enabled {
+		return nil
+	}
+	return &controllerReclaimSpaceServer{cs: cs}
+}
+
+// ControllerReclaimSpace maps the volume on the controller exclusively, and discards its
+// zero-filled ranges, which are returned to the cluster. The volumes attached to any host,
+// whose filesystems are trimmed by NodeReclaimSpace, and the lazy clones, whose discarded
+// ranges would read from the clone source again, are skipped with the usage unchanged.
+func (rs *controllerReclaimSpaceServer) ControllerReclaimSpace(
+	ctx context.Context,
+	req *reclaimspace.ControllerReclaimSpaceRequest) (*reclaimspace.ControllerReclaimSpaceResponse, error) {
+	volumeId := req.GetVolumeId()
+	if volumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty volume ID in request")
+	}
+	volOptions, err := newVolumeOptionsFromVolID(volumeId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if acquired := rs.cs.volumeLocks.TryAcquire(volOptions.reqName); !acquired {
+		ctxlog.Infof(ctx, util.VolumeOperationAlreadyExistsFmt, volumeId)
+		return nil, status.Errorf(codes.Aborted, util.VolumeOperationAlreadyExistsFmt, volOptions.reqName)
+	}
+	defer rs.cs.volumeLocks.Release(volOptions.reqName)
+
+	if err = volOptions.resolveCluster(rs.cs.clusters); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	secrets := req.GetSecrets()
+	if util.NewCredentials(secrets) == nil {
+		secrets = backgroundSecrets(ctx, rs.cs.credentialsDir, volOptions.user)
+	}
+	if err = volOptions.applyCredentials(secrets); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	curveVol := volOptions.curveVolume()
+	detail, err := curveVol.Stat(ctx)
+	if err != nil {
+		if util.IsNotFoundErr(err) {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeId)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	preUsage, err := curveVol.AllocatedBytes(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp := &reclaimspace.ControllerReclaimSpaceResponse{
+		PreUsage:  &reclaimspace.StorageConsumption{UsageBytes: preUsage},
+		PostUsage: &reclaimspace.StorageConsumption{UsageBytes: preUsage},
+	}
+	if detail.FileStatus != curveservice.CurveVolumeStatusCreated {
+		ctxlog.Infof(ctx, "volume %s is %s, skip reclaiming space", volumeId, detail.FileStatus)
+		return resp, nil
+	}
+
+	discarded, err := discardZeroRanges(ctx, curveVol, int64(detail.LengthGiB)<<30)
+	if err != nil {
+		var inUse *curveservice.InUseError
+		if errors.Is(err, errVolumeAttached) || errors.As(err, &inUse) {
+			ctxlog.Infof(ctx, "volume %s is attached, skip reclaiming space: %v", volumeId, err)
+			return resp, nil
+		}
+		ctxlog.ErrorS(ctx, err, "failed to reclaim space", "volumeId", volumeId)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	postUsage, err := curveVol.AllocatedBytes(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp.PostUsage.UsageBytes = postUsage
+	ctxlog.Infof(ctx, "discarded %d bytes of volume %s, allocated %d bytes before, %d bytes after", discarded, volumeId, preUsage, postUsage)
+	return resp, nil
+}
+
+var errVolumeAttached = errors.New("the volume is mapped on the controller")
+
+// discardZeroRanges maps the volume exclusively, and discards its zero ranges.
+// The in-use check of mapping rejects the volume opened by the other hosts, and
+// stops them from mapping it in the meantime.
+func discardZeroRanges(ctx context.Context, curveVol *curveservice.CurveVolume, size int64) (int64, error) {
+	device, err := curveVol.MappedDevice(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if device != "" {
+		return 0, fmt.Errorf("%w at %s", errVolumeAttached, device)
+	}
+	dev, closeDev, err := openMapped(ctx, curveVol, os.O_RDWR|syscall.O_EXCL)
+	if err != nil {
+		return 0, err
+	}
+	defer closeDev()
+	ranges, err := zeroRanges(ctx, dev, size)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %v", curveVol.FilePath, err)
+	}
+	return discardRanges(dev, ranges)
+}
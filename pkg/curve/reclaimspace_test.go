@@ -0,0 +1,138 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/csi-addons/spec/lib/go/reclaimspace"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/opencurve/curve-csi/pkg/util"
+)
+
+func TestParseFstrimOutput(t *testing.T) {
+	n, err := parseFstrimOutput([]byte("/mnt/staging/vol: 1.2 GiB (1288490188 bytes) trimmed on /dev/nbd0\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1288490188), n)
+
+	// the older fstrim does not print the device
+	n, err = parseFstrimOutput([]byte("/mnt/staging/vol: 0 B (0 bytes) trimmed\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+
+	_, err = parseFstrimOutput([]byte("fstrim: /mnt: the discard operation is not supported\n"))
+	assert.Error(t, err)
+}
+
+func TestStagedVolumes(t *testing.T) {
+	volumeId := "0003-k8s-csi-vol-pvc-eeafeeb3-7a35-11ea-934a-fa163e28f309"
+	stagingPath := "/var/lib/kubelet/plugins/kubernetes.io/csi/curve.csi.netease.com/abc/globalmount"
+	volumes := stagedVolumes([]stagedMount{
+		{device: "/dev/nbd0", path: stagingPath + "/" + volumeId},
+		// published
+		{device: "/dev/nbd0", path: "/var/lib/kubelet/pods/xyz/volumes/kubernetes.io~csi/pvc-eeafeeb3/mount"},
+		// not a curve volume
+		{device: "/dev/sda1", path: "/var/lib/docker/" + volumeId},
+	})
+	assert.Equal(t, []stagedVolume{{volumeId: volumeId, stagingPath: stagingPath}}, volumes)
+}
+
+func TestReclaimSpaceRejected(t *testing.T) {
+	ctx := context.TODO()
+	ns := &nodeServer{volumeLocks: util.NewVolumeLocks()}
+	stagingPath := t.TempDir()
+
+	_, err := ns.reclaimSpace(ctx, "vol", stagingPath)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// staged as a block volume
+	assert.NoError(t, os.WriteFile(filepath.Join(stagingPath, "vol"), nil, 0o600))
+	_, err = ns.reclaimSpace(ctx, "vol", stagingPath)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	assert.True(t, ns.volumeLocks.TryAcquire("vol"))
+	_, err = ns.reclaimSpace(ctx, "vol", stagingPath)
+	assert.Equal(t, codes.Aborted, status.Code(err))
+}
+
+func TestNodeReclaimSpace(t *testing.T) {
+	ctx := context.TODO()
+	rs := &nodeReclaimSpaceServer{ns: &nodeServer{volumeLocks: util.NewVolumeLocks()}}
+	stagingPath := t.TempDir()
+
+	_, err := rs.NodeReclaimSpace(ctx, &reclaimspace.NodeReclaimSpaceRequest{StagingTargetPath: stagingPath})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = rs.NodeReclaimSpace(ctx, &reclaimspace.NodeReclaimSpaceRequest{VolumeId: "vol"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = rs.NodeReclaimSpace(ctx, &reclaimspace.NodeReclaimSpaceRequest{VolumeId: "vol", StagingTargetPath: stagingPath})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// the block volumes are skipped
+	resp, err := rs.NodeReclaimSpace(ctx, &reclaimspace.NodeReclaimSpaceRequest{
+		VolumeId:          "vol",
+		StagingTargetPath: stagingPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, resp.GetPreUsage())
+	assert.NoError(t, os.WriteFile(filepath.Join(stagingPath, "vol"), nil, 0o600))
+	_, err = rs.NodeReclaimSpace(ctx, &reclaimspace.NodeReclaimSpaceRequest{VolumeId: "vol", StagingTargetPath: stagingPath})
+	assert.NoError(t, err)
+}
+
+func TestControllerReclaimSpaceRejected(t *testing.T) {
+	ctx := context.TODO()
+	rs := newControllerReclaimSpaceServer(&controllerServer{volumeLocks: util.NewVolumeLocks()}, true)
+
+	_, err := rs.ControllerReclaimSpace(ctx, &reclaimspace.ControllerReclaimSpaceRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = rs.ControllerReclaimSpace(ctx, &reclaimspace.ControllerReclaimSpaceRequest{VolumeId: "invalid"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Nil(t, newControllerReclaimSpaceServer(&controllerServer{}, false))
+}
+
+func TestZeroRanges(t *testing.T) {
+	ctx := context.TODO()
+	size := int64(5*reclaimChunkSize + 512)
+	data := make([]byte, size)
+	// the chunks 1 and 4 are written
+	data[reclaimChunkSize+100] = 1
+	data[4*reclaimChunkSize] = 1
+
+	ranges, err := zeroRanges(ctx, bytes.NewReader(data), size)
+	assert.NoError(t, err)
+	assert.Equal(t, []byteRange{
+		{offset: 0, length: reclaimChunkSize},
+		{offset: 2 * reclaimChunkSize, length: 2 * reclaimChunkSize},
+		{offset: 5 * reclaimChunkSize, length: 512},
+	}, ranges)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = zeroRanges(canceled, bytes.NewReader(data), size)
+	assert.Error(t, err)
+}
@@ -0,0 +1,892 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/csi-addons/spec/lib/go/replication"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+	"github.com/opencurve/curve-csi/pkg/util"
+	"github.com/opencurve/curve-csi/pkg/util/ctxlog"
+)
+
+const (
+	// the metadata kind of the replication of volumes, the subdir in the metadata dir
+	replicationMetaDir = "replication"
+	// the infix of the clone of a sync, and the name prefix of its snapshot
+	mirrorVolInfix       = "-mirror-"
+	mirrorSnapshotPrefix = "mirror-"
+
+	// VolumeReplicationClass parameters
+	replicationPeerClusterParam = "secondaryClusterID"
+	replicationIntervalParam    = "schedulingInterval"
+
+	defaultReplicationInterval = time.Hour
+)
+
+type replicationRole string
+
+const (
+	replicationPrimary   replicationRole = "primary"
+	replicationSecondary replicationRole = "secondary"
+)
+
+// replicationMeta is the replication state of a volume. The volume is mirrored
+// to the volume of the same user and name in the peer cluster.
+type replicationMeta struct {
+	// the cluster of the mirror, empty if unknown, e.g. promoted without enabling
+	PeerClusterID string          `json:"peerClusterID,omitempty"`
+	Interval      time.Duration   `json:"interval"`
+	Role          replicationRole `json:"role"`
+	// the snapshot time of the last sync
+	LastSyncTime *time.Time `json:"lastSyncTime,omitempty"`
+	// the bytes written to the destination by the last sync, -1 if unknown
+	LastSyncBytes int64  `json:"lastSyncBytes"`
+	LastError     string `json:"lastError,omitempty"`
+	// the clone of the last push in the local cluster, the image the peer holds,
+	// the next push writes the chunks changed since it only
+	BaseVolume string `json:"baseVolume,omitempty"`
+	// pulling a copy from the peer is requested by resync, and is done
+	Resyncing bool `json:"resyncing,omitempty"`
+	Resynced  bool `json:"resynced,omitempty"`
+	// disabled, the record is deleted once the round is cleaned up
+	Disabled bool `json:"disabled,omitempty"`
+	// the sync in progress
+	Round *mirrorRound `json:"round,omitempty"`
+}
+
+// due returns true if a round should be started or advanced.
+func (m *replicationMeta) due(now time.Time) bool {
+	if m.Round != nil || m.Disabled {
+		return true
+	}
+	if m.PeerClusterID == "" {
+		return false
+	}
+	if m.Role == replicationSecondary {
+		return m.Resyncing
+	}
+	return m.LastSyncTime == nil || now.Sub(*m.LastSyncTime) >= m.Interval
+}
+
+// cleaned returns true if neither a round nor the base is left in the clusters,
+// then the record may be deleted.
+func (m *replicationMeta) cleaned() bool {
+	return m.Round == nil && m.BaseVolume == ""
+}
+
+// parseReplicationParams parses the VolumeReplicationClass parameters,
+// the peer cluster is empty if not set.
+func parseReplicationParams(parameters map[string]string) (string, time.Duration, error) {
+	interval := defaultReplicationInterval
+	if str, ok := parameters[replicationIntervalParam]; ok {
+		d, err := time.ParseDuration(str)
+		if err != nil || d < time.Minute {
+			return "", 0, fmt.Errorf("invalid %s %q, must be a duration not less than 1m", replicationIntervalParam, str)
+		}
+		interval = d
+	}
+	return parameters[replicationPeerClusterParam], interval, nil
+}
+
+// replicationServer implements the csi-addons replication service by mirroring
+// the snapshots of the primary volume to the peer cluster periodically.
+type replicationServer struct {
+	replication.UnimplementedControllerServer
+	*worker
+
+	cs    *controllerServer
+	store util.ObjectStore
+	// copies the data between clusters, see docs/replication.md
+	copier mirrorCopier
+	// the volumes in syncing, the replication RPCs are aborted while syncing
+	syncing *util.VolumeLocks
+	now     func() time.Time
+}
+
+// newReplicationServer returns nil if the copier is not set.
+func newReplicationServer(cs *controllerServer, store util.ObjectStore, copier mirrorCopier) (*replicationServer, error) {
+	if copier == nil {
+		return nil, nil
+	}
+	if store == nil {
+		return nil, fmt.Errorf("the replication requires the metadata store")
+	}
+	rs := &replicationServer{
+		cs:      cs,
+		store:   store,
+		copier:  copier,
+		syncing: util.NewVolumeLocks(),
+		now:     time.Now,
+	}
+	rs.worker = newWorker("replication", time.Minute, func(ctx context.Context) interface{} {
+		rs.check(ctx)
+		return nil
+	})
+	return rs, nil
+}
+
+// replicationVolumeId returns the volume of the request, from the replication source if
+// the volume ID is not set. The replication of volume groups is not supported.
+func replicationVolumeId(req interface {
+	GetVolumeId() string
+	GetReplicationSource() *replication.ReplicationSource
+}) (string, error) {
+	source := req.GetReplicationSource()
+	if source.GetVolumegroup() != nil {
+		return "", status.Error(codes.InvalidArgument, "the replication of volume groups is not supported")
+	}
+	volumeId := req.GetVolumeId()
+	if volumeId == "" {
+		volumeId = source.GetVolume().GetVolumeId()
+	}
+	if volumeId == "" {
+		return "", status.Error(codes.InvalidArgument, "empty volume ID in request")
+	}
+	return volumeId, nil
+}
+
+// get returns nil if not found.
+func (rs *replicationServer) get(volumeId string) (*replicationMeta, error) {
+	meta := &replicationMeta{}
+	if err := rs.store.Get(volumeId, meta); err != nil {
+		if util.IsNotFoundErr(err, volumeId) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return meta, nil
+}
+
+// lock locks out the other RPCs and the sync of the volume, returns the release func.
+func (rs *replicationServer) lock(ctx context.Context, volumeId string) (func(), error) {
+	if acquired := rs.cs.volumeLocks.TryAcquire(volumeId); !acquired {
+		ctxlog.Infof(ctx, util.VolumeOperationAlreadyExistsFmt, volumeId)
+		return nil, status.Errorf(codes.Aborted, util.VolumeOperationAlreadyExistsFmt, volumeId)
+	}
+	if acquired := rs.syncing.TryAcquire(volumeId); !acquired {
+		rs.cs.volumeLocks.Release(volumeId)
+		return nil, status.Errorf(codes.Aborted, "volume %s is syncing", volumeId)
+	}
+	return func() {
+		rs.syncing.Release(volumeId)
+		rs.cs.volumeLocks.Release(volumeId)
+	}, nil
+}
+
+// localVolume returns the options of the volume, and of its mirror if peerClusterID is set.
+func (rs *replicationServer) localVolume(volumeId, peerClusterID string, secrets map[string]string) (*volumeOptions, *volumeOptions, error) {
+	volOptions, err := newVolumeOptionsFromVolID(volumeId)
+	if err != nil {
+		return nil, nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err = volOptions.resolveCluster(rs.cs.clusters); err != nil {
+		return nil, nil, status.Error(codes.Internal, err.Error())
+	}
+	if err = volOptions.applyCredentials(secrets); err != nil {
+		return nil, nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if peerClusterID == "" {
+		return volOptions, nil, nil
+	}
+	if peerClusterID == volOptions.clusterID {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "the %s must be another cluster than %q", replicationPeerClusterParam, peerClusterID)
+	}
+	peerOptions, err := volOptions.mirrorIn(rs.cs.clusters, peerClusterID)
+	if err != nil {
+		return nil, nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return volOptions, peerOptions, nil
+}
+
+// mirrorIn returns the options of the volume with the same user and name in the cluster.
+// The mirror is in the default poolset, since the poolset may not exist in the cluster.
+func (vo *volumeOptions) mirrorIn(cr *clusterResolver, clusterID string) (*volumeOptions, error) {
+	mirror := *vo
+	mirror.clusterID = clusterID
+	mirror.placement = placement{}
+	if err := mirror.resolveCluster(cr); err != nil {
+		return nil, err
+	}
+	if err := mirror.composeVolID(); err != nil {
+		return nil, err
+	}
+	return &mirror, nil
+}
+
+// EnableVolumeReplication creates the mirror of the volume in the peer cluster,
+// the volume is synced to it every interval.
+func (rs *replicationServer) EnableVolumeReplication(
+	ctx context.Context,
+	req *replication.EnableVolumeReplicationRequest) (*replication.EnableVolumeReplicationResponse, error) {
+	volumeId, err := replicationVolumeId(req)
+	if err != nil {
+		return nil, err
+	}
+	peerClusterID, interval, err := parseReplicationParams(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if peerClusterID == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing parameter %s", replicationPeerClusterParam)
+	}
+	release, err := rs.lock(ctx, volumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	volOptions, peerOptions, err := rs.localVolume(volumeId, peerClusterID, req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	if !volOptions.snapshotEnabled() || !peerOptions.snapshotEnabled() {
+		return nil, status.Error(codes.FailedPrecondition, "the replication requires the snapshot server of both clusters")
+	}
+	volDetail, err := volOptions.curveVolume().Stat(ctx)
+	if err != nil {
+		if util.IsNotFoundErr(err) {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeId)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	meta, err := rs.get(volumeId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if meta == nil || meta.Disabled {
+		// the mirror is created once, it is kept after disabling
+		peerOptions.sizeGiB = volDetail.LengthGiB
+		if err = ensureMirrorVolume(ctx, peerOptions); err != nil {
+			ctxlog.ErrorS(ctx, err, "failed to create mirror volume", "clusterID", peerClusterID)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if meta == nil {
+		meta = &replicationMeta{Role: replicationPrimary}
+	}
+	meta.PeerClusterID = peerClusterID
+	meta.Interval = interval
+	meta.Disabled = false
+	if err = rs.store.Put(volumeId, meta); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	ctxlog.Infof(ctx, "enabled replication of volume %s to cluster %q, role: %s", volumeId, peerClusterID, meta.Role)
+	return &replication.EnableVolumeReplicationResponse{}, nil
+}
+
+// ensureMirrorVolume creates the mirror volume, or expands it to the size.
+func ensureMirrorVolume(ctx context.Context, mirror *volumeOptions) error {
+	curveVol := mirror.curveVolume()
+	detail, err := curveVol.Stat(ctx)
+	if err != nil {
+		if !util.IsNotFoundErr(err) {
+			return err
+		}
+		return curveVol.Create(ctx)
+	}
+	if detail.LengthGiB < mirror.sizeGiB {
+		return curveVol.Extend(ctx, mirror.sizeGiB)
+	}
+	return nil
+}
+
+// DisableVolumeReplication stops syncing the volume, the mirror is kept.
+func (rs *replicationServer) DisableVolumeReplication(
+	ctx context.Context,
+	req *replication.DisableVolumeReplicationRequest) (*replication.DisableVolumeReplicationResponse, error) {
+	volumeId, err := replicationVolumeId(req)
+	if err != nil {
+		return nil, err
+	}
+	release, err := rs.lock(ctx, volumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	meta, err := rs.get(volumeId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if meta == nil {
+		return &replication.DisableVolumeReplicationResponse{}, nil
+	}
+	// the round and the base are cleaned up in background
+	if !meta.cleaned() {
+		meta.Disabled = true
+		err = rs.store.Put(volumeId, meta)
+	} else {
+		err = rs.store.Delete(volumeId)
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	ctxlog.Infof(ctx, "disabled replication of volume %s", volumeId)
+	return &replication.DisableVolumeReplicationResponse{}, nil
+}
+
+// PromoteVolume makes the volume primary, it is synced to the peer from then on.
+// Without force, a volume in resyncing is not promoted.
+func (rs *replicationServer) PromoteVolume(
+	ctx context.Context,
+	req *replication.PromoteVolumeRequest) (*replication.PromoteVolumeResponse, error) {
+	volumeId, err := replicationVolumeId(req)
+	if err != nil {
+		return nil, err
+	}
+	peerClusterID, interval, err := parseReplicationParams(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	release, err := rs.lock(ctx, volumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// the volume must exist, the peer may not be reachable
+	volOptions, _, err := rs.localVolume(volumeId, "", req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	if _, err = volOptions.curveVolume().Stat(ctx); err != nil {
+		if util.IsNotFoundErr(err) {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeId)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	meta, err := rs.get(volumeId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if meta == nil {
+		// e.g. the mirror is promoted in the secondary site
+		meta = &replicationMeta{PeerClusterID: peerClusterID, Interval: interval, Role: replicationSecondary}
+	}
+	if meta.Role == replicationPrimary {
+		return &replication.PromoteVolumeResponse{}, nil
+	}
+	if meta.Resyncing && !req.GetForce() {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is resyncing from the peer", volumeId)
+	}
+	meta.Role = replicationPrimary
+	meta.Resyncing = false
+	meta.Resynced = false
+	// the data is changed here, a full sync to the peer is required
+	meta.LastSyncTime = nil
+	if err = rs.store.Put(volumeId, meta); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	ctxlog.Infof(ctx, "promoted volume %s to primary", volumeId)
+	return &replication.PromoteVolumeResponse{}, nil
+}
+
+// DemoteVolume makes the volume secondary, it is not synced to the peer any more.
+func (rs *replicationServer) DemoteVolume(
+	ctx context.Context,
+	req *replication.DemoteVolumeRequest) (*replication.DemoteVolumeResponse, error) {
+	volumeId, err := replicationVolumeId(req)
+	if err != nil {
+		return nil, err
+	}
+	release, err := rs.lock(ctx, volumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	meta, err := rs.get(volumeId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if meta == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "replication of volume %s is not enabled", volumeId)
+	}
+	if meta.Role == replicationSecondary {
+		return &replication.DemoteVolumeResponse{}, nil
+	}
+	meta.Role = replicationSecondary
+	meta.Resynced = false
+	if err = rs.store.Put(volumeId, meta); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	ctxlog.Infof(ctx, "demoted volume %s to secondary", volumeId)
+	return &replication.DemoteVolumeResponse{}, nil
+}
+
+// ResyncVolume pulls a full copy of the peer to the secondary volume, it returns
+// ready once the copy is done. With force, the copy is pulled again.
+func (rs *replicationServer) ResyncVolume(
+	ctx context.Context,
+	req *replication.ResyncVolumeRequest) (*replication.ResyncVolumeResponse, error) {
+	volumeId, err := replicationVolumeId(req)
+	if err != nil {
+		return nil, err
+	}
+	peerClusterID, _, err := parseReplicationParams(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	release, err := rs.lock(ctx, volumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	meta, err := rs.get(volumeId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if meta == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "replication of volume %s is not enabled", volumeId)
+	}
+	if meta.Role != replicationSecondary {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is not secondary", volumeId)
+	}
+	if peerClusterID != "" {
+		meta.PeerClusterID = peerClusterID
+	}
+	if meta.PeerClusterID == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "the peer of volume %s is unknown, set %s", volumeId, replicationPeerClusterParam)
+	}
+	if meta.Resynced && !req.GetForce() {
+		return &replication.ResyncVolumeResponse{Ready: true}, nil
+	}
+	if !meta.Resyncing {
+		meta.Resyncing = true
+		meta.Resynced = false
+		if err = rs.store.Put(volumeId, meta); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		ctxlog.Infof(ctx, "resyncing volume %s from cluster %q", volumeId, meta.PeerClusterID)
+	}
+	return &replication.ResyncVolumeResponse{Ready: false}, nil
+}
+
+// GetVolumeReplicationInfo returns the snapshot time of the last sync of the primary volume.
+func (rs *replicationServer) GetVolumeReplicationInfo(
+	ctx context.Context,
+	req *replication.GetVolumeReplicationInfoRequest) (*replication.GetVolumeReplicationInfoResponse, error) {
+	volumeId, err := replicationVolumeId(req)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := rs.get(volumeId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if meta == nil || meta.Disabled {
+		return nil, status.Errorf(codes.FailedPrecondition, "replication of volume %s is not enabled", volumeId)
+	}
+	if meta.Role != replicationPrimary {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is not primary", volumeId)
+	}
+	if meta.LastSyncTime == nil {
+		return nil, status.Errorf(codes.Unavailable, "volume %s is not synced yet", volumeId)
+	}
+	return &replication.GetVolumeReplicationInfoResponse{
+		LastSyncTime: timestamppb.New(*meta.LastSyncTime),
+	}, nil
+}
+
+// mirrorStage is the stage of a sync round.
+type mirrorStage string
+
+const (
+	// the snapshot of the source is being taken
+	mirrorSnapshotting mirrorStage = "snapshotting"
+	// the snapshot is being cloned to the mirror volume in the source cluster
+	mirrorCloning mirrorStage = "cloning"
+	// the mirror volume is being copied to the destination
+	mirrorCopying mirrorStage = "copying"
+	// the mirror volume unless kept, the stale base, the clone task and the snapshot are being deleted
+	mirrorCleaning mirrorStage = "cleaning"
+)
+
+// mirrorRound is a sync from the primary to the peer, or the pull of a resync.
+// The source is snapshotted and the snapshot is cloned to the mirror volume,
+// which is a consistent point-in-time image readable by the copier.
+type mirrorRound struct {
+	// pulls from the peer to the local volume
+	Pull          bool        `json:"pull,omitempty"`
+	Stage         mirrorStage `json:"stage"`
+	SnapshotUUID  string      `json:"snapshotUUID,omitempty"`
+	CloneTaskUUID string      `json:"cloneTaskUUID,omitempty"`
+	StartedAt     time.Time   `json:"startedAt"`
+	// the clone of the snapshot in the source cluster, kept as the base of the next push once copied
+	MirrorVolume string `json:"mirrorVolume,omitempty"`
+	KeepMirror   bool   `json:"keepMirror,omitempty"`
+	// the base replaced or invalidated, deleted from the local cluster by the cleaning
+	StaleBase string `json:"staleBase,omitempty"`
+}
+
+// newMirrorRound returns the next round of the volume. The base is dropped
+// if the peer is not known to hold it, i.e. by a pull, or by a push requiring
+// a full sync, e.g. after the promotion.
+func newMirrorRound(meta *replicationMeta, volName string, now time.Time) *mirrorRound {
+	round := &mirrorRound{
+		Pull:         meta.Role == replicationSecondary,
+		StartedAt:    now,
+		MirrorVolume: mirrorVolName(volName, now),
+	}
+	if meta.BaseVolume != "" && (round.Pull || meta.LastSyncTime == nil) {
+		round.StaleBase = meta.BaseVolume
+		meta.BaseVolume = ""
+	}
+	return round
+}
+
+// mirrorVolName returns the name of the clone of the volume by the round started at the time.
+func mirrorVolName(volName string, startedAt time.Time) string {
+	return fmt.Sprintf("%s%s%d", volName, mirrorVolInfix, startedAt.Unix())
+}
+
+// mirrorSourceName returns the name of the volume of the clone of a round,
+// or the name itself if not a clone.
+func mirrorSourceName(name string) string {
+	i := strings.LastIndex(name, mirrorVolInfix)
+	if i <= 0 {
+		return name
+	}
+	if _, err := strconv.ParseInt(name[i+len(mirrorVolInfix):], 10, 64); err != nil {
+		return name
+	}
+	return name[:i]
+}
+
+// forget drops the replication of the deleted volume, the failure is only logged.
+// The record of a volume in syncing is dropped by the sync once it finds the volume gone.
+func (rs *replicationServer) forget(ctx context.Context, volumeId string) {
+	if rs == nil {
+		return
+	}
+	if acquired := rs.syncing.TryAcquire(volumeId); !acquired {
+		return
+	}
+	defer rs.syncing.Release(volumeId)
+	meta, err := rs.get(volumeId)
+	if err != nil || meta == nil {
+		return
+	}
+	if !meta.cleaned() {
+		meta.Disabled = true
+		err = rs.store.Put(volumeId, meta)
+	} else {
+		err = rs.store.Delete(volumeId)
+	}
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to drop replication of volume %s: %v", volumeId, err)
+	}
+}
+
+// ServeHTTP returns the replication of all the volumes in json.
+func (rs *replicationServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	metas := make(map[string]*replicationMeta)
+	keys, err := rs.store.Keys()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, volumeId := range keys {
+		if meta, err := rs.get(volumeId); err == nil && meta != nil {
+			metas[volumeId] = meta
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(metas)
+}
+
+// check advances each due volume in its own goroutine, the volumes in syncing are skipped.
+// It waits for the syncs, so none is left running once the worker is stopped.
+func (rs *replicationServer) check(ctx context.Context) {
+	keys, err := rs.store.Keys()
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to list replicated volumes: %v", err)
+		return
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	now := rs.now()
+	for _, volumeId := range keys {
+		if acquired := rs.syncing.TryAcquire(volumeId); !acquired {
+			continue
+		}
+		meta, err := rs.get(volumeId)
+		if err != nil || meta == nil || !meta.due(now) {
+			if err != nil {
+				ctxlog.Warningf(ctx, "failed to get replication of volume %s: %v", volumeId, err)
+			}
+			rs.syncing.Release(volumeId)
+			continue
+		}
+		wg.Add(1)
+		go func(volumeId string, meta *replicationMeta) {
+			defer wg.Done()
+			defer rs.syncing.Release(volumeId)
+			rs.sync(ctx, volumeId, meta)
+		}(volumeId, meta)
+	}
+}
+
+// sync advances the round of the volume until it waits for the backend, fails or is done.
+// The state is persisted after each stage, so the round is resumed after restart.
+func (rs *replicationServer) sync(ctx context.Context, volumeId string, meta *replicationMeta) {
+	local, peer, err := rs.localVolume(volumeId, meta.PeerClusterID, nil)
+	if err == nil {
+		// the sync has no CSI secrets, the ones of the user are loaded from the credentials dir
+		err = local.applyCredentials(backgroundSecrets(ctx, rs.cs.credentialsDir, local.user))
+	}
+	if err == nil && peer != nil {
+		peer.creds = local.creds
+	}
+	if err == nil {
+		_, err = local.curveVolume().Stat(ctx)
+		if err != nil && util.IsNotFoundErr(err) {
+			// the volume is deleted, cleans up and drops the replication
+			ctxlog.Infof(ctx, "volume %s not found, disabling its replication", volumeId)
+			meta.Disabled = true
+			err = nil
+		}
+	}
+	if err != nil {
+		rs.failed(ctx, volumeId, meta, err)
+		return
+	}
+
+	for ctx.Err() == nil {
+		round := meta.Round
+		if round == nil {
+			switch {
+			case meta.Disabled && meta.cleaned():
+				if err = rs.store.Delete(volumeId); err != nil {
+					ctxlog.Warningf(ctx, "failed to delete replication of volume %s: %v", volumeId, err)
+				}
+				return
+			case meta.Disabled:
+				// only the base is left
+				round = &mirrorRound{Stage: mirrorCleaning, StartedAt: rs.now(), StaleBase: meta.BaseVolume}
+				meta.BaseVolume = ""
+			default:
+				round = newMirrorRound(meta, local.volName, rs.now())
+			}
+			// persisted with the stale base by the next save, even if the stage fails
+			meta.Round = round
+		} else if meta.Disabled || round.Pull != (meta.Role == replicationSecondary) {
+			// disabled, promoted or demoted since the round started
+			round.Stage = mirrorCleaning
+		}
+
+		src, dst := local, peer
+		if round.Pull {
+			src, dst = peer, local
+		}
+		done, err := rs.advance(ctx, meta, round, src, dst)
+		if err != nil {
+			rs.failed(ctx, volumeId, meta, err)
+			return
+		}
+		if err = rs.store.Put(volumeId, meta); err != nil {
+			ctxlog.Warningf(ctx, "failed to save replication of volume %s: %v", volumeId, err)
+			return
+		}
+		if !done || meta.Round == nil {
+			if meta.Round == nil && meta.Disabled {
+				continue
+			}
+			return
+		}
+	}
+}
+
+// advance runs the current stage of the round, returns false if waiting for the backend.
+func (rs *replicationServer) advance(
+	ctx context.Context,
+	meta *replicationMeta,
+	round *mirrorRound,
+	src, dst *volumeOptions) (bool, error) {
+	snapServer := src.snapshotServer()
+	mirror := *src
+	mirror.volName = round.MirrorVolume
+	mirrorPath := mirror.genVolumePath()
+
+	switch round.Stage {
+	case "":
+		snapName := fmt.Sprintf("%s%d", mirrorSnapshotPrefix, round.StartedAt.Unix())
+		snapUUID, err := snapServer.CreateSnapshot(ctx, snapName)
+		if err != nil {
+			return false, fmt.Errorf("failed to snapshot %s: %v", src.genVolumePath(), err)
+		}
+		round.SnapshotUUID = snapUUID
+		round.Stage = mirrorSnapshotting
+		ctxlog.Infof(ctx, "started syncing %s to cluster %q with snapshot %s", src.genVolumePath(), dst.clusterID, snapUUID)
+	case mirrorSnapshotting:
+		snap, err := snapServer.GetFileSnapshotOfId(ctx, round.SnapshotUUID)
+		if err != nil {
+			return false, fmt.Errorf("failed to get snapshot %s: %v", round.SnapshotUUID, err)
+		}
+		switch snap.Status {
+		case curveservice.SnapshotStatusDone:
+		case curveservice.SnapshotStatusError:
+			round.Stage = mirrorCleaning
+			return false, fmt.Errorf("snapshot %s of %s failed", round.SnapshotUUID, src.genVolumePath())
+		default:
+			return false, nil
+		}
+		taskUUID, err := snapServer.Clone(ctx, round.SnapshotUUID, mirrorPath, false)
+		if err != nil {
+			return false, fmt.Errorf("failed to clone snapshot %s to %s: %v", round.SnapshotUUID, mirrorPath, err)
+		}
+		round.CloneTaskUUID = taskUUID
+		round.Stage = mirrorCloning
+	case mirrorCloning:
+		task, err := snapServer.GetCloneTaskOfId(ctx, round.CloneTaskUUID)
+		if err != nil {
+			return false, fmt.Errorf("failed to get clone task %s: %v", round.CloneTaskUUID, err)
+		}
+		switch task.TaskStatus {
+		case curveservice.TaskStatusDone:
+			round.Stage = mirrorCopying
+		case curveservice.TaskStatusError:
+			round.Stage = mirrorCleaning
+			return false, fmt.Errorf("clone task %s to %s failed", round.CloneTaskUUID, mirrorPath)
+		default:
+			return false, nil
+		}
+	case mirrorCopying:
+		// the base is of the pushes only, a pull has none
+		var base *volumeOptions
+		if !round.Pull && meta.BaseVolume != "" {
+			base = &volumeOptions{}
+			*base = *src
+			base.volName = meta.BaseVolume
+		}
+		written, err := rs.copy(ctx, &mirror, base, dst)
+		if err != nil {
+			return false, err
+		}
+		syncTime := round.StartedAt
+		meta.LastSyncTime = &syncTime
+		meta.LastSyncBytes = written
+		meta.LastError = ""
+		if round.Pull {
+			meta.Resyncing = false
+			meta.Resynced = true
+		} else {
+			// the clone is the image the peer holds now, the base of the next push
+			if meta.BaseVolume != "" {
+				round.StaleBase = meta.BaseVolume
+			}
+			meta.BaseVolume = round.MirrorVolume
+			round.KeepMirror = true
+		}
+		round.Stage = mirrorCleaning
+		ctxlog.Infof(ctx, "synced %s to cluster %q, %d bytes written", src.genVolumePath(), dst.clusterID, written)
+	case mirrorCleaning:
+		if round.CloneTaskUUID != "" {
+			task, err := snapServer.GetCloneTaskOfId(ctx, round.CloneTaskUUID)
+			if err != nil && !util.IsNotFoundErr(err) {
+				return false, fmt.Errorf("failed to get clone task %s: %v", round.CloneTaskUUID, err)
+			}
+			if err == nil {
+				if task.TaskStatus != curveservice.TaskStatusDone && task.TaskStatus != curveservice.TaskStatusError {
+					return false, nil
+				}
+				if !round.KeepMirror {
+					if err = mirror.curveVolume().Delete(ctx, true); err != nil && !util.IsNotFoundErr(err) {
+						return false, fmt.Errorf("failed to delete %s: %v", mirrorPath, err)
+					}
+				}
+				// the clone is kept, only the task is cleaned
+				if err = snapServer.CleanFinishedCloneTask(ctx, round.CloneTaskUUID); err != nil {
+					return false, fmt.Errorf("failed to clean clone task %s: %v", round.CloneTaskUUID, err)
+				}
+			}
+			round.CloneTaskUUID = ""
+		}
+		if round.SnapshotUUID != "" {
+			if err := snapServer.DeleteSnapshot(ctx, round.SnapshotUUID); err != nil && !util.IsNotFoundErr(err) {
+				return false, fmt.Errorf("failed to delete snapshot %s: %v", round.SnapshotUUID, err)
+			}
+			round.SnapshotUUID = ""
+		}
+		if round.StaleBase != "" {
+			// the base is in the local cluster, the destination of a pull
+			stale := *src
+			if round.Pull {
+				stale = *dst
+			}
+			stale.volName = round.StaleBase
+			if err := stale.curveVolume().Delete(ctx, true); err != nil && !util.IsNotFoundErr(err) {
+				return false, fmt.Errorf("failed to delete %s: %v", stale.genVolumePath(), err)
+			}
+			round.StaleBase = ""
+		}
+		meta.Round = nil
+	}
+	return true, nil
+}
+
+// copy copies the mirror volume to the destination, which is expanded to the size
+// of the mirror first. Only the chunks changed since the base are written if the base is set.
+func (rs *replicationServer) copy(ctx context.Context, mirror, base, dst *volumeOptions) (int64, error) {
+	detail, err := mirror.curveVolume().Stat(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat %s: %v", mirror.genVolumePath(), err)
+	}
+	dst.sizeGiB = detail.LengthGiB
+	if err = ensureMirrorVolume(ctx, dst); err != nil {
+		return 0, fmt.Errorf("failed to ensure %s in cluster %q: %v", dst.genVolumePath(), dst.clusterID, err)
+	}
+
+	job := &mirrorCopy{
+		src:     mirror.curveVolume(),
+		dst:     dst.curveVolume(),
+		sizeGiB: detail.LengthGiB,
+	}
+	if base != nil {
+		job.base = base.curveVolume()
+	}
+	written, err := rs.copier.copy(ctx, job)
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy %s to %s in cluster %q: %v", mirror.genVolumePath(), dst.genVolumePath(), dst.clusterID, err)
+	}
+	return written, nil
+}
+
+// failed records the error of the sync, the stage is retried in the next check.
+func (rs *replicationServer) failed(ctx context.Context, volumeId string, meta *replicationMeta, err error) {
+	ctxlog.Warningf(ctx, "failed to sync volume %s: %v", volumeId, err)
+	meta.LastError = err.Error()
+	if err = rs.store.Put(volumeId, meta); err != nil {
+		ctxlog.Warningf(ctx, "failed to save replication of volume %s: %v", volumeId, err)
+	}
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/csi-addons/spec/lib/go/replication"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/opencurve/curve-csi/pkg/util"
+)
+
+func TestParseReplicationParams(t *testing.T) {
+	peer, interval, err := parseReplicationParams(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "", peer)
+	assert.Equal(t, defaultReplicationInterval, interval)
+
+	peer, interval, err = parseReplicationParams(map[string]string{
+		replicationPeerClusterParam: "cluster2",
+		replicationIntervalParam:    "5m",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "cluster2", peer)
+	assert.Equal(t, 5*time.Minute, interval)
+
+	for _, str := range []string{"bad", "30s", "-1h"} {
+		_, _, err = parseReplicationParams(map[string]string{replicationIntervalParam: str})
+		assert.Error(t, err, str)
+	}
+}
+
+func TestReplicationDue(t *testing.T) {
+	now := time.Now()
+	synced := now.Add(-30 * time.Minute)
+
+	primary := &replicationMeta{PeerClusterID: "cluster2", Interval: time.Hour, Role: replicationPrimary}
+	assert.True(t, primary.due(now))
+	primary.LastSyncTime = &synced
+	assert.False(t, primary.due(now))
+	assert.True(t, primary.due(now.Add(30*time.Minute)))
+	primary.Round = &mirrorRound{Stage: mirrorCopying}
+	assert.True(t, primary.due(now))
+
+	// the secondary is synced only on resync
+	secondary := &replicationMeta{PeerClusterID: "cluster2", Interval: time.Hour, Role: replicationSecondary}
+	assert.False(t, secondary.due(now))
+	secondary.Resyncing = true
+	assert.True(t, secondary.due(now))
+
+	// the peer is unknown
+	unknown := &replicationMeta{Interval: time.Hour, Role: replicationPrimary}
+	assert.False(t, unknown.due(now))
+	unknown.Disabled = true
+	assert.True(t, unknown.due(now))
+}
+
+func TestNewReplicationServer(t *testing.T) {
+	rs, err := newReplicationServer(nil, util.NewFileStore(t.TempDir()), nil)
+	assert.NoError(t, err)
+	assert.Nil(t, rs)
+
+	_, err = newReplicationServer(nil, nil, nbdCopier{})
+	assert.Error(t, err)
+}
+
+func TestNewMirrorRound(t *testing.T) {
+	now := time.Unix(1654077600, 0)
+	synced := now.Add(-time.Hour)
+
+	// the first push is a full copy
+	meta := &replicationMeta{Role: replicationPrimary}
+	round := newMirrorRound(meta, "csi-vol-pvc-1", now)
+	assert.False(t, round.Pull)
+	assert.Equal(t, "csi-vol-pvc-1-mirror-1654077600", round.MirrorVolume)
+	assert.Empty(t, round.StaleBase)
+
+	// the next push is based on the last one
+	meta = &replicationMeta{Role: replicationPrimary, LastSyncTime: &synced, BaseVolume: "csi-vol-pvc-1-mirror-1654074000"}
+	round = newMirrorRound(meta, "csi-vol-pvc-1", now)
+	assert.Empty(t, round.StaleBase)
+	assert.Equal(t, "csi-vol-pvc-1-mirror-1654074000", meta.BaseVolume)
+
+	// promoted, a full copy is required
+	meta.LastSyncTime = nil
+	round = newMirrorRound(meta, "csi-vol-pvc-1", now)
+	assert.Equal(t, "csi-vol-pvc-1-mirror-1654074000", round.StaleBase)
+	assert.Empty(t, meta.BaseVolume)
+
+	// a pull has no base
+	meta = &replicationMeta{Role: replicationSecondary, LastSyncTime: &synced, BaseVolume: "csi-vol-pvc-1-mirror-1654074000"}
+	round = newMirrorRound(meta, "csi-vol-pvc-1", now)
+	assert.True(t, round.Pull)
+	assert.Equal(t, "csi-vol-pvc-1-mirror-1654074000", round.StaleBase)
+	assert.Empty(t, meta.BaseVolume)
+}
+
+func TestMirrorSourceName(t *testing.T) {
+	assert.Equal(t, "csi-vol-pvc-1", mirrorSourceName(mirrorVolName("csi-vol-pvc-1", time.Unix(1654077600, 0))))
+	assert.Equal(t, "csi-vol-pvc-1", mirrorSourceName("csi-vol-pvc-1"))
+	assert.Equal(t, "csi-vol-pvc-1-mirror-x", mirrorSourceName("csi-vol-pvc-1-mirror-x"))
+	assert.Equal(t, "-mirror-1", mirrorSourceName("-mirror-1"))
+}
+
+func TestReplicationVolumeId(t *testing.T) {
+	volumeId, err := replicationVolumeId(&replication.EnableVolumeReplicationRequest{VolumeId: "vol"})
+	assert.NoError(t, err)
+	assert.Equal(t, "vol", volumeId)
+
+	volumeId, err = replicationVolumeId(&replication.EnableVolumeReplicationRequest{
+		ReplicationSource: &replication.ReplicationSource{
+			Type: &replication.ReplicationSource_Volume{
+				Volume: &replication.ReplicationSource_VolumeSource{VolumeId: "vol"},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "vol", volumeId)
+
+	_, err = replicationVolumeId(&replication.EnableVolumeReplicationRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = replicationVolumeId(&replication.EnableVolumeReplicationRequest{
+		ReplicationSource: &replication.ReplicationSource{
+			Type: &replication.ReplicationSource_Volumegroup{
+				Volumegroup: &replication.ReplicationSource_VolumeGroupSource{VolumeGroupId: "group"},
+			},
+		},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestReplicationRoles(t *testing.T) {
+	ctx := context.TODO()
+	cs := &controllerServer{volumeLocks: util.NewVolumeLocks()}
+	rs, err := newReplicationServer(cs, util.NewFileStore(t.TempDir()), commandCopier{command: "/usr/bin/curve-copy"})
+	assert.NoError(t, err)
+	volumeId := "vol"
+
+	// not enabled
+	_, err = rs.DemoteVolume(ctx, &replication.DemoteVolumeRequest{VolumeId: volumeId})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = rs.DisableVolumeReplication(ctx, &replication.DisableVolumeReplicationRequest{VolumeId: volumeId})
+	assert.NoError(t, err)
+	_, err = rs.GetVolumeReplicationInfo(ctx, &replication.GetVolumeReplicationInfoRequest{VolumeId: volumeId})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	assert.NoError(t, rs.store.Put(volumeId, &replicationMeta{
+		PeerClusterID: "cluster2",
+		Interval:      time.Hour,
+		Role:          replicationPrimary,
+	}))
+	_, err = rs.GetVolumeReplicationInfo(ctx, &replication.GetVolumeReplicationInfoRequest{VolumeId: volumeId})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	synced := time.Unix(1654077600, 0)
+	meta, err := rs.get(volumeId)
+	assert.NoError(t, err)
+	meta.LastSyncTime = &synced
+	assert.NoError(t, rs.store.Put(volumeId, meta))
+	info, err := rs.GetVolumeReplicationInfo(ctx, &replication.GetVolumeReplicationInfoRequest{VolumeId: volumeId})
+	assert.NoError(t, err)
+	assert.Equal(t, synced.Unix(), info.GetLastSyncTime().GetSeconds())
+	_, err = rs.ResyncVolume(ctx, &replication.ResyncVolumeRequest{VolumeId: volumeId})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = rs.DemoteVolume(ctx, &replication.DemoteVolumeRequest{VolumeId: volumeId})
+	assert.NoError(t, err)
+	meta, err = rs.get(volumeId)
+	assert.NoError(t, err)
+	assert.Equal(t, replicationSecondary, meta.Role)
+
+	resp, err := rs.ResyncVolume(ctx, &replication.ResyncVolumeRequest{VolumeId: volumeId})
+	assert.NoError(t, err)
+	assert.False(t, resp.GetReady())
+	meta, _ = rs.get(volumeId)
+	assert.True(t, meta.Resyncing)
+
+	// done by the sync
+	meta.Resyncing = false
+	meta.Resynced = true
+	assert.NoError(t, rs.store.Put(volumeId, meta))
+	resp, err = rs.ResyncVolume(ctx, &replication.ResyncVolumeRequest{VolumeId: volumeId})
+	assert.NoError(t, err)
+	assert.True(t, resp.GetReady())
+	resp, err = rs.ResyncVolume(ctx, &replication.ResyncVolumeRequest{VolumeId: volumeId, Force: true})
+	assert.NoError(t, err)
+	assert.False(t, resp.GetReady())
+
+	// aborted while syncing
+	assert.True(t, rs.syncing.TryAcquire(volumeId))
+	_, err = rs.DisableVolumeReplication(ctx, &replication.DisableVolumeReplicationRequest{VolumeId: volumeId})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	rs.syncing.Release(volumeId)
+
+	// the round is cleaned up before the record is deleted
+	meta, _ = rs.get(volumeId)
+	meta.Round = &mirrorRound{Pull: true, Stage: mirrorCopying}
+	assert.NoError(t, rs.store.Put(volumeId, meta))
+	_, err = rs.DisableVolumeReplication(ctx, &replication.DisableVolumeReplicationRequest{VolumeId: volumeId})
+	assert.NoError(t, err)
+	meta, _ = rs.get(volumeId)
+	assert.True(t, meta.Disabled)
+
+	// the base of the pushes is cleaned up too
+	meta.Round = nil
+	meta.Disabled = false
+	meta.BaseVolume = "csi-vol-pvc-1-mirror-1654077600"
+	assert.NoError(t, rs.store.Put(volumeId, meta))
+	rs.forget(ctx, volumeId)
+	meta, _ = rs.get(volumeId)
+	assert.True(t, meta.Disabled)
+
+	meta.BaseVolume = ""
+	assert.NoError(t, rs.store.Put(volumeId, meta))
+	rs.forget(ctx, volumeId)
+	meta, err = rs.get(volumeId)
+	assert.NoError(t, err)
+	assert.Nil(t, meta)
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+	volumehelpers "k8s.io/cloud-provider/volume/helpers"
+
+	"github.com/opencurve/curve-csi/pkg/util"
+)
+
+const (
+	defaultMinSizeGiB         = 10
+	defaultMaxSizeGiB         = 4 * 1024
+	defaultSizeGranularityGiB = 1
+
+	// StorageClass parameters overriding the size policy of the cluster
+	minSizeGiBParam         = "minSizeGiB"
+	maxSizeGiBParam         = "maxSizeGiB"
+	sizeGranularityGiBParam = "sizeGranularityGiB"
+)
+
+// errSizeOutOfRange is returned if the capacity range can not be satisfied by the size policy.
+var errSizeOutOfRange = errors.New("size out of range")
+
+// sizePolicy is the effective size policy of a volume.
+type sizePolicy struct {
+	minGiB         int
+	maxGiB         int
+	granularityGiB int
+}
+
+func defaultSizePolicy() sizePolicy {
+	return sizePolicy{
+		minGiB:         defaultMinSizeGiB,
+		maxGiB:         defaultMaxSizeGiB,
+		granularityGiB: defaultSizeGranularityGiB,
+	}
+}
+
+// merge overrides the policy by the set fields of p.
+func (sp sizePolicy) merge(p *util.SizePolicy) sizePolicy {
+	if p == nil {
+		return sp
+	}
+	if p.MinSizeGiB > 0 {
+		sp.minGiB = p.MinSizeGiB
+	}
+	if p.MaxSizeGiB > 0 {
+		sp.maxGiB = p.MaxSizeGiB
+	}
+	if p.GranularityGiB > 0 {
+		sp.granularityGiB = p.GranularityGiB
+	}
+	return sp
+}
+
+func (sp sizePolicy) validate() error {
+	if sp.minGiB <= 0 || sp.maxGiB <= 0 || sp.granularityGiB <= 0 {
+		return fmt.Errorf("invalid size policy %+v, all fields must be positive", sp)
+	}
+	if sp.minGiB > sp.maxGiB {
+		return fmt.Errorf("invalid size policy %+v, min size is larger than max size", sp)
+	}
+	return nil
+}
+
+// roundUp returns the smallest size in GiB satisfying both the capacity range and the policy.
+// The min size is used if no size is required.
+func (sp sizePolicy) roundUp(capRange *csi.CapacityRange) (int, error) {
+	required := capRange.GetRequiredBytes()
+	limit := capRange.GetLimitBytes()
+	if required < 0 || limit < 0 {
+		return 0, fmt.Errorf("capacity range %v can not be negative", capRange)
+	}
+	if limit > 0 && required > limit {
+		return 0, fmt.Errorf("required bytes %d is larger than limit bytes %d", required, limit)
+	}
+
+	sizeGiB := sp.minGiB
+	if required > 0 {
+		reqGiB, err := volumehelpers.RoundUpToGiBInt(*resource.NewQuantity(required, resource.BinarySI))
+		if err != nil {
+			return 0, fmt.Errorf("%w: %v", errSizeOutOfRange, err)
+		}
+		if reqGiB > sizeGiB {
+			sizeGiB = reqGiB
+		}
+	}
+	if rem := sizeGiB % sp.granularityGiB; rem != 0 {
+		sizeGiB += sp.granularityGiB - rem
+	}
+
+	if sizeGiB > sp.maxGiB {
+		return 0, fmt.Errorf("%w: the volume size must be no more than %dGiB, got %dGiB",
+			errSizeOutOfRange, sp.maxGiB, sizeGiB)
+	}
+	if limit > 0 && int64(sizeGiB)*volumehelpers.GiB > limit {
+		return 0, fmt.Errorf("%w: the volume size %dGiB (min %dGiB, granularity %dGiB) exceeds limit bytes %d",
+			errSizeOutOfRange, sizeGiB, sp.minGiB, sp.granularityGiB, limit)
+	}
+	return sizeGiB, nil
+}
+
+// sizeErrorToStatus returns OutOfRange if the size policy can not be satisfied.
+func sizeErrorToStatus(err error) error {
+	if errors.Is(err, errSizeOutOfRange) {
+		return status.Error(codes.OutOfRange, err.Error())
+	}
+	return status.Error(codes.InvalidArgument, err.Error())
+}
+
+// parseSizePolicy parses the size policy in StorageClass parameters, returns nil if not set.
+func parseSizePolicy(parameters map[string]string) (*util.SizePolicy, error) {
+	p := &util.SizePolicy{}
+	var err error
+	if p.MinSizeGiB, err = parsePositiveIntParam(parameters, minSizeGiBParam); err != nil {
+		return nil, err
+	}
+	if p.MaxSizeGiB, err = parsePositiveIntParam(parameters, maxSizeGiBParam); err != nil {
+		return nil, err
+	}
+	if p.GranularityGiB, err = parsePositiveIntParam(parameters, sizeGranularityGiBParam); err != nil {
+		return nil, err
+	}
+	if *p == (util.SizePolicy{}) {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// parsePositiveIntParam returns 0 if the parameter is not set.
+func parsePositiveIntParam(parameters map[string]string, key string) (int, error) {
+	str, ok := parameters[key]
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(str)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s %q, must be a positive integer", key, str)
+	}
+	return n, nil
+}
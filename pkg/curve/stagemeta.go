@@ -0,0 +1,126 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+	"github.com/opencurve/curve-csi/pkg/util"
+)
+
+// the staging metadata is <staging path>/<volume ID>.json, next to the staging target path
+const stageMetaSuffix = ".json"
+
+// stageMeta records how a volume is staged on the node, it is written by NodeStageVolume,
+// and removed by NodeUnstageVolume after the volume unmapped.
+type stageMeta struct {
+	VolumeID  string `json:"volumeID"`
+	ClusterID string `json:"clusterID,omitempty"`
+	User      string `json:"user"`
+	// the curve file mapped, and the client conf of its cluster, empty for the default cluster
+	FilePath string `json:"filePath"`
+	ConfPath string `json:"confPath,omitempty"`
+	Device   string `json:"device"`
+	// how curve-nbd is run, and its systemd unit in the systemd map mode
+	MapMode            string `json:"mapMode"`
+	NbdUnit            string `json:"nbdUnit,omitempty"`
+	DisableInUseChecks bool   `json:"disableInUseChecks,omitempty"`
+	// the block volume is the device bind mounted at the staging target path
+	Block        bool     `json:"block"`
+	FsType       string   `json:"fsType,omitempty"`
+	MountOptions []string `json:"mountOptions,omitempty"`
+	ReadOnly     bool     `json:"readOnly,omitempty"`
+	// the volume or snapshot the volume is cloned from, see volSource of the volume context
+	CloneSource string    `json:"cloneSource,omitempty"`
+	StagedAt    time.Time `json:"stagedAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// putStageMeta writes the metadata of the volume staged under stagingPath.
+func putStageMeta(stagingPath string, meta *stageMeta) error {
+	meta.UpdatedAt = time.Now()
+	return util.NewFileStore(stagingPath).Put(meta.VolumeID, meta)
+}
+
+// getStageMeta returns nil if the volume has no metadata, e.g. staged by the old driver.
+func getStageMeta(stagingPath, volumeId string) (*stageMeta, error) {
+	meta := &stageMeta{}
+	if err := util.NewFileStore(stagingPath).Get(volumeId, meta); err != nil {
+		if util.IsNotFoundErr(err, volumeId) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return meta, nil
+}
+
+func deleteStageMeta(stagingPath, volumeId string) error {
+	return util.NewFileStore(stagingPath).Delete(volumeId)
+}
+
+// isStageMetaFile returns true if the name in the staging path is a metadata file.
+func isStageMetaFile(name string) bool {
+	return strings.HasSuffix(name, stageMetaSuffix)
+}
+
+// curveVolume returns the mapped curve file, enough to unmap it.
+func (m *stageMeta) curveVolume() *curveservice.CurveVolume {
+	return &curveservice.CurveVolume{FilePath: m.FilePath, User: m.User, ConfPath: m.ConfPath}
+}
+
+// nbdConnected returns false if the nbd device is disconnected, e.g. curve-nbd exited.
+func nbdConnected(device string) bool {
+	_, err := os.Stat(filepath.Join("/sys/block", filepath.Base(device), "pid"))
+	return err == nil
+}
+
+// stagedVolumeStatus is the diagnostics of a staged volume.
+type stagedVolumeStatus struct {
+	Path string `json:"path"`
+	// nil if staged by the old driver
+	Meta      *stageMeta `json:"meta"`
+	Connected bool       `json:"connected"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// serveStagedVolumes returns the volumes staged on the node and their metadata in json.
+func (ns *nodeServer) serveStagedVolumes(w http.ResponseWriter, req *http.Request) {
+	volumes := []stagedVolumeStatus{}
+	entries, err := listStagingEntries(ns.kubeletDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, entry := range entries {
+		volume := stagedVolumeStatus{Path: entry.path, Meta: entry.meta}
+		if entry.metaErr != nil {
+			volume.Error = entry.metaErr.Error()
+		}
+		if entry.meta != nil {
+			volume.Connected = nbdConnected(entry.meta.Device)
+		}
+		volumes = append(volumes, volume)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(volumes)
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/utils/mount"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+)
+
+func TestStageMeta(t *testing.T) {
+	stagingPath := t.TempDir()
+	volId, err := composeCSIID(&csiIdentifier{scheme: namingSchemeCSI, user: "k8s", volName: "csi-vol-pvc-1"})
+	assert.NoError(t, err)
+
+	meta, err := getStageMeta(stagingPath, volId)
+	assert.NoError(t, err)
+	assert.Nil(t, meta)
+
+	staged := &stageMeta{
+		VolumeID:     volId,
+		User:         "k8s",
+		FilePath:     "/k8s/csi-vol-pvc-1",
+		Device:       "/dev/nbd0",
+		MapMode:      curveservice.MapModeSystemd,
+		NbdUnit:      "curve-nbd-k8s-csi\\x2dvol\\x2dpvc\\x2d1",
+		FsType:       "xfs",
+		MountOptions: []string{"_netdev", "nouuid"},
+		StagedAt:     time.Now().Round(0),
+	}
+	assert.NoError(t, putStageMeta(stagingPath, staged))
+	assert.FileExists(t, filepath.Join(stagingPath, volId+stageMetaSuffix))
+	meta, err = getStageMeta(stagingPath, volId)
+	assert.NoError(t, err)
+	assert.True(t, meta.StagedAt.Equal(staged.StagedAt))
+	assert.True(t, meta.UpdatedAt.Equal(staged.UpdatedAt))
+	meta.StagedAt, meta.UpdatedAt = staged.StagedAt, staged.UpdatedAt
+	assert.Equal(t, staged, meta)
+	assert.Equal(t, &curveservice.CurveVolume{FilePath: "/k8s/csi-vol-pvc-1", User: "k8s"}, meta.curveVolume())
+
+	// the staging path is left empty for kubelet to remove
+	assert.NoError(t, deleteStageMeta(stagingPath, volId))
+	assert.NoError(t, deleteStageMeta(stagingPath, volId))
+	files, err := os.ReadDir(stagingPath)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestListStagingEntriesWithMeta(t *testing.T) {
+	kubeletDir := t.TempDir()
+	volId, err := composeCSIID(&csiIdentifier{scheme: namingSchemeCSI, user: "k8s", volName: "csi-vol-pvc-1"})
+	assert.NoError(t, err)
+	stagingPath := filepath.Join(kubeletDir, "plugins/kubernetes.io/csi/curve.csi.netease.com/abc/globalmount")
+	assert.NoError(t, os.MkdirAll(filepath.Join(stagingPath, volId), 0o750))
+	meta := &stageMeta{VolumeID: volId, User: "k8s", FilePath: "/k8s/csi-vol-pvc-1", Device: "/dev/nbd0"}
+	assert.NoError(t, putStageMeta(stagingPath, meta))
+
+	// the metadata file is not a staged volume
+	entries, err := listStagingEntries(kubeletDir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, filepath.Join(stagingPath, volId), entries[0].path)
+	assert.NoError(t, entries[0].metaErr)
+	assert.Equal(t, meta.Device, entries[0].meta.Device)
+
+	// the broken metadata is reported
+	assert.NoError(t, os.WriteFile(filepath.Join(stagingPath, volId+stageMetaSuffix), []byte("{"), 0o600))
+	entries, err = listStagingEntries(kubeletDir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Nil(t, entries[0].meta)
+	assert.Error(t, entries[0].metaErr)
+}
+
+func TestPlanReconcileWithMeta(t *testing.T) {
+	volId, err := composeCSIID(&csiIdentifier{scheme: namingSchemeCSI, user: "k8s", volName: "csi-vol-pvc-1"})
+	assert.NoError(t, err)
+	path := "/var/lib/kubelet/plugins/kubernetes.io/csi/curve.csi.netease.com/abc/globalmount/" + volId
+	mounts := []mount.MountInfo{{MountPoint: path, Source: "/dev/nbd0", FsType: "ext4", Root: "/"}}
+	mappings := []curveservice.NbdMapping{{Device: "/dev/nbd0", FilePath: "/k8s/csi-vol-pvc-1", User: "k8s"}}
+
+	// the file recorded at stage time is mapped
+	meta := &stageMeta{VolumeID: volId, User: "k8s", FilePath: "/k8s/csi-vol-pvc-1", Device: "/dev/nbd0"}
+	actions, _ := planReconcile([]stagingEntry{{volumeId: volId, path: path, meta: meta}}, mappings, mounts, nil)
+	assert.Empty(t, actions)
+
+	// the device is reused by another file
+	meta = &stageMeta{VolumeID: volId, User: "k8s", FilePath: "/k8s/csi-vol-other", Device: "/dev/nbd0", FsType: "ext4"}
+	actions, _ = planReconcile([]stagingEntry{{volumeId: volId, path: path, meta: meta}}, mappings, mounts, nil)
+	assert.Equal(t, []reconcileAction{
+		{Action: reconcileRemount, VolumeID: volId, Path: path, Device: "/dev/nbd0", fsType: "ext4", meta: meta},
+	}, actions)
+
+	// the device is the file of the same path in another cluster
+	meta = &stageMeta{VolumeID: volId, User: "k8s", FilePath: "/k8s/csi-vol-pvc-1", ConfPath: "/etc/curve/cluster1/client.conf", Device: "/dev/nbd0"}
+	actions, _ = planReconcile([]stagingEntry{{volumeId: volId, path: path, meta: meta}}, mappings, mounts, nil)
+	assert.Len(t, actions, 1)
+	assert.Equal(t, reconcileRemount, actions[0].Action)
+}
+
+func TestNbdConnected(t *testing.T) {
+	assert.False(t, nbdConnected("/dev/nbd-not-exists"))
+}
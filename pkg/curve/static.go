@@ -0,0 +1,257 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/opencurve/curve-csi/pkg/util"
+	"github.com/opencurve/curve-csi/pkg/util/ctxlog"
+)
+
+const (
+	// volumeAttributes of the static PVs
+	staticUserAttr      = "user"
+	staticPathAttr      = "path"
+	staticClusterIDAttr = "clusterID"
+
+	// mutable parameter, true to delete the adopted volume on DeleteVolume
+	ownedParam = "owned"
+)
+
+// adopted returns true if the volume is a pre-existing file adopted by static provisioning.
+func (vo *volumeOptions) adopted() bool {
+	return vo.scheme == namingSchemeStatic
+}
+
+// newStaticVolumeOptions returns the options of the adopted file at the path,
+// which must be in the directory of the user.
+func newStaticVolumeOptions(clusterID, user, path string) (*volumeOptions, error) {
+	if user == "" || len(user) > curveUserMaxLen {
+		return nil, fmt.Errorf("length of user must be 1~%v", curveUserMaxLen)
+	}
+	volName := strings.TrimPrefix(path, "/"+user+"/")
+	if volName == path || volName == "" {
+		return nil, fmt.Errorf("path %q is not a file in the directory /%s of user %q", path, user, user)
+	}
+	for _, elem := range strings.Split(volName, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return nil, fmt.Errorf("path %q is not clean", path)
+		}
+	}
+	vo := &volumeOptions{
+		reqName:   volName,
+		volName:   volName,
+		user:      user,
+		clusterID: clusterID,
+		scheme:    namingSchemeStatic,
+	}
+	if err := vo.composeVolID(); err != nil {
+		return nil, err
+	}
+	return vo, nil
+}
+
+// newNodeVolumeOptions returns the options of the volume to stage. The volume handle of
+// a static PV written by hand may not be a volume ID of the driver, then the adopted file
+// is derived from the volumeAttributes user, path and clusterID, and keeps the handle as
+// its volume ID.
+func newNodeVolumeOptions(volumeId string, volumeContext map[string]string) (*volumeOptions, error) {
+	vo, err := newVolumeOptionsFromVolID(volumeId)
+	if err == nil {
+		if vo.adopted() {
+			if err = checkStaticVolumeContext(vo, volumeContext); err != nil {
+				return nil, err
+			}
+		}
+		return vo, nil
+	}
+	user, path := volumeContext[staticUserAttr], volumeContext[staticPathAttr]
+	if user == "" || path == "" {
+		return nil, fmt.Errorf("volume handle %q is not a volume ID of the driver, and the volumeAttributes %s and %s are not set: %v",
+			volumeId, staticUserAttr, staticPathAttr, err)
+	}
+	vo, err = newStaticVolumeOptions(volumeContext[staticClusterIDAttr], user, path)
+	if err != nil {
+		return nil, err
+	}
+	vo.volId = volumeId
+	return vo, nil
+}
+
+// isStagedVolumeId returns true if the name under the staging path is a volume staged by
+// the driver: a volume ID of the driver, or a volume handle with the staging metadata.
+func isStagedVolumeId(stagingPath, name string) bool {
+	if _, err := decomposeCSIID(name); err == nil {
+		return true
+	}
+	meta, err := getStageMeta(stagingPath, name)
+	return err == nil && meta != nil
+}
+
+// checkStaticVolumeContext checks the volumeAttributes of the static PV, if set,
+// refer to the adopted volume of the volume ID.
+func checkStaticVolumeContext(vo *volumeOptions, volumeContext map[string]string) error {
+	if user, ok := volumeContext[staticUserAttr]; ok && user != vo.user {
+		return fmt.Errorf("the %s %q of volumeAttributes does not match the user %q of volume", staticUserAttr, user, vo.user)
+	}
+	if path, ok := volumeContext[staticPathAttr]; ok && path != vo.genVolumePath() {
+		return fmt.Errorf("the %s %q of volumeAttributes does not match the path %q of volume", staticPathAttr, path, vo.genVolumePath())
+	}
+	if clusterID, ok := volumeContext[staticClusterIDAttr]; ok && clusterID != vo.clusterID {
+		return fmt.Errorf("the %s %q of volumeAttributes does not match the cluster %q of volume", staticClusterIDAttr, clusterID, vo.clusterID)
+	}
+	return nil
+}
+
+var pvNameInvalidChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// staticPVName derives a PV name from the path, e.g. "/vm/db_01" to "curve-vm-db-01".
+func staticPVName(path string) string {
+	name := pvNameInvalidChars.ReplaceAllString(strings.ToLower(path), "-")
+	name = strings.Trim("curve-"+strings.Trim(name, "-"), "-")
+	if len(name) > 63 {
+		name = strings.TrimRight(name[:63], "-")
+	}
+	return name
+}
+
+var staticPVTemplate = template.Must(template.New("pv").Parse(`apiVersion: v1
+kind: PersistentVolume
+metadata:
+  name: {{ .Name }}
+spec:
+  accessModes:
+  - {{ .AccessMode }}
+  capacity:
+    storage: {{ .SizeGiB }}Gi
+  persistentVolumeReclaimPolicy: {{ .ReclaimPolicy }}
+{{- if .StorageClass }}
+  storageClassName: {{ .StorageClass }}
+{{- end }}
+  volumeMode: {{ .VolumeMode }}
+  csi:
+    driver: {{ .DriverName }}
+{{- if eq .VolumeMode "Filesystem" }}
+    fsType: {{ .FsType }}
+{{- end }}
+    volumeHandle: {{ .VolumeID }}
+    volumeAttributes:
+{{- if .ClusterID }}
+      clusterID: {{ .ClusterID }}
+{{- end }}
+      user: {{ .User }}
+      path: {{ .Path }}
+`))
+
+type staticPV struct {
+	Name          string
+	AccessMode    string
+	SizeGiB       int
+	ReclaimPolicy string
+	StorageClass  string
+	VolumeMode    string
+	DriverName    string
+	FsType        string
+	VolumeID      string
+	ClusterID     string
+	User          string
+	Path          string
+}
+
+// RunImport implements the subcommand 'import', which validates a pre-existing curve
+// file and writes the static PV adopting it to out.
+func RunImport(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	var (
+		driverName    = fs.String("drivername", "curve.csi.netease.com", "name of the driver")
+		clusterConfig = fs.String("cluster-config", util.DefaultClusterConfig, "path of the config file describing the curve clusters")
+		clusterID     = fs.String("cluster-id", "", "the cluster of the file, empty for the default cluster")
+		user          = fs.String("user", "", "the curve user owning the file")
+		password      = fs.String("password", "", "the password of the user")
+		path          = fs.String("path", "", "the path of the file, e.g. /vm/db01")
+		pvName        = fs.String("pv-name", "", "name of the PV, derived from the path if not set")
+		accessMode    = fs.String("access-mode", "ReadWriteOnce", "access mode of the PV")
+		volumeMode    = fs.String("volume-mode", "Filesystem", "volume mode of the PV: Filesystem or Block")
+		fsType        = fs.String("fs-type", "ext4", "filesystem type of the file in the Filesystem mode")
+		reclaimPolicy = fs.String("reclaim-policy", "Retain", "reclaim policy of the PV: Retain or Delete, the file is kept on Delete unless owned")
+		storageClass  = fs.String("storage-class", "", "storage class name of the PV")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *volumeMode != "Filesystem" && *volumeMode != "Block" {
+		return fmt.Errorf("invalid volume mode %q", *volumeMode)
+	}
+	if *reclaimPolicy != "Retain" && *reclaimPolicy != "Delete" {
+		return fmt.Errorf("invalid reclaim policy %q", *reclaimPolicy)
+	}
+	if *accessMode == "ReadWriteMany" && *volumeMode != "Block" {
+		return fmt.Errorf("access mode ReadWriteMany requires the Block volume mode")
+	}
+
+	vo, err := newStaticVolumeOptions(*clusterID, *user, *path)
+	if err != nil {
+		return err
+	}
+	if err = vo.resolveCluster(newClusterResolver(*clusterConfig, "")); err != nil {
+		return err
+	}
+	if *password != "" {
+		vo.creds = &util.Credentials{User: *user, Password: *password}
+	}
+
+	ctx := context.WithValue(context.Background(), ctxlog.CtxKey, "import")
+	detail, err := vo.curveVolume().Stat(ctx)
+	if err != nil {
+		if util.IsNotFoundErr(err) {
+			return fmt.Errorf("file %s not found in cluster %q", *path, *clusterID)
+		}
+		return fmt.Errorf("failed to stat file %s: %v", *path, err)
+	}
+	if detail.FileType != "" && detail.FileType != "INODE_PAGEFILE" {
+		return fmt.Errorf("%s is not a volume file, but %s", *path, detail.FileType)
+	}
+	if detail.User != "" && detail.User != *user {
+		return fmt.Errorf("file %s is owned by user %q, not %q", *path, detail.User, *user)
+	}
+
+	pv := staticPV{
+		Name:          *pvName,
+		AccessMode:    *accessMode,
+		SizeGiB:       detail.LengthGiB,
+		ReclaimPolicy: *reclaimPolicy,
+		StorageClass:  *storageClass,
+		VolumeMode:    *volumeMode,
+		DriverName:    *driverName,
+		FsType:        *fsType,
+		VolumeID:      vo.volId,
+		ClusterID:     *clusterID,
+		User:          *user,
+		Path:          *path,
+	}
+	if pv.Name == "" {
+		pv.Name = staticPVName(*path)
+	}
+	return staticPVTemplate.Execute(out, pv)
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewStaticVolumeOptions(t *testing.T) {
+	vo, err := newStaticVolumeOptions("cluster1", "vm", "/vm/db01")
+	assert.NoError(t, err)
+	assert.True(t, vo.adopted())
+	assert.Equal(t, "/vm/db01", vo.genVolumePath())
+
+	// the volume ID round-trips
+	decoded, err := newVolumeOptionsFromVolID(vo.volId)
+	assert.NoError(t, err)
+	assert.True(t, decoded.adopted())
+	assert.Equal(t, "cluster1", decoded.clusterID)
+	assert.Equal(t, "vm", decoded.user)
+	assert.Equal(t, "/vm/db01", decoded.genVolumePath())
+
+	// in a subdir
+	vo, err = newStaticVolumeOptions("", "vm", "/vm/mysql/db02")
+	assert.NoError(t, err)
+	assert.Equal(t, "/vm/mysql/db02", vo.genVolumePath())
+
+	for _, path := range []string{"/vm", "/vm/", "/other/db01", "vm/db01", "/vm/../k8s/db01", "/vm//db01"} {
+		_, err = newStaticVolumeOptions("", "vm", path)
+		assert.Error(t, err, path)
+	}
+	_, err = newStaticVolumeOptions("", "", "/vm/db01")
+	assert.Error(t, err)
+
+	// the volumes created by the driver are not adopted
+	vo, err = newVolumeOptionsFromVolID("0003-k8s-csi-vol-pvc-eeafeeb3-7a35-11ea-934a-fa163e28f309")
+	assert.NoError(t, err)
+	assert.False(t, vo.adopted())
+}
+
+func TestCheckStaticVolumeContext(t *testing.T) {
+	vo, err := newStaticVolumeOptions("cluster1", "vm", "/vm/db01")
+	assert.NoError(t, err)
+
+	assert.NoError(t, checkStaticVolumeContext(vo, nil))
+	assert.NoError(t, checkStaticVolumeContext(vo, map[string]string{
+		staticUserAttr:      "vm",
+		staticPathAttr:      "/vm/db01",
+		staticClusterIDAttr: "cluster1",
+	}))
+	assert.Error(t, checkStaticVolumeContext(vo, map[string]string{staticUserAttr: "k8s"}))
+	assert.Error(t, checkStaticVolumeContext(vo, map[string]string{staticPathAttr: "/vm/db02"}))
+	assert.Error(t, checkStaticVolumeContext(vo, map[string]string{staticClusterIDAttr: ""}))
+}
+
+func TestNewNodeVolumeOptions(t *testing.T) {
+	vo, err := newStaticVolumeOptions("cluster1", "vm", "/vm/db01")
+	assert.NoError(t, err)
+
+	// the volume ID of import
+	decoded, err := newNodeVolumeOptions(vo.volId, map[string]string{staticPathAttr: "/vm/db01"})
+	assert.NoError(t, err)
+	assert.Equal(t, vo.volId, decoded.volId)
+	_, err = newNodeVolumeOptions(vo.volId, map[string]string{staticPathAttr: "/vm/db02"})
+	assert.Error(t, err)
+
+	// a volume handle written by hand
+	decoded, err = newNodeVolumeOptions("vm-db01", map[string]string{
+		staticUserAttr:      "vm",
+		staticPathAttr:      "/vm/db01",
+		staticClusterIDAttr: "cluster1",
+	})
+	assert.NoError(t, err)
+	assert.True(t, decoded.adopted())
+	assert.Equal(t, "vm-db01", decoded.volId)
+	assert.Equal(t, "cluster1", decoded.clusterID)
+	assert.Equal(t, "/vm/db01", decoded.genVolumePath())
+
+	_, err = newNodeVolumeOptions("vm-db01", map[string]string{staticUserAttr: "vm"})
+	assert.Error(t, err)
+	_, err = newNodeVolumeOptions("vm-db01", map[string]string{staticUserAttr: "vm", staticPathAttr: "/k8s/db01"})
+	assert.Error(t, err)
+}
+
+func TestIsStagedVolumeId(t *testing.T) {
+	stagingPath := t.TempDir()
+	assert.True(t, isStagedVolumeId(stagingPath, "0003-k8s-csi-vol-pvc-eeafeeb3-7a35-11ea-934a-fa163e28f309"))
+	assert.False(t, isStagedVolumeId(stagingPath, "vm-db01"))
+	assert.NoError(t, putStageMeta(stagingPath, &stageMeta{VolumeID: "vm-db01", FilePath: "/vm/db01"}))
+	assert.True(t, isStagedVolumeId(stagingPath, "vm-db01"))
+}
+
+func TestStaticPVName(t *testing.T) {
+	assert.Equal(t, "curve-vm-db01", staticPVName("/vm/db01"))
+	assert.Equal(t, "curve-vm-mysql-db-02", staticPVName("/vm/MySQL/db_02"))
+	assert.LessOrEqual(t, len(staticPVName("/vm/"+strings.Repeat("a", 100))), 63)
+}
+
+func TestStaticPVTemplate(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, staticPVTemplate.Execute(&buf, staticPV{
+		Name:          "curve-vm-db01",
+		AccessMode:    "ReadWriteOnce",
+		SizeGiB:       20,
+		ReclaimPolicy: "Retain",
+		VolumeMode:    "Filesystem",
+		DriverName:    "curve.csi.netease.com",
+		FsType:        "ext4",
+		VolumeID:      "v1-00-00-1-02vm-db01",
+		User:          "vm",
+		Path:          "/vm/db01",
+	}))
+	assert.Equal(t, `apiVersion: v1
+kind: PersistentVolume
+metadata:
+  name: curve-vm-db01
+spec:
+  accessModes:
+  - ReadWriteOnce
+  capacity:
+    storage: 20Gi
+  persistentVolumeReclaimPolicy: Retain
+  volumeMode: Filesystem
+  csi:
+    driver: curve.csi.netease.com
+    fsType: ext4
+    volumeHandle: v1-00-00-1-02vm-db01
+    volumeAttributes:
+      user: vm
+      path: /vm/db01
+`, buf.String())
+}
+
+func TestVolumeMetaOwned(t *testing.T) {
+	meta := &volumeMeta{}
+	assert.True(t, isMutableParam(ownedParam))
+	_, err := meta.modify(map[string]string{ownedParam: "true"})
+	assert.NoError(t, err)
+	assert.True(t, *meta.Owned)
+	assert.False(t, meta.isEmpty())
+	_, err = meta.modify(map[string]string{ownedParam: "yes"})
+	assert.Error(t, err)
+}
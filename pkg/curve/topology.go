@@ -0,0 +1,165 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/opencurve/curve-csi/pkg/util"
+)
+
+// topologyKey qualifies the topology segment key by the driver domain,
+// e.g. "zone" is "topology.curve.csi.netease.com/zone".
+func topologyKey(driverName, key string) string {
+	if strings.Contains(key, "/") {
+		return key
+	}
+	return "topology." + driverName + "/" + key
+}
+
+// qualifyTopology returns the segments with the qualified keys.
+func qualifyTopology(driverName string, segments map[string]string) map[string]string {
+	qualified := make(map[string]string, len(segments))
+	for k, v := range segments {
+		qualified[topologyKey(driverName, k)] = v
+	}
+	return qualified
+}
+
+// parseTopology parses the topology segments like "zone=zone-a,rack=rack1".
+func parseTopology(driverName, str string) (map[string]string, error) {
+	segments := map[string]string{}
+	for _, kv := range strings.Split(str, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			return nil, fmt.Errorf("invalid topology segment %q, must be key=value", kv)
+		}
+		segments[topologyKey(driverName, pair[0])] = pair[1]
+	}
+	return segments, nil
+}
+
+// nodeTopology returns the topology segments of the node, which are the static
+// segments and the values of the node labels. The segment of a label is keyed by
+// the last part of the label, e.g. "topology.kubernetes.io/zone" is reported as
+// "topology.<driver name>/zone". The client is only used if nodeLabels is set.
+func nodeTopology(
+	client kubernetes.Interface,
+	driverName, nodeID, static, nodeLabels string) (map[string]string, error) {
+	segments, err := parseTopology(driverName, static)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(nodeLabels) == "" {
+		return segments, nil
+	}
+
+	labels, err := util.GetNodeLabels(context.Background(), client, nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get labels of node %s: %v", nodeID, err)
+	}
+	for _, label := range strings.Split(nodeLabels, ",") {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			continue
+		}
+		value, ok := labels[label]
+		if !ok {
+			return nil, fmt.Errorf("missing label %s on node %s", label, nodeID)
+		}
+		segments[topologyKey(driverName, label[strings.LastIndex(label, "/")+1:])] = value
+	}
+	return segments, nil
+}
+
+// topologyChoice is the cluster and poolset selected for the topology requirement.
+type topologyChoice struct {
+	clusterID string
+	poolset   string
+	// the segments of the selected pool, where the volume is accessible from
+	segments map[string]string
+}
+
+// selectTopology picks the first pool of the candidate clusters accessible from the
+// preferred, then the requisite topologies of the requirement. The pools of other
+// poolset than the requested one, if any, are skipped.
+// It returns nil if the requirement is not set or no candidate declares topologies.
+func selectTopology(
+	driverName string,
+	candidates []util.ClusterInfo,
+	poolset string,
+	requirement *csi.TopologyRequirement) (*topologyChoice, error) {
+	if requirement == nil {
+		return nil, nil
+	}
+	declared := false
+	for i := range candidates {
+		if len(candidates[i].Topologies) > 0 {
+			declared = true
+		}
+	}
+	if !declared {
+		return nil, nil
+	}
+
+	topologies := append(append([]*csi.Topology{}, requirement.GetPreferred()...), requirement.GetRequisite()...)
+	for _, topology := range topologies {
+		for i := range candidates {
+			for _, pool := range candidates[i].Topologies {
+				if poolset != "" && pool.Poolset != "" && pool.Poolset != poolset {
+					continue
+				}
+				segments := qualifyTopology(driverName, pool.Segments)
+				if !isSubTopology(segments, topology.GetSegments()) {
+					continue
+				}
+				choice := &topologyChoice{
+					clusterID: candidates[i].ClusterID,
+					poolset:   pool.Poolset,
+					segments:  segments,
+				}
+				if choice.poolset == "" {
+					choice.poolset = poolset
+				}
+				return choice, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no pool is accessible from the topologies %v", topologies)
+}
+
+// isSubTopology returns true if all the segments of sub are in the segments.
+func isSubTopology(sub, segments map[string]string) bool {
+	if len(sub) == 0 {
+		return false
+	}
+	for k, v := range sub {
+		if segments[k] != v {
+			return false
+		}
+	}
+	return true
+}
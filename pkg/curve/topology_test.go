@@ -0,0 +1,144 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/opencurve/curve-csi/pkg/util"
+)
+
+const (
+	testDriverName = "curve.csi.netease.com"
+	testZoneKey    = "topology.curve.csi.netease.com/zone"
+)
+
+func TestParseTopology(t *testing.T) {
+	segments, err := parseTopology(testDriverName, "")
+	assert.NoError(t, err)
+	assert.Empty(t, segments)
+
+	segments, err = parseTopology(testDriverName, "zone=zone-a, example.com/rack=rack1")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		testZoneKey:        "zone-a",
+		"example.com/rack": "rack1",
+	}, segments)
+
+	for _, str := range []string{"zone", "zone=", "=zone-a"} {
+		_, err = parseTopology(testDriverName, str)
+		assert.Error(t, err, str)
+	}
+
+	// only the static segments, the node labels are not queried
+	segments, err = nodeTopology(nil, testDriverName, "node1", "zone=zone-a", "")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{testZoneKey: "zone-a"}, segments)
+
+	client := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   "node1",
+		Labels: map[string]string{"topology.kubernetes.io/zone": "zone-b", "kubernetes.io/hostname": "node1"},
+	}})
+	segments, err = nodeTopology(client, testDriverName, "node1", "rack=rack-1", "topology.kubernetes.io/zone, kubernetes.io/hostname")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		testZoneKey:                             "zone-b",
+		topologyKey(testDriverName, "rack"):     "rack-1",
+		topologyKey(testDriverName, "hostname"): "node1",
+	}, segments)
+	_, err = nodeTopology(client, testDriverName, "node1", "", "topology.kubernetes.io/region")
+	assert.Error(t, err)
+	_, err = nodeTopology(client, testDriverName, "node2", "", "topology.kubernetes.io/zone")
+	assert.Error(t, err)
+}
+
+func TestSelectTopology(t *testing.T) {
+	zone := func(z string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{testZoneKey: z, "kubernetes.io/hostname": "node1"}}
+	}
+	candidates := []util.ClusterInfo{
+		{ClusterID: "cluster0"},
+		{
+			ClusterID: "cluster1",
+			Topologies: []util.TopologyPool{
+				{Segments: map[string]string{"zone": "zone-a"}, Poolset: "ssd-a"},
+				{Segments: map[string]string{"zone": "zone-a"}, Poolset: "hdd-a"},
+			},
+		},
+		{
+			ClusterID: "cluster2",
+			Topologies: []util.TopologyPool{
+				{Segments: map[string]string{testZoneKey: "zone-b"}},
+			},
+		},
+	}
+
+	// topology not required or not declared
+	choice, err := selectTopology(testDriverName, candidates, "", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, choice)
+	choice, err = selectTopology(testDriverName, candidates[:1], "", &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{zone("zone-a")},
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, choice)
+
+	// the preferred topology goes first
+	choice, err = selectTopology(testDriverName, candidates, "", &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{zone("zone-a"), zone("zone-b")},
+		Preferred: []*csi.Topology{zone("zone-b")},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &topologyChoice{
+		clusterID: "cluster2",
+		segments:  map[string]string{testZoneKey: "zone-b"},
+	}, choice)
+
+	// the pool of the requested poolset
+	choice, err = selectTopology(testDriverName, candidates, "hdd-a", &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{zone("zone-a")},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &topologyChoice{
+		clusterID: "cluster1",
+		poolset:   "hdd-a",
+		segments:  map[string]string{testZoneKey: "zone-a"},
+	}, choice)
+
+	// the pool of the default poolset takes the requested poolset
+	choice, err = selectTopology(testDriverName, candidates, "ssd", &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{zone("zone-b")},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "ssd", choice.poolset)
+
+	// no pool is accessible
+	_, err = selectTopology(testDriverName, candidates, "", &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{zone("zone-c")},
+	})
+	assert.Error(t, err)
+	_, err = selectTopology(testDriverName, candidates, "ssd", &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{zone("zone-a")},
+	})
+	assert.Error(t, err)
+}
@@ -67,6 +67,24 @@ func (cs *controllerServer) validateExpandVolumeRequest(req *csi.ControllerExpan
 	return nil
 }
 
+func (cs *controllerServer) validateModifyVolumeRequest(req *csi.ControllerModifyVolumeRequest) error {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_MODIFY_VOLUME); err != nil {
+		return err
+	}
+
+	if req.GetVolumeId() == "" {
+		return status.Error(codes.InvalidArgument, "volume Id cannot be empty")
+	}
+
+	for key := range req.GetMutableParameters() {
+		if !isMutableParam(key) {
+			return status.Errorf(codes.InvalidArgument, "parameter %q can not be modified", key)
+		}
+	}
+
+	return nil
+}
+
 func (cs *controllerServer) validateSnapshotReq(req *csi.CreateSnapshotRequest) error {
 	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
 		return err
@@ -95,6 +113,56 @@ func (cs *controllerServer) validateDeleteSnapshotReq(req *csi.DeleteSnapshotReq
 	return nil
 }
 
+// Group controller service request validation
+func (gcs *groupControllerServer) validateCreateVolumeGroupSnapshotRequest(req *csi.CreateVolumeGroupSnapshotRequest) error {
+	if err := gcs.Driver.ValidateGroupControllerServiceRequest(csi.GroupControllerServiceCapability_RPC_CREATE_DELETE_GET_VOLUME_GROUP_SNAPSHOT); err != nil {
+		return err
+	}
+
+	if req.GetName() == "" {
+		return status.Error(codes.InvalidArgument, "group snapshot Name cannot be empty")
+	}
+	if len(req.GetSourceVolumeIds()) == 0 {
+		return status.Error(codes.InvalidArgument, "source Volume IDs cannot be empty")
+	}
+	seen := make(map[string]bool, len(req.GetSourceVolumeIds()))
+	for _, volumeId := range req.GetSourceVolumeIds() {
+		if volumeId == "" {
+			return status.Error(codes.InvalidArgument, "source Volume ID cannot be empty")
+		}
+		if seen[volumeId] {
+			return status.Errorf(codes.InvalidArgument, "duplicated source Volume ID %s", volumeId)
+		}
+		seen[volumeId] = true
+	}
+
+	return nil
+}
+
+func (gcs *groupControllerServer) validateDeleteVolumeGroupSnapshotRequest(req *csi.DeleteVolumeGroupSnapshotRequest) error {
+	if err := gcs.Driver.ValidateGroupControllerServiceRequest(csi.GroupControllerServiceCapability_RPC_CREATE_DELETE_GET_VOLUME_GROUP_SNAPSHOT); err != nil {
+		return err
+	}
+
+	if req.GetGroupSnapshotId() == "" {
+		return status.Error(codes.InvalidArgument, "group snapshot ID cannot be empty")
+	}
+
+	return nil
+}
+
+func (gcs *groupControllerServer) validateGetVolumeGroupSnapshotRequest(req *csi.GetVolumeGroupSnapshotRequest) error {
+	if err := gcs.Driver.ValidateGroupControllerServiceRequest(csi.GroupControllerServiceCapability_RPC_CREATE_DELETE_GET_VOLUME_GROUP_SNAPSHOT); err != nil {
+		return err
+	}
+
+	if req.GetGroupSnapshotId() == "" {
+		return status.Error(codes.InvalidArgument, "group snapshot ID cannot be empty")
+	}
+
+	return nil
+}
+
 func (ns *nodeServer) validateNodeStageVolumeRequest(req *csi.NodeStageVolumeRequest) error {
 	if req.GetVolumeCapability() == nil {
 		return status.Error(codes.InvalidArgument, "volume capability missing in request")
@@ -142,7 +210,8 @@ func (ns *nodeServer) validateNodePublishVolumeRequest(req *csi.NodePublishVolum
 		return status.Error(codes.InvalidArgument, "target path missing in request")
 	}
 
-	if req.GetStagingTargetPath() == "" {
+	// the ephemeral inline volumes are not staged
+	if req.GetStagingTargetPath() == "" && !isEphemeral(req.GetVolumeContext()) {
 		return status.Error(codes.InvalidArgument, "staging target path missing in request")
 	}
 
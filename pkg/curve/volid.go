@@ -17,76 +17,222 @@ limitations under the License.
 package curve
 
 import (
-	"encoding/binary"
-	"encoding/hex"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 )
 
 const (
 	maxCSIIDLen = 128
+
+	// prefix of the versioned CSI IDs, the legacy IDs start with hex digits
+	csiIDVersion1 = "v1"
 )
 
+// namingScheme describes how the curve volume name is derived.
+type namingScheme byte
+
+const (
+	// the volume name is csiVolNamingPrefix + request name
+	namingSchemeCSI namingScheme = '0'
+	// the volume is a pre-existing file adopted by static provisioning,
+	// the volume name is its path relative to the directory of the user
+	namingSchemeStatic namingScheme = '1'
+)
+
+func (s namingScheme) valid() bool {
+	return s == namingSchemeCSI || s == namingSchemeStatic
+}
+
+// errInvalidCSIID is returned if a CSI ID can not be decoded.
+var errInvalidCSIID = errors.New("invalid CSI ID")
+
+// csiIdentifier holds the fields encoded in a CSI volume ID.
+type csiIdentifier struct {
+	clusterID string
+	pool      string
+	scheme    namingScheme
+	user      string
+	volName   string
+}
+
 /*
 ComposeCSIID composes a CSI ID from passed in parameters.
-	[length of user=1:4byte] + [-:1byte]
-	[user] + [-:1byte]
+	[version=v1:2byte] + [-:1byte]
+	[length of clusterID:2byte] + [clusterID] + [-:1byte]
+	[length of pool:2byte] + [pool] + [-:1byte]
+	[naming scheme:1byte] + [-:1byte]
+	[length of user:2byte] + [user] + [-:1byte]
 	[volName]
+The lengths are lowercase hex.
 */
-func composeCSIID(user, volName string) (string, error) {
-	buf16 := make([]byte, 2)
+func composeCSIID(ci *csiIdentifier) (string, error) {
+	if ci.user == "" || ci.volName == "" {
+		return "", fmt.Errorf("user and volName of CSI ID can not be empty")
+	}
+	if !ci.scheme.valid() {
+		return "", fmt.Errorf("unknown naming scheme %q", ci.scheme)
+	}
 
-	if (4 + 1 + len(user) + 1 + len(volName)) > maxCSIIDLen {
+	var buf strings.Builder
+	buf.WriteString(csiIDVersion1)
+	for _, field := range []string{ci.clusterID, ci.pool} {
+		if len(field) > 0xff {
+			return "", fmt.Errorf("field %q of CSI ID is too long", field)
+		}
+		buf.WriteString(fmt.Sprintf("-%02x%s", len(field), field))
+	}
+	buf.WriteString(fmt.Sprintf("-%c", ci.scheme))
+	if len(ci.user) > 0xff {
+		return "", fmt.Errorf("field %q of CSI ID is too long", ci.user)
+	}
+	buf.WriteString(fmt.Sprintf("-%02x%s-%s", len(ci.user), ci.user, ci.volName))
+
+	if buf.Len() > maxCSIIDLen {
 		return "", fmt.Errorf("CSI ID encoding length overflow")
 	}
+	return buf.String(), nil
+}
+
+// decomposeCSIID decodes both versioned and legacy CSI IDs,
+// it returns errInvalidCSIID if the ID is malformed.
+func decomposeCSIID(composedCSIID string) (*csiIdentifier, error) {
+	if len(composedCSIID) > maxCSIIDLen {
+		return nil, fmt.Errorf("%w: %q is longer than %d", errInvalidCSIID, composedCSIID, maxCSIIDLen)
+	}
+	if strings.HasPrefix(composedCSIID, csiIDVersion1+"-") {
+		return decomposeCSIIDv1(composedCSIID)
+	}
+	return decomposeLegacyCSIID(composedCSIID)
+}
+
+func decomposeCSIIDv1(composedCSIID string) (*csiIdentifier, error) {
+	var err error
+	ci := &csiIdentifier{}
+	rest := strings.TrimPrefix(composedCSIID, csiIDVersion1)
+
+	if ci.clusterID, rest, err = nextLenPrefixedField(rest, 2); err != nil {
+		return nil, fmt.Errorf("%w: %q bad clusterID: %v", errInvalidCSIID, composedCSIID, err)
+	}
+	if ci.pool, rest, err = nextLenPrefixedField(rest, 2); err != nil {
+		return nil, fmt.Errorf("%w: %q bad pool: %v", errInvalidCSIID, composedCSIID, err)
+	}
+	if len(rest) < 2 || rest[0] != '-' || !namingScheme(rest[1]).valid() {
+		return nil, fmt.Errorf("%w: %q bad naming scheme", errInvalidCSIID, composedCSIID)
+	}
+	ci.scheme = namingScheme(rest[1])
+	rest = rest[2:]
+	if ci.user, rest, err = nextLenPrefixedField(rest, 2); err != nil {
+		return nil, fmt.Errorf("%w: %q bad user: %v", errInvalidCSIID, composedCSIID, err)
+	}
+	if ci.user == "" {
+		return nil, fmt.Errorf("%w: %q empty user", errInvalidCSIID, composedCSIID)
+	}
+	if len(rest) < 2 || rest[0] != '-' {
+		return nil, fmt.Errorf("%w: %q missing volName", errInvalidCSIID, composedCSIID)
+	}
+	ci.volName = rest[1:]
+	return ci, nil
+}
 
-	binary.BigEndian.PutUint16(buf16, uint16(len(user)))
-	userLength := hex.EncodeToString(buf16)
+/*
+decomposeLegacyCSIID decodes the legacy CSI ID:
+	[length of user:4byte] + [-:1byte]
+	[user] + [-:1byte]
+	[volName]
+The legacy volumes are always in the default cluster.
+*/
+func decomposeLegacyCSIID(composedCSIID string) (*csiIdentifier, error) {
+	user, rest, err := legacyLenPrefixedField(composedCSIID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q bad user: %v", errInvalidCSIID, composedCSIID, err)
+	}
+	if user == "" {
+		return nil, fmt.Errorf("%w: %q empty user", errInvalidCSIID, composedCSIID)
+	}
+	if len(rest) < 2 || rest[0] != '-' {
+		return nil, fmt.Errorf("%w: %q missing volName", errInvalidCSIID, composedCSIID)
+	}
 
-	return strings.Join([]string{userLength, user, volName}, "-"), nil
+	return &csiIdentifier{
+		scheme:  namingSchemeCSI,
+		user:    user,
+		volName: rest[1:],
+	}, nil
 }
 
-func decomposeCSIID(composedCSIID string) (user string, volName string, err error) {
-	if len(composedCSIID) < 8 {
-		return "", "", fmt.Errorf("%q can not less than 8", composedCSIID)
+// nextLenPrefixedField parses "-<lowercase hex length of lenDigits><field>" at
+// the beginning of s, and returns the field and the rest of s.
+func nextLenPrefixedField(s string, lenDigits int) (field, rest string, err error) {
+	if len(s) < 1+lenDigits || s[0] != '-' {
+		return "", "", fmt.Errorf("missing field")
+	}
+	lenStr := s[1 : 1+lenDigits]
+	if strings.ToLower(lenStr) != lenStr {
+		return "", "", fmt.Errorf("length %q must be lowercase hex", lenStr)
 	}
-	buf16, err := hex.DecodeString(composedCSIID[0:4])
+	fieldLen, err := strconv.ParseUint(lenStr, 16, 16)
 	if err != nil {
-		return "", "", err
+		return "", "", fmt.Errorf("bad length %q", lenStr)
 	}
-	userLength := binary.BigEndian.Uint16(buf16)
-	user = composedCSIID[5 : 5+userLength]
-	volName = composedCSIID[6+userLength:]
-	return user, volName, nil
+	s = s[1+lenDigits:]
+	if uint64(len(s)) < fieldLen {
+		return "", "", fmt.Errorf("length %d overflow", fieldLen)
+	}
+	return s[:fieldLen], s[fieldLen:], nil
+}
+
+// legacyLenPrefixedField parses "<hex length of 4 digits>-<field>" at the beginning of s.
+func legacyLenPrefixedField(s string) (field, rest string, err error) {
+	if len(s) < 5 || s[4] != '-' {
+		return "", "", fmt.Errorf("missing field")
+	}
+	return nextLenPrefixedField("-"+s[:4]+s[5:], 4)
 }
 
 /*
 ComposeSnapshotID composes a Snapshot ID from passed in parameters.
-	[length of snapCurveUUID=1:4byte] + [-:1byte]
-	[snapCurveUUID] + [-:1byte]
-	+ composeCSIID(user, volName string)
+	[version=v1:2byte] + [-:1byte]
+	[length of snapCurveUUID:2byte] + [snapCurveUUID] + [-:1byte]
+	[volId]
 */
 func composeSnapshotID(snapCurveUUID, volId string) (string, error) {
-	buf16 := make([]byte, 2)
-	if (4 + 1 + len(snapCurveUUID) + 1 + len(volId)) > maxCSIIDLen {
+	if snapCurveUUID == "" || len(snapCurveUUID) > 0xff {
+		return "", fmt.Errorf("bad snapshot uuid %q", snapCurveUUID)
+	}
+	if (2 + 1 + 2 + len(snapCurveUUID) + 1 + len(volId)) > maxCSIIDLen {
 		return "", fmt.Errorf("CSI Snapshot ID encoding length overflow")
 	}
 
-	binary.BigEndian.PutUint16(buf16, uint16(len(snapCurveUUID)))
-	snapCurveUUIDLength := hex.EncodeToString(buf16)
-	return strings.Join([]string{snapCurveUUIDLength, snapCurveUUID, volId}, "-"), nil
+	return fmt.Sprintf("%s-%02x%s-%s", csiIDVersion1, len(snapCurveUUID), snapCurveUUID, volId), nil
 }
 
+/*
+decomposeSnapshotID decodes both versioned and legacy snapshot IDs, the legacy one is:
+	[length of snapCurveUUID:4byte] + [-:1byte]
+	[snapCurveUUID] + [-:1byte]
+	[volId]
+*/
 func decomposeSnapshotID(composedSnapID string) (snapCurveUUID string, volId string, err error) {
-	if len(composedSnapID) < 8 {
-		return "", "", fmt.Errorf("%q can not less than 8", composedSnapID)
+	if len(composedSnapID) > maxCSIIDLen {
+		return "", "", fmt.Errorf("%w: %q is longer than %d", errInvalidCSIID, composedSnapID, maxCSIIDLen)
+	}
+
+	var rest string
+	if strings.HasPrefix(composedSnapID, csiIDVersion1+"-") {
+		snapCurveUUID, rest, err = nextLenPrefixedField(strings.TrimPrefix(composedSnapID, csiIDVersion1), 2)
+	} else {
+		snapCurveUUID, rest, err = legacyLenPrefixedField(composedSnapID)
 	}
-	buf16, err := hex.DecodeString(composedSnapID[0:4])
 	if err != nil {
-		return "", "", err
+		return "", "", fmt.Errorf("%w: %q bad snapshot uuid: %v", errInvalidCSIID, composedSnapID, err)
+	}
+	if snapCurveUUID == "" {
+		return "", "", fmt.Errorf("%w: %q empty snapshot uuid", errInvalidCSIID, composedSnapID)
+	}
+	if len(rest) < 2 || rest[0] != '-' {
+		return "", "", fmt.Errorf("%w: %q missing volume id", errInvalidCSIID, composedSnapID)
 	}
-	snapCurveUUIDLength := binary.BigEndian.Uint16(buf16)
-	snapCurveUUID = composedSnapID[5 : 5+snapCurveUUIDLength]
-	volId = composedSnapID[6+snapCurveUUIDLength:]
-	return snapCurveUUID, volId, nil
+	return snapCurveUUID, rest[1:], nil
 }
@@ -0,0 +1,93 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func FuzzDecomposeCSIID(f *testing.F) {
+	for _, seed := range []string{
+		"0003-k8s-csi-vol-pvc-eeafeeb3-7a35-11ea-934a-fa163e28f309",
+		"v1-00-00-0-03k8s-csi-vol-pvc-eeafeeb3-7a35-11ea-934a-fa163e28f309",
+		"v1-08cluster1-03ssd-0-03k8s-csi-vol-pvc-eeafeeb3-7a35-11ea-934a-fa163e28f309",
+		"ffff-k8s",
+		"v1-ff",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, id string) {
+		ci, err := decomposeCSIID(id)
+		if err != nil {
+			if !errors.Is(err, errInvalidCSIID) {
+				t.Fatalf("%q: unexpected error type: %v", id, err)
+			}
+			return
+		}
+		if ci.user == "" || ci.volName == "" {
+			t.Fatalf("%q: decoded empty field: %+v", id, ci)
+		}
+		// the versioned ID must be encoded uniquely
+		if strings.HasPrefix(id, csiIDVersion1+"-") {
+			composed, err := composeCSIID(ci)
+			if err != nil {
+				t.Fatalf("%q: failed to compose decoded %+v: %v", id, ci, err)
+			}
+			if composed != id {
+				t.Fatalf("%q: composed to a different ID %q", id, composed)
+			}
+		}
+	})
+}
+
+func FuzzDecomposeSnapshotID(f *testing.F) {
+	for _, seed := range []string{
+		"0024-9ea1a8fc-160d-47ef-b2ef-f0e09677b066-0003-k8s-csi-vol-volume-fa0c04c9-2e93-487e-8986-1e1625fd8c46",
+		"v1-249ea1a8fc-160d-47ef-b2ef-f0e09677b066-v1-00-00-0-03k8s-csi-vol-pvc-eeafeeb3-7a35-11ea-934a-fa163e28f309",
+		"0024-",
+		"v1-ff",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, id string) {
+		uuid, volId, err := decomposeSnapshotID(id)
+		if err != nil {
+			if !errors.Is(err, errInvalidCSIID) {
+				t.Fatalf("%q: unexpected error type: %v", id, err)
+			}
+			return
+		}
+		if uuid == "" || volId == "" {
+			t.Fatalf("%q: decoded empty field", id)
+		}
+		if strings.HasPrefix(id, csiIDVersion1+"-") {
+			composed, err := composeSnapshotID(uuid, volId)
+			if err != nil || composed != id {
+				t.Fatalf("%q: composed to %q, err: %v", id, composed, err)
+			}
+		}
+		// the embedded volume id must be decoded without panic
+		_, _ = decomposeCSIID(volId)
+	})
+}
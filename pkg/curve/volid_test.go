@@ -17,6 +17,8 @@ limitations under the License.
 package curve
 
 import (
+	"errors"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -26,15 +28,93 @@ func TestComposeCSIID(t *testing.T) {
 	user := "k8s"
 	volName := csiVolNamingPrefix + "pvc-eeafeeb3-7a35-11ea-934a-fa163e28f309"
 
-	id, err := composeCSIID(user, volName)
+	id, err := composeCSIID(&csiIdentifier{scheme: namingSchemeCSI, user: user, volName: volName})
 	assert.NoError(t, err)
-	assert.Equal(t, "0003-k8s-csi-vol-pvc-eeafeeb3-7a35-11ea-934a-fa163e28f309", id)
+	assert.Equal(t, "v1-00-00-0-03k8s-csi-vol-pvc-eeafeeb3-7a35-11ea-934a-fa163e28f309", id)
+
+	id, err = composeCSIID(&csiIdentifier{clusterID: "cluster1", pool: "ssd", scheme: namingSchemeCSI, user: user, volName: volName})
+	assert.NoError(t, err)
+	assert.Equal(t, "v1-08cluster1-03ssd-0-03k8s-csi-vol-pvc-eeafeeb3-7a35-11ea-934a-fa163e28f309", id)
+
+	_, err = composeCSIID(&csiIdentifier{scheme: namingSchemeCSI, volName: volName})
+	assert.Error(t, err)
+
+	_, err = composeCSIID(&csiIdentifier{scheme: namingSchemeCSI, user: user, volName: volName + strings.Repeat("a", maxCSIIDLen)})
+	assert.Error(t, err)
 }
 
 func TestDecomposeCSIID(t *testing.T) {
-	id := "0003-k8s-csi-vol-pvc-eeafeeb3-7a35-11ea-934a-fa163e28f309"
-	user, volName, err := decomposeCSIID(id)
+	validCases := map[string]csiIdentifier{
+		"0003-k8s-csi-vol-pvc-eeafeeb3-7a35-11ea-934a-fa163e28f309": {
+			scheme: namingSchemeCSI, user: "k8s", volName: "csi-vol-pvc-eeafeeb3-7a35-11ea-934a-fa163e28f309",
+		},
+		"v1-00-00-0-03k8s-csi-vol-pvc-eeafeeb3-7a35-11ea-934a-fa163e28f309": {
+			scheme: namingSchemeCSI, user: "k8s", volName: "csi-vol-pvc-eeafeeb3-7a35-11ea-934a-fa163e28f309",
+		},
+		"v1-08cluster1-03ssd-0-03k8s-csi-vol-pvc-eeafeeb3-7a35-11ea-934a-fa163e28f309": {
+			clusterID: "cluster1", pool: "ssd", scheme: namingSchemeCSI, user: "k8s", volName: "csi-vol-pvc-eeafeeb3-7a35-11ea-934a-fa163e28f309",
+		},
+		"v1-00-00-1-02vm-mysql/db01": {
+			scheme: namingSchemeStatic, user: "vm", volName: "mysql/db01",
+		},
+	}
+	for id, expected := range validCases {
+		ci, err := decomposeCSIID(id)
+		assert.NoError(t, err, id)
+		assert.Equal(t, expected, *ci, id)
+	}
+
+	invalidCases := []string{
+		"",
+		"0003",
+		"0003-k8",
+		"0003-k8s",
+		"0003-k8s-",
+		"0000--csi-vol",
+		"ffff-k8s-csi-vol",
+		"000G-k8s-csi-vol",
+		"000A-k8s-csi-vol-a",
+		"v1-",
+		"v1-00-00-0-03k8s",
+		"v1-00-00-0-03k8s-",
+		"v1-00-00-2-03k8s-csi-vol",
+		"v1-00-00-0-00-csi-vol",
+		"v1-ff-00-0-03k8s-csi-vol",
+		"v1-0g-00-0-03k8s-csi-vol",
+		"v1-+1a-00-0-03k8s-csi-vol",
+		"0003-k8s-" + strings.Repeat("a", maxCSIIDLen),
+	}
+	for _, id := range invalidCases {
+		_, err := decomposeCSIID(id)
+		assert.True(t, errors.Is(err, errInvalidCSIID), "%q: %v", id, err)
+	}
+}
+
+func TestComposeSnapshotID(t *testing.T) {
+	volId := "v1-00-00-0-03k8s-csi-vol-pvc-eeafeeb3-7a35-11ea-934a-fa163e28f309"
+	id, err := composeSnapshotID("9ea1a8fc-160d-47ef-b2ef-f0e09677b066", volId)
 	assert.NoError(t, err)
-	assert.Equal(t, "k8s", user)
-	assert.Equal(t, "csi-vol-pvc-eeafeeb3-7a35-11ea-934a-fa163e28f309", volName)
+	assert.Equal(t, "v1-249ea1a8fc-160d-47ef-b2ef-f0e09677b066-"+volId, id)
+
+	_, err = composeSnapshotID("", volId)
+	assert.Error(t, err)
+}
+
+func TestDecomposeSnapshotID(t *testing.T) {
+	legacyVolId := "0003-k8s-csi-vol-volume-fa0c04c9-2e93-487e-8986-1e1625fd8c46"
+	uuid, volId, err := decomposeSnapshotID("0024-9ea1a8fc-160d-47ef-b2ef-f0e09677b066-" + legacyVolId)
+	assert.NoError(t, err)
+	assert.Equal(t, "9ea1a8fc-160d-47ef-b2ef-f0e09677b066", uuid)
+	assert.Equal(t, legacyVolId, volId)
+
+	v1VolId := "v1-00-00-0-03k8s-csi-vol-pvc-eeafeeb3-7a35-11ea-934a-fa163e28f309"
+	uuid, volId, err = decomposeSnapshotID("v1-249ea1a8fc-160d-47ef-b2ef-f0e09677b066-" + v1VolId)
+	assert.NoError(t, err)
+	assert.Equal(t, "9ea1a8fc-160d-47ef-b2ef-f0e09677b066", uuid)
+	assert.Equal(t, v1VolId, volId)
+
+	for _, id := range []string{"", "0024", "0024-9ea1a8fc", "0000--" + legacyVolId, "v1-24", "v1-00-" + v1VolId, "v1-249ea1a8fc-160d-47ef-b2ef-f0e09677b066"} {
+		_, _, err = decomposeSnapshotID(id)
+		assert.True(t, errors.Is(err, errInvalidCSIID), "%q: %v", id, err)
+	}
 }
@@ -0,0 +1,125 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+	"github.com/opencurve/curve-csi/pkg/util"
+)
+
+// volumeMeta is the controller side metadata of a volume,
+// which can not be recovered from the volume ID or the backend.
+type volumeMeta struct {
+	QoS *qosSpec `json:"qos,omitempty"`
+	// the laziness of the clones from the volume and its snapshots,
+	// overrides the cloneLazy of the destination
+	CloneLazy *bool `json:"cloneLazy,omitempty"`
+	// false to delete the volume without moving it to the trash
+	Trash *bool `json:"trash,omitempty"`
+	// the source volume ID of the clone, the one of the snapshot if cloned from a snapshot
+	CloneSource string `json:"cloneSource,omitempty"`
+	// the clones of other users from the volume and its snapshots, from the volume ID
+	// of the clone to the volume path or snapshot UUID it is cloned from
+	CrossUserClones map[string]string `json:"crossUserClones,omitempty"`
+	// true to delete the adopted volume on DeleteVolume, which is kept by default
+	Owned *bool `json:"owned,omitempty"`
+	// the disk image the volume was populated from
+	Image *imageSpec `json:"image,omitempty"`
+}
+
+func (m *volumeMeta) isEmpty() bool {
+	return m.QoS == nil && m.CloneLazy == nil && m.Trash == nil && m.CloneSource == "" && len(m.CrossUserClones) == 0 && m.Owned == nil &&
+		m.Image == nil
+}
+
+// modify applies the mutable parameters, returns the removed throttle types.
+func (m *volumeMeta) modify(parameters map[string]string) ([]curveservice.ThrottleType, error) {
+	qos, removed, err := modifyQoSSpec(m.QoS, parameters)
+	if err != nil {
+		return nil, err
+	}
+	cloneLazy, err := parseBoolParam(parameters, cloneLazyParam)
+	if err != nil {
+		return nil, err
+	}
+	trash, err := parseBoolParam(parameters, trashParam)
+	if err != nil {
+		return nil, err
+	}
+	owned, err := parseBoolParam(parameters, ownedParam)
+	if err != nil {
+		return nil, err
+	}
+
+	m.QoS = qos
+	if cloneLazy != nil {
+		m.CloneLazy = cloneLazy
+	}
+	if trash != nil {
+		m.Trash = trash
+	}
+	if owned != nil {
+		m.Owned = owned
+	}
+	return removed, nil
+}
+
+// isMutableParam returns true if the parameter can be modified by ControllerModifyVolume.
+func isMutableParam(key string) bool {
+	return isQoSParam(key) || key == cloneLazyParam || key == trashParam || key == ownedParam
+}
+
+// volumeMetaStore persists the volumeMeta by volume ID,
+// it does nothing if the metadata store is not set.
+type volumeMetaStore struct {
+	store util.ObjectStore
+}
+
+func newVolumeMetaStore(store util.ObjectStore) *volumeMetaStore {
+	return &volumeMetaStore{store: store}
+}
+
+// enabled returns false if the metadata store is not set.
+func (s *volumeMetaStore) enabled() bool {
+	return s.store != nil
+}
+
+// get returns the empty metadata if not found.
+func (s *volumeMetaStore) get(volumeId string) (*volumeMeta, error) {
+	meta := &volumeMeta{}
+	if s.store == nil {
+		return meta, nil
+	}
+	if err := s.store.Get(volumeId, meta); err != nil && !util.IsNotFoundErr(err, volumeId) {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (s *volumeMetaStore) put(volumeId string, meta *volumeMeta) error {
+	if s.store == nil {
+		return nil
+	}
+	return s.store.Put(volumeId, meta)
+}
+
+func (s *volumeMetaStore) delete(volumeId string) error {
+	if s.store == nil {
+		return nil
+	}
+	return s.store.Delete(volumeId)
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opencurve/curve-csi/pkg/util"
+)
+
+func TestVolumeMetaStore(t *testing.T) {
+	volId := "v1-00-00-0-03k8s-csi-vol-pvc-1"
+
+	// disabled
+	s := newVolumeMetaStore(nil)
+	assert.False(t, s.enabled())
+	assert.NoError(t, s.put(volId, &volumeMeta{}))
+	meta, err := s.get(volId)
+	assert.NoError(t, err)
+	assert.True(t, meta.isEmpty())
+
+	s = newVolumeMetaStore(util.NewFileStore(t.TempDir()))
+	assert.True(t, s.enabled())
+	meta, err = s.get(volId)
+	assert.NoError(t, err)
+	assert.True(t, meta.isEmpty())
+
+	q, err := parseQoSSpec(map[string]string{"readIOPSPerGiB": "10"})
+	assert.NoError(t, err)
+	trash := false
+	assert.NoError(t, s.put(volId, &volumeMeta{QoS: q, Trash: &trash}))
+	meta, err = s.get(volId)
+	assert.NoError(t, err)
+	assert.Equal(t, q.toParameters(10), meta.QoS.toParameters(10))
+	assert.True(t, meta.QoS.scalesWithSize())
+	assert.False(t, *meta.Trash)
+	assert.Nil(t, meta.CloneLazy)
+	assert.Empty(t, meta.CloneSource)
+
+	// the clone source alone is persisted
+	srcVolId := "v1-00-00-0-03k8s-csi-vol-pvc-0"
+	assert.False(t, (&volumeMeta{CloneSource: srcVolId}).isEmpty())
+	assert.NoError(t, s.put(volId, &volumeMeta{CloneSource: srcVolId}))
+	meta, err = s.get(volId)
+	assert.NoError(t, err)
+	assert.Equal(t, srcVolId, meta.CloneSource)
+
+	assert.NoError(t, s.delete(volId))
+	meta, err = s.get(volId)
+	assert.NoError(t, err)
+	assert.True(t, meta.isEmpty())
+}
+
+func TestVolumeMetaModify(t *testing.T) {
+	meta := &volumeMeta{}
+	removed, err := meta.modify(map[string]string{
+		"cloneLazy": "false",
+		"readIOPS":  "100",
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, removed)
+	assert.False(t, *meta.CloneLazy)
+	assert.Nil(t, meta.Trash)
+	assert.Equal(t, map[string]string{"readIOPS": "100"}, meta.QoS.toParameters(10))
+
+	// cloneLazy is kept if not set
+	_, err = meta.modify(map[string]string{"trash": "true", "readIOPS": "0"})
+	assert.NoError(t, err)
+	assert.False(t, *meta.CloneLazy)
+	assert.True(t, *meta.Trash)
+	assert.Nil(t, meta.QoS)
+
+	_, err = meta.modify(map[string]string{"trash": "maybe"})
+	assert.Error(t, err)
+}
+
+func TestIsMutableParam(t *testing.T) {
+	for _, key := range []string{"readIOPS", "totalBPSPerGiB", "cloneLazy", "trash"} {
+		assert.True(t, isMutableParam(key), key)
+	}
+	for _, key := range []string{"user", "clusterID", "stripeUnit", "stripeCount", "poolset", "readIOPSPerGB"} {
+		assert.False(t, isMutableParam(key), key)
+	}
+}
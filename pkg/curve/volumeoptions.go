@@ -18,11 +18,13 @@ package curve
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"k8s.io/apimachinery/pkg/api/resource"
-	volumehelpers "k8s.io/cloud-provider/volume/helpers"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+	"github.com/opencurve/curve-csi/pkg/util"
 )
 
 const (
@@ -32,6 +34,10 @@ const (
 	curveUserMaxLen = 30
 	// clone lazy
 	curveCloneDefaultLazy = true
+
+	// StorageClass parameters
+	cloneLazyParam = "cloneLazy"
+	trashParam     = "trash"
 )
 
 type volumeOptions struct {
@@ -41,12 +47,141 @@ type volumeOptions struct {
 	sizeGiB   int
 	user      string
 	cloneLazy bool
+	clusterID string
+	// size policy from StorageClass parameters, overrides the cluster's one
+	sizePolicy *util.SizePolicy
+	// QoS from StorageClass parameters
+	qos *qosSpec
+	// move to the trash on deletion, nil to follow the cluster
+	trash *bool
+	// max depth of lazy clone chain from StorageClass parameters, nil to follow --max-clone-depth
+	maxCloneDepth *int
+	// what is flattened when the max clone depth is exceeded, see cloneDepthFlattenParam
+	cloneDepthFlatten string
+	// the source volume ID if created from a content source
+	cloneSource string
+	// the other users allowed to clone from, see cloneSourceUsersParam
+	cloneSourceUsers []string
+	// the disk image to populate the volume from
+	image *imageSpec
+	// stripe and poolset, the poolset is encoded in the volume ID
+	placement placement
+	// how the volume name is derived, zero for the volumes created by the driver
+	scheme namingScheme
+	// curve credentials from CSI secrets
+	creds *util.Credentials
+
+	// resolved from clusterID
+	cluster *util.ClusterInfo
 }
 
 func (vo *volumeOptions) genVolumePath() string {
 	return "/" + vo.user + "/" + vo.volName
 }
 
+// resolveTopology selects the cluster and poolset accessible from the topology requirement,
+// and returns the accessible topology of the volume, nil if the topology is not declared.
+// It must be called before resolveCluster.
+func (vo *volumeOptions) resolveTopology(
+	cr *clusterResolver,
+	driverName string,
+	requirement *csi.TopologyRequirement) ([]*csi.Topology, error) {
+	candidates, err := cr.candidates(vo.clusterID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get info of cluster %q: %w", vo.clusterID, err)
+	}
+	choice, err := selectTopology(driverName, candidates, vo.placement.poolset, requirement)
+	if err != nil || choice == nil {
+		return nil, err
+	}
+	vo.clusterID = choice.clusterID
+	vo.placement.poolset = choice.poolset
+	if err = vo.composeVolID(); err != nil {
+		return nil, err
+	}
+	return []*csi.Topology{{Segments: choice.segments}}, nil
+}
+
+// resolveCluster gets the cluster info of the volume from the clusterID.
+func (vo *volumeOptions) resolveCluster(cr *clusterResolver) error {
+	cluster, err := cr.resolve(vo.clusterID)
+	if err != nil {
+		return fmt.Errorf("failed to get info of cluster %q: %w", vo.clusterID, err)
+	}
+	vo.cluster = cluster
+	return nil
+}
+
+// resolveSize computes the volume size from the capacity range by the size policy,
+// it must be called after resolveCluster.
+func (vo *volumeOptions) resolveSize(capRange *csi.CapacityRange) error {
+	sp := defaultSizePolicy()
+	if vo.cluster != nil {
+		sp = sp.merge(vo.cluster.SizePolicy)
+	}
+	sp = sp.merge(vo.sizePolicy)
+	if err := sp.validate(); err != nil {
+		return err
+	}
+
+	sizeGiB, err := sp.roundUp(capRange)
+	if err != nil {
+		return err
+	}
+	vo.sizeGiB = sizeGiB
+	return nil
+}
+
+// applyCredentials sets the curve credentials from the CSI secrets,
+// the user of secrets, if set, must be the user of the volume.
+func (vo *volumeOptions) applyCredentials(secrets map[string]string) error {
+	creds := util.NewCredentials(secrets)
+	if creds == nil {
+		return nil
+	}
+	if creds.User != "" && creds.User != vo.user {
+		return fmt.Errorf("the user %q of secrets does not match the user %q of volume", creds.User, vo.user)
+	}
+	vo.creds = creds
+	return nil
+}
+
+// curveVolume returns the curve volume in the cluster of the volume.
+func (vo *volumeOptions) curveVolume() *curveservice.CurveVolume {
+	curveVol := curveservice.NewCurveVolume(vo.user, vo.volName, vo.sizeGiB)
+	if vo.cluster != nil {
+		curveVol.ConfPath = vo.cluster.ClientConf
+		curveVol.MdsAddrs = vo.cluster.MdsAddrs
+	}
+	curveVol.StripeUnit = vo.placement.stripeUnit
+	curveVol.StripeCount = vo.placement.stripeCount
+	curveVol.Poolset = vo.placement.poolset
+	if vo.creds != nil {
+		curveVol.Password = vo.creds.Password
+	}
+	return curveVol
+}
+
+// snapshotEnabled returns true if the cluster of the volume has snapshot servers.
+func (vo *volumeOptions) snapshotEnabled() bool {
+	return vo.cluster != nil && len(vo.cluster.SnapshotServers) > 0
+}
+
+// snapshotServer returns the snapshot server in the cluster of the volume.
+func (vo *volumeOptions) snapshotServer() *curveservice.SnapshotServer {
+	var servers []string
+	if vo.cluster != nil {
+		servers = vo.cluster.SnapshotServers
+	}
+	snapServer := curveservice.NewSnapshotServer(servers, vo.user, vo.volName)
+	snapServer.Poolset = vo.placement.poolset
+	if vo.creds != nil {
+		snapServer.Password = vo.creds.Password
+		snapServer.Token = vo.creds.Token
+	}
+	return snapServer
+}
+
 func newVolumeOptions(req *csi.CreateVolumeRequest) (*volumeOptions, error) {
 	var (
 		ok  bool
@@ -58,66 +193,133 @@ func newVolumeOptions(req *csi.CreateVolumeRequest) (*volumeOptions, error) {
 	}
 
 	parameters := req.GetParameters()
-	opts.user, ok = parameters["user"]
-	if !ok {
+	opts.user = parameters["user"]
+	// the user of the provisioner secret is used if the parameter is not set
+	if opts.user == "" {
+		opts.user = util.NewCredentials(req.GetSecrets()).GetUser()
+	}
+	if opts.user == "" {
 		return nil, fmt.Errorf("missing required field: user")
 	}
+	if err = opts.applyCredentials(req.GetSecrets()); err != nil {
+		return nil, err
+	}
 	if len(opts.user) == 0 || len(opts.user) > curveUserMaxLen {
 		return nil, fmt.Errorf("length of field user must be 1~%v", curveUserMaxLen)
 	}
 
-	cloneLazy, ok := parameters["cloneLazy"]
+	opts.clusterID = parameters["clusterID"]
+
+	cloneLazy, ok := parameters[cloneLazyParam]
 	if ok {
 		opts.cloneLazy = cloneLazy == "true"
 	} else {
 		opts.cloneLazy = curveCloneDefaultLazy
 	}
 
-	// volume size - default is 10GiB
-	opts.sizeGiB = 10
-	if req.GetCapacityRange() != nil {
-		opts.sizeGiB, err = roundUpToGiBInt(req.GetCapacityRange().GetRequiredBytes())
-		if err != nil {
-			return nil, err
-		}
+	opts.qos, err = parseQoSSpec(parameters)
+	if err != nil {
+		return nil, err
+	}
+	opts.trash, err = parseBoolParam(parameters, trashParam)
+	if err != nil {
+		return nil, err
+	}
+	opts.maxCloneDepth, err = parseMaxCloneDepth(parameters)
+	if err != nil {
+		return nil, err
+	}
+	opts.cloneDepthFlatten, err = parseCloneDepthFlatten(parameters)
+	if err != nil {
+		return nil, err
+	}
+	opts.cloneSourceUsers, err = parseCloneSourceUsers(parameters)
+	if err != nil {
+		return nil, err
+	}
+	opts.placement, err = parsePlacement(parameters)
+	if err != nil {
+		return nil, err
+	}
+	opts.image, err = parseImageSpec(parameters)
+	if err != nil {
+		return nil, err
+	}
+	if opts.image != nil && req.GetVolumeContentSource() != nil {
+		return nil, fmt.Errorf("%s can not be set with a volume content source", imageSourceParam)
 	}
 
-	opts.volId, err = composeCSIID(opts.user, opts.volName)
+	// the volume size is resolved with the cluster
+	opts.sizePolicy, err = parseSizePolicy(parameters)
 	if err != nil {
-		return nil, fmt.Errorf("failed to composeCSIID: %v", err)
+		return nil, err
+	}
+
+	if err = opts.composeVolID(); err != nil {
+		return nil, err
 	}
 
 	return opts, nil
 }
 
-func newVolumeOptionsFromVolID(volumeId string) (*volumeOptions, error) {
-	var err error
-	volOptions := &volumeOptions{
-		volId: volumeId,
+// composeVolID sets the volume ID from the cluster, poolset, user and name.
+func (vo *volumeOptions) composeVolID() error {
+	scheme := vo.scheme
+	if scheme == 0 {
+		scheme = namingSchemeCSI
+	}
+	volId, err := composeCSIID(&csiIdentifier{
+		clusterID: vo.clusterID,
+		pool:      vo.placement.poolset,
+		scheme:    scheme,
+		user:      vo.user,
+		volName:   vo.volName,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to composeCSIID: %v", err)
 	}
-	volOptions.user, volOptions.volName, err = decomposeCSIID(volumeId)
+	vo.volId = volId
+	return nil
+}
+
+func newVolumeOptionsFromVolID(volumeId string) (*volumeOptions, error) {
+	ci, err := decomposeCSIID(volumeId)
 	if err != nil {
 		return nil, err
 	}
+	volOptions := &volumeOptions{
+		volId:     volumeId,
+		clusterID: ci.clusterID,
+		user:      ci.user,
+		volName:   ci.volName,
+		placement: placement{poolset: ci.pool},
+		scheme:    ci.scheme,
+	}
 	volOptions.reqName = strings.TrimPrefix(volOptions.volName, csiVolNamingPrefix)
 
 	return volOptions, nil
 }
 
-func roundUpToGiBInt(sizeBytes int64) (int, error) {
-	quantity := resource.NewQuantity(sizeBytes, resource.BinarySI)
-	sizeGiB, err := volumehelpers.RoundUpToGiBInt(*quantity)
-	if err != nil {
-		return 0, err
+// meta returns the metadata to persist, nil if nothing.
+func (vo *volumeOptions) meta() *volumeMeta {
+	meta := &volumeMeta{QoS: vo.qos, Trash: vo.trash, CloneSource: vo.cloneSource, Image: vo.image}
+	if meta.isEmpty() {
+		return nil
 	}
-	if sizeGiB > 4*1024 {
-		return 0, fmt.Errorf("the volume size must be less than 4TiB, got %dGiB", sizeGiB)
+	return meta
+}
+
+// parseBoolParam returns nil if the parameter is not set.
+func parseBoolParam(parameters map[string]string, key string) (*bool, error) {
+	str, ok := parameters[key]
+	if !ok {
+		return nil, nil
 	}
-	// must more than 10GiB
-	if sizeGiB < 10 {
-		sizeGiB = 10
+	b, err := strconv.ParseBool(str)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q, must be true or false", key, str)
 	}
-	return sizeGiB, nil
+	return &b, nil
 }
 
 func parseSnapshotID(snapshotId string) (string, *volumeOptions, error) {
@@ -17,22 +17,131 @@ limitations under the License.
 package curve
 
 import (
-	"github.com/stretchr/testify/assert"
+	"errors"
+	"fmt"
 	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opencurve/curve-csi/pkg/util"
 )
 
-func TestRoundUpToGiBInt(t *testing.T) {
-	var size1Mi int64 = 1 * 1024 * 1024
-	size, err := roundUpToGiBInt(size1Mi)
+const (
+	size1Mi int64 = 1 * 1024 * 1024
+	size1Gi int64 = 1024 * size1Mi
+)
+
+func TestSizePolicyRoundUp(t *testing.T) {
+	sp := defaultSizePolicy()
+	size, err := sp.roundUp(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, size)
+
+	size, err = sp.roundUp(&csi.CapacityRange{RequiredBytes: size1Mi})
 	assert.NoError(t, err)
 	assert.Equal(t, 10, size)
 
-	var size20Gi int64 = 20 * 1024 * 1024 * 1024
-	size, err = roundUpToGiBInt(size20Gi + size1Mi)
+	size, err = sp.roundUp(&csi.CapacityRange{RequiredBytes: 20*size1Gi + size1Mi})
 	assert.NoError(t, err)
 	assert.Equal(t, 21, size)
 
-	var size4Ti int64 = 4 * 1024 * 1024 * 1024 * 1024
-	_, err = roundUpToGiBInt(size4Ti + size1Mi)
+	_, err = sp.roundUp(&csi.CapacityRange{RequiredBytes: 4*1024*size1Gi + size1Mi})
+	assert.True(t, errors.Is(err, errSizeOutOfRange))
+
+	// the min size exceeds limit bytes
+	_, err = sp.roundUp(&csi.CapacityRange{RequiredBytes: size1Mi, LimitBytes: 5 * size1Gi})
+	assert.True(t, errors.Is(err, errSizeOutOfRange))
+
+	// required bytes is larger than limit bytes
+	_, err = sp.roundUp(&csi.CapacityRange{RequiredBytes: 20 * size1Gi, LimitBytes: 10 * size1Gi})
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, errSizeOutOfRange))
+
+	sp = sizePolicy{minGiB: 1, maxGiB: 100, granularityGiB: 8}
+	size, err = sp.roundUp(&csi.CapacityRange{RequiredBytes: 9 * size1Gi})
+	assert.NoError(t, err)
+	assert.Equal(t, 16, size)
+
+	size, err = sp.roundUp(&csi.CapacityRange{RequiredBytes: 9 * size1Gi, LimitBytes: 16 * size1Gi})
+	assert.NoError(t, err)
+	assert.Equal(t, 16, size)
+
+	_, err = sp.roundUp(&csi.CapacityRange{RequiredBytes: 9 * size1Gi, LimitBytes: 15 * size1Gi})
+	assert.True(t, errors.Is(err, errSizeOutOfRange))
+
+	_, err = sp.roundUp(&csi.CapacityRange{RequiredBytes: 97 * size1Gi})
+	assert.True(t, errors.Is(err, errSizeOutOfRange))
+}
+
+func TestResolveSize(t *testing.T) {
+	vo := &volumeOptions{
+		cluster: &util.ClusterInfo{
+			SizePolicy: &util.SizePolicy{MinSizeGiB: 1, MaxSizeGiB: 64},
+		},
+	}
+	assert.NoError(t, vo.resolveSize(&csi.CapacityRange{RequiredBytes: size1Mi}))
+	assert.Equal(t, 1, vo.sizeGiB)
+	assert.Error(t, vo.resolveSize(&csi.CapacityRange{RequiredBytes: 65 * size1Gi}))
+
+	// the StorageClass overrides the cluster
+	sizePolicy, err := parseSizePolicy(map[string]string{
+		maxSizeGiBParam:         "128",
+		sizeGranularityGiBParam: "4",
+	})
+	assert.NoError(t, err)
+	vo.sizePolicy = sizePolicy
+	assert.NoError(t, vo.resolveSize(&csi.CapacityRange{RequiredBytes: 65 * size1Gi}))
+	assert.Equal(t, 68, vo.sizeGiB)
+
+	// min size is larger than max size
+	vo.sizePolicy = &util.SizePolicy{MinSizeGiB: 256}
+	assert.Error(t, vo.resolveSize(nil))
+}
+
+func TestParseSizePolicy(t *testing.T) {
+	p, err := parseSizePolicy(map[string]string{"user": "k8s"})
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+
+	p, err = parseSizePolicy(map[string]string{minSizeGiBParam: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, &util.SizePolicy{MinSizeGiB: 1}, p)
+
+	for _, v := range []string{"0", "-1", "1.5", "1Gi"} {
+		_, err = parseSizePolicy(map[string]string{sizeGranularityGiBParam: v})
+		assert.Error(t, err, v)
+	}
+}
+
+func TestVolumeOptionsCredentials(t *testing.T) {
+	req := &csi.CreateVolumeRequest{
+		Name:       "pvc-1",
+		Parameters: map[string]string{},
+		Secrets:    map[string]string{"user": "k8s", "password": "secret"},
+	}
+	vo, err := newVolumeOptions(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "k8s", vo.user)
+	assert.Equal(t, "secret", vo.curveVolume().Password)
+	assert.Equal(t, "secret", vo.snapshotServer().Password)
+	assert.NotContains(t, fmt.Sprintf("%+v", vo), "secret")
+
+	// the user of secrets does not match the parameter
+	req.Parameters["user"] = "other"
+	_, err = newVolumeOptions(req)
+	assert.Error(t, err)
+
+	// no user at all
+	delete(req.Parameters, "user")
+	req.Secrets = map[string]string{"password": "secret"}
+	_, err = newVolumeOptions(req)
 	assert.Error(t, err)
+
+	vo = &volumeOptions{user: "k8s"}
+	assert.NoError(t, vo.applyCredentials(nil))
+	assert.Nil(t, vo.creds)
+	assert.NoError(t, vo.applyCredentials(map[string]string{"token": "t"}))
+	assert.Equal(t, "t", vo.snapshotServer().Token)
+	assert.Error(t, vo.applyCredentials(map[string]string{"user": "other"}))
 }
@@ -0,0 +1,138 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+	"github.com/opencurve/curve-csi/pkg/util"
+	"github.com/opencurve/curve-csi/pkg/util/ctxlog"
+)
+
+// worker runs a background job at once and every interval until stopped,
+// and serves the report of the last run in json.
+type worker struct {
+	name     string
+	interval time.Duration
+	// runs the job once, returns the report
+	job func(ctx context.Context) interface{}
+
+	mu         sync.Mutex
+	lastReport interface{}
+}
+
+func newWorker(name string, interval time.Duration, job func(ctx context.Context) interface{}) *worker {
+	return &worker{name: name, interval: interval, job: job}
+}
+
+// ServeHTTP returns the report of the last run in json.
+func (w *worker) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	w.mu.Lock()
+	report := w.lastReport
+	w.mu.Unlock()
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(report)
+}
+
+// run runs the job every interval until ctx is done.
+func (w *worker) run(ctx context.Context) {
+	ctx = context.WithValue(ctx, ctxlog.CtxKey, w.name)
+	ctxlog.Infof(ctx, "starting %s, interval: %v", w.name, w.interval)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		report := w.job(ctx)
+		w.mu.Lock()
+		w.lastReport = report
+		w.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			ctxlog.Infof(ctx, "stopped %s", w.name)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runWorkers runs the workers until ctx is done, and waits for them to return.
+func runWorkers(ctx context.Context, workers []*worker) {
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			w.run(ctx)
+		}(w)
+	}
+	wg.Wait()
+}
+
+// runControllerWorkers runs the workers of the controller until ctx is done. With the
+// leader election, they run on the leader of the controller replicas only, so the
+// background jobs, e.g. the flatten concurrency, are bounded in the whole deployment.
+func runControllerWorkers(ctx context.Context, le *util.LeaderElection, workers []*worker) {
+	if len(workers) == 0 {
+		return
+	}
+	if le == nil {
+		runWorkers(ctx, workers)
+		return
+	}
+	le.Run(ctx, func(ctx context.Context) {
+		runWorkers(ctx, workers)
+	})
+}
+
+// backgroundSecrets returns the secrets of the user for the work without the CSI secrets,
+// e.g. of the workers, from the credentials dir. The failure is only logged.
+func backgroundSecrets(ctx context.Context, credentialsDir, user string) map[string]string {
+	secrets, err := util.LoadSecrets(credentialsDir, user)
+	if err != nil {
+		ctxlog.Warningf(ctx, "failed to load the credentials of user %s: %v", user, err)
+	}
+	return secrets
+}
+
+// snapshotBackend is the part of the snapshot server used by the workers.
+type snapshotBackend interface {
+	ListCloneTasks(ctx context.Context) ([]curveservice.TaskInfo, error)
+	CleanFinishedCloneTask(ctx context.Context, uuid string) error
+	GetCloneTaskOfDestination(ctx context.Context, destination string) (curveservice.TaskInfo, error)
+	Flatten(ctx context.Context, uuid string) error
+	GetUserSnapshotOfId(ctx context.Context, uuid string) (curveservice.Snapshot, error)
+}
+
+// workerBackend reaches the curve clusters for the workers and the controller, faked in tests.
+type workerBackend interface {
+	snapshotServer(vo *volumeOptions) snapshotBackend
+	stat(ctx context.Context, vo *volumeOptions) (*curveservice.CurveVolumeDetail, error)
+}
+
+type curveBackend struct{}
+
+func (curveBackend) snapshotServer(vo *volumeOptions) snapshotBackend {
+	return vo.snapshotServer()
+}
+
+func (curveBackend) stat(ctx context.Context, vo *volumeOptions) (*curveservice.CurveVolumeDetail, error) {
+	return vo.curveVolume().Stat(ctx)
+}
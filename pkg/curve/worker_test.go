@@ -0,0 +1,291 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curve
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opencurve/curve-csi/pkg/curveservice"
+	"github.com/opencurve/curve-csi/pkg/util"
+)
+
+// fakeBackend serves the clone tasks and volumes in memory, and records the calls.
+type fakeBackend struct {
+	mu sync.Mutex
+	// clone tasks by the destination path
+	tasks map[string]curveservice.TaskInfo
+	// snapshots by the uuid
+	snapshots map[string]curveservice.Snapshot
+	// the existing volume paths
+	volumes map[string]bool
+	// the password of the calls by the user
+	passwords  map[string]string
+	cleaned    []string
+	flattened  []string
+	flattenErr error
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		tasks:     map[string]curveservice.TaskInfo{},
+		snapshots: map[string]curveservice.Snapshot{},
+		volumes:   map[string]bool{},
+		passwords: map[string]string{},
+	}
+}
+
+type fakeSnapshotServer struct {
+	b    *fakeBackend
+	user string
+}
+
+func (b *fakeBackend) snapshotServer(vo *volumeOptions) snapshotBackend {
+	b.record(vo)
+	return &fakeSnapshotServer{b: b, user: vo.user}
+}
+
+func (b *fakeBackend) stat(ctx context.Context, vo *volumeOptions) (*curveservice.CurveVolumeDetail, error) {
+	b.record(vo)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.volumes[vo.genVolumePath()] {
+		return nil, util.NewNotFoundErr()
+	}
+	return &curveservice.CurveVolumeDetail{}, nil
+}
+
+func (b *fakeBackend) record(vo *volumeOptions) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if vo.creds != nil {
+		b.passwords[vo.user] = vo.creds.Password
+	}
+}
+
+func (s *fakeSnapshotServer) ListCloneTasks(ctx context.Context) ([]curveservice.TaskInfo, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	var tasks []curveservice.TaskInfo
+	for file, task := range s.b.tasks {
+		if path.Dir(file) == "/"+s.user {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks, nil
+}
+
+func (s *fakeSnapshotServer) CleanFinishedCloneTask(ctx context.Context, uuid string) error {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	s.b.cleaned = append(s.b.cleaned, uuid)
+	return nil
+}
+
+func (s *fakeSnapshotServer) GetCloneTaskOfDestination(ctx context.Context, destination string) (curveservice.TaskInfo, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	task, ok := s.b.tasks[destination]
+	if !ok {
+		return curveservice.TaskInfo{}, util.NewNotFoundErr()
+	}
+	return task, nil
+}
+
+func (s *fakeSnapshotServer) Flatten(ctx context.Context, uuid string) error {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	if s.b.flattenErr != nil {
+		return s.b.flattenErr
+	}
+	s.b.flattened = append(s.b.flattened, uuid)
+	return nil
+}
+
+func (s *fakeSnapshotServer) GetUserSnapshotOfId(ctx context.Context, uuid string) (curveservice.Snapshot, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	snap, ok := s.b.snapshots[uuid]
+	if !ok || snap.User != s.user {
+		return curveservice.Snapshot{}, util.NewNotFoundErr()
+	}
+	return snap, nil
+}
+
+func writeCredentials(t *testing.T, dir, user, password string) {
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, user), 0o700))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, user, "password"), []byte(password), 0o600))
+}
+
+func TestWorkerRun(t *testing.T) {
+	runs := make(chan struct{}, 10)
+	w := newWorker("test", time.Millisecond, func(ctx context.Context) interface{} {
+		runs <- struct{}{}
+		return len(runs)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runWorkers(ctx, []*worker{w})
+		close(done)
+	}()
+	<-runs
+	<-runs
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the worker is not stopped")
+	}
+	w.mu.Lock()
+	assert.NotNil(t, w.lastReport)
+	w.mu.Unlock()
+
+	// nothing to run
+	runControllerWorkers(context.Background(), nil, nil)
+}
+
+func TestCloneTaskGCCollectUser(t *testing.T) {
+	ctx := context.TODO()
+	credentialsDir := t.TempDir()
+	writeCredentials(t, credentialsDir, "k8s", "secret")
+
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	microseconds := func(t time.Time) int64 { return t.UnixNano() / 1000 }
+	backend := newFakeBackend()
+	backend.tasks = map[string]curveservice.TaskInfo{
+		// the destination is deleted
+		"/k8s/csi-vol-pvc-1": {UUID: "t1", File: "/k8s/csi-vol-pvc-1", TaskStatus: curveservice.TaskStatusDone, Time: microseconds(now)},
+		// the destination exists
+		"/k8s/csi-vol-pvc-2": {UUID: "t2", File: "/k8s/csi-vol-pvc-2", TaskStatus: curveservice.TaskStatusDone, Time: microseconds(now)},
+		// failed long ago
+		"/k8s/csi-vol-pvc-3": {UUID: "t3", File: "/k8s/csi-vol-pvc-3", TaskStatus: curveservice.TaskStatusError, Time: microseconds(now.Add(-2 * time.Hour))},
+		// failed but locked by a CreateVolume
+		"/k8s/csi-vol-pvc-4": {UUID: "t4", File: "/k8s/csi-vol-pvc-4", TaskStatus: curveservice.TaskStatusError, Time: microseconds(now.Add(-2 * time.Hour))},
+		"/k8s/csi-vol-pvc-5": {UUID: "t5", File: "/k8s/csi-vol-pvc-5", TaskStatus: curveservice.TaskStatusCloning, Time: microseconds(now)},
+		// of another user
+		"/other/csi-vol-pvc-6": {UUID: "t6", File: "/other/csi-vol-pvc-6", TaskStatus: curveservice.TaskStatusError},
+	}
+	backend.volumes["/k8s/csi-vol-pvc-2"] = true
+
+	gc, err := newCloneTaskGC(nil, util.NewVolumeLocks(), credentialsDir, "k8s", time.Hour, time.Hour, false)
+	assert.NoError(t, err)
+	gc.backend = backend
+	gc.now = func() time.Time { return now }
+	assert.True(t, gc.volumeLocks.TryAcquire("pvc-4"))
+
+	items := gc.collectUser(ctx, &util.ClusterInfo{ClusterID: "c1"}, "k8s")
+	cleaned := map[string]bool{}
+	for _, item := range items {
+		assert.Equal(t, "c1", item.ClusterID)
+		cleaned[item.UUID] = item.Cleaned
+	}
+	assert.Equal(t, map[string]bool{"t1": true, "t3": true}, cleaned)
+	assert.ElementsMatch(t, []string{"t1", "t3"}, backend.cleaned)
+	// the credentials of the user are loaded from the credentials dir
+	assert.Equal(t, map[string]string{"k8s": "secret"}, backend.passwords)
+
+	// only reported in dry-run
+	gc.dryRun = true
+	backend.cleaned = nil
+	gc.volumeLocks.Release("pvc-4")
+	items = gc.collectUser(ctx, &util.ClusterInfo{ClusterID: "c1"}, "k8s")
+	assert.Len(t, items, 3)
+	assert.Empty(t, backend.cleaned)
+}
+
+func TestFlattenSchedulerCheck(t *testing.T) {
+	ctx := context.TODO()
+	credentialsDir := t.TempDir()
+	writeCredentials(t, credentialsDir, "k8s", "secret")
+	cs := &controllerServer{
+		volumeLocks:    util.NewVolumeLocks(),
+		clusters:       newClusterResolver(filepath.Join(t.TempDir(), "config.json"), "http://127.0.0.1:5555"),
+		volumeMeta:     newVolumeMetaStore(nil),
+		credentialsDir: credentialsDir,
+	}
+	volIds := make([]string, 6)
+	for i := range volIds {
+		var err error
+		volIds[i], err = composeCSIID(&csiIdentifier{scheme: namingSchemeCSI, user: "k8s", volName: csiVolNamingPrefix + "pvc-" + string(rune('0'+i))})
+		assert.NoError(t, err)
+	}
+	backend := newFakeBackend()
+	backend.tasks = map[string]curveservice.TaskInfo{
+		// due
+		"/k8s/csi-vol-pvc-0": {UUID: "t0", TaskStatus: curveservice.TaskStatusMetaInstalled},
+		"/k8s/csi-vol-pvc-1": {UUID: "t1", TaskStatus: curveservice.TaskStatusMetaInstalled},
+		// flattening
+		"/k8s/csi-vol-pvc-2": {UUID: "t2", TaskStatus: curveservice.TaskStatusCloning},
+		// flattened
+		"/k8s/csi-vol-pvc-3": {UUID: "t3", TaskStatus: curveservice.TaskStatusDone},
+		// pvc-4 is not found
+		// due but in operation
+		"/k8s/csi-vol-pvc-5": {UUID: "t5", TaskStatus: curveservice.TaskStatusMetaInstalled},
+	}
+
+	s, err := newFlattenScheduler(cs, util.NewFileStore(t.TempDir()), time.Hour, "", 2)
+	assert.NoError(t, err)
+	s.backend = backend
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.Local)
+	s.now = func() time.Time { return now }
+	for _, volId := range volIds {
+		s.enqueue(ctx, volId, "")
+	}
+	assert.True(t, cs.volumeLocks.TryAcquire(volIds[5]))
+
+	// not due yet
+	s.check(ctx)
+	assert.Empty(t, backend.flattened)
+	pending, err := s.pending()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 4)
+
+	// one flattening already, so only one more within the concurrency
+	now = now.Add(time.Hour)
+	s.check(ctx)
+	assert.Len(t, backend.flattened, 1)
+	assert.Contains(t, []string{"t0", "t1"}, backend.flattened[0])
+	assert.Equal(t, map[string]string{"k8s": "secret"}, backend.passwords)
+
+	pending, err = s.pending()
+	assert.NoError(t, err)
+	started := 0
+	for _, status := range pending {
+		if status.StartedAt != nil {
+			started++
+			assert.Equal(t, 1, status.Attempts)
+		}
+	}
+	assert.Equal(t, 1, started)
+
+	// the failure is recorded
+	backend.flattenErr = errors.New("flatten failed")
+	task := &flattenTask{TaskUUID: "t5"}
+	cs.volumeLocks.Release(volIds[5])
+	assert.False(t, s.flatten(ctx, volIds[5], task, now))
+	assert.Equal(t, "flatten failed", task.LastError)
+	assert.Equal(t, 1, task.Attempts)
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curveservice
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// e.g. "allocated size: 10GB", the size of the segments allocated to the file
+var allocatedSizeRegexp = regexp.MustCompile(`(?m)^\s*allocated size:\s*(\d+)\s*([KMGT]?B)\s*$`)
+
+var sizeUnits = map[string]int64{
+	"B":  1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+	"TB": 1 << 40,
+}
+
+// parseAllocatedSize returns the allocated bytes reported by 'curve_ops_tool get'.
+func parseAllocatedSize(output []byte) (int64, error) {
+	match := allocatedSizeRegexp.FindSubmatch(output)
+	if match == nil {
+		return 0, fmt.Errorf("no allocated size in the output of %s: %q", curveOpsToolCmd, strings.TrimSpace(string(output)))
+	}
+	size, err := strconv.ParseInt(string(match[1]), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return size * sizeUnits[string(match[2])], nil
+}
+
+// AllocatedBytes returns the bytes of the segments allocated to the file,
+// which are returned to the cluster when the file is discarded.
+// curve_ops_tool get -fileName=FILENAME
+func (cv *CurveVolume) AllocatedBytes(ctx context.Context) (int64, error) {
+	output, err := cv.execOpsTool(ctx, "get", "-fileName="+cv.FilePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the allocated size of %s, err: %v, output: %v", cv.FilePath, err, string(output))
+	}
+	return parseAllocatedSize(output)
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curveservice
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAllocatedSize(t *testing.T) {
+	output := `id: 39007
+parentid: 39005
+filetype: INODE_PAGEFILE
+length(GB): 10
+user: k8s
+filename: pvc-ce482926-91d8-11ea-bf6e-fa163e23ce53
+fileStatus: Created
+allocated size: 3GB
+`
+	size, err := parseAllocatedSize([]byte(output))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3)<<30, size)
+
+	size, err = parseAllocatedSize([]byte("allocated size: 512 MB\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(512)<<20, size)
+
+	size, err = parseAllocatedSize([]byte("allocated size: 0B"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+
+	_, err = parseAllocatedSize([]byte("length(GB): 10\n"))
+	assert.Error(t, err)
+	_, err = parseAllocatedSize([]byte("allocated size: 3PB\n"))
+	assert.Error(t, err)
+}
@@ -51,6 +51,16 @@ type CurveVolume struct {
 	DirPath  string `json:"dirpath"`
 	User     string `json:"user"`
 	SizeGiB  int    `json:"size"`
+	// the curve client config of the cluster, empty to use the default
+	ConfPath string `json:"confpath"`
+	// the mds addresses of the cluster, empty to use the default
+	MdsAddrs []string `json:"mdsaddrs"`
+	// the striping and poolset of the volume, zero to use the default of cluster
+	StripeUnit  int64  `json:"stripeUnit"`
+	StripeCount int64  `json:"stripeCount"`
+	Poolset     string `json:"poolset"`
+	// the password of User, never logged
+	Password string `json:"-"`
 }
 
 func NewCurveVolume(user, volName string, sizeGiB int) *CurveVolume {
@@ -63,10 +73,36 @@ func NewCurveVolume(user, volName string, sizeGiB int) *CurveVolume {
 	}
 }
 
+// curveArgs appends the cluster related args to the curve command args.
+func (cv *CurveVolume) curveArgs(args ...string) []string {
+	if cv.ConfPath != "" {
+		args = append(args, "--confpath", cv.ConfPath)
+	}
+	if cv.Password != "" {
+		args = append(args, "--password", cv.Password)
+	}
+	return args
+}
+
+// nbdImage returns the image of the file for curve-nbd, cbd:<user>/<file path>_<user>_,
+// followed by :<client conf> if not the default cluster, nebd opens the file with the conf.
+func (cv *CurveVolume) nbdImage() string {
+	image := fmt.Sprintf("cbd:%s/%s_%s_", cv.User, cv.FilePath, cv.User)
+	if cv.ConfPath != "" {
+		image += ":" + cv.ConfPath
+	}
+	return image
+}
+
+// redactArgs hides the password in args for logging.
+func redactArgs(args []string) []string {
+	return util.RedactArgs(args, "--password")
+}
+
 // curve stat [-h] --user USER --filename FILENAME
 func (cv *CurveVolume) Stat(ctx context.Context) (*CurveVolumeDetail, error) {
-	args := []string{"stat", "--user", cv.User, "--filename", cv.FilePath}
-	ctxlog.V(4).Infof(ctx, "starting exec: curve %v", args)
+	args := cv.curveArgs("stat", "--user", cv.User, "--filename", cv.FilePath)
+	ctxlog.V(4).Infof(ctx, "starting exec: curve %v", redactArgs(args))
 	output, err := util.ExecCommand("curve", args)
 	outputStr := string(output)
 	if err == nil {
@@ -79,7 +115,7 @@ func (cv *CurveVolume) Stat(ctx context.Context) (*CurveVolumeDetail, error) {
 		return nil, util.NewNotFoundErr()
 	}
 
-	return nil, fmt.Errorf("can not run curve %v, err: %v, output: %v", args, err, outputStr)
+	return nil, fmt.Errorf("can not run curve %v, err: %v, output: %v", redactArgs(args), err, outputStr)
 }
 
 // curve create file, mkdir the dir if not exists
@@ -106,10 +142,14 @@ func (cv *CurveVolume) Create(ctx context.Context) error {
 	return fmt.Errorf("failed to create %s, err: %v, output: %v", cv.FilePath, err, string(output))
 }
 
-// curve delete [-h] --user USER --filename FILENAME
-func (cv *CurveVolume) Delete(ctx context.Context) error {
-	args := []string{"delete", "--user", cv.User, "--filename", cv.FilePath}
-	ctxlog.V(4).Infof(ctx, "starting exec: curve %v", args)
+// curve delete [-h] --user USER --filename FILENAME [--forcedelete true]
+// The volume is moved to the trash if enabled by the cluster, unless force.
+func (cv *CurveVolume) Delete(ctx context.Context, force bool) error {
+	args := cv.curveArgs("delete", "--user", cv.User, "--filename", cv.FilePath)
+	if force {
+		args = append(args, "--forcedelete", "true")
+	}
+	ctxlog.V(4).Infof(ctx, "starting exec: curve %v", redactArgs(args))
 	output, err := util.ExecCommand("curve", args)
 	if err != nil {
 		if strings.Contains(string(output), fmt.Sprintf(retFailFormat, retNotExist)) {
@@ -126,8 +166,8 @@ func (cv *CurveVolume) Delete(ctx context.Context) error {
 // curve extend [-h] --user USER --filename FILENAME --length LENGTH
 func (cv *CurveVolume) Extend(ctx context.Context, newSizeGiB int) error {
 	volLength := strconv.Itoa(newSizeGiB)
-	args := []string{"extend", "--user", cv.User, "--filename", cv.FilePath, "--length", volLength}
-	ctxlog.V(4).Infof(ctx, "starting exec: curve %v", args)
+	args := cv.curveArgs("extend", "--user", cv.User, "--filename", cv.FilePath, "--length", volLength)
+	ctxlog.V(4).Infof(ctx, "starting exec: curve %v", redactArgs(args))
 	output, err := util.ExecCommand("curve", args)
 	if err != nil {
 		return fmt.Errorf("failed to extend %s, err: %v, output: %v", cv.FilePath, err, string(output))
@@ -138,25 +178,35 @@ func (cv *CurveVolume) Extend(ctx context.Context, newSizeGiB int) error {
 
 // curve mkdir [-h] --user USER --dirname DIRNAME
 func (cv *CurveVolume) mkdir(ctx context.Context) error {
-	args := []string{"mkdir", "--user", cv.User, "--dirname", cv.DirPath}
-	ctxlog.V(4).Infof(ctx, "starting exec: curve %v", args)
+	args := cv.curveArgs("mkdir", "--user", cv.User, "--dirname", cv.DirPath)
+	ctxlog.V(4).Infof(ctx, "starting exec: curve %v", redactArgs(args))
 	output, err := util.ExecCommand("curve", args)
 	if err != nil {
 		if strings.Contains(string(output), fmt.Sprintf(retFailFormat, retExist)) {
 			ctxlog.V(4).Infof(ctx, "[curve] the dir %s of user %s already exists, ignore to mkdir", cv.DirPath, cv.User)
 			return nil
 		}
-		return fmt.Errorf("failed to run curve %v, err: %v, output: %v", args, err, string(output))
+		return fmt.Errorf("failed to run curve %v, err: %v, output: %v", redactArgs(args), err, string(output))
 	}
 	ctxlog.V(4).Infof(ctx, "[curve] successfully mkdir %s of user %s", cv.DirPath, cv.User)
 	return nil
 }
 
 // curve create [-h] --filename FILENAME --length LENGTH --user USER
+// [--stripeUnit STRIPEUNIT --stripeCount STRIPECOUNT] [--poolset POOLSET]
 func (cv *CurveVolume) create(ctx context.Context) (output []byte, err error) {
 	volLength := strconv.Itoa(cv.SizeGiB)
 	args := []string{"create", "--filename", cv.FilePath, "--length", volLength, "--user", cv.User}
-	ctxlog.V(4).Infof(ctx, "starting exec: curve %v", args)
+	if cv.StripeUnit > 0 && cv.StripeCount > 0 {
+		args = append(args,
+			"--stripeUnit", strconv.FormatInt(cv.StripeUnit, 10),
+			"--stripeCount", strconv.FormatInt(cv.StripeCount, 10))
+	}
+	if cv.Poolset != "" {
+		args = append(args, "--poolset", cv.Poolset)
+	}
+	args = cv.curveArgs(args...)
+	ctxlog.V(4).Infof(ctx, "starting exec: curve %v", redactArgs(args))
 	output, err = util.ExecCommand("curve", args)
 	if err != nil {
 		if strings.Contains(string(output), fmt.Sprintf(retFailFormat, retExist)) {
@@ -168,10 +218,11 @@ func (cv *CurveVolume) create(ctx context.Context) (output []byte, err error) {
 	return output, err
 }
 
+// List lists the file names in the dir of the volume.
 // curve list [-h] --user USER --dirname DIRNAME
-func (cv *CurveVolume) list(ctx context.Context) ([]string, error) {
-	args := []string{"list", "--user", cv.User, "--dirname", cv.DirPath}
-	ctxlog.V(4).Infof(ctx, "starting exec: curve %v", args)
+func (cv *CurveVolume) List(ctx context.Context) ([]string, error) {
+	args := cv.curveArgs("list", "--user", cv.User, "--dirname", cv.DirPath)
+	ctxlog.V(4).Infof(ctx, "starting exec: curve %v", redactArgs(args))
 	output, err := util.ExecCommand("curve", args)
 	outputStr := string(output)
 	if err != nil {
@@ -179,7 +230,7 @@ func (cv *CurveVolume) list(ctx context.Context) ([]string, error) {
 			ctxlog.Warningf(ctx, "[curve] the %s not exist, output: %v", cv.DirPath, outputStr)
 			return []string{}, nil
 		}
-		return nil, fmt.Errorf("failed to run curve %v, err: %v, output: %v", args, err, outputStr)
+		return nil, fmt.Errorf("failed to run curve %v, err: %v, output: %v", redactArgs(args), err, outputStr)
 	}
 
 	ctxlog.V(4).Infof(ctx, "[curve] get volumes: %v in %v", outputStr, cv.DirPath)
@@ -194,9 +245,10 @@ func (cv *CurveVolume) list(ctx context.Context) ([]string, error) {
 	return volumes, nil
 }
 
-// curve-nbd map cbd:<user>/<filename_full_path>_<user>_
+// curve-nbd map cbd:<user>/<filename_full_path>_<user>_[:<client conf>]
 func (cv *CurveVolume) Map(ctx context.Context, disableInUseChecks bool) (string, error) {
-	devicePath, found := waitForMapped(ctx, cv.FilePath, cv.User, 1)
+	image := cv.nbdImage()
+	devicePath, found := waitForMapped(ctx, image, 1)
 	if found {
 		ctxlog.V(4).Infof(ctx, "[curve-nbd] the curve file %s already mapped at %v", cv.FilePath, devicePath)
 		return devicePath, nil
@@ -204,17 +256,33 @@ func (cv *CurveVolume) Map(ctx context.Context, disableInUseChecks bool) (string
 
 	ctxlog.Infof(ctx, "[curve-nbd] starting to attach curve file: %s", cv.FilePath)
 
+	if err := checkFenced(); err != nil {
+		return "", err
+	}
 	// wait for curve image status available and able to mapped
-	if err := waitForCurveFileReady(ctx, cv.FileName, cv.User, disableInUseChecks); err != nil {
+	if err := waitForCurveFileReady(ctx, cv, disableInUseChecks); err != nil {
+		switch err.(type) {
+		case *InUseError, *InUseCheckError:
+			return "", err
+		}
 		return "", fmt.Errorf("curve file %s may not be ready, err: %v", cv.FilePath, err)
 	}
 
-	// map device
-	cbdMapPath := fmt.Sprintf("cbd:%s/%s_%s_", cv.User, cv.FilePath, cv.User)
-	args := []string{"map", cbdMapPath, "--timeout", "86400"}
-	go util.ExecCommand(curveNbdCmd, args)
+	// map device, nebd opens the file as the user with the password
+	args := []string{"map", image, "--timeout", "86400"}
+	if cv.Password != "" {
+		args = append(args, "--password", cv.Password)
+	}
+	ctxlog.V(4).Infof(ctx, "starting exec: %s %v", curveNbdCmd, redactArgs(args))
+	if mapMode == MapModeSystemd {
+		if err := mapOnHost(ctx, cv.nbdUnit(), args, cv.Password); err != nil {
+			return "", err
+		}
+	} else {
+		go util.ExecCommand(curveNbdCmd, args)
+	}
 
-	devicePath, found = waitForMapped(ctx, cv.FilePath, cv.User, 10)
+	devicePath, found = waitForMapped(ctx, image, 10)
 	if !found {
 		return "", fmt.Errorf("can not find devicePath after mapping successfully")
 	}
@@ -222,18 +290,34 @@ func (cv *CurveVolume) Map(ctx context.Context, disableInUseChecks bool) (string
 	return devicePath, nil
 }
 
-// curve-nbd unmap
+// MappedDevice returns the nbd device of the curve file mapped on the node, empty if not mapped.
+func (cv *CurveVolume) MappedDevice(ctx context.Context) (string, error) {
+	return getNbdDevFromImage(ctx, cv.nbdImage())
+}
+
+// curve-nbd unmap, it is not an error if not mapped
 func (cv *CurveVolume) UnMap(ctx context.Context) error {
-	devicePath, err := getNbdDevFromFileName(ctx, cv.FilePath, cv.User)
+	devicePath, err := getNbdDevFromImage(ctx, cv.nbdImage())
 	if err != nil {
 		return err
 	}
+	if devicePath == "" {
+		ctxlog.V(4).Infof(ctx, "[curve-nbd] the curve file %s is not mapped, ignore unmapping", cv.FilePath)
+		if mapMode == MapModeSystemd {
+			stopNbdUnit(ctx, cv.nbdUnit())
+		}
+		return nil
+	}
 
 	// unmap
 	output, err := util.ExecCommand(curveNbdCmd, []string{"unmap", devicePath})
 	if err != nil {
 		return fmt.Errorf("curve: unmap file %s failed, err: %v, output: %v", cv.FilePath, err, string(output))
 	}
+	if mapMode == MapModeSystemd {
+		// the unit remains after the daemon exits
+		stopNbdUnit(ctx, cv.nbdUnit())
+	}
 
 	return nil
 }
@@ -19,6 +19,8 @@ package curveservice
 import (
 	"context"
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -40,20 +42,34 @@ const (
 	curveNbdCmd = "curve-nbd"
 )
 
-func InitCurveNbd() {
+// InitCurveNbd loads the nbd module and checks the nebd-daemon, the failures are logged
+// and returned, so the caller which maps the volumes decides whether to go on.
+func InitCurveNbd() error {
 	output, err := util.ExecCommandHost("modprobe", []string{"nbd", fmt.Sprintf("nbds_max=%d", nbdsMax)})
 	if err != nil {
 		klog.Errorf("curve-nbd: nbd modprobe failed with error %v, output: %v", err, string(output))
+		return fmt.Errorf("failed to load the nbd module: %v, output: %s", err, output)
 	}
 
 	running, err := checkNebdDaemonRunning()
-	if err == nil && !running {
+	if err != nil {
+		return fmt.Errorf("failed to check nebd-daemon: %v", err)
+	}
+	if !running {
 		klog.Errorf("nebd-daemon not started, please run: nebd-daemon start")
+		return fmt.Errorf("nebd-daemon is not running")
 	}
+	return nil
 }
 
+// checkNebdDaemonRunning checks the nebd-daemon serving curve-nbd, which runs on the host
+// in the systemd map mode.
 func checkNebdDaemonRunning() (bool, error) {
-	output, err := util.ExecCommand("nebd-daemon", []string{"status"})
+	exec := util.ExecCommand
+	if mapMode == MapModeSystemd {
+		exec = util.ExecCommandHost
+	}
+	output, err := exec("nebd-daemon", []string{"status"})
 	if err != nil {
 		klog.Warningf("failed to run nebd-daemon status, output: %v, err: %v", string(output), err)
 		return false, err
@@ -65,13 +81,13 @@ func checkNebdDaemonRunning() (bool, error) {
 }
 
 // Stat a path, if it doesn't exist, retry maxRetries times.
-func waitForMapped(ctx context.Context, filePath, user string, maxRetries int) (string, bool) {
+func waitForMapped(ctx context.Context, image string, maxRetries int) (string, bool) {
 	for i := 0; i < maxRetries; i++ {
 		if i != 0 {
 			time.Sleep(time.Second)
 		}
 
-		if devicePath, err := getNbdDevFromFileName(ctx, filePath, user); devicePath != "" {
+		if devicePath, err := getNbdDevFromImage(ctx, image); devicePath != "" {
 			return devicePath, true
 		} else if err != nil {
 			klog.Warning(err)
@@ -80,66 +96,249 @@ func waitForMapped(ctx context.Context, filePath, user string, maxRetries int) (
 	return "", false
 }
 
-// cmd "curve-nbd list-mapped" return nbd device mapped locally.
-// id      image                                                                device
-// 1509297 cbd:k8s//k8s/csi-vol-pvc-647525be-c0d6-464b-b548-1fa26f6d183c_k8s_ /dev/nbd1
-func getNbdDevFromFileName(ctx context.Context, filePath, user string) (string, error) {
-	output, err := util.ExecCommand("curve-nbd", []string{"list-mapped"})
+// getNbdDevFromImage returns the device the image is mapped at by curve-nbd, empty if not mapped.
+// The image carries the client conf of the cluster, so the files of the same path in
+// different clusters are told apart.
+func getNbdDevFromImage(ctx context.Context, image string) (string, error) {
+	mappings, err := ListMapped(ctx)
 	if err != nil {
-		return "", fmt.Errorf("can not run curve-nbd list-mapped, err: %v, output: %s", err, string(output))
+		return "", err
 	}
-	for _, l := range strings.Split(string(output), "\n") {
-		// 1509297 cbd:k8s//k8s/csi-vol-pvc-647525be-c0d6-464b-b548-1fa26f6d183c_k8s_ /dev/nbd1
-		tLine := strings.TrimSpace(l)
-		if tLine == "" || strings.HasPrefix(tLine, "id") {
-			continue
+	for _, m := range mappings {
+		if m.image == image {
+			ctxlog.Infof(ctx, "get device path: %s of image: %s", m.Device, image)
+			return m.Device, nil
 		}
-		lineSlice := strings.Fields(tLine)
-		if len(lineSlice) < 3 {
+	}
+
+	ctxlog.Warningf(ctx, "can't find devicePath of image: %s", image)
+	return "", nil
+}
+
+// InUseError is returned by Map if the curve file is still opened by the clients of other hosts.
+type InUseError struct {
+	FilePath string
+	// the addresses of the clients, with the host names if resolved
+	Holders []string
+}
+
+func (e *InUseError) Error() string {
+	return fmt.Sprintf("curve file %s is still being used by %s", e.FilePath, strings.Join(e.Holders, ", "))
+}
+
+const (
+	// the policies of a failed in-use check: fail-closed refuses to map the file,
+	// fail-open maps it as if no other host opened it
+	InUseCheckFailClosed = "fail-closed"
+	InUseCheckFailOpen   = "fail-open"
+)
+
+var inUseCheckPolicy = InUseCheckFailClosed
+
+// SetInUseCheckPolicy sets what Map does if the in-use check keeps failing.
+func SetInUseCheckPolicy(policy string) error {
+	if policy != InUseCheckFailClosed && policy != InUseCheckFailOpen {
+		return fmt.Errorf("invalid in-use check policy %q, must be %s or %s", policy, InUseCheckFailClosed, InUseCheckFailOpen)
+	}
+	inUseCheckPolicy = policy
+	return nil
+}
+
+// InUseCheckError is returned by Map if the clients opening the curve file are unknown,
+// e.g. curve_ops_tool is missing or the MDS is unreachable, in the fail-closed policy.
+type InUseCheckError struct {
+	FilePath string
+	Err      error
+}
+
+func (e *InUseCheckError) Error() string {
+	return fmt.Sprintf("failed to check whether curve file %s is used by other hosts: %v", e.FilePath, e.Err)
+}
+
+// NbdMapping is a curve file mapped on the node by curve-nbd.
+type NbdMapping struct {
+	Device   string `json:"device"`
+	FilePath string `json:"filePath"`
+	User     string `json:"user"`
+	// the client conf of the cluster, empty for the default cluster
+	ConfPath string `json:"confPath,omitempty"`
+
+	image string
+}
+
+// ListMapped returns the curve files mapped on the node.
+func ListMapped(ctx context.Context) ([]NbdMapping, error) {
+	output, err := util.ExecCommand(curveNbdCmd, []string{"list-mapped"})
+	if err != nil {
+		return nil, fmt.Errorf("can not run curve-nbd list-mapped, err: %v, output: %s", err, string(output))
+	}
+	return parseListMapped(string(output)), nil
+}
+
+// parseListMapped parses the output of curve-nbd list-mapped:
+// id      image                                                                device
+// 1509297 cbd:k8s//k8s/csi-vol-pvc-647525be-c0d6-464b-b548-1fa26f6d183c_k8s_ /dev/nbd1
+// 1509298 cbd:k8s//k8s/csi-vol-pvc-3e1b2c2a_k8s_:/etc/curve/cluster1/client.conf /dev/nbd2
+func parseListMapped(output string) []NbdMapping {
+	var mappings []NbdMapping
+	for _, l := range strings.Split(output, "\n") {
+		fields := strings.Fields(l)
+		if len(fields) < 3 || fields[0] == "id" || !strings.HasPrefix(fields[1], "cbd:") {
 			continue
 		}
-		// cbdMapPathSuffix: /k8s/csi-vol-pvc-647525be-c0d6-464b-b548-1fa26f6d183c_k8s_
-		cbdMapPathSuffix := fmt.Sprintf("%s_%s_", filePath, user)
-		if strings.HasSuffix(lineSlice[1], cbdMapPathSuffix) {
-			ctxlog.Infof(ctx, "get device path: %s of filePath: %s", lineSlice[2], filePath)
-			return lineSlice[2], nil
+		// cbd:<user>/<file path>_<user>_[:<client conf>]
+		image, confPath, _ := strings.Cut(strings.TrimPrefix(fields[1], "cbd:"), ":")
+		user, path, ok := strings.Cut(image, "/")
+		if !ok || !strings.HasSuffix(path, "_"+user+"_") {
+			continue
 		}
+		mappings = append(mappings, NbdMapping{
+			Device:   fields[2],
+			FilePath: strings.TrimSuffix(path, "_"+user+"_"),
+			User:     user,
+			ConfPath: confPath,
+			image:    fields[1],
+		})
 	}
-
-	ctxlog.Warningf(ctx, "can't find devicePath of filePath: %s", filePath)
-	return "", nil
+	return mappings
 }
 
 // Wait for the curve file ready and not mapped at other nodes
-func waitForCurveFileReady(ctx context.Context, fileName, user string, disableInUseChecks bool) error {
+func waitForCurveFileReady(ctx context.Context, cv *CurveVolume, disableInUseChecks bool) error {
+	if disableInUseChecks {
+		ctxlog.Infof(ctx, "valid multi-node attach requested, ignoring the in-use checks of %s", cv.FilePath)
+		return nil
+	}
 	backoff := wait.Backoff{
 		Duration: curveFileWatcherInitDelay,
 		Factor:   curveFileWatcherFactor,
 		Steps:    curveFileWatcherSteps,
 	}
 
+	// the result of the last check, a failed check is retried as a held file
+	var (
+		holders  []string
+		checkErr error
+	)
 	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
-		used, output, err := curveStatus(ctx, fileName, user)
-		if err != nil {
-			return false, fmt.Errorf("fail to check curve file %s status with: (%v), output: (%s)", fileName, err, output)
+		var output string
+		holders, output, checkErr = curveStatus(ctx, cv)
+		if checkErr != nil {
+			checkErr = fmt.Errorf("%v, output: %s", checkErr, strings.TrimSpace(output))
+			ctxlog.Warningf(ctx, "failed to check the clients of curve file %s: %v", cv.FilePath, checkErr)
+			return false, nil
 		}
-		if disableInUseChecks && used {
-			ctxlog.Infof(ctx, "valid multi-node attach requested, ignoring watcher in-use result")
-			return used, nil
+		if len(holders) > 0 {
+			ctxlog.Warningf(ctx, "curve file %s is still being used by %v", cv.FilePath, holders)
 		}
-		return !used, nil
+		return len(holders) == 0, nil
 	})
-	// return error if curve image has not become available for the specified timeout
-	if err == wait.ErrWaitTimeout {
-		return fmt.Errorf("curve file %s is still being used", fileName)
+	if err != wait.ErrWaitTimeout {
+		return err
+	}
+	// the file is not available for the specified timeout
+	if checkErr == nil {
+		return &InUseError{FilePath: cv.FilePath, Holders: resolveHosts(ctx, holders)}
+	}
+	if inUseCheckPolicy == InUseCheckFailOpen {
+		ctxlog.Warningf(ctx, "the in-use check of curve file %s keeps failing, mapping it in the %s policy: %v", cv.FilePath, InUseCheckFailOpen, checkErr)
+		return nil
+	}
+	return &InUseCheckError{FilePath: cv.FilePath, Err: checkErr}
+}
+
+// the header of the output of find-mount-point, followed by a client address per line
+const mountPointHeaderSuffix = "mount point:"
+
+// curveStatus returns the addresses of the clients of other hosts opening the file,
+// which are found by the mds from the sessions of the file.
+// curve_ops_tool find-mount-point -fileName=FILENAME
+func curveStatus(ctx context.Context, cv *CurveVolume) ([]string, string, error) {
+	output, err := cv.execOpsTool(ctx, "find-mount-point", "-fileName="+cv.FilePath)
+	if err != nil {
+		return nil, string(output), err
+	}
+	local, err := localIPs()
+	if err != nil {
+		return nil, string(output), err
+	}
+	holders, err := parseMountPoints(string(output), local)
+	if err != nil {
+		return nil, string(output), err
+	}
+	holders, err = unfencedHolders(ctx, holders)
+	return holders, string(output), err
+}
+
+// parseMountPoints returns the client addresses in the output, except the ones of the
+// local host. The addresses follow the header, one per line:
+//
+//	file /k8s/csi-vol-pvc-1 mount point:
+//	10.0.0.2:9000
+//
+// The lines before the header, e.g. the logs, are skipped. The output without the header
+// lists no clients, e.g. "file /k8s/csi-vol-pvc-1 is not mounted", unless it reports a
+// failure. Any other line after the header fails the parsing, instead of being guessed.
+func parseMountPoints(output string, local map[string]bool) ([]string, error) {
+	var holders []string
+	seen := map[string]bool{}
+	header := false
+	for _, l := range strings.Split(output, "\n") {
+		l = strings.TrimSpace(l)
+		if !header {
+			if strings.HasSuffix(l, mountPointHeaderSuffix) {
+				header = true
+			} else if strings.Contains(strings.ToLower(l), "fail") {
+				return nil, fmt.Errorf("find-mount-point failed: %s", l)
+			}
+			continue
+		}
+		if l == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(l)
+		if err != nil || net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("unexpected client address %q in the output of find-mount-point", l)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return nil, fmt.Errorf("unexpected client address %q in the output of find-mount-point", l)
+		}
+		if local[host] || seen[l] {
+			continue
+		}
+		seen[l] = true
+		holders = append(holders, l)
 	}
-	// return error if any other errors were encountered during waiting for the image to become available
-	return err
+	return holders, nil
 }
 
-// curveStatus checks if there is watcher on the file.
-// It returns true if there is a watcher on the file, otherwise returns false.
-func curveStatus(ctx context.Context, fileName, user string) (bool, string, error) {
-	// Not implemented yet
-	return false, "", nil
+// localIPs returns the addresses of the host, the node plugin runs in the host network.
+// It is replaced in tests.
+var localIPs = func() (map[string]bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := map[string]bool{}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips[ipNet.IP.String()] = true
+		}
+	}
+	return ips, nil
+}
+
+// resolveHosts appends the host names to the client addresses if resolved.
+func resolveHosts(ctx context.Context, addrs []string) []string {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	hosts := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		host, _, _ := net.SplitHostPort(addr)
+		if names, err := net.DefaultResolver.LookupAddr(ctx, host); err == nil && len(names) > 0 {
+			addr = fmt.Sprintf("%s (%s)", addr, strings.TrimSuffix(names[0], "."))
+		}
+		hosts = append(hosts, addr)
+	}
+	return hosts
 }
@@ -0,0 +1,102 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curveservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMountPoints(t *testing.T) {
+	local := map[string]bool{"10.0.0.1": true}
+	output := `I1019 10:00:00.000000 mds addr 10.0.0.9:6700
+file /k8s/csi-vol-pvc-1 mount point:
+10.0.0.1:9000
+10.0.0.2:9000
+10.0.0.2:9000
+10.0.0.3:9001
+`
+	holders, err := parseMountPoints(output, local)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2:9000", "10.0.0.3:9001"}, holders)
+	// opened only by the local host
+	holders, err = parseMountPoints("file /k8s/csi-vol-pvc-1 mount point:\n10.0.0.1:9000\n", local)
+	assert.NoError(t, err)
+	assert.Empty(t, holders)
+	holders, err = parseMountPoints("file /k8s/csi-vol-pvc-1 is not mounted\n", local)
+	assert.NoError(t, err)
+	assert.Empty(t, holders)
+
+	// the addresses outside the list are not holders
+	holders, err = parseMountPoints("connect to mds 10.0.0.9:6700\n", local)
+	assert.NoError(t, err)
+	assert.Empty(t, holders)
+	for _, output := range []string{
+		"FindFileMountPoint fail, ret = -1\n",
+		"file /k8s/csi-vol-pvc-1 mount point:\nconnect to 10.0.0.2:9000 timeout\n",
+		"file /k8s/csi-vol-pvc-1 mount point:\n10.0.0.2:0\n",
+	} {
+		_, err = parseMountPoints(output, local)
+		assert.Error(t, err, output)
+	}
+}
+
+func TestSetInUseCheckPolicy(t *testing.T) {
+	defer func() { inUseCheckPolicy = InUseCheckFailClosed }()
+	assert.NoError(t, SetInUseCheckPolicy(InUseCheckFailOpen))
+	assert.Equal(t, InUseCheckFailOpen, inUseCheckPolicy)
+	assert.Error(t, SetInUseCheckPolicy("off"))
+
+	err := &InUseCheckError{FilePath: "/k8s/csi-vol-pvc-1", Err: errors.New("curve_ops_tool not found")}
+	assert.Contains(t, err.Error(), "/k8s/csi-vol-pvc-1")
+}
+
+func TestInUseError(t *testing.T) {
+	err := &InUseError{FilePath: "/k8s/csi-vol-pvc-1", Holders: resolveHosts(context.TODO(), []string{"192.0.2.10:9000"})}
+	assert.Contains(t, err.Error(), "/k8s/csi-vol-pvc-1 is still being used by 192.0.2.10:9000")
+
+	// the in-use checks are skipped for MULTI_NODE_MULTI_WRITER
+	assert.NoError(t, waitForCurveFileReady(context.TODO(), NewCurveVolume("k8s", "csi-vol-pvc-1", 10), true))
+}
+
+func TestParseListMapped(t *testing.T) {
+	output := `id      image                                                                device
+1509297 cbd:k8s//k8s/csi-vol-pvc-647525be-c0d6-464b-b548-1fa26f6d183c_k8s_ /dev/nbd1
+1509301 cbd:vm//vm/db01_vm_ /dev/nbd2
+1509302 rbd:pool/image /dev/nbd3
+1509303 cbd:k8s//k8s/csi-vol-pvc-647525be-c0d6-464b-b548-1fa26f6d183c_k8s_:/etc/curve/cluster1/client.conf /dev/nbd4
+`
+	mappings := parseListMapped(output)
+	assert.Equal(t, []NbdMapping{
+		{Device: "/dev/nbd1", FilePath: "/k8s/csi-vol-pvc-647525be-c0d6-464b-b548-1fa26f6d183c", User: "k8s",
+			image: "cbd:k8s//k8s/csi-vol-pvc-647525be-c0d6-464b-b548-1fa26f6d183c_k8s_"},
+		{Device: "/dev/nbd2", FilePath: "/vm/db01", User: "vm", image: "cbd:vm//vm/db01_vm_"},
+		{Device: "/dev/nbd4", FilePath: "/k8s/csi-vol-pvc-647525be-c0d6-464b-b548-1fa26f6d183c", User: "k8s",
+			ConfPath: "/etc/curve/cluster1/client.conf",
+			image:    "cbd:k8s//k8s/csi-vol-pvc-647525be-c0d6-464b-b548-1fa26f6d183c_k8s_:/etc/curve/cluster1/client.conf"},
+	}, mappings)
+	assert.Empty(t, parseListMapped(""))
+
+	// the same file in two clusters are mapped at different devices
+	cv := NewCurveVolume("k8s", "csi-vol-pvc-647525be-c0d6-464b-b548-1fa26f6d183c", 10)
+	assert.Equal(t, mappings[0].image, cv.nbdImage())
+	cv.ConfPath = "/etc/curve/cluster1/client.conf"
+	assert.Equal(t, mappings[2].image, cv.nbdImage())
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curveservice
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/opencurve/curve-csi/pkg/util/ctxlog"
+)
+
+// FencedError is returned by Map if the host is fenced by the csi-addons NetworkFence.
+type FencedError struct {
+	Addr string
+	CIDR string
+}
+
+func (e *FencedError) Error() string {
+	return fmt.Sprintf("the address %s of the host is fenced by %s, refusing to map curve files", e.Addr, e.CIDR)
+}
+
+// fenceList returns the fenced CIDRs, the fence is not enforced on the host if nil.
+var fenceList func() ([]string, error)
+
+// SetFenceList sets the source of the fenced CIDRs. The hosts in them are refused to
+// map the curve files, and their clients are ignored by the in-use checks of the others.
+func SetFenceList(list func() ([]string, error)) {
+	fenceList = list
+}
+
+// fencedNets returns the fenced CIDRs, none if the fence is not enforced.
+func fencedNets() ([]*net.IPNet, error) {
+	if fenceList == nil {
+		return nil, nil
+	}
+	cidrs, err := fenceList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the fenced CIDRs: %v", err)
+	}
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fenced CIDR %q: %v", cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// fencedBy returns the CIDR containing the ip, empty if none.
+func fencedBy(nets []*net.IPNet, ip net.IP) string {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return ipNet.String()
+		}
+	}
+	return ""
+}
+
+// checkFenced returns the FencedError if an address of the host is fenced.
+func checkFenced() error {
+	nets, err := fencedNets()
+	if err != nil || len(nets) == 0 {
+		return err
+	}
+	local, err := localIPs()
+	if err != nil {
+		return err
+	}
+	for addr := range local {
+		if cidr := fencedBy(nets, net.ParseIP(addr)); cidr != "" {
+			return &FencedError{Addr: addr, CIDR: cidr}
+		}
+	}
+	return nil
+}
+
+// unfencedHolders returns the client addresses not fenced, the fenced clients can not
+// reach the volumes any longer, so they are not considered holding them.
+func unfencedHolders(ctx context.Context, holders []string) ([]string, error) {
+	nets, err := fencedNets()
+	if err != nil || len(nets) == 0 {
+		return holders, err
+	}
+	var unfenced []string
+	for _, holder := range holders {
+		host, _, err := net.SplitHostPort(holder)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client address %q: %v", holder, err)
+		}
+		if cidr := fencedBy(nets, net.ParseIP(host)); cidr != "" {
+			ctxlog.Infof(ctx, "ignoring the client %s fenced by %s", holder, cidr)
+			continue
+		}
+		unfenced = append(unfenced, holder)
+	}
+	return unfenced, nil
+}
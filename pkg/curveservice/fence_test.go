@@ -0,0 +1,68 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curveservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFence(t *testing.T) {
+	ctx := context.TODO()
+	origLocalIPs := localIPs
+	defer func() {
+		localIPs = origLocalIPs
+		SetFenceList(nil)
+	}()
+	localIPs = func() (map[string]bool, error) {
+		return map[string]bool{"127.0.0.1": true, "10.0.1.5": true}, nil
+	}
+	holders := []string{"10.0.0.2:9000", "10.0.2.3:9000", "[fd00::3]:9000"}
+
+	// not enforced
+	assert.NoError(t, checkFenced())
+	unfenced, err := unfencedHolders(ctx, holders)
+	assert.NoError(t, err)
+	assert.Equal(t, holders, unfenced)
+
+	SetFenceList(func() ([]string, error) {
+		return []string{"10.0.0.0/24", "fd00::/64"}, nil
+	})
+	assert.NoError(t, checkFenced())
+	unfenced, err = unfencedHolders(ctx, holders)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.2.3:9000"}, unfenced)
+
+	// the host is fenced
+	SetFenceList(func() ([]string, error) {
+		return []string{"10.0.1.0/24"}, nil
+	})
+	var fenced *FencedError
+	assert.True(t, errors.As(checkFenced(), &fenced))
+	assert.Equal(t, &FencedError{Addr: "10.0.1.5", CIDR: "10.0.1.0/24"}, fenced)
+
+	// the holders are unknown if the list fails
+	SetFenceList(func() ([]string, error) {
+		return nil, errors.New("timeout")
+	})
+	assert.Error(t, checkFenced())
+	_, err = unfencedHolders(ctx, holders)
+	assert.Error(t, err)
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curveservice
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"github.com/opencurve/curve-csi/pkg/util"
+	"github.com/opencurve/curve-csi/pkg/util/ctxlog"
+)
+
+const (
+	// curve-nbd runs as a child process of the driver, killed with the driver
+	MapModeProcess = "process"
+	// curve-nbd runs as a transient systemd unit on the host, surviving the restarts of the driver
+	MapModeSystemd = "systemd"
+
+	nbdUnitPrefix = "curve-nbd-"
+)
+
+var mapMode = MapModeProcess
+
+// SetMapMode sets how curve-nbd is run by Map, before InitCurveNbd.
+func SetMapMode(mode string) error {
+	if mode != MapModeProcess && mode != MapModeSystemd {
+		return fmt.Errorf("invalid map mode %q, must be %s or %s", mode, MapModeProcess, MapModeSystemd)
+	}
+	mapMode = mode
+	return nil
+}
+
+// MapMode returns how curve-nbd is run by Map.
+func MapMode() string {
+	return mapMode
+}
+
+// NbdUnit returns the systemd unit running curve-nbd of the volume,
+// empty if curve-nbd is not run as a systemd unit.
+func (cv *CurveVolume) NbdUnit() string {
+	if mapMode != MapModeSystemd {
+		return ""
+	}
+	return cv.nbdUnit()
+}
+
+func (cv *CurveVolume) nbdUnit() string {
+	return nbdUnitName(cv.FilePath, cv.ConfPath)
+}
+
+// nbdUnitName returns the name of the systemd unit running curve-nbd of the file,
+// which is the file path escaped like systemd-escape --path, e.g.
+// curve-nbd-k8s-csi\x2dvol\x2dpvc\x2d1 of /k8s/csi-vol-pvc-1.
+// The file of a cluster other than the default one is suffixed by the crc32 of its
+// client conf, e.g. curve-nbd-k8s-csi\x2dvol\x2dpvc\x2d1-c839ab17.
+func nbdUnitName(filePath, confPath string) string {
+	path := strings.Trim(filePath, "/")
+	var b strings.Builder
+	b.WriteString(nbdUnitPrefix)
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '/':
+			b.WriteByte('-')
+		case c == '.' && i == 0,
+			!(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == ':' || c == '_' || c == '.'):
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if confPath != "" {
+		fmt.Fprintf(&b, "-%08x", crc32.ChecksumIEEE([]byte(confPath)))
+	}
+	return b.String()
+}
+
+// mapOnHost runs curve-nbd map as a transient systemd unit of the host,
+// the password in args is redacted from the status of the unit logged on failure.
+func mapOnHost(ctx context.Context, unit string, args []string, password string) error {
+	// the file is not mapped, the unit left is stale, e.g. the daemon exited
+	// or the driver restarted while mapping it
+	stopNbdUnit(ctx, unit)
+	return util.SystemMapOnHost(ctx, unit, append([]string{curveNbdCmd}, args...), password)
+}
+
+// stopNbdUnit stops and clears the unit, it is not an error if the unit does not exist.
+func stopNbdUnit(ctx context.Context, unit string) {
+	if output, err := util.ExecCommandHost("systemctl", []string{"stop", unit}); err != nil &&
+		!strings.Contains(string(output), "not loaded") {
+		ctxlog.Warningf(ctx, "failed to stop %s.service, err: %v, output: %s", unit, err, string(output))
+	}
+	_, _ = util.ExecCommandHost("systemctl", []string{"reset-failed", unit})
+}
+
+// ReconnectNbdUnits finds the curve-nbd units left by the previous driver on the host,
+// keeps the active ones serving their devices, and clears the failed ones.
+// It returns the active units.
+func ReconnectNbdUnits(ctx context.Context) ([]string, error) {
+	if mapMode != MapModeSystemd {
+		return nil, nil
+	}
+	output, err := util.ExecCommandHost("systemctl",
+		[]string{"list-units", "--all", "--plain", "--no-legend", nbdUnitPrefix + "*"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the curve-nbd units, err: %v, output: %s", err, string(output))
+	}
+	active, failed := parseNbdUnits(string(output))
+	for _, unit := range failed {
+		ctxlog.Warningf(ctx, "clearing the failed unit %s", unit)
+		_, _ = util.ExecCommandHost("systemctl", []string{"reset-failed", unit})
+	}
+	for _, unit := range active {
+		ctxlog.Infof(ctx, "reconnected to the running unit %s", unit)
+	}
+	return active, nil
+}
+
+// parseNbdUnits parses the output of systemctl list-units --plain --no-legend:
+// curve-nbd-k8s-csi\x2dvol\x2dpvc\x2d1.service loaded active exited k8scsi
+func parseNbdUnits(output string) (active, failed []string) {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		// the failed units may be marked
+		if len(fields) > 0 && (fields[0] == "●" || fields[0] == "*") {
+			fields = fields[1:]
+		}
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], nbdUnitPrefix) {
+			continue
+		}
+		unit := strings.TrimSuffix(fields[0], ".service")
+		switch fields[2] {
+		case "active", "activating", "reloading":
+			active = append(active, unit)
+		case "failed":
+			failed = append(failed, unit)
+		}
+	}
+	return active, failed
+}
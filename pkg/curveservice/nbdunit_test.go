@@ -0,0 +1,53 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curveservice
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNbdUnitName(t *testing.T) {
+	assert.Equal(t, `curve-nbd-k8s-csi\x2dvol\x2dpvc\x2d1`, nbdUnitName("/k8s/csi-vol-pvc-1", ""))
+	assert.Equal(t, `curve-nbd-vm-db01.img`, nbdUnitName("/vm/db01.img", ""))
+	// the leading dot is escaped
+	assert.Equal(t, `curve-nbd-\x2evm-data`, nbdUnitName("/.vm/data", ""))
+	// the same file in another cluster
+	unit := nbdUnitName("/k8s/csi-vol-pvc-1", "/etc/curve/cluster1/client.conf")
+	assert.Regexp(t, `^curve-nbd-k8s-csi\\x2dvol\\x2dpvc\\x2d1-[0-9a-f]{8}$`, unit)
+	assert.NotEqual(t, unit, nbdUnitName("/k8s/csi-vol-pvc-1", "/etc/curve/cluster2/client.conf"))
+}
+
+func TestParseNbdUnits(t *testing.T) {
+	output := `curve-nbd-k8s-csi\x2dvol\x2dpvc\x2d1.service loaded active exited k8scsi
+curve-nbd-k8s-csi\x2dvol\x2dpvc\x2d2.service loaded inactive dead k8scsi
+● curve-nbd-k8s-csi\x2dvol\x2dpvc\x2d3.service loaded failed failed k8scsi
+sshd.service loaded active running OpenSSH server daemon
+`
+	active, failed := parseNbdUnits(output)
+	assert.Equal(t, []string{`curve-nbd-k8s-csi\x2dvol\x2dpvc\x2d1`}, active)
+	assert.Equal(t, []string{`curve-nbd-k8s-csi\x2dvol\x2dpvc\x2d3`}, failed)
+}
+
+func TestSetMapMode(t *testing.T) {
+	defer SetMapMode(MapModeProcess)
+	assert.NoError(t, SetMapMode(MapModeSystemd))
+	assert.Equal(t, MapModeSystemd, mapMode)
+	assert.Error(t, SetMapMode("docker"))
+	assert.Equal(t, MapModeSystemd, mapMode)
+}
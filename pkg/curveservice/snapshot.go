@@ -39,19 +39,63 @@ const (
 )
 
 type SnapshotServer struct {
-	URL      string `json:"server"`
-	User     string `json:"user"`
-	FilePath string `json:"filepath"`
+	URLs     []string `json:"servers"`
+	User     string   `json:"user"`
+	FilePath string   `json:"filepath"`
+	// the poolset of the clone destination, empty to use the default
+	Poolset string `json:"poolset"`
+	// the credentials of User, never logged
+	Password string `json:"-"`
+	Token    string `json:"-"`
 }
 
-func NewSnapshotServer(server, user, volName string) *SnapshotServer {
+// NewSnapshotServer creates a snapshot server client, the servers are the
+// endpoints of the same snapshot/clone service and are tried in order.
+func NewSnapshotServer(servers []string, user, volName string) *SnapshotServer {
+	urls := make([]string, 0, len(servers))
+	for _, server := range servers {
+		urls = append(urls, server+"/SnapshotCloneService")
+	}
 	return &SnapshotServer{
-		URL:      server + "/SnapshotCloneService",
+		URLs:     urls,
 		User:     user,
 		FilePath: "/" + user + "/" + volName,
 	}
 }
 
+// httpGet sends the request to the first available server.
+func (cs *SnapshotServer) httpGet(ctx context.Context, queryMap map[string]string) (int, []byte, error) {
+	if len(cs.URLs) == 0 {
+		return 0, nil, fmt.Errorf("no snapshot server available")
+	}
+
+	var (
+		statusCode int
+		data       []byte
+		err        error
+	)
+	for _, url := range cs.URLs {
+		statusCode, data, err = util.HttpGetWithHeader(url, queryMap, cs.authHeader())
+		if err == nil {
+			return statusCode, data, nil
+		}
+		ctxlog.Warningf(ctx, "[curve snapshot] failed to request snapshot server %v, err: %v", url, err)
+	}
+	return statusCode, data, err
+}
+
+// authHeader returns the bearer token if set, or the basic auth of user and password.
+func (cs *SnapshotServer) authHeader() http.Header {
+	header := http.Header{}
+	if cs.Token != "" {
+		header.Set("Authorization", "Bearer "+cs.Token)
+	} else if cs.Password != "" {
+		req := &http.Request{Header: header}
+		req.SetBasicAuth(cs.User, cs.Password)
+	}
+	return header
+}
+
 // GetSnapshotByName gets the snapshot with specific name
 func (cs *SnapshotServer) GetFileSnapshotOfName(ctx context.Context, snapName string) (Snapshot, error) {
 	var snap Snapshot
@@ -75,6 +119,25 @@ func (cs *SnapshotServer) GetFileSnapshotOfName(ctx context.Context, snapName st
 	return snap, util.NewNotFoundErr()
 }
 
+// ListFileSnapshots lists the snapshots of the file.
+func (cs *SnapshotServer) ListFileSnapshots(ctx context.Context) ([]Snapshot, error) {
+	snaps := make([]Snapshot, 0)
+	limit, offset, total := 20, 0, 1
+	for offset < total {
+		snapshotResp, err := cs.getFileSnapshots(ctx, "", limit, offset)
+		if err != nil {
+			if util.IsNotFoundErr(err) {
+				break
+			}
+			return nil, err
+		}
+		snaps = append(snaps, snapshotResp.Snapshots...)
+		total = snapshotResp.TotalCount
+		offset += limit
+	}
+	return snaps, nil
+}
+
 // GetSnapshotById gets the snapshot with specific uuid
 func (cs *SnapshotServer) GetFileSnapshotOfId(ctx context.Context, uuid string) (Snapshot, error) {
 	var snap Snapshot
@@ -96,6 +159,13 @@ func (cs *SnapshotServer) GetFileSnapshotOfId(ctx context.Context, uuid string)
 	return snapshotResp.Snapshots[0], nil
 }
 
+// GetUserSnapshotOfId gets the snapshot of the user with the uuid, whose file is not known.
+func (cs *SnapshotServer) GetUserSnapshotOfId(ctx context.Context, uuid string) (Snapshot, error) {
+	userServer := *cs
+	userServer.FilePath = ""
+	return userServer.GetFileSnapshotOfId(ctx, uuid)
+}
+
 // getFileSnapshots get snapshots list
 func (cs *SnapshotServer) getFileSnapshots(ctx context.Context, uuid string, limit, offset int) (GetSnapshotResp, error) {
 	var resp GetSnapshotResp
@@ -103,7 +173,10 @@ func (cs *SnapshotServer) getFileSnapshots(ctx context.Context, uuid string, lim
 		"Action":  "GetFileSnapshotInfo",
 		"Version": "0.0.6",
 		"User":    cs.User,
-		"File":    cs.FilePath,
+	}
+	// the snapshots of all the files of the user if not set
+	if cs.FilePath != "" {
+		queryMap["File"] = cs.FilePath
 	}
 	if limit > 0 {
 		queryMap["Limit"] = strconv.Itoa(limit)
@@ -116,7 +189,7 @@ func (cs *SnapshotServer) getFileSnapshots(ctx context.Context, uuid string, lim
 	}
 
 	ctxlog.V(4).Infof(ctx, "starting to get snapshots: %v", queryMap)
-	statusCode, data, err := util.HttpGet(cs.URL, queryMap)
+	statusCode, data, err := cs.httpGet(ctx, queryMap)
 	if err != nil {
 		return resp, fmt.Errorf("failed to get snapshot, err: %v", err)
 	}
@@ -152,7 +225,7 @@ func (cs *SnapshotServer) CreateSnapshot(ctx context.Context, snapName string) (
 	}
 
 	ctxlog.V(4).Infof(ctx, "starting to create snapshot: %v", queryMap)
-	statusCode, data, err := util.HttpGet(cs.URL, queryMap)
+	statusCode, data, err := cs.httpGet(ctx, queryMap)
 	if err != nil {
 		return "", fmt.Errorf("failed to create snapshot, err: %v", err)
 	}
@@ -184,7 +257,7 @@ func (cs *SnapshotServer) DeleteSnapshot(ctx context.Context, uuid string) error
 	}
 
 	ctxlog.V(4).Infof(ctx, "starting to delete snapshot: %v", queryMap)
-	statusCode, data, err := util.HttpGet(cs.URL, queryMap)
+	statusCode, data, err := cs.httpGet(ctx, queryMap)
 	if err != nil {
 		return fmt.Errorf("failed to delete snapshot, err: %v", err)
 	}
@@ -216,7 +289,7 @@ func (cs *SnapshotServer) CancelSnapshot(ctx context.Context, uuid string) error
 	}
 
 	ctxlog.V(4).Infof(ctx, "starting to cancel snapshot: %v", queryMap)
-	statusCode, data, err := util.HttpGet(cs.URL, queryMap)
+	statusCode, data, err := cs.httpGet(ctx, queryMap)
 	if err != nil {
 		return fmt.Errorf("failed to cancel snapshot, err: %v", err)
 	}
@@ -315,7 +388,7 @@ func (cs *SnapshotServer) getCloneTask(ctx context.Context, uuid, destination st
 	}
 
 	ctxlog.V(4).Infof(ctx, "starting to get clone task: %v", queryMap)
-	statusCode, data, err := util.HttpGet(cs.URL, queryMap)
+	statusCode, data, err := cs.httpGet(ctx, queryMap)
 	if err != nil {
 		return resp, fmt.Errorf("failed to get clone task, err: %v", err)
 	}
@@ -343,9 +416,12 @@ func (cs *SnapshotServer) Clone(ctx context.Context, source, destination string,
 		"Destination": destination,
 		"Lazy":        strconv.FormatBool(lazy),
 	}
+	if cs.Poolset != "" {
+		queryMap["PoolSet"] = cs.Poolset
+	}
 
 	ctxlog.V(4).Infof(ctx, "starting to clone snapshot: %v", queryMap)
-	statusCode, data, err := util.HttpGet(cs.URL, queryMap)
+	statusCode, data, err := cs.httpGet(ctx, queryMap)
 	if err != nil {
 		return "", fmt.Errorf("failed to clone snapshot, err: %v", err)
 	}
@@ -400,7 +476,7 @@ func (cs *SnapshotServer) cleanCloneTask(ctx context.Context, uuid string) error
 	}
 
 	ctxlog.V(4).Infof(ctx, "starting to clean cloneTask: %v", queryMap)
-	statusCode, data, err := util.HttpGet(cs.URL, queryMap)
+	statusCode, data, err := cs.httpGet(ctx, queryMap)
 	if err != nil {
 		return fmt.Errorf("failed to clean cloneTask, err: %v", err)
 	}
@@ -430,7 +506,7 @@ func (cs *SnapshotServer) Flatten(ctx context.Context, uuid string) error {
 	}
 
 	ctxlog.V(4).Infof(ctx, "starting to flatten task: %v", queryMap)
-	statusCode, data, err := util.HttpGet(cs.URL, queryMap)
+	statusCode, data, err := cs.httpGet(ctx, queryMap)
 	if err != nil {
 		return fmt.Errorf("failed to flatten task, err: %v", err)
 	}
@@ -494,10 +570,9 @@ func (cs *SnapshotServer) WaitForCloneTaskDone(ctx context.Context, destination
 	return cs.waitForCloneTaskStatus(ctx, destination, TaskStatusDone)
 }
 
-func (cs *SnapshotServer) EnsureTaskFromSourceDone(ctx context.Context, source string) error {
-	ctxlog.V(4).Infof(ctx, "ensure task created from %v status done", source)
-
-	needFlatten := make([]TaskInfo, 0)
+// ListCloneTasks lists all the clone and recover tasks of the user.
+func (cs *SnapshotServer) ListCloneTasks(ctx context.Context) ([]TaskInfo, error) {
+	tasks := make([]TaskInfo, 0)
 	limit, offset, total := 20, 0, 1
 	for offset < total {
 		taskResp, err := cs.getCloneTask(ctx, "", "", limit, offset)
@@ -505,16 +580,34 @@ func (cs *SnapshotServer) EnsureTaskFromSourceDone(ctx context.Context, source s
 			if util.IsNotFoundErr(err) {
 				break
 			}
-			return err
-		}
-		for _, oneTask := range taskResp.TaskInfos {
-			if oneTask.Src == source && oneTask.TaskStatus == TaskStatusMetaInstalled {
-				needFlatten = append(needFlatten, oneTask)
-			}
+			return nil, err
 		}
+		tasks = append(tasks, taskResp.TaskInfos...)
 		total = taskResp.TotalCount
 		offset += limit
 	}
+	return tasks, nil
+}
+
+// CleanFinishedCloneTask cleans the clone task without flattening and waiting,
+// the task must be done or error.
+func (cs *SnapshotServer) CleanFinishedCloneTask(ctx context.Context, uuid string) error {
+	return cs.cleanCloneTask(ctx, uuid)
+}
+
+func (cs *SnapshotServer) EnsureTaskFromSourceDone(ctx context.Context, source string) error {
+	ctxlog.V(4).Infof(ctx, "ensure task created from %v status done", source)
+
+	tasks, err := cs.ListCloneTasks(ctx)
+	if err != nil {
+		return err
+	}
+	needFlatten := make([]TaskInfo, 0)
+	for _, oneTask := range tasks {
+		if oneTask.Src == source && oneTask.TaskStatus == TaskStatusMetaInstalled {
+			needFlatten = append(needFlatten, oneTask)
+		}
+	}
 
 	ctxlog.V(4).Infof(ctx, "need flatten tasks: %v", needFlatten)
 	for _, t := range needFlatten {
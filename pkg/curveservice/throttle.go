@@ -0,0 +1,106 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package curveservice
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/opencurve/curve-csi/pkg/util"
+	"github.com/opencurve/curve-csi/pkg/util/ctxlog"
+)
+
+const (
+	curveOpsToolCmd = "curve_ops_tool"
+)
+
+// ThrottleType is the type of curve file throttle.
+type ThrottleType string
+
+const (
+	ThrottleIOPSTotal ThrottleType = "IOPS_TOTAL"
+	ThrottleIOPSRead  ThrottleType = "IOPS_READ"
+	ThrottleIOPSWrite ThrottleType = "IOPS_WRITE"
+	ThrottleBPSTotal  ThrottleType = "BPS_TOTAL"
+	ThrottleBPSRead   ThrottleType = "BPS_READ"
+	ThrottleBPSWrite  ThrottleType = "BPS_WRITE"
+)
+
+// CheckOpsTool returns an error if curve_ops_tool is not installed.
+func CheckOpsTool() error {
+	if _, err := exec.LookPath(curveOpsToolCmd); err != nil {
+		return fmt.Errorf("%s is not installed: %v", curveOpsToolCmd, err)
+	}
+	return nil
+}
+
+// execOpsTool runs curve_ops_tool with the cluster and auth related args appended.
+// The password is passed by a flagfile of gflags readable by the driver only, so it
+// is not on the command line seen by the other processes of the host.
+func (cv *CurveVolume) execOpsTool(ctx context.Context, args ...string) ([]byte, error) {
+	if len(cv.MdsAddrs) > 0 {
+		args = append(args, "-mdsAddr="+strings.Join(cv.MdsAddrs, ","))
+	}
+	args = append(args, "-userName="+cv.User)
+	ctxlog.V(4).Infof(ctx, "starting exec: %s %v", curveOpsToolCmd, args)
+	if cv.Password != "" {
+		flagfile, err := writeOpsToolFlagfile(cv.Password)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(flagfile)
+		args = append(args, "-flagfile="+flagfile)
+	}
+	return util.ExecCommand(curveOpsToolCmd, args)
+}
+
+// writeOpsToolFlagfile writes the password to a new flagfile of mode 0600, and
+// returns its path, which must be removed by the caller.
+func writeOpsToolFlagfile(password string) (string, error) {
+	f, err := os.CreateTemp("", "curve-ops-tool-*.flags")
+	if err != nil {
+		return "", fmt.Errorf("failed to create the flagfile of %s: %v", curveOpsToolCmd, err)
+	}
+	if _, err = f.WriteString("-password=" + password + "\n"); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write the flagfile of %s: %v", curveOpsToolCmd, err)
+	}
+	return f.Name(), nil
+}
+
+// UpdateThrottle sets the throttle limit of the file, limit 0 means unlimited.
+// curve_ops_tool update-throttle -fileName=FILENAME -throttleType=TYPE -limit=LIMIT
+func (cv *CurveVolume) UpdateThrottle(ctx context.Context, throttleType ThrottleType, limit int64) error {
+	output, err := cv.execOpsTool(ctx, "update-throttle",
+		"-fileName="+cv.FilePath,
+		"-throttleType="+string(throttleType),
+		fmt.Sprintf("-limit=%d", limit))
+	if err != nil {
+		return fmt.Errorf("failed to update throttle %s of %s to %d, err: %v, output: %v",
+			throttleType, cv.FilePath, limit, err, string(output))
+	}
+	ctxlog.V(4).Infof(ctx, "[curve] successfully update throttle %s of %s to %d", throttleType, cv.FilePath, limit)
+	return nil
+}
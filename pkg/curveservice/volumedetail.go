@@ -34,6 +34,10 @@ type CurveVolumeDetail struct {
 	User       string            `param:"user"`
 	FileName   string            `param:"filename"`
 	FileStatus CurveVolumeStatus `param:"fileStatus"`
+	// reported by the newer curve only, zero if not reported
+	StripeUnit  int64  `param:"stripeUnit"`
+	StripeCount int64  `param:"stripeCount"`
+	Poolset     string `param:"poolset"`
 }
 
 // Parse the output of 'curve stat':
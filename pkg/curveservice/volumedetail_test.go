@@ -69,13 +69,39 @@ paramA: valueA
 				FileName:   "pvc-ce482926-91d8-11ea-bf6e-fa163e23ce53",
 				FileStatus: "Created",
 			},
+		}, {
+			output: `id: 39008
+parentid: 39005
+filetype: INODE_PAGEFILE
+length(GB): 20
+createtime: 2022-08-07 10:51:52
+user: k8s
+filename: pvc-0b1c27a4-4c1a-4bb0-9d7e-5d8f0bd2f6a1
+fileStatus: Created
+stripeUnit: 65536
+stripeCount: 16
+poolset: ssd
+`,
+			volDetail: CurveVolumeDetail{
+				Id:          "39008",
+				ParentId:    "39005",
+				FileType:    "INODE_PAGEFILE",
+				LengthGiB:   20,
+				CreateTime:  "2022-08-07 10:51:52",
+				User:        "k8s",
+				FileName:    "pvc-0b1c27a4-4c1a-4bb0-9d7e-5d8f0bd2f6a1",
+				FileStatus:  "Created",
+				StripeUnit:  65536,
+				StripeCount: 16,
+				Poolset:     "ssd",
+			},
 		},
 	}
 
 	for _, tcase := range validStatus {
 		vDetail, err := simpleParseVolumeDetail([]byte(tcase.output))
 		assert.NoError(t, err)
-		assert.Equal(t, tcase.volDetail, vDetail)
+		assert.Equal(t, tcase.volDetail, *vDetail)
 	}
 
 	invalidStatCase := statCase{
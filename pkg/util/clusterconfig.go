@@ -0,0 +1,109 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	// DefaultClusterConfig is the default path of the cluster config file,
+	// usually mounted from a ConfigMap.
+	DefaultClusterConfig = "/etc/curve-csi-config/config.json"
+)
+
+// ClusterInfo describes how to reach one curve cluster.
+type ClusterInfo struct {
+	// ClusterID is the unique id of the cluster, used in StorageClass and volume ID
+	ClusterID string `json:"clusterID"`
+	// ClientConf is the path of the curve client.conf of the cluster
+	ClientConf string `json:"clientConf,omitempty"`
+	// MdsAddrs is the list of mds addresses, e.g. ["10.0.0.1:6700"]
+	MdsAddrs []string `json:"mdsAddrs,omitempty"`
+	// SnapshotServers is the list of snapshot/clone http server endpoints
+	SnapshotServers []string `json:"snapshotServers,omitempty"`
+	// SizePolicy limits the size of the volumes created in the cluster
+	SizePolicy *SizePolicy `json:"sizePolicy,omitempty"`
+	// Topologies are the poolsets of the cluster and where they are accessible from
+	Topologies []TopologyPool `json:"topologies,omitempty"`
+}
+
+// TopologyPool is a poolset accessible from the nodes with the topology segments.
+type TopologyPool struct {
+	// Segments are the topology segments, the key is qualified by the driver
+	// domain if not, e.g. "zone" refers to "topology.<driver name>/zone"
+	Segments map[string]string `json:"segments"`
+	// Poolset is the curve poolset, empty for the default poolset
+	Poolset string `json:"poolset,omitempty"`
+}
+
+// SizePolicy describes the allowed volume sizes, the zero fields are unset.
+type SizePolicy struct {
+	// MinSizeGiB is the minimum volume size, smaller requests are rounded up to it
+	MinSizeGiB int `json:"minSizeGiB,omitempty"`
+	// MaxSizeGiB is the maximum volume size
+	MaxSizeGiB int `json:"maxSizeGiB,omitempty"`
+	// GranularityGiB is the allocation unit, the volume size is a multiple of it
+	GranularityGiB int `json:"granularityGiB,omitempty"`
+}
+
+// Parse the cluster config file, it contains a json array:
+//
+//	[
+//	  {
+//	    "clusterID": "cluster1",
+//	    "clientConf": "/etc/curve/cluster1/client.conf",
+//	    "mdsAddrs": ["10.0.0.1:6700", "10.0.0.2:6700"],
+//	    "snapshotServers": ["http://10.0.0.1:5555"],
+//	    "sizePolicy": {"minSizeGiB": 10, "maxSizeGiB": 4096, "granularityGiB": 1},
+//	    "topologies": [{"segments": {"zone": "zone-a"}, "poolset": "ssd-a"}]
+//	  }
+//	]
+func readClusterInfo(pathToConfig string) ([]ClusterInfo, error) {
+	var clusters []ClusterInfo
+
+	content, err := ioutil.ReadFile(pathToConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster config %s, err: %w", pathToConfig, err)
+	}
+	if err = json.Unmarshal(content, &clusters); err != nil {
+		return nil, fmt.Errorf("unmarshal failed when read cluster config %s, content: %v, err: %v",
+			pathToConfig, string(content), err)
+	}
+	return clusters, nil
+}
+
+// ListClusterInfo returns all the clusters in the config file.
+func ListClusterInfo(pathToConfig string) ([]ClusterInfo, error) {
+	return readClusterInfo(pathToConfig)
+}
+
+// GetClusterInfo returns the cluster with specific clusterID in the config file.
+func GetClusterInfo(pathToConfig, clusterID string) (*ClusterInfo, error) {
+	clusters, err := readClusterInfo(pathToConfig)
+	if err != nil {
+		return nil, err
+	}
+	for i := range clusters {
+		if clusters[i].ClusterID == clusterID {
+			return &clusters[i], nil
+		}
+	}
+	return nil, NewNotFoundErr(clusterID)
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetClusterInfo(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	content := `[
+  {
+    "clusterID": "cluster1",
+    "clientConf": "/etc/curve/cluster1/client.conf",
+    "mdsAddrs": ["10.0.0.1:6700", "10.0.0.2:6700"],
+    "snapshotServers": ["http://10.0.0.1:5555"]
+  },
+  {
+    "clusterID": "cluster2"
+  }
+]`
+	assert.NoError(t, ioutil.WriteFile(configPath, []byte(content), 0o600))
+
+	cluster, err := GetClusterInfo(configPath, "cluster1")
+	assert.NoError(t, err)
+	assert.Equal(t, &ClusterInfo{
+		ClusterID:       "cluster1",
+		ClientConf:      "/etc/curve/cluster1/client.conf",
+		MdsAddrs:        []string{"10.0.0.1:6700", "10.0.0.2:6700"},
+		SnapshotServers: []string{"http://10.0.0.1:5555"},
+	}, cluster)
+
+	cluster, err = GetClusterInfo(configPath, "cluster2")
+	assert.NoError(t, err)
+	assert.Equal(t, "cluster2", cluster.ClusterID)
+	assert.Empty(t, cluster.SnapshotServers)
+
+	_, err = GetClusterInfo(configPath, "cluster3")
+	assert.True(t, IsNotFoundErr(err, "cluster3"))
+
+	_, err = GetClusterInfo(filepath.Join(t.TempDir(), "not-exist.json"), "cluster1")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package util
 
 import (
+	"os"
 	"os/exec"
 )
 
@@ -30,3 +31,12 @@ func ExecCommand(command string, args []string) ([]byte, error) {
 	cmd := exec.Command(command, args...)
 	return cmd.CombinedOutput()
 }
+
+// ExecCommandWithEnv runs the command with the env appended to the environment of the driver.
+func ExecCommandWithEnv(command string, args []string, env []string) ([]byte, error) {
+	cmd := exec.Command(command, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return cmd.CombinedOutput()
+}
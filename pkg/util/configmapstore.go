@@ -0,0 +1,183 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// the labels of the ConfigMaps of a store
+	configMapStoreDriverLabel = "curve.csi.netease.com/driver"
+	configMapStoreKindLabel   = "curve.csi.netease.com/metadata"
+
+	configMapStoreKeyField   = "key"
+	configMapStoreValueField = "value"
+	// the hex length of the key hash in the ConfigMap name
+	configMapStoreHashLen = 32
+)
+
+// ObjectStore persists json objects by key.
+type ObjectStore interface {
+	// Put saves the object v of key.
+	Put(key string, v interface{}) error
+	// Get loads the object of key into v, returns NotFoundErr if not exists.
+	Get(key string, v interface{}) error
+	// Delete removes the object of key, it is not an error if not exists.
+	Delete(key string) error
+	// Keys lists the keys in the store.
+	Keys() ([]string, error)
+}
+
+// ConfigMapStore persists json objects as ConfigMaps in a namespace, one ConfigMap
+// per key, so the objects are shared by the replicas of the controller on any node.
+// The ConfigMap is named by the hash of the key and labeled with the driver and
+// the kind of the store, the key itself is kept in the data.
+type ConfigMapStore struct {
+	client    kubernetes.Interface
+	namespace string
+	driver    string
+	kind      string
+}
+
+// NewConfigMapStore returns the store of the kind of objects of the driver in the namespace,
+// the kind is a DNS label, e.g. flatten.
+func NewConfigMapStore(client kubernetes.Interface, namespace, driver, kind string) *ConfigMapStore {
+	return &ConfigMapStore{client: client, namespace: namespace, driver: driver, kind: kind}
+}
+
+func (s *ConfigMapStore) name(key string) string {
+	sum := sha256.Sum256([]byte(s.driver + "/" + s.kind + "/" + key))
+	return "curve-csi-" + s.kind + "-" + hex.EncodeToString(sum[:])[:configMapStoreHashLen]
+}
+
+func (s *ConfigMapStore) selector() string {
+	return labels.SelectorFromSet(labels.Set{
+		configMapStoreDriverLabel: s.driver,
+		configMapStoreKindLabel:   s.kind,
+	}).String()
+}
+
+// get returns the ConfigMap of key, NotFoundErr if not exists.
+func (s *ConfigMapStore) get(ctx context.Context, key string) (*corev1.ConfigMap, error) {
+	cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name(key), metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, NewNotFoundErr(key)
+		}
+		return nil, fmt.Errorf("failed to get ConfigMap of %s: %v", key, err)
+	}
+	if cm.Data[configMapStoreKeyField] != key {
+		return nil, fmt.Errorf("ConfigMap %s/%s is of key %q, not %q", s.namespace, cm.Name, cm.Data[configMapStoreKeyField], key)
+	}
+	return cm, nil
+}
+
+// Put saves the object v of key.
+func (s *ConfigMapStore) Put(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %v", key, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), kubeAPIQueryTimeout)
+	defer cancel()
+
+	cm, err := s.get(ctx, key)
+	if err == nil {
+		cm.Data[configMapStoreValueField] = string(data)
+		if _, err = s.client.CoreV1().ConfigMaps(s.namespace).Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("failed to update ConfigMap of %s: %v", key, err)
+		}
+		return nil
+	}
+	if !IsNotFoundErr(err, key) {
+		return err
+	}
+	cm = &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.name(key),
+			Namespace: s.namespace,
+			Labels: map[string]string{
+				configMapStoreDriverLabel: s.driver,
+				configMapStoreKindLabel:   s.kind,
+			},
+		},
+		Data: map[string]string{
+			configMapStoreKeyField:   key,
+			configMapStoreValueField: string(data),
+		},
+	}
+	if _, err = s.client.CoreV1().ConfigMaps(s.namespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create ConfigMap of %s: %v", key, err)
+	}
+	return nil
+}
+
+// Get loads the object of key into v, returns NotFoundErr if not exists.
+func (s *ConfigMapStore) Get(key string, v interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), kubeAPIQueryTimeout)
+	defer cancel()
+
+	cm, err := s.get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal([]byte(cm.Data[configMapStoreValueField]), v); err != nil {
+		return fmt.Errorf("failed to unmarshal %s: %v", key, err)
+	}
+	return nil
+}
+
+// Delete removes the object of key, it is not an error if not exists.
+func (s *ConfigMapStore) Delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), kubeAPIQueryTimeout)
+	defer cancel()
+
+	err := s.client.CoreV1().ConfigMaps(s.namespace).Delete(ctx, s.name(key), metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete ConfigMap of %s: %v", key, err)
+	}
+	return nil
+}
+
+// Keys lists the keys in the store.
+func (s *ConfigMapStore) Keys() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kubeAPIQueryTimeout)
+	defer cancel()
+
+	list, err := s.client.CoreV1().ConfigMaps(s.namespace).List(ctx, metav1.ListOptions{LabelSelector: s.selector()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ConfigMaps of %s: %v", s.kind, err)
+	}
+	keys := make([]string, 0, len(list.Items))
+	for _, cm := range list.Items {
+		if key, ok := cm.Data[configMapStoreKeyField]; ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// keys of the CSI secrets
+	credUserKey     = "user"
+	credPasswordKey = "password"
+	credTokenKey    = "token"
+
+	redactedValue = "***"
+)
+
+// Credentials is the curve auth info carried by the CSI secrets.
+type Credentials struct {
+	User     string
+	Password string
+	Token    string
+}
+
+// NewCredentials gets the credentials from the CSI secrets, returns nil if no secrets.
+func NewCredentials(secrets map[string]string) *Credentials {
+	creds := &Credentials{
+		User:     secrets[credUserKey],
+		Password: secrets[credPasswordKey],
+		Token:    secrets[credTokenKey],
+	}
+	if *creds == (Credentials{}) {
+		return nil
+	}
+	return creds
+}
+
+// GetUser returns the user, it is safe to call on nil.
+func (c *Credentials) GetUser() string {
+	if c == nil {
+		return ""
+	}
+	return c.User
+}
+
+// String redacts the password and token.
+func (c *Credentials) String() string {
+	if c == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("{User:%s Password:%s Token:%s}", c.User, redact(c.Password), redact(c.Token))
+}
+
+// LoadSecrets returns the CSI secrets of the user from dir, which holds a subdir per user
+// with a file per secret key, e.g. <dir>/k8s/password, as the Secrets mounted by a projected
+// volume. It returns nil if dir is not set or has none of the user.
+func LoadSecrets(dir, user string) (map[string]string, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if user == "" || filepath.Base(user) != user || user == ".." {
+		return nil, fmt.Errorf("invalid user %q", user)
+	}
+	secrets := make(map[string]string)
+	for _, key := range []string{credPasswordKey, credTokenKey} {
+		data, err := os.ReadFile(filepath.Join(dir, user, key))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read %s of user %s: %v", key, user, err)
+		}
+		secrets[key] = strings.TrimSpace(string(data))
+	}
+	if len(secrets) == 0 {
+		return nil, nil
+	}
+	secrets[credUserKey] = user
+	return secrets, nil
+}
+
+// RedactArgs returns a copy of the command args with the value of the sensitive flags redacted.
+func RedactArgs(args []string, sensitiveFlags ...string) []string {
+	redacted := make([]string, len(args))
+	copy(redacted, args)
+	for i := 0; i < len(redacted)-1; i++ {
+		for _, flag := range sensitiveFlags {
+			if redacted[i] == flag {
+				redacted[i+1] = redactedValue
+				i++
+				break
+			}
+		}
+	}
+	return redacted
+}
+
+// RedactOutput returns the command output with the secrets redacted, e.g. the command line
+// shown by systemctl status.
+func RedactOutput(output []byte, secrets ...string) string {
+	s := string(output)
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, redactedValue)
+		}
+	}
+	return s
+}
+
+func redact(s string) string {
+	if s == "" {
+		return ""
+	}
+	return redactedValue
+}
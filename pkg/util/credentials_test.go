@@ -0,0 +1,79 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewCredentials(t *testing.T) {
+	assert.Nil(t, NewCredentials(nil))
+	assert.Nil(t, NewCredentials(map[string]string{"foo": "bar"}))
+	assert.Equal(t, "", NewCredentials(nil).GetUser())
+
+	creds := NewCredentials(map[string]string{"user": "k8s", "password": "secret"})
+	assert.Equal(t, &Credentials{User: "k8s", Password: "secret"}, creds)
+	assert.Equal(t, "k8s", creds.GetUser())
+	assert.NotContains(t, fmt.Sprintf("%v", creds), "secret")
+	assert.NotContains(t, fmt.Sprintf("%+v", creds), "secret")
+}
+
+func TestRedactArgs(t *testing.T) {
+	args := []string{"stat", "--user", "k8s", "--password", "secret", "--filename", "/k8s/vol"}
+	redacted := RedactArgs(args, "--password")
+	assert.Equal(t, []string{"stat", "--user", "k8s", "--password", "***", "--filename", "/k8s/vol"}, redacted)
+	// the args are not changed
+	assert.Equal(t, "secret", args[4])
+
+	// the flag without value
+	assert.Equal(t, []string{"stat", "--password"}, RedactArgs([]string{"stat", "--password"}, "--password"))
+}
+
+func TestRedactOutput(t *testing.T) {
+	output := []byte("CGroup: /system.slice/curve-nbd-k8s-vol.service\n└─123 curve-nbd map cbd:k8s//k8s/vol_k8s_ --password secret\n")
+	assert.Equal(t, "CGroup: /system.slice/curve-nbd-k8s-vol.service\n└─123 curve-nbd map cbd:k8s//k8s/vol_k8s_ --password ***\n",
+		RedactOutput(output, "secret"))
+	// the empty secret is not redacted
+	assert.Equal(t, "curve-nbd list-mapped", RedactOutput([]byte("curve-nbd list-mapped"), ""))
+}
+
+func TestLoadSecrets(t *testing.T) {
+	secrets, err := LoadSecrets("", "k8s")
+	assert.NoError(t, err)
+	assert.Nil(t, secrets)
+
+	dir := t.TempDir()
+	secrets, err = LoadSecrets(dir, "k8s")
+	assert.NoError(t, err)
+	assert.Nil(t, secrets)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "k8s"), 0o700))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "k8s", "password"), []byte("secret\n"), 0o600))
+	secrets, err = LoadSecrets(dir, "k8s")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"user": "k8s", "password": "secret"}, secrets)
+
+	for _, user := range []string{"", "..", "k8s/../k8s"} {
+		_, err = LoadSecrets(dir, user)
+		assert.Error(t, err, user)
+	}
+}
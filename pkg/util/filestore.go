@@ -0,0 +1,130 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// DefaultMetadataDir is the default directory of the controller metadata.
+	DefaultMetadataDir = "/var/lib/curve-csi/metadata"
+	// DefaultEphemeralDir is the default directory of the ephemeral volume records on the node,
+	// it is in the plugin dir of kubelet mounted to the node plugin.
+	DefaultEphemeralDir = "/var/lib/kubelet/plugins/curve.csi.netease.com/ephemeral"
+	DefaultKubeletDir   = "/var/lib/kubelet"
+
+	fileStoreSuffix = ".json"
+)
+
+// FileStore persists json objects as files in a directory, one file per key.
+// The writes are atomic, a partially written file is never read.
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore returns the store in dir, the dir is created on the first write.
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+func (s *FileStore) path(key string) string {
+	return filepath.Join(s.dir, url.PathEscape(key)+fileStoreSuffix)
+}
+
+// Put saves the object v of key.
+func (s *FileStore) Put(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %v", key, err)
+	}
+	if err = os.MkdirAll(s.dir, 0o750); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(key))
+}
+
+// Get loads the object of key into v, returns NotFoundErr if not exists.
+func (s *FileStore) Get(key string, v interface{}) error {
+	data, err := ioutil.ReadFile(s.path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return NewNotFoundErr(key)
+		}
+		return err
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to unmarshal %s: %v", key, err)
+	}
+	return nil
+}
+
+// Delete removes the object of key, it is not an error if not exists.
+func (s *FileStore) Delete(key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Keys lists the keys in the store.
+func (s *FileStore) Keys() ([]string, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, fileStoreSuffix) {
+			continue
+		}
+		key, err := url.PathUnescape(strings.TrimSuffix(name, fileStoreSuffix))
+		if err != nil {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
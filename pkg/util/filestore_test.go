@@ -0,0 +1,56 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStore(t *testing.T) {
+	type object struct {
+		Name string `json:"name"`
+	}
+	s := NewFileStore(filepath.Join(t.TempDir(), "store"))
+
+	keys, err := s.Keys()
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	var obj object
+	err = s.Get("v1-00-00-0-03k8s-csi-vol-a", &obj)
+	assert.True(t, IsNotFoundErr(err, "v1-00-00-0-03k8s-csi-vol-a"))
+
+	// the key is escaped as file name
+	assert.NoError(t, s.Put("v1-00-00-0-03k8s-csi-vol-a", &object{Name: "a"}))
+	assert.NoError(t, s.Put("k8s/b", &object{Name: "b"}))
+	assert.NoError(t, s.Put("k8s/b", &object{Name: "b2"}))
+
+	assert.NoError(t, s.Get("k8s/b", &obj))
+	assert.Equal(t, "b2", obj.Name)
+	keys, err = s.Keys()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"v1-00-00-0-03k8s-csi-vol-a", "k8s/b"}, keys)
+
+	assert.NoError(t, s.Delete("k8s/b"))
+	assert.NoError(t, s.Delete("k8s/b"))
+	keys, err = s.Keys()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"v1-00-00-0-03k8s-csi-vol-a"}, keys)
+}
@@ -82,6 +82,12 @@ func addPath(name string, handler http.Handler) {
 }
 
 func HttpGet(reqURL string, queryMap map[string]string) (int, []byte, error) {
+	return HttpGetWithHeader(reqURL, queryMap, nil)
+}
+
+// HttpGetWithHeader sends the GET request with the extra header, e.g. Authorization.
+// The header is not logged since it may contain credentials.
+func HttpGetWithHeader(reqURL string, queryMap map[string]string, extraHeader http.Header) (int, []byte, error) {
 	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
 	if err != nil {
 		return 0, nil, err
@@ -91,12 +97,17 @@ func HttpGet(reqURL string, queryMap map[string]string) (int, []byte, error) {
 	header := http.Header{}
 	header.Add("Content-Type", "application/json")
 	header.Add("Accept", "application/json")
+	for key, values := range extraHeader {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
 	req.Header = header
 
 	// TODO: now the snapshot server can not recognize URL encode
 	req.URL.RawQuery = buildRawQuery(queryMap)
 
-	klog.V(6).Infof("Request: %+v", req)
+	klog.V(6).Infof("Request: %s %s", req.Method, req.URL)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return -1, nil, err
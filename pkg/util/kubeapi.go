@@ -0,0 +1,54 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const kubeAPIQueryTimeout = 30 * time.Second
+
+// NewKubeClient returns the client of the in-cluster kubernetes API
+// by the service account of the pod.
+func NewKubeClient() (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get in-cluster config: %v", err)
+	}
+	config.Timeout = kubeAPIQueryTimeout
+	return kubernetes.NewForConfig(config)
+}
+
+// GetNodeLabels returns the labels of the node, the service account of the pod
+// must be allowed to get nodes.
+func GetNodeLabels(ctx context.Context, client kubernetes.Interface, nodeName string) (map[string]string, error) {
+	node, err := client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, NewNotFoundErr(nodeName)
+		}
+		return nil, fmt.Errorf("failed to get node %s: %v", nodeName, err)
+	}
+	return node.Labels, nil
+}
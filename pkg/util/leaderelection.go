@@ -0,0 +1,94 @@
+/*
+Copyright 2022 The Netease Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// LeaderElection runs a function only on the leader of the replicas, elected by a Lease.
+type LeaderElection struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	identity  string
+}
+
+// NewLeaderElection returns the election of the Lease <name> in the namespace,
+// the name is sanitized from the driver name, e.g. curve-csi-netease-com-workers.
+func NewLeaderElection(client kubernetes.Interface, namespace, name string) *LeaderElection {
+	identity, err := os.Hostname()
+	if err != nil || identity == "" {
+		identity = fmt.Sprintf("curve-csi-%d", os.Getpid())
+	}
+	name = strings.ToLower(strings.NewReplacer(".", "-", "/", "-", "_", "-").Replace(name))
+	return &LeaderElection{client: client, namespace: namespace, name: name, identity: identity}
+}
+
+// Run runs the function whenever the replica is elected, until ctx is done. The context
+// passed to the function is canceled once the leadership is lost, and the Lease is released
+// on return.
+func (le *LeaderElection) Run(ctx context.Context, run func(ctx context.Context)) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: le.namespace, Name: le.name},
+		Client:     le.client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: le.identity},
+	}
+	var running sync.WaitGroup
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   leaseDuration,
+			RenewDeadline:   renewDeadline,
+			RetryPeriod:     retryPeriod,
+			ReleaseOnCancel: true,
+			Name:            le.name,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					running.Add(1)
+					defer running.Done()
+					run(ctx)
+				},
+				OnStoppedLeading: func() {
+					klog.Infof("%s stopped leading %s/%s", le.identity, le.namespace, le.name)
+				},
+				OnNewLeader: func(identity string) {
+					klog.Infof("the leader of %s/%s is %s", le.namespace, le.name, identity)
+				},
+			},
+		})
+		// the function of the lost leadership must return before campaigning again
+		running.Wait()
+	}
+}
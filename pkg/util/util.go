@@ -47,7 +47,9 @@ func ValidateDriverName(driverName string) error {
 	return err
 }
 
-func SystemMapOnHost(ctx context.Context, serviceName string, mapCommands []string) (err error) {
+// SystemMapOnHost runs the map commands as the transient systemd unit serviceName on the host,
+// the secrets in the commands are redacted from the output logged or returned.
+func SystemMapOnHost(ctx context.Context, serviceName string, mapCommands []string, secrets ...string) (err error) {
 	ctxlog.Infof(ctx, "starting to run %s.service", serviceName)
 	systemMapArgs := []string{"--description=k8scsi", "--unit", serviceName, "-r", "--"}
 	systemMapArgs = append(systemMapArgs, mapCommands...)
@@ -57,7 +59,7 @@ func SystemMapOnHost(ctx context.Context, serviceName string, mapCommands []stri
 		// tear down
 		if err != nil {
 			output, _ = ExecCommandHost("systemctl", []string{"status", serviceName})
-			ctxlog.Warningf(ctx, "systemctl status %s, output: %s", serviceName, string(output))
+			ctxlog.Warningf(ctx, "systemctl status %s, output: %s", serviceName, RedactOutput(output, secrets...))
 			_, _ = ExecCommandHost("systemctl", []string{"stop", serviceName})
 			_, _ = ExecCommandHost("systemctl", []string{"reset-failed", serviceName})
 		}
@@ -67,7 +69,7 @@ func SystemMapOnHost(ctx context.Context, serviceName string, mapCommands []stri
 	if err != nil {
 		// service already exists, reset it and try again
 		if !strings.Contains(string(output), "already exists") {
-			return fmt.Errorf("failed to map, output: %s", string(output))
+			return fmt.Errorf("failed to map, output: %s", RedactOutput(output, secrets...))
 		}
 		ctxlog.Warningf(ctx, "systemctl reset-failed %s.service and try mapping again", serviceName)
 		_, _ = ExecCommandHost("systemctl", []string{"reset-failed", serviceName})
@@ -79,7 +81,7 @@ func SystemMapOnHost(ctx context.Context, serviceName string, mapCommands []stri
 		return fmt.Errorf("systemctl show %s.service failed, output: %s", serviceName, string(output))
 	}
 	if !strings.Contains(string(output), "ExecMainStatus=0") {
-		return fmt.Errorf("%s.service started successfully, but map failed, %s", serviceName, string(output))
+		return fmt.Errorf("%s.service started successfully, but map failed, %s", serviceName, RedactOutput(output, secrets...))
 	}
 	ctxlog.Infof(ctx, "map successfully, running as %s.service", serviceName)
 	return nil